@@ -0,0 +1,11 @@
+// Package crd embeds the CustomResourceDefinitions of the tool.
+package crd
+
+import (
+	_ "embed"
+)
+
+// PerfTest is the CustomResourceDefinition of PerfTest.
+//
+//go:embed perf.konveyor.io_perftests.yaml
+var PerfTest []byte
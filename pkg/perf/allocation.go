@@ -0,0 +1,173 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// allocatedPVC is a PVC of the backed up namespaces, with why it is not
+// snapshotted when it is not.
+type allocatedPVC struct {
+	Namespace string `json:"namespace"`
+	PVC       string `json:"pvc"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (p allocatedPVC) String() string {
+	if p.Reason == "" {
+		return p.Namespace + "/" + p.PVC
+	}
+	return fmt.Sprintf("%s/%s (%s)", p.Namespace, p.PVC, p.Reason)
+}
+
+// allocationResult compares the PVCs of the backed up namespaces Velero is
+// expected to snapshot with the VSCs it created, so volumes left out of the
+// backup show up as soon as it is done rather than as a run short of volumes.
+type allocationResult struct {
+	PVCs              int `json:"pvcs"`
+	ExpectedSnapshots int `json:"expectedSnapshots"`
+	// Snapshots is the number of VSCs of the backup, set once it is done.
+	Snapshots int `json:"snapshots"`
+	// Skipped are the PVCs not expected to be snapshotted and Missing
+	// those expected to be that no VSC was created for.
+	Skipped []allocatedPVC `json:"skipped,omitempty"`
+	Missing []allocatedPVC `json:"missing,omitempty"`
+
+	expected []allocatedPVC
+}
+
+// summary gives the expected and created snapshot counts.
+func (a *allocationResult) summary() string {
+	return fmt.Sprintf("%d PVCs, %d snapshots expected, %d created, %d PVCs skipped, %d missing", a.PVCs, a.ExpectedSnapshots, a.Snapshots, len(a.Skipped), len(a.Missing))
+}
+
+// expectSnapshots enumerates the PVCs of the namespaces of the backup called
+// name and records in results those Velero is expected to snapshot: the
+// bound CSI volumes the label selector of the backup selects, whose driver
+// has a VolumeSnapshotClass labeled for Velero. None are expected when the
+// backup does not snapshot volumes or backs them up with the file system
+// backup.
+func expectSnapshots(ctx context.Context, c client.Client, veleroNamespace, name string, namespaces []string, results *runResults) (*allocationResult, error) {
+	backup := velerov1.Backup{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: name}, &backup)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backup %s", name)
+	}
+	selector := labels.Everything()
+	if backup.Spec.LabelSelector != nil {
+		selector, err = metav1.LabelSelectorAsSelector(backup.Spec.LabelSelector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid label selector of backup %s", name)
+		}
+	}
+	noSnapshots := ""
+	switch {
+	case backup.Spec.SnapshotVolumes != nil && !*backup.Spec.SnapshotVolumes:
+		noSnapshots = "the backup has snapshotVolumes false"
+	case backup.Spec.DefaultVolumesToFsBackup != nil && *backup.Spec.DefaultVolumesToFsBackup:
+		noSnapshots = "the backup uses the file system backup"
+	}
+	classes := v1.VolumeSnapshotClassList{}
+	err = c.List(ctx, &classes, client.MatchingLabels{volumeSnapshotClassLabel: "true"})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumesnapshotclasses")
+	}
+	drivers := map[string]bool{}
+	for _, class := range classes.Items {
+		drivers[class.Driver] = true
+	}
+
+	a := &allocationResult{}
+	for _, ns := range namespaces {
+		p, err := planNamespace(ctx, c, ns)
+		if err != nil {
+			return nil, err
+		}
+		a.PVCs += p.pvcs
+		a.Skipped = append(a.Skipped, p.skipped...)
+		for _, v := range p.volumes {
+			pvc := allocatedPVC{Namespace: ns, PVC: v.pvc}
+			switch {
+			case noSnapshots != "":
+				pvc.Reason = noSnapshots
+			case !selector.Matches(labels.Set(v.labels)):
+				pvc.Reason = "not selected by the label selector of the backup"
+			case !drivers[v.driver]:
+				pvc.Reason = fmt.Sprintf("driver %s has no VolumeSnapshotClass labeled %s=true", v.driver, volumeSnapshotClassLabel)
+			}
+			if pvc.Reason != "" {
+				loggerFrom(ctx).Warnw("persistentvolumeclaim will not be snapshotted", "phase", phaseSnapshot, "namespace", ns, "pvc", v.pvc, "reason", pvc.Reason)
+				a.Skipped = append(a.Skipped, pvc)
+				continue
+			}
+			a.expected = append(a.expected, pvc)
+		}
+	}
+	a.ExpectedSnapshots = len(a.expected)
+	results.mu.Lock()
+	results.Allocation = a
+	results.mu.Unlock()
+
+	loggerFrom(ctx).Infow("expecting snapshots", "phase", phaseSnapshot, "pvcs", a.PVCs, "expected", a.ExpectedSnapshots, "skipped", len(a.Skipped))
+	return a, nil
+}
+
+// checkSnapshots compares the VSCs of the backup called name with the PVCs a
+// expects to be snapshotted, recording and logging those without one. It is
+// run once the backup is done, by when Velero has created every VSC.
+func checkSnapshots(ctx context.Context, c client.Reader, name string, a *allocationResult, results *runResults) error {
+	vscList, err := listVolumeSnapshotContents(ctx, c, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to list volumesnapshotcontents")
+	}
+	snapshotted := map[types.NamespacedName]bool{}
+	snapshots := map[string]*v1.VolumeSnapshotList{}
+	for _, vsc := range vscList.Items {
+		ref := vsc.Spec.VolumeSnapshotRef
+		list, ok := snapshots[ref.Namespace]
+		if !ok {
+			list = &v1.VolumeSnapshotList{}
+			err := c.List(ctx, list, client.InNamespace(ref.Namespace))
+			if err != nil {
+				return errors.Wrapf(err, "failed to list volumesnapshots in %s", ref.Namespace)
+			}
+			snapshots[ref.Namespace] = list
+		}
+		for _, vs := range list.Items {
+			if vs.Name == ref.Name && vs.Spec.Source.PersistentVolumeClaimName != nil {
+				snapshotted[types.NamespacedName{Namespace: ref.Namespace, Name: *vs.Spec.Source.PersistentVolumeClaimName}] = true
+			}
+		}
+	}
+
+	missing := []allocatedPVC{}
+	for _, pvc := range a.expected {
+		if !snapshotted[types.NamespacedName{Namespace: pvc.Namespace, Name: pvc.PVC}] {
+			missing = append(missing, pvc)
+		}
+	}
+	results.mu.Lock()
+	a.Snapshots = len(vscList.Items)
+	a.Missing = missing
+	results.mu.Unlock()
+
+	if len(missing) == 0 {
+		loggerFrom(ctx).Infow("every expected snapshot was created", "phase", phaseSnapshot, "expected", a.ExpectedSnapshots, "vscs", a.Snapshots)
+		return nil
+	}
+	names := []string{}
+	for _, pvc := range missing {
+		names = append(names, pvc.String())
+	}
+	loggerFrom(ctx).Warnw("backup did not snapshot every expected PVC, check the velero log for why", "phase", phaseSnapshot, "expected", a.ExpectedSnapshots, "vscs", a.Snapshots, "missing", strings.Join(names, ", "))
+	return nil
+}
@@ -0,0 +1,238 @@
+package perf
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Annotations recording the timings of a run on its Backup and VSBs, so they
+// survive on the cluster when the client dies and report --run can put the
+// results back together from them.
+const (
+	annotationStartTime         = "oadp-perf/start-time"
+	annotationSnapshotEndTime   = "oadp-perf/snapshot-end-time"
+	annotationDataMoverEndTime  = "oadp-perf/data-mover-end-time"
+	annotationConcurrency       = "oadp-perf/concurrency"
+	annotationSchedule          = "oadp-perf/schedule"
+	annotationMover             = "oadp-perf/mover"
+	annotationBatch             = "oadp-perf/batch"
+	annotationVSCReadyTime      = "oadp-perf/vsc-ready-time"
+	annotationVSBCompletionTime = "oadp-perf/completion-time"
+)
+
+// annotationTime formats t for an annotation, empty if it is not set.
+func annotationTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseAnnotationTime returns the time of the annotation key of annotations,
+// or fallback if it has none.
+func parseAnnotationTime(annotations map[string]string, key string, fallback time.Time) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, annotations[key])
+	if err != nil {
+		return fallback
+	}
+	return t
+}
+
+// annotate merges annotations into those of obj on the cluster. It is best
+// effort: the timings are in the results already, so a failure is logged and
+// does not fail the run.
+func annotate(ctx context.Context, c client.Client, obj client.Object, annotations map[string]string) {
+	original := obj.DeepCopyObject().(client.Object)
+	merged := obj.GetAnnotations()
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	for key, value := range annotations {
+		merged[key] = value
+	}
+	obj.SetAnnotations(merged)
+	err := c.Patch(ctx, obj, client.MergeFrom(original))
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to record timings in annotations", "namespace", obj.GetNamespace(), "name", obj.GetName(), "error", err)
+	}
+}
+
+// backupAnnotations returns the annotations recording the run level timings
+// of results on its Backup, leaving out those not known yet.
+func backupAnnotations(results *runResults) map[string]string {
+	results.mu.Lock()
+	defer results.mu.Unlock()
+	annotations := map[string]string{}
+	for key, value := range map[string]string{
+		annotationStartTime:        annotationTime(results.StartTime),
+		annotationSnapshotEndTime:  annotationTime(results.SnapshotEndTime),
+		annotationDataMoverEndTime: annotationTime(results.DataMoverEndTime),
+		annotationConcurrency:      strconv.Itoa(results.Concurrency),
+		annotationSchedule:         results.Schedule,
+		annotationMover:            results.Mover,
+	} {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// annotateBackup records the run level timings of results on its Backup.
+func annotateBackup(ctx context.Context, c client.Client, veleroNamespace string, results *runResults) {
+	name := results.Backup
+	annotations := backupAnnotations(results)
+	backup := &velerov1.Backup{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: name}, backup)
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to record timings in annotations", "namespace", veleroNamespace, "name", name, "error", err)
+		return
+	}
+	annotate(ctx, c, backup, annotations)
+}
+
+// annotateVSB records the timings of the volume of the VSC called vscName on
+// its VSB, once the VSB is done.
+func (r *vsbRunner) annotateVSB(ctx context.Context, vscName string) {
+	r.results.mu.Lock()
+	v, ok := r.results.volumes[vscName]
+	if !ok || v.VolumeSnapshotBackup == "" || v.VSBCompletionTime.IsZero() {
+		r.results.mu.Unlock()
+		return
+	}
+	key := types.NamespacedName{Namespace: v.Namespace, Name: v.VolumeSnapshotBackup}
+	annotations := map[string]string{
+		annotationVSBCompletionTime: annotationTime(v.VSBCompletionTime),
+	}
+	r.results.mu.Unlock()
+	vsb := &dmv1.VolumeSnapshotBackup{}
+	err := r.client.Get(ctx, key, vsb)
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to record timings in annotations", "namespace", key.Namespace, "name", key.Name, "error", err)
+		return
+	}
+	annotate(ctx, r.client, vsb, annotations)
+}
+
+// vsbCreateAnnotations returns the annotations a VSB is created with for job.
+func (r *vsbRunner) vsbCreateAnnotations(job vsbJob, start time.Time) map[string]string {
+	annotations := map[string]string{
+		annotationStartTime: annotationTime(start),
+		annotationBatch:     strconv.Itoa(job.batch),
+	}
+	r.results.mu.Lock()
+	if v, ok := r.results.volumes[job.vsc.Name]; ok && !v.VSCReadyTime.IsZero() {
+		annotations[annotationVSCReadyTime] = annotationTime(v.VSCReadyTime)
+	}
+	r.results.mu.Unlock()
+	return annotations
+}
+
+// resultsFromCluster puts the results of the run called name back together
+// from the annotations of its Backup and VSBs, for runs whose client died
+// before writing them. Timings that were never annotated fall back to what
+// the objects themselves record.
+func resultsFromCluster(ctx context.Context, c client.Client, veleroNamespace, name string) (*runResults, error) {
+	backup := velerov1.Backup{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: name}, &backup)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backup %s", name)
+	}
+	annotations := backup.Annotations
+	concurrency, _ := strconv.Atoi(annotations[annotationConcurrency])
+	results := newRunResults(backup.Spec.IncludedNamespaces, concurrency, annotations[annotationSchedule])
+	results.Backup = name
+	results.Mover = annotations[annotationMover]
+	results.StartTime = parseAnnotationTime(annotations, annotationStartTime, backup.CreationTimestamp.Time)
+
+	vscList, err := listVolumeSnapshotContents(ctx, c, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumesnapshotcontents")
+	}
+	for i := range vscList.Items {
+		vsc := &vscList.Items[i]
+		if vsc.Status == nil || vsc.Status.ReadyToUse == nil || !*vsc.Status.ReadyToUse {
+			continue
+		}
+		var size int64
+		if vsc.Status.RestoreSize != nil {
+			size = *vsc.Status.RestoreSize
+		}
+		ready := vsc.CreationTimestamp.Time
+		if vsc.Status.CreationTime != nil {
+			ready = time.Unix(0, *vsc.Status.CreationTime)
+		}
+		results.vscReady(vsc.Name, vsc.Spec.VolumeSnapshotRef.Namespace, size, ready)
+	}
+
+	vsbList, err := listVolumeSnapshotBackups(ctx, c, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumesnapshotbackups")
+	}
+	var lastCompletion time.Time
+	for i := range vsbList.Items {
+		vsb := &vsbList.Items[i]
+		completion := recordAnnotatedVSB(results, vsb, lastTransitionTime(vsb.Status.Conditions))
+		if completion.After(lastCompletion) {
+			lastCompletion = completion
+		}
+	}
+
+	snapshotEnd := parseAnnotationTime(annotations, annotationSnapshotEndTime, time.Time{})
+	if !snapshotEnd.IsZero() {
+		results.snapshotsDone(snapshotEnd)
+	}
+	dataMoverEnd := parseAnnotationTime(annotations, annotationDataMoverEndTime, time.Time{})
+	if dataMoverEnd.IsZero() && !snapshotEnd.IsZero() && len(vsbList.Items) > 0 && len(vsbList.Items) == len(results.Volumes) {
+		// The client died after the last VSB but before annotating the
+		// Backup, so the data mover ended with the last VSB.
+		dataMoverEnd = lastCompletion
+		for _, v := range results.Volumes {
+			if v.VSBCompletionTime.IsZero() && v.Error == "" {
+				dataMoverEnd = time.Time{}
+			}
+		}
+	}
+	if !dataMoverEnd.IsZero() {
+		results.dataMoverDone(dataMoverEnd)
+	}
+	return results, nil
+}
+
+// recordAnnotatedVSB records vsb in the results from its annotations, once,
+// and returns when it completed: its completion-time annotation, or
+// completed if it has none, or the zero time if it is not completed.
+func recordAnnotatedVSB(results *runResults, vsb *dmv1.VolumeSnapshotBackup, completed time.Time) time.Time {
+	vscName := vsb.Spec.VolumeSnapshotContent.Name
+	results.mu.Lock()
+	v, seen := results.volumes[vscName]
+	started := seen && v.VolumeSnapshotBackup == vsb.Name
+	if !started {
+		// The ready time seen by the run is more accurate than the
+		// creation time of the snapshot.
+		v = results.volume(vscName)
+		v.VSCReadyTime = parseAnnotationTime(vsb.Annotations, annotationVSCReadyTime, v.VSCReadyTime)
+	}
+	results.mu.Unlock()
+	if !started {
+		batch, _ := strconv.Atoi(vsb.Annotations[annotationBatch])
+		results.vsbStarted(vscName, vsb.Name, batch, parseAnnotationTime(vsb.Annotations, annotationStartTime, vsb.CreationTimestamp.Time))
+	}
+
+	if isVSBCompleted(vsb) {
+		completion := parseAnnotationTime(vsb.Annotations, annotationVSBCompletionTime, completed)
+		results.vsbCompleted(vscName, vsb.Status.SourcePVCData.Name, vsb.Status.SourcePVCData.Size, completion)
+		return completion
+	}
+	if failure := vsbFailure(vsb); failure != nil {
+		results.vsbFailed(vscName, failure)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,140 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	volsyncv1alpha1 "github.com/backube/volsync/api/v1alpha1"
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// schemeAPI is an API group version the tool registers in the scheme of its
+// clients, on top of the built in Kubernetes APIs.
+type schemeAPI struct {
+	groupVersion schema.GroupVersion
+	addToScheme  func(*runtime.Scheme) error
+	// required APIs are needed by every run, while optional ones are only
+	// needed by some movers or commands.
+	required bool
+	// usedFor says what needs the API, for the message listing those the
+	// cluster does not serve.
+	usedFor string
+}
+
+func (a schemeAPI) String() string {
+	return fmt.Sprintf("%s (%s)", a.groupVersion, a.usedFor)
+}
+
+// schemeAPIs returns the APIs the tool works with, with the data mover types
+// under dataMover, the version of their API the cluster serves.
+func schemeAPIs(dataMover schema.GroupVersion) []schemeAPI {
+	return []schemeAPI{
+		{velerov1.SchemeGroupVersion, velerov1.AddToScheme, true, "Velero backups and restores"},
+		{v1.SchemeGroupVersion, v1.AddToScheme, false, "CSI volume snapshots"},
+		{dataMover, func(scheme *runtime.Scheme) error { return addDataMoverToScheme(scheme, dataMover) }, false, "mover vsm"},
+		{volsyncv1alpha1.GroupVersion, volsyncv1alpha1.AddToScheme, false, "VolSync replication of mover vsm"},
+		{oadpGroupVersion, addOADPToScheme, false, "DataProtectionApplication defaults"},
+		{perfGroupVersion, addPerfTestToScheme, false, "PerfTests of the operator command"},
+	}
+}
+
+// newScheme returns the scheme of the clients of the tool, with every API
+// of schemeAPIs registered.
+func newScheme(dataMover schema.GroupVersion) (*runtime.Scheme, error) {
+	scheme := runtime.NewScheme()
+	err := clientgoscheme.AddToScheme(scheme)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to register the kubernetes APIs")
+	}
+	for _, api := range schemeAPIs(dataMover) {
+		err = api.addToScheme(scheme)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to register %s", api.groupVersion)
+		}
+	}
+	return scheme, nil
+}
+
+// discoverAPIs returns the version of the data mover API the cluster serves
+// and logs which of the optional APIs of the tool the cluster does not serve,
+// including when neither the VolumeSnapshotMover nor the data mover built
+// into Velero is, since only runs moving data need one. It fails when a
+// required API is not served, so a missing CRD is named up front instead of
+// surfacing as a failed list later. Discovery failing is only logged,
+// falling back to the built in data mover version.
+func discoverAPIs(ctx context.Context, config *rest.Config) (schema.GroupVersion, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to create discovery client, assuming the data mover serves its built in version", "version", dmv1.GroupVersion.String(), "error", err)
+		return dmv1.GroupVersion, nil
+	}
+	groups, err := dc.ServerGroups()
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to discover the APIs served by the cluster, assuming the data mover serves its built in version", "version", dmv1.GroupVersion.String(), "error", err)
+		return dmv1.GroupVersion, nil
+	}
+	dataMover := servedDataMoverVersion(ctx, groups)
+
+	required, optional := missingAPIs(groups, schemeAPIs(dataMover))
+	if !dataMoverServed(groups) {
+		optional = append(optional, fmt.Sprintf("%s or %s (a data mover, for runs that move data)", dmv1.GroupVersion.Group, dataUploadGVK.GroupVersion()))
+	}
+	if len(optional) > 0 {
+		loggerFrom(ctx).Infow("optional API groups are not served by the cluster", "missing", strings.Join(optional, ", "))
+	}
+	if len(required) > 0 {
+		return dataMover, withExitCode(errors.Errorf("required API groups are not served by the cluster: %s", strings.Join(required, ", ")), exitPreflight)
+	}
+	return dataMover, nil
+}
+
+// dataMoverServed reports whether groups has the VolumeSnapshotMover, in any
+// version, or the DataUploads of the data mover built into Velero.
+func dataMoverServed(groups *metav1.APIGroupList) bool {
+	for _, group := range groups.Groups {
+		if group.Name == dmv1.GroupVersion.Group {
+			return true
+		}
+		if group.Name != dataUploadGVK.Group {
+			continue
+		}
+		for _, version := range group.Versions {
+			if version.Version == dataUploadGVK.Version {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// missingAPIs returns the required and the optional APIs of apis the cluster
+// does not serve, according to groups.
+func missingAPIs(groups *metav1.APIGroupList, apis []schemeAPI) (required, optional []string) {
+	served := map[schema.GroupVersion]bool{}
+	for _, group := range groups.Groups {
+		for _, version := range group.Versions {
+			served[schema.GroupVersion{Group: group.Name, Version: version.Version}] = true
+		}
+	}
+	for _, api := range apis {
+		if served[api.groupVersion] {
+			continue
+		}
+		if api.required {
+			required = append(required, api.String())
+		} else {
+			optional = append(optional, api.String())
+		}
+	}
+	return required, optional
+}
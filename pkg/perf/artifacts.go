@@ -0,0 +1,150 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	volsyncv1alpha1 "github.com/backube/volsync/api/v1alpha1"
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// artifactCollector gathers what is needed to debug a VSB that failed,
+// stalled or timed out into a directory per VSB: the VSB itself, its events,
+// its ReplicationSource and the volsync mover pods with their logs. Each VSB
+// is collected once. A nil collector collects nothing.
+type artifactCollector struct {
+	dir             string
+	client          client.Client
+	clientset       kubernetes.Interface
+	veleroNamespace string
+
+	mu        sync.Mutex
+	collected map[types.NamespacedName]bool
+}
+
+func newArtifactCollector(dir string, c client.Client, clientset kubernetes.Interface, veleroNamespace string) *artifactCollector {
+	return &artifactCollector{
+		dir:             dir,
+		client:          c,
+		clientset:       clientset,
+		veleroNamespace: veleroNamespace,
+		collected:       map[types.NamespacedName]bool{},
+	}
+}
+
+// collect gathers the artifacts of the VSB called key, recording why in
+// reason.txt. Errors are logged rather than returned so a failed collection
+// does not end the run.
+func (a *artifactCollector) collect(ctx context.Context, key types.NamespacedName, reason string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.collected[key] {
+		a.mu.Unlock()
+		return
+	}
+	a.collected[key] = true
+	a.mu.Unlock()
+
+	dir := filepath.Join(a.dir, key.Namespace+"-"+key.Name)
+	log := loggerFrom(ctx).With("phase", phaseDataMover, "namespace", key.Namespace, "vsb", key.Name, "dir", dir)
+	err := a.collectVSB(ctx, dir, key, reason)
+	if err != nil {
+		log.Errorw("failed to collect VSB artifacts", "error", err)
+		return
+	}
+	log.Infow("collected VSB artifacts")
+}
+
+func (a *artifactCollector) collectVSB(ctx context.Context, dir string, key types.NamespacedName, reason string) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create artifacts directory %s", dir)
+	}
+	err = os.WriteFile(filepath.Join(dir, "reason.txt"), []byte(reason+"\n"), 0o644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write reason")
+	}
+
+	vsb := dmv1.VolumeSnapshotBackup{}
+	err = a.client.Get(ctx, key, &vsb)
+	if err != nil {
+		return errors.Wrap(err, "failed to get volumesnapshotbackup")
+	}
+	err = writeYAML(filepath.Join(dir, "vsb.yaml"), &vsb)
+	if err != nil {
+		return err
+	}
+
+	events := corev1.EventList{}
+	err = a.client.List(ctx, &events, client.InNamespace(key.Namespace), client.MatchingFields{"involvedObject.name": key.Name})
+	if err != nil {
+		return errors.Wrap(err, "failed to list events")
+	}
+	err = writeYAML(filepath.Join(dir, "events.yaml"), &events)
+	if err != nil {
+		return err
+	}
+
+	// The data mover names the ReplicationSource <vsb>-rep-src and volsync
+	// runs it as the job volsync-src-<replicationsource>.
+	rsName := fmt.Sprintf("%s-rep-src", key.Name)
+	rs := volsyncv1alpha1.ReplicationSource{}
+	err = a.client.Get(ctx, types.NamespacedName{Namespace: a.veleroNamespace, Name: rsName}, &rs)
+	switch {
+	case err == nil:
+		err = writeYAML(filepath.Join(dir, "replicationsource.yaml"), &rs)
+		if err != nil {
+			return err
+		}
+	case client.IgnoreNotFound(err) != nil:
+		return errors.Wrap(err, "failed to get replicationsource")
+	}
+
+	pods := corev1.PodList{}
+	err = a.client.List(ctx, &pods, client.InNamespace(a.veleroNamespace), client.MatchingLabels{"job-name": "volsync-src-" + rsName})
+	if err != nil {
+		return errors.Wrap(err, "failed to list mover pods")
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		err = writeYAML(filepath.Join(dir, "pod-"+pod.Name+".yaml"), pod)
+		if err != nil {
+			return err
+		}
+		for _, container := range pod.Spec.Containers {
+			out, err := a.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: container.Name}).DoRaw(ctx)
+			if err != nil {
+				loggerFrom(ctx).Warnw("failed to get mover pod logs", "phase", phaseDataMover, "pod", pod.Name, "container", container.Name, "error", err)
+				continue
+			}
+			err = os.WriteFile(filepath.Join(dir, fmt.Sprintf("pod-%s-%s.log", pod.Name, container.Name)), out, 0o644)
+			if err != nil {
+				return errors.Wrap(err, "failed to write pod logs")
+			}
+		}
+	}
+	return nil
+}
+
+func writeYAML(path string, obj interface{}) error {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %s", filepath.Base(path))
+	}
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type attachOptions struct {
+	*rootOptions
+	run        string
+	output     string
+	outputFile string
+	tui        bool
+}
+
+func newAttachCommand(root *rootOptions) *cobra.Command {
+	o := &attachOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "attach",
+		Short: "Follow a run started elsewhere until it is done and report on it",
+		Long: `Follow a run started elsewhere, from another terminal or a Job, without
+creating anything. What the run recorded so far is read back from the labels
+and annotations of its Backup and VolumeSnapshotBackups, and the run is then
+watched until its data mover is done, printing its summary as report does.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.run == "" {
+				return errors.New("missing run flag")
+			}
+			if o.output != "" && o.output != outputJSON && o.output != outputCSV && o.output != outputJUnit {
+				return errors.Errorf("unknown output format %q, must be one of %s, %s or %s", o.output, outputJSON, outputCSV, outputJUnit)
+			}
+			c, err := o.client(cmd.Context())
+			if err != nil {
+				return err
+			}
+			err = o.resolveVeleroNamespace(cmd.Context(), c)
+			if err != nil {
+				return err
+			}
+			results, err := o.attach(cmd.Context(), c)
+			if results != nil {
+				if err != nil {
+					results.runFailed(err)
+				}
+				printReport(results)
+				if o.output != "" {
+					path := o.outputFile
+					if path == "" {
+						path = fmt.Sprintf("results-%s.%s", o.run, resultsExtension(o.output))
+					}
+					writeErr := results.write(o.output, path)
+					if writeErr != nil {
+						return writeErr
+					}
+					loggerFrom(cmd.Context()).Infow("results written", "path", path)
+				}
+			}
+			return err
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.run, "run", "", "name of the backup created by the run to attach to")
+	flags.StringVar(&o.output, "output", "", "write machine readable results in this format, json, csv or junit")
+	flags.StringVar(&o.outputFile, "output-file", "", "path of the results file, defaults to results-<backup name>.<output>")
+	flags.BoolVar(&o.tui, "tui", false, "show a live status of the run on the terminal, with the logs written in full to oadp-perf-<backup name>.log")
+	return cmd
+}
+
+// attach rebuilds the results of the run from the cluster and records the
+// rest of it as it happens, until the data mover is done.
+func (o *attachOptions) attach(ctx context.Context, c client.Client) (*runResults, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results, err := resultsFromCluster(ctx, c, o.veleroNamespace, o.run)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withLogger(ctx, loggerFrom(ctx).With("run", o.run))
+	if !results.DataMoverEndTime.IsZero() {
+		loggerFrom(ctx).Infow("run is already done")
+		return results, nil
+	}
+	mover := results.Mover
+	if mover == "" || mover == modeCSI {
+		mover = moverVSM
+	}
+	loggerFrom(ctx).Infow("attached to run", "mover", mover, "volumes", len(results.Volumes))
+	if o.tui {
+		display, err := startStatusDisplay(ctx, results, results.Concurrency, fmt.Sprintf("oadp-perf-%s.log", o.run))
+		if err != nil {
+			return nil, err
+		}
+		defer display.stop()
+		ctx = display.context(ctx)
+	}
+
+	config, err := o.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := o.scheme(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newRunWatcher(ctx, config, scheme, o.run, mover, results)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mover {
+	case moverNative:
+		err = waitForBackupToComplete(ctx, c, o.veleroNamespace, o.run)
+		if err == nil {
+			err = waitForDataUploadsToComplete(ctx, w, o.run, results, false)
+		}
+	case moverFSBackup:
+		err = waitForPodVolumeBackupsToComplete(ctx, w, o.veleroNamespace, o.run, results, false)
+	default:
+		err = waitForBackupToComplete(ctx, c, o.veleroNamespace, o.run)
+		if err == nil && results.SnapshotEndTime.IsZero() {
+			err = waitForVSCsToBeReady(ctx, w, o.run, 0, results)
+			if err == nil {
+				results.snapshotsDone(time.Now())
+			}
+		}
+		if err == nil && results.Mover != modeCSI {
+			err = waitForAttachedVSBs(ctx, w, o.veleroNamespace, o.run, results)
+		}
+	}
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for the run to finish", "phase", phaseDataMover)
+		}
+		return results, err
+	}
+
+	// The run itself knows best when its data mover finished.
+	backup := velerov1.Backup{}
+	err = c.Get(ctx, types.NamespacedName{Namespace: o.veleroNamespace, Name: o.run}, &backup)
+	if err != nil {
+		return results, errors.Wrapf(err, "failed to get backup %s", o.run)
+	}
+	if results.SnapshotEndTime.IsZero() {
+		results.snapshotsDone(parseAnnotationTime(backup.Annotations, annotationSnapshotEndTime, results.StartTime))
+	}
+	results.dataMoverDone(parseAnnotationTime(backup.Annotations, annotationDataMoverEndTime, time.Now()))
+	loggerFrom(ctx).Infow("data mover done", "phase", phaseDataMover, "elapsed", results.DataMoverTime.String(), "total", results.TotalTime.String(), "throughput", fmt.Sprintf("%.2f GiB/min", results.Throughput))
+	return results, nil
+}
+
+// waitForAttachedVSBs records the VSBs the run creates as they come and go,
+// until the run annotates its Backup as done or every VSC has a VSB that is
+// done, for runs whose client is gone.
+func waitForAttachedVSBs(ctx context.Context, w *runWatcher, veleroNamespace, name string, results *runResults) error {
+	timeout := 120 * time.Minute
+	lastDone, lastRunning := -1, -1
+	return w.waitFor(ctx, timeout, func() (bool, error) {
+		backup := velerov1.Backup{}
+		err := w.cache.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: name}, &backup)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to get backup")
+		}
+		vsbList, err := listVolumeSnapshotBackups(ctx, w.cache, name)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list volumesnapshotbackups")
+		}
+		done, running := 0, 0
+		now := time.Now()
+		for i := range vsbList.Items {
+			vsb := &vsbList.Items[i]
+			recordAnnotatedVSB(results, vsb, now)
+			if isVSBDone(vsb) {
+				done++
+				continue
+			}
+			running++
+		}
+		if done != lastDone || running != lastRunning {
+			loggerFrom(ctx).Infow("waiting for VSBs", "phase", phaseDataMover, "done", done, "running", running)
+			lastDone, lastRunning = done, running
+		}
+		if _, ok := backup.Annotations[annotationDataMoverEndTime]; ok {
+			return true, nil
+		}
+		return running == 0 && done > 0 && done >= results.volumeCount(), nil
+	})
+}
+
+// volumeCount returns the number of volumes recorded so far.
+func (r *runResults) volumeCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Volumes)
+}
+
+// isVSBDone reports whether the data mover is done with vsb, whether or not
+// it succeeded.
+func isVSBDone(vsb *dmv1.VolumeSnapshotBackup) bool {
+	return isVSBCompleted(vsb) || vsbFailure(vsb) != nil
+}
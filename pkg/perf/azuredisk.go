@@ -0,0 +1,113 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	// azureResourceManager is the endpoint of the Azure Resource Manager
+	// API of the public cloud.
+	azureResourceManager = "https://management.azure.com"
+	// azureComputeAPIVersion is the version of the Microsoft.Compute API
+	// snapshots are read with.
+	azureComputeAPIVersion = "2023-04-02"
+	// azureSucceeded is the provisioning state of a snapshot that was
+	// created.
+	azureSucceeded = "Succeeded"
+)
+
+// azureDiskVerifier asks Azure Resource Manager about the Managed Disk
+// snapshots of the run, whose snapshotHandles are their resource IDs,
+// authenticating as the service principal of the environment.
+type azureDiskVerifier struct {
+	client   *http.Client
+	endpoint string
+}
+
+// newAzureDiskVerifier reads the service principal from AZURE_TENANT_ID,
+// AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, and a sovereign cloud from
+// AZURE_AUTHORITY_HOST and AZURE_RESOURCE_MANAGER_ENDPOINT.
+func newAzureDiskVerifier(ctx context.Context) (SnapshotVerifier, error) {
+	tenant := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	secret := os.Getenv("AZURE_CLIENT_SECRET")
+	if tenant == "" || clientID == "" || secret == "" {
+		return nil, errors.New("cloud-verify azure requires AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET")
+	}
+	authority := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com"
+	}
+	endpoint := os.Getenv("AZURE_RESOURCE_MANAGER_ENDPOINT")
+	if endpoint == "" {
+		endpoint = azureResourceManager
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	config := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: secret,
+		TokenURL:     fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authority, "/"), tenant),
+		Scopes:       []string{endpoint + "/.default"},
+		AuthStyle:    oauth2.AuthStyleInParams,
+	}
+	client := config.Client(ctx)
+	client.Timeout = time.Minute
+	return &azureDiskVerifier{client: client, endpoint: endpoint}, nil
+}
+
+func (a *azureDiskVerifier) Name() string { return cloudAzure }
+
+// Describe gets the snapshot of each handle. Incremental snapshots report
+// how much of their data is copied as completionPercent and are only usable
+// once it reaches 100.
+func (a *azureDiskVerifier) Describe(ctx context.Context, handles []string) (map[string]CloudSnapshot, error) {
+	return describeEach(ctx, handles, a.describe)
+}
+
+func (a *azureDiskVerifier) describe(ctx context.Context, handle string) (CloudSnapshot, bool, error) {
+	if !strings.HasPrefix(strings.ToLower(handle), "/subscriptions/") {
+		return CloudSnapshot{}, false, errors.Errorf("snapshot handle %q is not an Azure resource ID", handle)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s%s?api-version=%s", a.endpoint, handle, azureComputeAPIVersion), nil)
+	if err != nil {
+		return CloudSnapshot{}, false, errors.Wrapf(err, "failed to create request for snapshot %s", handle)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return CloudSnapshot{}, false, errors.Wrapf(err, "failed to get snapshot %s", handle)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return CloudSnapshot{}, false, nil
+	}
+	if resp.StatusCode >= 300 {
+		return CloudSnapshot{}, false, errors.Errorf("failed to get snapshot %s: %s", handle, resp.Status)
+	}
+	snapshot := struct {
+		Properties struct {
+			ProvisioningState string   `json:"provisioningState"`
+			CompletionPercent *float64 `json:"completionPercent"`
+		} `json:"properties"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	if err != nil {
+		return CloudSnapshot{}, false, errors.Wrapf(err, "failed to parse snapshot %s", handle)
+	}
+	s := CloudSnapshot{State: snapshot.Properties.ProvisioningState}
+	s.Completed = s.State == azureSucceeded
+	if percent := snapshot.Properties.CompletionPercent; percent != nil {
+		s.Progress = fmt.Sprintf("%.0f%%", *percent)
+		s.Completed = s.Completed && *percent >= 100
+	}
+	return s, true, nil
+}
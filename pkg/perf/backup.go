@@ -0,0 +1,1545 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// defaultResticSecretName is the volsync restic secret of a DPA called
+	// dpa-sample-1, used when there is no DPA to discover it from.
+	defaultResticSecretName = "dpa-sample-1-volsync-restic"
+	defaultConcurrency      = 12
+)
+
+type backupOptions struct {
+	*rootOptions
+	resticSecretName string
+	namespaces       string
+	namespacesFile   string
+	concurrency      int
+	createRate       float64
+	createBurst      int
+	schedule         string
+	output           string
+	outputFile       string
+	restore          bool
+	resume           string
+	metricsAddr      string
+	stallTimeout     time.Duration
+	onFailure        string
+	skipPreflight    bool
+	verify           bool
+	verifyImage      string
+	mover            string
+	mode             string
+	baseline         string
+	threshold        float64
+	maxTotalTime     time.Duration
+	maxVSBP95        time.Duration
+	dryRun           bool
+	iterations       int
+	tui              bool
+	notifyURL        string
+	notifyFormat     string
+	forever          bool
+	interval         time.Duration
+	backupsPerRun    int
+	order            string
+	snapshotOnly     bool
+	existingBackup   string
+	vsb              vsbOptions
+	spec             backupSpecOptions
+	filter           vscFilter
+	retainSnapshots  bool
+	cloudVerify      string
+	repoStats        bool
+	repoStatsImage   string
+	measureStorage   bool
+	chaos            []string
+	chaosInterval    time.Duration
+	exceedDPALimit   bool
+	sampleResources  bool
+	sampleInterval   time.Duration
+	cleanupAfter     bool
+	secretTemplate   string
+	artifactsDir     string
+	resultsURL       string
+	historyDB        string
+	otlpEndpoint     string
+	sinkSpecs        []string
+	events           string
+	kubeconfigs      []string
+	contexts         []string
+	namePrefix       string
+	// excludeNamespaces and namespaceSelector leave out of and add to the
+	// namespaces of the run.
+	excludeNamespaces string
+	namespaceSelector string
+	// volumeSnapshotClass is checked before the run and, with
+	// setVolumeSnapshotClass, named on the backup for its CSI driver,
+	// volumeSnapshotDriver.
+	volumeSnapshotClass    string
+	setVolumeSnapshotClass bool
+	volumeSnapshotDriver   string
+	// noSnapshotsTimeout is how long the backup may have no
+	// volumesnapshotcontents before the run is diagnosed and failed.
+	noSnapshotsTimeout time.Duration
+	// batchAdvanceThreshold is the share of a batch that must be done
+	// before the next one starts, all of it if 0 or 1.
+	batchAdvanceThreshold float64
+	// veleroSchedule is the cron expression of the Velero Schedule that
+	// fires the backups of the command, veleroScheduleName the schedule
+	// once it is created and scheduledBackups the backups it fired that
+	// were already seen.
+	veleroSchedule     string
+	veleroScheduleName string
+	scheduledBackups   map[string]bool
+	// etaInterval is how often the estimated time left is logged.
+	etaInterval time.Duration
+	// batchDelay pauses between batches and createJitter delays each VSB
+	// create by a random time up to it.
+	batchDelay   time.Duration
+	createJitter time.Duration
+	// maxFailures aborts the run once this many VSBs have failed, if set.
+	maxFailures int
+	// flagConfig holds the flags the command was run with, recorded in
+	// the results.
+	flagConfig map[string]string
+	// checkRBACAccess checks the identity of the client has the access a
+	// run needs before it starts.
+	checkRBACAccess bool
+	// namespaceMappings restores namespaces into others, as source:target
+	// pairs, parsed into restoreMappings.
+	namespaceMappings string
+	restoreMappings   map[string]string
+	// ready waits for the restored applications once the restore is
+	// done.
+	ready readinessOptions
+	// sinks are the result sinks given to the Runner.
+	sinks []ResultSink
+	// eventStream is opened from events once for every backup of the
+	// command.
+	eventStream *eventStream
+	// snapshotVerifier is created from cloudVerify once for every backup
+	// of the command.
+	snapshotVerifier SnapshotVerifier
+	// dpaLimit is the maxConcurrentBackupVolumes of the DPA, if it sets
+	// one.
+	dpaLimit int
+	// cluster names the cluster of the options of each backup run by
+	// backupClusters.
+	cluster string
+	// shard numbers the shard of the options of each backup run by
+	// backupShards, labelling its metrics.
+	shard string
+	// sharded is set on the options of each backup run by backupShards
+	// and backupClusters, which run concurrently and so share the
+	// terminal without a status display.
+	sharded bool
+}
+
+// newBackupOptions returns the options of a backup with the defaults of the
+// backup command, for the commands and callers that build them instead of
+// parsing its flags.
+func newBackupOptions(root *rootOptions) *backupOptions {
+	return &backupOptions{
+		rootOptions:      root,
+		resticSecretName: defaultResticSecretName,
+		concurrency:      defaultConcurrency,
+		createBurst:      1,
+		schedule:         scheduleWindow,
+		onFailure:        onFailureAbort,
+		mover:            moverVSM,
+		mode:             modeDataMover,
+		iterations:       1,
+		backupsPerRun:    1,
+		verifyImage:      defaultImage,
+		notifyFormat:     notifyJSON,
+		spec:             backupSpecOptions{snapshotVolumes: true},
+		namePrefix:       defaultNamePrefix,
+	}
+}
+
+func newBackupCommand(root *rootOptions) *cobra.Command {
+	o := &backupOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Create a Velero backup and drive its snapshots through the data mover",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd.Context(), cmd.Flags())
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.resticSecretName, "restic-secret", defaultResticSecretName, "name of restic secret for volsync to use, <dpa-name>-volsync-restic of the DataProtectionApplication if not set")
+	flags.StringVar(&o.vsb.resticSecrets, "restic-secrets", "", "comma separated namespace=secret pairs of restic secrets to use for the volumesnapshotbackups of some namespaces instead of restic-secret; namespaces may be shell patterns such as team-a-*")
+	flags.StringVar(&o.vsb.resticSecretsFile, "restic-secrets-file", "", "path to a YAML file mapping namespaces, or shell patterns of them, to the restic secret their volumesnapshotbackups use instead of restic-secret; restic-secrets wins for namespaces both name")
+	flags.StringVar(&o.secretTemplate, "restic-secret-template", "", "path to a Secret YAML to create the restic secret of each namespace from, with RESTIC_REPOSITORY suffixed by the namespace and RESTIC_PASSWORD taken from $RESTIC_PASSWORD or generated if the template has none")
+	flags.StringVar(&o.vsb.storageClass, "storage-class", "", "storage class of the snapshot clone the data mover backs up from")
+	flags.StringVar(&o.vsb.accessMode, "access-mode", "", "access mode of the snapshot clone the data mover backs up from")
+	flags.StringVar(&o.vsb.cacheStorageClass, "cache-storage-class", "", "storage class of the volsync restic cache volume")
+	flags.StringVar(&o.vsb.cacheCapacity, "cache-capacity", "", "size of the volsync restic cache volume, e.g. 2Gi")
+	flags.StringVar(&o.vsb.cacheAccessMode, "cache-access-mode", "", "access mode of the volsync restic cache volume")
+	flags.BoolVar(&o.vsb.moverSecurityContext, "mover-security-context", false, "run the volsync mover pods with the security context of the source pods")
+	flags.StringVar(&o.namespaces, "namespaces", "", "comma separated list of namespaces to backup")
+	flags.StringVar(&o.namespacesFile, "namespaces-file", "", "path to a file listing namespaces to backup, one per line")
+	flags.StringVar(&o.namePrefix, "name-prefix", defaultNamePrefix, "prefix of the name of the backup, followed by the start time and a short random ID; the name identifies the run in labels, results and artifacts")
+	flags.StringVar(&o.namespaceSelector, "namespace-selector", "", "label selector of namespaces to backup, such as app=perf-target, added to namespaces and namespaces-file")
+	flags.StringVar(&o.excludeNamespaces, "exclude-namespaces", "", "comma separated namespaces, or shell patterns such as perf-target-1*, to leave out of the backup")
+	flags.StringVar(&o.volumeSnapshotClass, "volume-snapshot-class", "", "VolumeSnapshotClass the snapshots of the run should use, checked before the backup is created to have the velero.io/csi-volumesnapshot-class label, the annotations the data mover needs and deletionPolicy Retain")
+	flags.BoolVar(&o.setVolumeSnapshotClass, "set-volume-snapshot-class", false, "name volume-snapshot-class on the backup with the velero.io/csi-volumesnapshot-class_<driver> annotation, so Velero 1.12+ uses it rather than the labeled class it picks for the driver")
+	flags.StringVar(&o.veleroSchedule, "velero-schedule", "", "create a Velero Schedule with this cron expression, such as '@every 30m', instead of a backup and follow the backups it fires, one per iteration, so cron-triggered backups overlapping with the data mover of earlier ones are measured; the schedule is deleted once the command is done")
+	flags.StringVar(&o.spec.template, "backup-template", "", "path to a Velero Backup YAML whose labels, annotations and spec the backup is created from, with includedNamespaces replaced by the namespaces of the run")
+	flags.StringVar(&o.spec.selector, "selector", "", "label selector of the resources to back up, e.g. app=db,tier!=cache")
+	flags.StringSliceVar(&o.spec.includedResources, "include-resources", nil, "comma separated resources to back up, all if not set")
+	flags.StringSliceVar(&o.spec.excludedResources, "exclude-resources", nil, "comma separated resources not to back up")
+	flags.BoolVar(&o.spec.snapshotVolumes, "snapshot-volumes", true, "set snapshotVolumes of the backup")
+	flags.BoolVar(&o.spec.fsBackup, "default-volumes-to-fs-backup", false, "set defaultVolumesToFsBackup of the backup, backing up pod volumes that are not opted out with the file system backup instead of snapshotting them")
+	flags.DurationVar(&o.spec.ttl, "ttl", 0, "how long Velero keeps the backup, its default if 0")
+	flags.StringArrayVar(&o.spec.hooks.pre, "pre-hook", nil, "command to run in the pods of a namespace before their volumes are snapshotted, e.g. to flush or quiesce a database, as <namespace>[/<container>]=<command> with * for every namespace, repeatable")
+	flags.StringArrayVar(&o.spec.hooks.post, "post-hook", nil, "command to run in the pods of a namespace once their volumes are snapshotted, e.g. to unquiesce a database, as <namespace>[/<container>]=<command> with * for every namespace, repeatable")
+	flags.StringVar(&o.spec.hooks.selector, "hook-selector", "", "label selector of the pods to run pre-hook and post-hook commands in, every pod of the namespace if not set")
+	flags.DurationVar(&o.spec.hooks.timeout, "hook-timeout", 0, "how long Velero waits for each hook command, its default if 0")
+	flags.StringVar(&o.spec.hooks.onError, "hook-on-error", string(velerov1.HookErrorModeFail), "what Velero does when a hook command fails: Fail fails the backup, Continue carries on")
+	flags.IntVar(&o.concurrency, "concurrency", defaultConcurrency, "number of concurrent volumesnapshotbackups to run; also the number of workers creating them. Defaults to maxConcurrentBackupVolumes of the DataProtectionApplication if it is set")
+	flags.IntVar(&o.concurrency, "concurrent", defaultConcurrency, "deprecated alias for concurrency")
+	flags.MarkDeprecated("concurrent", "use --concurrency instead")
+	flags.StringVar(&o.filter.storageClass, "pvc-storage-class", "", "only create volumesnapshotbackups for snapshots of PVCs of this storage class")
+	flags.StringVar(&o.filter.minSize, "min-pvc-size", "", "only create volumesnapshotbackups for snapshots of PVCs requesting at least this much storage, e.g. 10Gi")
+	flags.StringVar(&o.filter.selector, "pvc-label-selector", "", "only create volumesnapshotbackups for snapshots of PVCs matching this label selector")
+	flags.Float64Var(&o.createRate, "vsb-create-rate", 0, "maximum volumesnapshotbackups to create per second, so the burst of creates at the start of a run or batch does not trip API priority and fairness throttling, unlimited if 0")
+	flags.IntVar(&o.createBurst, "vsb-create-burst", 1, "number of volumesnapshotbackups that may be created at once before vsb-create-rate applies")
+	flags.DurationVar(&o.createJitter, "create-jitter", 0, "delay each volumesnapshotbackup create by a random time up to this, e.g. 2s, to spread out the bursts the snapshot controller and object store see")
+	flags.BoolVar(&o.exceedDPALimit, "exceed-dpa-limit", false, "keep a concurrency above the maxConcurrentBackupVolumes of the DataProtectionApplication instead of holding it to the limit, reporting how long volumesnapshotbackups queue in the data mover")
+	flags.StringVar(&o.schedule, "schedule", scheduleWindow, "how volumesnapshotbackups are scheduled: window keeps concurrency running at all times, batch waits for each batch of concurrency to complete")
+	flags.DurationVar(&o.batchDelay, "batch-delay", 0, "with schedule batch, pause this long, e.g. 30s, before starting each batch after the first")
+	flags.Float64Var(&o.batchAdvanceThreshold, "batch-advance-threshold", 1, "with schedule batch, start the next batch once this share of the current one is done, e.g. 0.8, carrying the stragglers forward into the slots of the next batch")
+	flags.StringVar(&o.order, "order", "", "order to queue volumesnapshotcontents for volumesnapshotbackups in by the requested size of their PVCs: largest-first, smallest-first or random. Defaults to the order they are listed in")
+	flags.StringVar(&o.output, "output", "", "write machine readable results in this format, json, csv or junit")
+	flags.StringVar(&o.outputFile, "output-file", "", "path of the results file, defaults to results-<backup name>.<output>")
+	flags.BoolVar(&o.restore, "restore", false, "restore the backup with volumesnapshotrestores once all volumesnapshotbackups complete")
+	flags.BoolVar(&o.ready.waitReady, "wait-ready", false, "with restore, wait for the PVCs of the restored namespaces to be bound and their deployments and statefulsets to be ready, timing each")
+	flags.DurationVar(&o.ready.timeout, "ready-timeout", 30*time.Minute, "how long to wait for the restored applications to be ready")
+	flags.StringVar(&o.ready.validateCommand, "validate-command", "", "with restore, shell command to run for every restored namespace once its applications are ready, with NAMESPACE and RUN set, such as a row count query; a non-zero exit fails the run. Implies wait-ready")
+	flags.StringVar(&o.namespaceMappings, "namespace-mappings", "", "with restore, comma separated source:target pairs of namespaces to restore into other namespaces, which are created if missing, so the backed up namespaces can be left in place")
+	flags.StringVar(&o.metricsAddr, "metrics-addr", "", "address such as :8080 to serve Prometheus metrics for the run on, disabled if empty")
+	flags.DurationVar(&o.stallTimeout, "vsb-stall-timeout", 0, "give up on a volumesnapshotbackup whose status has not changed for this long and carry on with the rest, disabled if 0")
+	flags.IntVar(&o.maxFailures, "max-failures", 0, "abort the run and delete its volumesnapshotbackups once this many could not be created, failed or stalled, rather than carrying on against a broken repository or secret; unlimited if 0")
+	flags.StringVar(&o.onFailure, "on-failure", onFailureAbort, "what to do when a volumesnapshotbackup or dataupload fails: abort stops the run, continue records the failure and carries on with the rest")
+	flags.StringVar(&o.artifactsDir, "artifacts-dir", "", "directory to collect the YAML, events, replicationsource and mover pod logs of volumesnapshotbackups that fail, stall or time out into, disabled if empty")
+	flags.StringVar(&o.resultsURL, "results-url", "", "s3://bucket/prefix or http(s):// URL to upload the results file and artifacts of the run to when it ends, so runs in cluster Jobs deliver their results without exec'ing into the pod; s3 URLs use the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_REGION and AWS_ENDPOINT_URL environment variables")
+	flags.StringVar(&o.historyDB, "history-db", "", "path of a local database to record the results of every run in, whether or not it failed, for the history command, disabled if empty")
+	flags.StringVar(&o.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint such as http://otel-collector:4318 to export the run to as an OpenTelemetry trace when it ends, disabled if empty")
+	flags.StringArrayVar(&o.sinkSpecs, "sink", nil, "where to deliver the results of the run when it ends, as name or name=value, repeatable: stdout, json[=<path>], pushgateway=<url>, history=<path>, objectstore=<url> or otlp=<url>")
+	flags.StringVar(&o.events, "events", "", "write progress events as newline delimited JSON to this file, to stdout if -, or to every client of the unix socket unix:<path>, disabled if empty")
+	flags.BoolVar(&o.skipPreflight, "skip-preflight", false, "do not run the preflight checks before starting")
+	flags.BoolVar(&o.checkRBACAccess, "check-rbac", false, "check with SelfSubjectAccessReviews that the current identity can create backups, watch volumesnapshotcontents and create volumesnapshotbackups in every namespace backed up before starting, listing the verbs it is missing; runs even with skip-preflight")
+	flags.BoolVar(&o.verify, "verify", false, "checksum the data of PVCs created by generate before the backup and again after the restore, requires --restore")
+	flags.StringVar(&o.verifyImage, "verify-image", defaultImage, "image of the verification pods, must provide sha256sum")
+	flags.StringVar(&o.mover, "mover", moverVSM, "data mover to benchmark: vsm creates volumesnapshotbackups for the OADP 1.2 volsync data mover, native backs up with snapshotMoveData and waits on the datauploads of the OADP 1.3+ built-in data mover")
+	flags.StringVar(&o.mode, "mode", modeDataMover, "what to benchmark: data-mover snapshots the volumes and moves their data with the mover, fs-backup backs them up with defaultVolumesToFsBackup and times the restic or kopia podvolumebackups instead")
+	flags.StringVar(&o.baseline, "baseline", "", "JSON results file of a previous run to compare this run against")
+	flags.Float64Var(&o.threshold, "regression-threshold", 10, "percentage by which a timing may be slower than the baseline before the command fails")
+	flags.DurationVar(&o.maxTotalTime, "max-total-time", 0, "fail the run if its total time is longer than this, disabled if 0")
+	flags.DurationVar(&o.maxVSBP95, "max-vsb-p95", 0, "fail the run if the 95th percentile volumesnapshotbackup duration is longer than this, disabled if 0")
+	flags.StringVar(&o.existingBackup, "use-existing-backup", "", "skip creating a backup and run the data mover again against the volumesnapshotcontents of this completed backup, deleting the volumesnapshotbackups of earlier runs against it first")
+	flags.BoolVar(&o.cleanupAfter, "cleanup-after", false, "once the run is done, delete the backup with a DeleteBackupRequest and time how long Velero takes to delete it and its volumesnapshotcontents and snapshots")
+	flags.BoolVar(&o.retainSnapshots, "retain-snapshots", false, "set the deletionPolicy of the volumesnapshotcontents of the backup to Retain once they are ready, so the snapshots outlive the backup for use-existing-backup; cleanup sets it back to Delete")
+	flags.StringVar(&o.resume, "resume", "", "resume an interrupted run from its existing backup instead of creating a new one")
+	flags.StringSliceVar(&o.kubeconfigs, "kubeconfigs", nil, "comma separated kubeconfig files of clusters to run the same backup against at the same time, printing a comparison of the clusters")
+	flags.StringSliceVar(&o.contexts, "contexts", nil, "comma separated contexts of the kubeconfig to run the same backup against at the same time, printing a comparison of the clusters")
+	flags.IntVar(&o.backupsPerRun, "backups-per-run", 1, "split the namespaces round robin across this many Velero backups run at the same time, each with its own concurrency")
+	flags.BoolVar(&o.repoStats, "repo-stats", false, "once the volumesnapshotbackups complete, run restic stats against the repositories they backed up to and record their size, dedup ratio and growth since the previous run in history-db")
+	flags.StringVar(&o.repoStatsImage, "repo-stats-image", defaultResticImage, "image of the repository statistics pods, must provide sh and restic")
+	flags.BoolVar(&o.measureStorage, "measure-storage", false, "list the S3 bucket prefixes of the restic repositories before the first volumesnapshotbackup and once the data mover is done, recording the bytes and objects uploaded and the upload bandwidth; the credentials are those of the restic secrets")
+	flags.StringSliceVar(&o.chaos, "chaos", nil, "comma separated chaos actions to take every chaos-interval while the volumesnapshotbackups run, recording how long the data mover takes to recover: kill-mover-pods deletes a random running volsync mover pod, restart-controllers restarts the velero and volume-snapshot-mover deployments")
+	flags.DurationVar(&o.chaosInterval, "chaos-interval", 5*time.Minute, "time between chaos actions")
+	flags.BoolVar(&o.sampleResources, "sample-resources", false, "sample the CPU and memory of the velero, volume-snapshot-mover, node agent and volsync mover pods and of the nodes from the metrics API throughout the run, recording their peak and mean usage")
+	flags.DurationVar(&o.etaInterval, "eta-interval", time.Minute, "how often to log the estimated time left of the current batch and of the run, worked out from the latest volumesnapshotbackups to complete and those left, disabled if 0")
+	flags.DurationVar(&o.sampleInterval, "sample-interval", 15*time.Second, "time between resource usage samples")
+	flags.StringVar(&o.cloudVerify, "cloud-verify", "", "cross-check the snapshotHandle of every volumesnapshotcontent with the cloud the snapshots are in, logging their progress while waiting for them and failing the run if any is not completed once the VSCs are ready: aws checks EBS snapshots using the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION environment variables, azure Managed Disk snapshots using AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, gcp Persistent Disk snapshots using the application default credentials; disabled if empty")
+	flags.DurationVar(&o.noSnapshotsTimeout, "no-snapshots-timeout", 5*time.Minute, "fail the run with a diagnosis of the backup, the CSI setup of Velero, the PVCs of the namespaces and the velero log if the completed backup has no volumesnapshotcontents for this long; wait the full snapshot timeout if 0")
+	flags.BoolVar(&o.snapshotOnly, "snapshot-only", false, "stop once the volumesnapshotcontents are ready and record only the snapshot time, as a CSI baseline for data mover runs")
+	flags.IntVar(&o.iterations, "iterations", 1, "run the whole backup and data mover cycle this many times, cleaning up between iterations, and print the mean, standard deviation and trend of the timings across them")
+	flags.BoolVar(&o.forever, "forever", false, "run iterations until interrupted, then print their aggregates")
+	flags.DurationVar(&o.interval, "interval", 0, "pause between iterations")
+	flags.BoolVar(&o.tui, "tui", false, "show a live status of the run on the terminal, with the logs written in full to oadp-perf-<backup name>.log; plain logs are kept when stderr is not a terminal")
+	flags.StringVar(&o.notifyURL, "notify-url", "", "webhook to post a summary of the run to when it finishes, fails, times out or panics")
+	flags.StringVar(&o.notifyFormat, "notify-format", notifyJSON, "payload posted to notify-url: json for the summary itself, slack for a Slack compatible message")
+	flags.BoolVar(&o.dryRun, "dry-run", false, "print the PVCs found, the expected number of volumesnapshotcontents, the backup, the schedule and the estimated data volume without creating anything")
+	return cmd
+}
+
+func (o *backupOptions) validate() error {
+	if o.concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	err := validateNamePrefix(o.namePrefix)
+	if err != nil {
+		return err
+	}
+	if o.namespaceSelector != "" {
+		_, err := labels.Parse(o.namespaceSelector)
+		if err != nil {
+			return errors.Wrapf(err, "invalid namespace-selector %q", o.namespaceSelector)
+		}
+	}
+	if o.setVolumeSnapshotClass && o.volumeSnapshotClass == "" {
+		return errors.New("set-volume-snapshot-class needs volume-snapshot-class")
+	}
+	if o.schedule != scheduleWindow && o.schedule != scheduleBatch {
+		return errors.Errorf("unknown schedule %q, must be one of %s or %s", o.schedule, scheduleWindow, scheduleBatch)
+	}
+	if o.batchAdvanceThreshold < 0 || o.batchAdvanceThreshold > 1 {
+		return errors.New("batch-advance-threshold must be between 0 and 1")
+	}
+	if o.batchAdvanceThreshold > 0 && o.batchAdvanceThreshold < 1 && o.schedule != scheduleBatch {
+		return errors.Errorf("batch-advance-threshold needs schedule %s", scheduleBatch)
+	}
+	if o.veleroSchedule != "" && (o.resume != "" || o.existingBackup != "") {
+		return errors.New("velero-schedule cannot be combined with resume or use-existing-backup")
+	}
+	if o.veleroSchedule != "" && o.backupsPerRun > 1 {
+		return errors.New("velero-schedule cannot be combined with backups-per-run")
+	}
+	if o.noSnapshotsTimeout < 0 {
+		return errors.New("no-snapshots-timeout must not be negative")
+	}
+	if o.maxFailures < 0 {
+		return errors.New("max-failures must not be negative")
+	}
+	if o.maxFailures > 0 && o.mover != moverVSM {
+		return errors.New("max-failures needs mover vsm, Velero drives the uploads of the other movers")
+	}
+	if o.batchDelay < 0 || o.createJitter < 0 {
+		return errors.New("batch-delay and create-jitter must not be negative")
+	}
+	if o.batchDelay > 0 && o.schedule != scheduleBatch {
+		return errors.New("batch-delay needs schedule batch")
+	}
+	if o.createRate < 0 {
+		return errors.New("vsb-create-rate must not be negative")
+	}
+	if o.createBurst < 1 {
+		return errors.New("vsb-create-burst must be at least 1")
+	}
+	switch o.mode {
+	case modeDataMover, "":
+		o.mode = modeDataMover
+		if o.mover != moverVSM && o.mover != moverNative {
+			return errors.Errorf("unknown mover %q, must be one of %s or %s", o.mover, moverVSM, moverNative)
+		}
+	case modeFSBackup:
+		if o.mover != moverVSM && o.mover != moverFSBackup {
+			return errors.New("mode fs-backup cannot be used with mover, the node agent moves the data")
+		}
+		// Every later check and the run itself treat the file system
+		// backup as one more mover.
+		o.mover = moverFSBackup
+		o.spec.fsBackup, o.spec.fsBackupSet = true, true
+	default:
+		return errors.Errorf("unknown mode %q, must be one of %s or %s", o.mode, modeDataMover, modeFSBackup)
+	}
+	err = o.vsb.validate()
+	if err != nil {
+		return err
+	}
+	err = o.spec.validate()
+	if err != nil {
+		return err
+	}
+	err = o.filter.validate()
+	if err != nil {
+		return err
+	}
+	if o.filter.enabled() && (o.mover != moverVSM || o.snapshotOnly) {
+		return errors.New("pvc-storage-class, min-pvc-size and pvc-label-selector cannot be used with mover native, mode fs-backup or snapshot-only, they pick the volumes to create volumesnapshotbackups for")
+	}
+	if o.onFailure != onFailureAbort && o.onFailure != onFailureContinue {
+		return errors.Errorf("unknown on-failure %q, must be one of %s or %s", o.onFailure, onFailureAbort, onFailureContinue)
+	}
+	switch o.order {
+	case "", orderLargestFirst, orderSmallestFirst, orderRandom:
+	default:
+		return errors.Errorf("unknown order %q, must be one of %s, %s or %s", o.order, orderLargestFirst, orderSmallestFirst, orderRandom)
+	}
+	if o.stallTimeout < 0 {
+		return errors.New("vsb-stall-timeout must not be negative")
+	}
+	if o.verify && !o.restore {
+		return errors.New("verify requires restore")
+	}
+	o.restoreMappings, err = parseNamespaceMappings(o.namespaceMappings)
+	if err != nil {
+		return err
+	}
+	if len(o.restoreMappings) > 0 && !o.restore {
+		return errors.New("namespace-mappings requires restore")
+	}
+	err = o.ready.validate()
+	if err != nil {
+		return err
+	}
+	if o.ready.enabled() && !o.restore {
+		return errors.New("wait-ready and validate-command require restore")
+	}
+	if o.verify && o.resume != "" {
+		return errors.New("verify cannot be used with resume since the data must be checksummed before the backup")
+	}
+	if o.output != "" && o.output != outputJSON && o.output != outputCSV && o.output != outputJUnit {
+		return errors.Errorf("unknown output format %q, must be one of %s, %s or %s", o.output, outputJSON, outputCSV, outputJUnit)
+	}
+	if o.threshold < 0 {
+		return errors.New("regression-threshold must not be negative")
+	}
+	if o.maxTotalTime < 0 || o.maxVSBP95 < 0 {
+		return errors.New("max-total-time and max-vsb-p95 must not be negative")
+	}
+	if o.backupsPerRun < 1 {
+		return errors.New("backups-per-run must be at least 1")
+	}
+	if o.backupsPerRun > 1 {
+		switch {
+		case o.resume != "":
+			return errors.New("backups-per-run cannot be used with resume")
+		case o.baseline != "":
+			return errors.New("backups-per-run cannot be used with baseline")
+		case o.maxTotalTime > 0 || o.maxVSBP95 > 0:
+			return errors.New("backups-per-run cannot be used with max-total-time or max-vsb-p95")
+		case o.outputFile != "":
+			return errors.New("backups-per-run cannot be used with output-file, each backup writes results-<backup name>.<output>")
+		}
+	}
+	if o.snapshotOnly {
+		switch {
+		case o.mover != moverVSM:
+			return errors.New("snapshot-only cannot be used with mover native or mode fs-backup")
+		case o.restore:
+			return errors.New("snapshot-only cannot be used with restore")
+		}
+	}
+	if o.cleanupAfter {
+		switch {
+		case o.retainSnapshots:
+			return errors.New("cleanup-after cannot be used with retain-snapshots, the snapshots would be kept")
+		case o.existingBackup != "":
+			return errors.New("cleanup-after cannot be used with use-existing-backup, the backup is meant to be reused")
+		}
+	}
+	if o.retainSnapshots && o.mover == moverNative {
+		return errors.New("retain-snapshots cannot be used with mover native, Velero deletes the snapshots once their data is moved")
+	}
+	if o.retainSnapshots && o.mover == moverFSBackup {
+		return errors.New("retain-snapshots cannot be used with mode fs-backup, it takes no snapshots")
+	}
+	if o.existingBackup != "" {
+		switch {
+		case o.resume != "":
+			return errors.New("use-existing-backup cannot be used with resume")
+		case o.mover == moverNative:
+			return errors.New("use-existing-backup cannot be used with mover native, Velero creates the datauploads itself")
+		case o.mover == moverFSBackup:
+			return errors.New("use-existing-backup cannot be used with mode fs-backup, it takes no snapshots")
+		case o.snapshotOnly:
+			return errors.New("use-existing-backup cannot be used with snapshot-only")
+		case o.verify:
+			return errors.New("use-existing-backup cannot be used with verify since the data must be checksummed before the backup")
+		case o.backupsPerRun > 1:
+			return errors.New("use-existing-backup cannot be used with backups-per-run")
+		}
+	}
+	if o.secretTemplate != "" {
+		switch {
+		case o.mover != moverVSM:
+			return errors.New("restic-secret-template cannot be used with mover native or mode fs-backup")
+		case o.resume != "" || o.existingBackup != "":
+			return errors.New("restic-secret-template cannot be used with resume or use-existing-backup, the secrets were provisioned by the original run")
+		}
+	}
+	if len(o.kubeconfigs) > 0 || len(o.contexts) > 0 {
+		switch {
+		case len(o.kubeconfigs) > 0 && len(o.contexts) > 0:
+			return errors.New("kubeconfigs and contexts cannot be used together")
+		case o.resume != "" || o.existingBackup != "":
+			return errors.New("kubeconfigs and contexts cannot be used with resume or use-existing-backup, the backup names differ per cluster")
+		case o.backupsPerRun > 1 || o.iterations > 1 || o.forever:
+			return errors.New("kubeconfigs and contexts cannot be used with backups-per-run, iterations or forever")
+		case o.baseline != "" || o.outputFile != "":
+			return errors.New("kubeconfigs and contexts cannot be used with baseline or output-file, each cluster writes results-<cluster>-<backup name>.<output>")
+		case o.dryRun:
+			return errors.New("kubeconfigs and contexts cannot be used with dry-run")
+		}
+	}
+	if o.iterations < 1 {
+		return errors.New("iterations must be at least 1")
+	}
+	if o.interval < 0 {
+		return errors.New("interval must not be negative")
+	}
+	if o.iterations > 1 || o.forever {
+		switch {
+		case o.resume != "":
+			return errors.New("iterations and forever cannot be used with resume")
+		case o.backupsPerRun > 1:
+			return errors.New("iterations and forever cannot be used with backups-per-run")
+		case o.baseline != "":
+			return errors.New("iterations and forever cannot be used with baseline")
+		case o.outputFile != "":
+			return errors.New("iterations and forever cannot be used with output-file, each iteration writes results-<backup name>.<output>")
+		}
+	}
+	if o.notifyURL != "" && o.notifyFormat != "" && o.notifyFormat != notifyJSON && o.notifyFormat != notifySlack {
+		return errors.Errorf("unknown notify-format %q, must be one of %s or %s", o.notifyFormat, notifyJSON, notifySlack)
+	}
+	if o.repoStats && (o.mover != moverVSM || o.snapshotOnly) {
+		return errors.New("repo-stats can only be used with mover vsm, whose volumesnapshotbackups back up to restic repositories")
+	}
+	for _, action := range o.chaos {
+		switch action {
+		case chaosKillMoverPods, chaosRestartControllers:
+		default:
+			return errors.Errorf("unknown chaos action %q, must be %s or %s", action, chaosKillMoverPods, chaosRestartControllers)
+		}
+	}
+	if len(o.chaos) > 0 {
+		switch {
+		case o.mover != moverVSM || o.snapshotOnly:
+			return errors.New("chaos can only be used with mover vsm, whose volumesnapshotbackups run volsync mover pods")
+		case o.chaosInterval <= 0:
+			return errors.New("chaos-interval must be positive")
+		}
+	}
+	if o.etaInterval < 0 {
+		return errors.New("eta-interval must not be negative")
+	}
+	if o.sampleResources && o.sampleInterval <= 0 {
+		return errors.New("sample-interval must be positive")
+	}
+	if o.measureStorage && (o.mover != moverVSM || o.snapshotOnly) {
+		return errors.New("measure-storage can only be used with mover vsm, whose volumesnapshotbackups back up to restic repositories")
+	}
+	if o.cloudVerify != "" {
+		if _, ok := snapshotVerifiers[o.cloudVerify]; !ok {
+			return errors.Errorf("unknown cloud-verify %q, must be one of %s", o.cloudVerify, strings.Join(snapshotVerifierNames(), ", "))
+		}
+		if o.mover != moverVSM {
+			return errors.New("cloud-verify cannot be used with mover native or mode fs-backup")
+		}
+	}
+	if o.resultsURL != "" {
+		_, err := newObjectStore(o.resultsURL)
+		if err != nil {
+			return err
+		}
+		if o.output == "" && o.artifactsDir == "" {
+			return errors.New("results-url requires an output format or artifacts-dir to upload")
+		}
+	}
+	if o.otlpEndpoint != "" {
+		_, err := newOTLPSink(o.otlpEndpoint)
+		if err != nil {
+			return err
+		}
+	}
+	for _, spec := range o.sinkSpecs {
+		_, err := parseSink(spec)
+		if err != nil {
+			return err
+		}
+	}
+	if o.dryRun && o.resume != "" {
+		return errors.New("dry-run cannot be used with resume")
+	}
+	return nil
+}
+
+func (o *backupOptions) run(ctx context.Context, flags *pflag.FlagSet) error {
+	o.spec.changedFlags(flags)
+	o.flagConfig = runConfig(flags)
+	err := o.validate()
+	if err != nil {
+		return err
+	}
+	if o.events != "" {
+		o.eventStream, err = openEventStream(ctx, o.events)
+		if err != nil {
+			return err
+		}
+		defer o.eventStream.close()
+	}
+	if o.cloudVerify != "" {
+		o.snapshotVerifier, err = newSnapshotVerifier(ctx, o.cloudVerify)
+		if err != nil {
+			return err
+		}
+	}
+	var baseline *runResults
+	if o.baseline != "" {
+		baseline, err = readResults(o.baseline)
+		if err != nil {
+			return err
+		}
+	}
+	if len(o.kubeconfigs) > 0 || len(o.contexts) > 0 {
+		if o.metricsAddr != "" {
+			serveMetrics(ctx, o.metricsAddr)
+		}
+		return o.backupClusters(ctx, flags, os.Stdout)
+	}
+	c, err := o.connect(ctx, flags)
+	if err != nil {
+		return err
+	}
+	defer o.deleteVeleroSchedule(ctx, c)
+	if o.dryRun {
+		return o.plan(ctx, c, os.Stdout)
+	}
+	if o.metricsAddr != "" {
+		serveMetrics(ctx, o.metricsAddr)
+	}
+	if o.backupsPerRun > 1 {
+		return o.backupShards(ctx, c)
+	}
+	if o.iterations > 1 || o.forever {
+		return o.soak(ctx, c, os.Stdout)
+	}
+
+	results, err := o.backup(ctx, c)
+	if err != nil {
+		return err
+	}
+	thresholdErr := thresholdError(ctx, results, o.maxTotalTime, o.maxVSBP95)
+	if baseline != nil {
+		deltas := compareBaseline(results, baseline, o.threshold)
+		printBaseline(os.Stdout, o.baseline, deltas)
+		err = regressionError(deltas, o.threshold)
+		if err != nil {
+			return err
+		}
+	}
+	return thresholdErr
+}
+
+// connect returns a client for the cluster of o, fills in the defaults taken
+// from the cluster and runs the preflight checks.
+func (o *backupOptions) connect(ctx context.Context, flags *pflag.FlagSet) (client.Client, error) {
+	resticSecretName, concurrency := unsetFlags(flags, &o.resticSecretName, &o.concurrency)
+	// A mover given on the command line is not second guessed, nor are
+	// commands without one.
+	moverSet := flags.Lookup("mover") == nil || flags.Changed("mover")
+	return o.connectWith(ctx, resticSecretName, concurrency, moverSet)
+}
+
+// connectWith is connect for callers without flags. The restic secret and
+// concurrency not nil are taken from the DataProtectionApplication, and the
+// run only falls back to another mover when moverSet is false.
+func (o *backupOptions) connectWith(ctx context.Context, resticSecretName *string, concurrency *int, moverSet bool) (client.Client, error) {
+	c, err := o.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = o.resolveVeleroNamespace(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	err = o.applyDPADefaults(ctx, c, resticSecretName, concurrency, false)
+	if err != nil {
+		return nil, err
+	}
+	err = o.applyDPALimit(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	err = o.fallBackWithoutDataMover(ctx, c, moverSet)
+	if err != nil {
+		return nil, err
+	}
+	if o.secretTemplate != "" && !o.dryRun {
+		err = o.provisionResticSecrets(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !o.skipPreflight {
+		err = runPreflight(ctx, c, o.veleroNamespace, o.resticSecretName, o.mover, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.checkRBACAccess {
+		err = o.checkRBAC(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.volumeSnapshotClass != "" {
+		o.volumeSnapshotDriver, err = checkSelectedVolumeSnapshotClass(ctx, c, o.volumeSnapshotClass, o.mover)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// backup runs a single backup with the data mover and returns its results.
+func (o *backupOptions) backup(ctx context.Context, c client.Client) (_ *runResults, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// results is kept apart from the returned results, which are nil on
+	// failure, so the notification still has whatever was recorded.
+	var results *runResults
+	panicked := false
+	if o.notifyURL != "" {
+		defer func() {
+			notify(ctx, o.notifyURL, o.notifyFormat, newNotification(results, err, panicked))
+		}()
+	}
+
+	// Hand the results to the sinks once everything else has written
+	// them, whether or not the run failed.
+	defer func() {
+		if results == nil {
+			return
+		}
+		if err != nil && results.Error == "" {
+			results.runFailed(err)
+		}
+		results.emit(event{Type: eventRunDone, Volumes: len(results.Volumes), Seconds: time.Since(results.StartTime).Seconds(), Error: results.Error})
+		o.writeSinks(ctx, results, err)
+	}()
+
+	// Once the results of a failed run are written, tell the user what is
+	// left of it and how to pick it up again or clean it up.
+	defer func() {
+		if err != nil && results != nil {
+			o.printFailureSummary(os.Stdout, results, err)
+		}
+	}()
+
+	// Write what was recorded of a run that failed so it can be looked
+	// at, and so CI sees its failures.
+	defer func() {
+		if err == nil || results == nil || o.output == "" {
+			return
+		}
+		results.runFailed(err)
+		writeErr := o.writeResults(ctx, results)
+		if writeErr != nil {
+			loggerFrom(ctx).Errorw("failed to write results of failed run", "error", writeErr)
+		}
+	}()
+
+	// Turn a panic into the error of the run so what was measured up to it
+	// is still written, rather than lost with the process.
+	defer func() {
+		if p := recover(); p != nil {
+			loggerFrom(ctx).Errorw("run panicked", "panic", p, "stack", string(debug.Stack()))
+			panicked = true
+			err = errors.Errorf("panic: %v", p)
+		}
+	}()
+
+	switch {
+	case o.resume != "":
+		results, err = o.resumeBackup(ctx, c)
+	case o.existingBackup != "":
+		results, err = o.reuseBackup(ctx, c)
+	default:
+		results, err = o.startBackup(ctx, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	results.Cluster = o.cluster
+	results.metrics = newRunMetrics(o.cluster, o.shard)
+	results.Config = o.flagConfig
+	if clientset, err := o.clientset(); err == nil {
+		results.ClusterInfo = describeCluster(ctx, c, clientset, o.veleroNamespace)
+	}
+	results.DPAConcurrencyLimit = o.dpaLimit
+	if o.batchAdvanceThreshold < 1 {
+		results.BatchAdvanceThreshold = o.batchAdvanceThreshold
+	}
+	results.BatchDelay = o.batchDelay
+	results.CreateJitter = o.createJitter
+	results.events = o.eventStream
+	if o.resume == "" && o.existingBackup == "" {
+		results.emit(event{Time: results.StartTime, Type: eventBackupCreated})
+	}
+	name := results.Backup
+	log := loggerFrom(ctx).With("run", name)
+	if o.cluster != "" {
+		log = log.With("cluster", o.cluster)
+	}
+	ctx = withLogger(ctx, log)
+	snapshotStartTime := results.StartTime
+	results.metrics.started(snapshotStartTime)
+	if o.tui && !o.sharded {
+		display, err := startStatusDisplay(ctx, results, o.concurrency, fmt.Sprintf("oadp-perf-%s.log", name))
+		if err != nil {
+			return nil, err
+		}
+		defer display.stop()
+		ctx = display.context(ctx)
+	}
+
+	// Watch the objects of the run so waiting for them does not hammer the
+	// API server
+	config, err := o.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := o.scheme(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newRunWatcher(ctx, config, scheme, name, o.mover, results)
+	if err != nil {
+		return nil, err
+	}
+	if o.etaInterval > 0 {
+		go reportETA(ctx, results, o.etaInterval)
+	}
+	if o.sampleResources {
+		clientset, err := o.clientset()
+		if err != nil {
+			return nil, err
+		}
+		results.sampler, err = startResourceSampler(ctx, clientset, o.veleroNamespace, o.sampleInterval, results)
+		if err != nil {
+			return nil, err
+		}
+		defer results.sampler.stop()
+	}
+
+	if o.mover == moverNative {
+		err = o.runNative(ctx, c, w, results)
+		if err != nil {
+			return nil, err
+		}
+		return results, o.finish(ctx, c, results)
+	}
+	if o.mover == moverFSBackup {
+		err = o.runPodVolumeBackups(ctx, w, results)
+		if err != nil {
+			return nil, err
+		}
+		return results, o.finish(ctx, c, results)
+	}
+
+	// Work out how many snapshots to expect while the backup runs, so
+	// any missing ones are caught as soon as it is done.
+	allocation, err := expectSnapshots(ctx, c, o.veleroNamespace, name, results.Namespaces, results)
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to work out the expected snapshots", "phase", phaseSnapshot, "error", err)
+	}
+
+	// Wait for backup to complete
+	err = waitForBackupToComplete(ctx, c, o.veleroNamespace, name)
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for backup to complete", "phase", phaseBackup)
+		}
+		return nil, err
+	}
+	if allocation != nil {
+		err = checkSnapshots(ctx, c, name, allocation, results)
+		if err != nil {
+			loggerFrom(ctx).Warnw("failed to compare the snapshots with the expected ones", "phase", phaseSnapshot, "error", err)
+		}
+	}
+
+	stopCloud := func() {}
+	if o.snapshotVerifier != nil {
+		var cloudCtx context.Context
+		cloudCtx, stopCloud = context.WithCancel(ctx)
+		go watchCloudSnapshots(cloudCtx, o.snapshotVerifier, w, name, results)
+	}
+
+	// Sit and wait for all VSCs to be in a ready to use state
+	err = waitForVSCsToBeReady(ctx, w, name, o.noSnapshotsTimeout, results)
+	stopCloud()
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for VSCs to be ready", "phase", phaseSnapshot)
+			return nil, withExitCode(err, exitVSCTimeout)
+		}
+		if err == errNoSnapshots {
+			return nil, withExitCode(o.diagnoseNoSnapshots(ctx, c, name), exitVSCTimeout)
+		}
+		return nil, err
+	}
+	if o.snapshotVerifier != nil {
+		vscList, err := listVolumeSnapshotContents(ctx, w.cache, name)
+		if err != nil {
+			return nil, err
+		}
+		err = verifyCloudSnapshots(ctx, o.snapshotVerifier, vscList.Items, results)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	snapshotEndTime := time.Now()
+	results.snapshotsDone(snapshotEndTime)
+	snapshotTime := snapshotEndTime.Sub(snapshotStartTime)
+	loggerFrom(ctx).Infow("snapshots done", "phase", phaseSnapshot, "elapsed", snapshotTime.String())
+	annotateBackup(ctx, c, o.veleroNamespace, results)
+	o.logSnapshotTimings(ctx, c, w, results)
+	if o.retainSnapshots {
+		vscList, err := listVolumeSnapshotContents(ctx, c, name)
+		if err != nil {
+			return nil, err
+		}
+		err = retainVSCs(ctx, c, vscList.Items)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.snapshotOnly {
+		results.Mover = modeCSI
+		results.dataMoverDone(snapshotEndTime)
+		return results, o.finish(ctx, c, results)
+	}
+
+	// Now that VSCs are all ready, we can generate VolumeSnapshotBackups
+	// and batch them waiting for them to complete
+	vscList, err := listVolumeSnapshotContents(ctx, w.cache, name)
+	if err != nil {
+		return nil, err
+	}
+	sizes, sources, err := resolveVSCSources(ctx, c, vscList.Items, results)
+	if err != nil {
+		return nil, err
+	}
+	vscs := vscList.Items
+	if o.filter.enabled() {
+		var excluded []string
+		vscs, excluded = o.filter.filter(vscs, sources)
+		results.excludeVolumes(excluded)
+		loggerFrom(ctx).Infow("filtered volumesnapshotcontents by their source PVCs", "phase", phaseDataMover, "selected", len(vscs), "excluded", len(excluded))
+		if len(vscs) == 0 {
+			return nil, errors.New("no volumesnapshotcontents match the pvc-storage-class, min-pvc-size and pvc-label-selector filters")
+		}
+	}
+	resticSecrets, err := o.vsb.resticSecretsFor(ctx, c, o.veleroNamespace, name, o.resticSecretName, results.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	results.resticSecretsUsed(resticSecrets)
+	var meter *bucketMeter
+	if o.measureStorage {
+		meter, err = newBucketMeter(ctx, c, o.veleroNamespace, resticSecrets)
+		if err != nil {
+			return nil, err
+		}
+	}
+	runner := &vsbRunner{
+		client:           c,
+		watcher:          w,
+		veleroNamespace:  o.veleroNamespace,
+		name:             name,
+		resticSecretName: o.resticSecretName,
+		resticSecrets:    resticSecrets,
+		concurrency:      o.concurrency,
+		schedule:         o.schedule,
+		results:          results,
+		stalls:           newStallTracker(o.stallTimeout),
+		abortOnFailure:   o.onFailure == onFailureAbort,
+		advanceThreshold: o.batchAdvanceThreshold,
+		batchDelay:       o.batchDelay,
+		createJitter:     o.createJitter,
+		maxFailures:      o.maxFailures,
+	}
+	if o.createRate > 0 {
+		runner.createLimiter = flowcontrol.NewTokenBucketRateLimiter(float32(o.createRate), o.createBurst)
+	}
+	if o.artifactsDir != "" {
+		clientset, err := o.clientset()
+		if err != nil {
+			return nil, err
+		}
+		runner.artifacts = newArtifactCollector(filepath.Join(o.artifactsDir, name), c, clientset, o.veleroNamespace)
+	}
+	vscs = orderVSCs(vscs, sizes, o.order)
+	results.metrics.vsbsPending.Add(float64(len(vscs)))
+	if o.resume != "" {
+		vscs, err = runner.resume(ctx, vscs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stopChaos := o.startChaos(ctx, c, results)
+	err = runner.run(ctx, vscs)
+	stopChaos()
+	switch {
+	case errors.Is(err, errTooManyFailures):
+		// Leave the VSCs and backup for a resume once the cause is
+		// fixed, but stop the data mover working on the rest.
+		clearErr := clearDataMover(ctx, c, o.veleroNamespace, name)
+		if clearErr != nil {
+			loggerFrom(ctx).Errorw("failed to delete the volumesnapshotbackups of the run", "phase", phaseDataMover, "error", clearErr)
+		}
+		return nil, withExitCode(err, exitVSBFailed)
+	case errors.Is(err, errVSBFailed):
+		return nil, withExitCode(err, exitVSBFailed)
+	case err == wait.ErrWaitTimeout:
+		return nil, withExitCode(err, exitDataMoverTimeout)
+	case err != nil:
+		return nil, err
+	}
+
+	volsyncTimeComplete := time.Now()
+	results.dataMoverDone(volsyncTimeComplete)
+	loggerFrom(ctx).Infow("data mover done", "phase", phaseDataMover, "elapsed", results.DataMoverTime.String(), "total", results.TotalTime.String(), "throughput", fmt.Sprintf("%.2f GiB/min", results.Throughput))
+	// The watcher still records the phases VSBs go through after they
+	// are done, so summarize them under the lock.
+	results.mu.Lock()
+	controllerQueue := controllerQueueSummary(results)
+	queueStats := queueDurationStats(results)[0]
+	vsbStats := vsbDurationStats(results)[0]
+	syncStats := syncDurationStats(results)[0]
+	results.mu.Unlock()
+	if controllerQueue != "" {
+		loggerFrom(ctx).Infow("data mover queue", "phase", phaseDataMover, "queue", controllerQueue)
+	}
+	if summary := results.chaosSummary(); summary != "" {
+		loggerFrom(ctx).Infow("run completed despite chaos", "phase", phaseDataMover, "chaos", summary)
+	}
+	if meter != nil {
+		err := meter.record(ctx, results)
+		if err != nil {
+			loggerFrom(ctx).Warnw("failed to measure object storage after the data mover", "phase", phaseDataMover, "error", err)
+		}
+	}
+	queue, setup, transfer, cleanup := results.meanVSBPhases()
+	loggerFrom(ctx).Infow("mean VSB phase durations", "phase", phaseDataMover, "queue", queue.String(), "setup", setup.String(), "transfer", transfer.String(), "cleanup", cleanup.String())
+	if queueStats.Count > 0 {
+		loggerFrom(ctx).Infow("VSB queue times", "phase", phaseDataMover, "count", queueStats.Count, "min", queueStats.Min.String(), "mean", queueStats.Mean.String(), "p50", queueStats.P50.String(), "p95", queueStats.P95.String(), "max", queueStats.Max.String())
+	}
+	if vsbStats.Count > 0 {
+		loggerFrom(ctx).Infow("VSB durations", "phase", phaseDataMover, "count", vsbStats.Count, "min", vsbStats.Min.String(), "mean", vsbStats.Mean.String(), "p50", vsbStats.P50.String(), "p90", vsbStats.P90.String(), "p95", vsbStats.P95.String(), "p99", vsbStats.P99.String(), "max", vsbStats.Max.String())
+	}
+	if syncStats.Count > 0 {
+		loggerFrom(ctx).Infow("volsync sync durations", "phase", phaseDataMover, "count", syncStats.Count, "min", syncStats.Min.String(), "mean", syncStats.Mean.String(), "p50", syncStats.P50.String(), "p95", syncStats.P95.String(), "max", syncStats.Max.String())
+	}
+	if len(results.ByNamespace) > 1 {
+		for _, n := range results.ByNamespace {
+			loggerFrom(ctx).Infow("namespace done", "phase", phaseDataMover, "namespace", n.Namespace, "volumes", n.Volumes, "failed", n.Failed, "size", formatBytes(n.SizeBytes), "vsbTime", n.VSBTime.String(), "vsbP95", n.P95.String(), "throughput", fmt.Sprintf("%.2f GiB/min", n.Throughput))
+		}
+	}
+	for _, v := range results.createFailures() {
+		loggerFrom(ctx).Errorw("no VSB could be created", "phase", phaseDataMover, "namespace", v.Namespace, "vsc", v.VolumeSnapshotContent, "batch", v.Batch, "attempts", v.CreateAttempts, "error", v.Error)
+	}
+	stragglers := results.stragglers()
+	if len(stragglers) > 0 {
+		loggerFrom(ctx).Warnw("VSBs stalled and were left behind", "phase", phaseDataMover, "count", len(stragglers))
+		for _, v := range stragglers {
+			loggerFrom(ctx).Warnw("stalled VSB", "phase", phaseDataMover, "namespace", v.Namespace, "vsb", v.VolumeSnapshotBackup, "vsc", v.VolumeSnapshotContent, "batch", v.Batch)
+		}
+	}
+	if o.repoStats {
+		o.logRepoStats(ctx, c, results)
+	}
+
+	return results, o.finish(ctx, c, results)
+}
+
+// finish records the timings of the run on its Backup, collects the log of
+// the Backup into the artifacts directory, writes the results
+// and then restores and verifies the backup and deletes it if asked to.
+func (o *backupOptions) finish(ctx context.Context, c client.Client, results *runResults) error {
+	results.sampler.stop()
+	annotateBackup(ctx, c, o.veleroNamespace, results)
+	if o.artifactsDir != "" {
+		o.collectBackupLogs(ctx, c, results)
+	}
+	err := o.writeResults(ctx, results)
+	if err != nil {
+		return err
+	}
+
+	if o.restore {
+		err = o.restoreRun(ctx, c, results)
+		if err != nil {
+			return err
+		}
+	}
+	if o.cleanupAfter {
+		return o.deleteRun(ctx, c, results)
+	}
+	return nil
+}
+
+// printFailureSummary prints why the run failed, where its partial results
+// were written and the commands to resume or clean it up.
+func (o *backupOptions) printFailureSummary(out io.Writer, results *runResults, err error) {
+	name := results.Backup
+	if name == "" {
+		return
+	}
+	fmt.Fprintf(out, "Run %s failed after %v: %v\n", name, time.Since(results.StartTime).Round(time.Second), err)
+	if o.output != "" {
+		if path := o.resultsPath(results); fileExists(path) {
+			fmt.Fprintf(out, "Partial results:    %s\n", path)
+		}
+	}
+	if o.mover == moverVSM && o.veleroSchedule == "" {
+		fmt.Fprintf(out, "Resume with:        oadp-perf backup --resume %s --velero-namespace %s\n", name, o.veleroNamespace)
+	}
+	fmt.Fprintf(out, "Clean up with:      oadp-perf cleanup --run %s --velero-namespace %s\n", name, o.veleroNamespace)
+}
+
+// restoreRun restores the backup of the run and verifies the restored data if
+// asked to.
+func (o *backupOptions) restoreRun(ctx context.Context, c client.Client, results *runResults) error {
+	restoreStartTime := time.Now()
+	var err error
+	if o.mover != moverVSM {
+		// Velero restores the data itself, through DataDownloads or
+		// PodVolumeRestores.
+		err = runNativeRestore(ctx, c, o.veleroNamespace, results.Backup, o.restoreMappings, results)
+	} else {
+		var config *rest.Config
+		config, err = o.restConfig()
+		if err != nil {
+			return err
+		}
+		var scheme *runtime.Scheme
+		scheme, err = o.scheme(ctx, config)
+		if err != nil {
+			return err
+		}
+		r := &vsrRunner{
+			client:           c,
+			config:           config,
+			scheme:           scheme,
+			veleroNamespace:  o.veleroNamespace,
+			name:             results.Backup,
+			resticSecretName: o.resticSecretName,
+			concurrency:      o.concurrency,
+			schedule:         o.schedule,
+			order:            o.order,
+			advanceThreshold: o.batchAdvanceThreshold,
+			mappings:         o.restoreMappings,
+			results:          results,
+		}
+		err = r.restore(ctx)
+		// The VSR timings are written even if the restore failed.
+		writeErr := o.writeResults(ctx, results)
+		if err == nil {
+			err = writeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if o.ready.enabled() {
+		namespaces := []string{}
+		for _, ns := range results.Namespaces {
+			namespaces = append(namespaces, mappedNamespace(o.restoreMappings, ns))
+		}
+		err = waitForApps(ctx, c, results, namespaces, restoreStartTime, o.ready)
+		writeErr := o.writeResults(ctx, results)
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !o.verify {
+		return nil
+	}
+	clientset, err := o.clientset()
+	if err != nil {
+		return err
+	}
+	verifyErr := verifyRestoredDigests(ctx, c, clientset, o.verifyImage, results, o.restoreMappings)
+	err = o.writeResults(ctx, results)
+	if err != nil {
+		return err
+	}
+	return verifyErr
+}
+
+// writeResults writes the results file if an output format was requested.
+func (o *backupOptions) writeResults(ctx context.Context, results *runResults) error {
+	if o.output == "" {
+		return nil
+	}
+	path := o.resultsPath(results)
+	err := results.write(o.output, path)
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Infow("results written", "path", path)
+	return nil
+}
+
+// resultsPath returns the path of the results file of the run.
+func (o *backupOptions) resultsPath(results *runResults) string {
+	path := o.outputFile
+	switch {
+	case path != "":
+	case o.cluster != "":
+		path = fmt.Sprintf("results-%s-%s.%s", o.cluster, results.Backup, resultsExtension(o.output))
+	case results.Reused:
+		// Every run against a reused backup has the same name, so
+		// tell their results files apart by start time.
+		path = fmt.Sprintf("results-%s-%s.%s", results.Backup, results.StartTime.Format("20060102-150405"), resultsExtension(o.output))
+	default:
+		path = fmt.Sprintf("results-%s.%s", results.Backup, resultsExtension(o.output))
+	}
+	return path
+}
+
+// startBackup creates the Velero backup for a new run.
+func (o *backupOptions) startBackup(ctx context.Context, c client.Client) (*runResults, error) {
+	namespaces, err := o.resolveNamespaces(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure every namespace exists before we create anything
+	err = validateNamespaces(ctx, c, namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	results := newRunResults(namespaces, o.concurrency, o.schedule)
+	results.Mover = o.mover
+	results.Order = o.order
+	results.VSBCreateRate = o.createRate
+	if o.verify {
+		clientset, err := o.clientset()
+		if err != nil {
+			return nil, err
+		}
+		err = recordSourceDigests(ctx, c, clientset, o.verifyImage, namespaces, results)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Register start time for snapshots
+	results.StartTime = time.Now()
+
+	// create backup to get all CSI snapshots in the cluster
+	template, err := o.spec.backup()
+	if err != nil {
+		return nil, err
+	}
+	// Annotate the backup from the start, so attach can tell how to
+	// follow the run.
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	for key, value := range backupAnnotations(results) {
+		template.Annotations[key] = value
+	}
+	if o.setVolumeSnapshotClass {
+		template.Annotations[volumeSnapshotClassAnnotationPrefix+o.volumeSnapshotDriver] = o.volumeSnapshotClass
+	}
+	if o.veleroSchedule != "" {
+		backup, err := o.scheduledBackup(ctx, c, namespaces, template)
+		if err != nil {
+			return nil, err
+		}
+		loggerFrom(ctx).Infow("scheduled backup fired, to monitor VSCs run oc get volumesnapshotcontents -l velero.io/backup-name=<run>", "run", backup.Name, "schedule", o.veleroScheduleName, "waited", time.Since(results.StartTime).Round(time.Second).String())
+		// The run starts when the backup fired, which may be before it
+		// was waited for.
+		results.StartTime = backup.CreationTimestamp.Time
+		results.VeleroSchedule = o.veleroScheduleName
+		results.Backup = backup.Name
+		annotateBackup(ctx, c, o.veleroNamespace, results)
+		return results, nil
+	}
+	name, err := createBackup(ctx, c, o.veleroNamespace, o.namePrefix, namespaces, o.mover == moverNative, template)
+	if err != nil {
+		return nil, err
+	}
+	loggerFrom(ctx).Infow("backup created, to monitor VSCs run oc get volumesnapshotcontents -l velero.io/backup-name=<run>", "run", name, "veleroNamespace", o.veleroNamespace)
+	results.Backup = name
+	return results, nil
+}
+
+// resumeBackup picks up the backup of an interrupted run. The namespaces are
+// taken from the backup spec and the snapshot timing is measured from the
+// backup's creation.
+func (o *backupOptions) resumeBackup(ctx context.Context, c client.Client) (*runResults, error) {
+	backup := velerov1.Backup{}
+	err := c.Get(ctx, types.NamespacedName{Name: o.resume, Namespace: o.veleroNamespace}, &backup)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backup %s to resume", o.resume)
+	}
+	loggerFrom(ctx).Infow("resuming backup", "run", backup.Name, "veleroNamespace", backup.Namespace)
+
+	results := newRunResults(backup.Spec.IncludedNamespaces, o.concurrency, o.schedule)
+	results.Mover = o.mover
+	results.Order = o.order
+	results.VSBCreateRate = o.createRate
+	results.StartTime = backup.CreationTimestamp.Time
+	results.Backup = backup.Name
+	return results, nil
+}
+
+// reuseBackup prepares a run against the snapshots of an existing completed
+// backup. The VSBs left by earlier runs against it are deleted along with the
+// resources the data mover created for them, so the VSBs of this run are
+// created afresh. The snapshot time only covers checking the VSCs are ready.
+func (o *backupOptions) reuseBackup(ctx context.Context, c client.Client) (*runResults, error) {
+	backup := velerov1.Backup{}
+	err := c.Get(ctx, types.NamespacedName{Name: o.existingBackup, Namespace: o.veleroNamespace}, &backup)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backup %s to reuse", o.existingBackup)
+	}
+	if backup.Status.Phase != velerov1.BackupPhaseCompleted {
+		return nil, errors.Errorf("backup %s is %s, it must be %s to be reused", backup.Name, backup.Status.Phase, velerov1.BackupPhaseCompleted)
+	}
+	loggerFrom(ctx).Infow("reusing backup", "run", backup.Name, "veleroNamespace", backup.Namespace)
+	err = clearDataMover(ctx, c, o.veleroNamespace, backup.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	results := newRunResults(backup.Spec.IncludedNamespaces, o.concurrency, o.schedule)
+	results.Mover = o.mover
+	results.Order = o.order
+	results.VSBCreateRate = o.createRate
+	results.Backup = backup.Name
+	results.Reused = true
+	return results, nil
+}
+
+func waitForBackupToComplete(ctx context.Context, c client.Client, namespace, name string) error {
+	timeout := 120 * time.Minute
+	interval := 5 * time.Second
+	err := wait.PollImmediate(interval, timeout, func() (bool, error) {
+		backup := velerov1.Backup{}
+		err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &backup)
+		if err != nil {
+			return false, errors.Wrapf(err, fmt.Sprintf("failed to get backup"))
+		}
+		switch backup.Status.Phase {
+		case velerov1.BackupPhaseCompleted:
+			return true, nil
+		case velerov1.BackupPhasePartiallyFailed:
+			loggerFrom(ctx).Warnw("backup partially failed", "phase", phaseBackup, "errors", backup.Status.Errors, "warnings", backup.Status.Warnings)
+			return true, nil
+		case velerov1.BackupPhaseFailed, velerov1.BackupPhaseFailedValidation:
+			return false, errors.Errorf("backup %s %s: %s", name, backup.Status.Phase, backupFailureReason(&backup))
+		}
+		loggerFrom(ctx).Infow("waiting for backup", "phase", phaseBackup, "backupPhase", backup.Status.Phase)
+
+		return false, nil
+	})
+	return err
+}
+
+// backupFailureReason returns why Velero says the backup failed.
+func backupFailureReason(backup *velerov1.Backup) string {
+	if len(backup.Status.ValidationErrors) > 0 {
+		return strings.Join(backup.Status.ValidationErrors, "; ")
+	}
+	if backup.Status.FailureReason != "" {
+		return backup.Status.FailureReason
+	}
+	return "no reason given"
+}
+
+// waitForVSCsToBeReady waits for every VSC of the backup called name to be
+// ready, returning errNoSnapshots if there are none for noSnapshotsTimeout,
+// unless it is 0.
+func waitForVSCsToBeReady(ctx context.Context, w *runWatcher, name string, noSnapshotsTimeout time.Duration, results *runResults) error {
+	timeout := 120 * time.Minute
+	start := time.Now()
+	lastTotal, lastReady := -1, -1
+	return w.waitFor(ctx, timeout, func() (bool, error) {
+		vscList, err := listVolumeSnapshotContents(ctx, w.cache, name)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list volumesnapshotcontents")
+		}
+		if len(vscList.Items) == 0 {
+			if noSnapshotsTimeout > 0 && time.Since(start) > noSnapshotsTimeout {
+				return false, errNoSnapshots
+			}
+			if lastTotal != 0 {
+				loggerFrom(ctx).Infow("found no snapshots yet, waiting", "phase", phaseSnapshot)
+				lastTotal = 0
+			}
+			return false, nil
+		}
+		readyVscs := []string{}
+		unreadyVscs := []string{}
+		for _, vsc := range vscList.Items {
+			if vsc.Status == nil || vsc.Status.SnapshotHandle == nil || vsc.Status.ReadyToUse == nil || !*vsc.Status.ReadyToUse {
+				unreadyVscs = append(unreadyVscs, vsc.Name)
+				continue
+			}
+			var size int64
+			if vsc.Status.RestoreSize != nil {
+				size = *vsc.Status.RestoreSize
+			}
+			results.vscReady(vsc.Name, vsc.Spec.VolumeSnapshotRef.Namespace, size, time.Now())
+			readyVscs = append(readyVscs, vsc.Name)
+		}
+		if len(vscList.Items) != lastTotal || len(readyVscs) != lastReady {
+			loggerFrom(ctx).Infow("waiting for VSCs", "phase", phaseSnapshot, "total", len(vscList.Items), "ready", len(readyVscs), "unready", len(unreadyVscs))
+			lastTotal, lastReady = len(vscList.Items), len(readyVscs)
+		}
+
+		return len(unreadyVscs) == 0, nil
+	})
+}
+
+func listVolumeSnapshotContents(ctx context.Context, c client.Reader, name string) (*v1.VolumeSnapshotContentList, error) {
+	vsc := v1.VolumeSnapshotContentList{}
+	labels := map[string]string{
+		"velero.io/backup-name": name,
+	}
+	listOptions := client.MatchingLabels(labels)
+	err := listAll(ctx, c, &vsc, listOptions)
+	return &vsc, err
+}
+
+// listVolumeSnapshotBackups lists the VSBs of the run called name, none when
+// the cluster does not serve them, as for runs of the other movers.
+func listVolumeSnapshotBackups(ctx context.Context, c client.Reader, name string) (*dmv1.VolumeSnapshotBackupList, error) {
+	vsb := dmv1.VolumeSnapshotBackupList{}
+	labels := map[string]string{
+		"perf-test": name,
+	}
+	listOptions := client.MatchingLabels(labels)
+	err := listAll(ctx, c, &vsb, listOptions)
+	if meta.IsNoMatchError(err) {
+		return &vsb, nil
+	}
+	return &vsb, err
+}
+
+// defaultNamePrefix starts the name of the backup of every run.
+const defaultNamePrefix = "perf-"
+
+// nameAttempts bounds how many run names are tried before giving up on
+// finding one that is not taken.
+const nameAttempts = 5
+
+// newRunName returns the name of a new run: prefix followed by the time in
+// UTC and a short random ID, such as perf-20231015-143012-3f9a. Runs sort by
+// time in oc get backups, and the name is short enough to be the value of the
+// perf-test label of its VSBs.
+func newRunName(prefix string, now time.Time) string {
+	return prefix + now.UTC().Format("20060102-150405") + "-" + strings.ReplaceAll(uuid.New().String(), "-", "")[:4]
+}
+
+// validateNamePrefix checks that the names of runs with prefix are valid
+// label values and object names.
+func validateNamePrefix(prefix string) error {
+	if errs := validation.IsDNS1123Label(newRunName(prefix, time.Now())); len(errs) > 0 {
+		return errors.Errorf("invalid name-prefix %q: %s", prefix, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// runNameTaken reports whether a Backup called name exists, or VSBs labelled
+// with it were left behind by an earlier run.
+func runNameTaken(ctx context.Context, c client.Client, veleroNamespace, name string) (bool, error) {
+	err := c.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: name}, &velerov1.Backup{})
+	if err == nil {
+		return true, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, errors.Wrapf(err, "failed to get backup %s", name)
+	}
+	vsbList := dmv1.VolumeSnapshotBackupList{}
+	err = c.List(ctx, &vsbList, client.MatchingLabels{"perf-test": name}, client.Limit(1))
+	if err != nil && !meta.IsNoMatchError(err) {
+		return false, errors.Wrapf(err, "failed to list volumesnapshotbackups of %s", name)
+	}
+	return len(vsbList.Items) > 0, nil
+}
+
+// createBackup creates the Velero backup of namespaces from template, if it
+// is not nil, named by newRunName with prefix. Names that are taken are
+// replaced by new ones.
+func createBackup(ctx context.Context, c client.Client, veleroNamespace, prefix string, namespaces []string, snapshotMoveData bool, template *velerov1.Backup) (string, error) {
+	for attempt := 1; ; attempt++ {
+		name := newRunName(prefix, time.Now())
+		taken, err := runNameTaken(ctx, c, veleroNamespace, name)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			b, err := newBackup(veleroNamespace, name, namespaces, snapshotMoveData, template)
+			if err != nil {
+				return "", err
+			}
+			err = c.Create(ctx, b)
+			if !apierrors.IsAlreadyExists(err) {
+				return name, err
+			}
+		}
+		if attempt == nameAttempts {
+			return "", errors.Errorf("failed to find a run name that is not taken after %d attempts", nameAttempts)
+		}
+		loggerFrom(ctx).Warnw("run name is taken, picking another", "run", name)
+	}
+}
+
+// newBackup returns the Velero backup of namespaces, with the labels,
+// annotations and spec of template if it is not nil. snapshotMoveData asks
+// Velero 1.12+ to move the snapshot data with its native data mover; the
+// field is newer than the Velero client, so it is set on an unstructured copy.
+func newBackup(veleroNamespace, name string, namespaces []string, snapshotMoveData bool, template *velerov1.Backup) (client.Object, error) {
+	b := velerov1.Backup{}
+	if template != nil {
+		b.Labels = template.Labels
+		b.Annotations = template.Annotations
+		b.Spec = template.Spec
+	}
+	b.SetGroupVersionKind(velerov1.SchemeGroupVersion.WithKind("Backup"))
+	b.Spec.IncludedNamespaces = namespaces
+	b.Namespace = veleroNamespace
+	b.Name = name
+	if !snapshotMoveData {
+		return &b, nil
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&b)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert backup")
+	}
+	u := &unstructured.Unstructured{Object: obj}
+	err = unstructured.SetNestedField(u.Object, true, "spec", "snapshotMoveData")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to set snapshotMoveData")
+	}
+	return u, nil
+}
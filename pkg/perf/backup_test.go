@@ -0,0 +1,86 @@
+package perf
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRestoreRunReturnsRestoreError(t *testing.T) {
+	// Without the data mover in the scheme of the client, its RESTMapper
+	// does not know VolumeSnapshotRestores and the restore fails.
+	scheme := runtime.NewScheme()
+	if err := velerov1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	o := newBackupOptions(&rootOptions{
+		clusterConfig:    &rest.Config{Host: "https://127.0.0.1:1"},
+		dataMoverVersion: &dmv1.GroupVersion,
+		veleroNamespace:  "openshift-adp",
+	})
+	o.mover = moverVSM
+	results := newRunResults([]string{"perf-target"}, o.concurrency, o.schedule)
+	results.Backup = "perf-1"
+
+	if err := o.restoreRun(context.Background(), c, results); err == nil {
+		t.Fatal("restoreRun() = nil, want the error of the restore")
+	}
+}
+
+func TestNewRunName(t *testing.T) {
+	now := time.Date(2023, 10, 15, 16, 30, 12, 0, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: defaultNamePrefix, want: `^perf-20231015-143012-[0-9a-f]{4}$`},
+		{prefix: "nightly-", want: `^nightly-20231015-143012-[0-9a-f]{4}$`},
+		{prefix: "", want: `^20231015-143012-[0-9a-f]{4}$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got := newRunName(tt.prefix, now)
+			if !regexp.MustCompile(tt.want).MatchString(got) {
+				t.Errorf("newRunName(%q) = %s, want it to match %s", tt.prefix, got, tt.want)
+			}
+		})
+	}
+	if newRunName(defaultNamePrefix, now) == newRunName(defaultNamePrefix, now) {
+		t.Error("runs started at the same time got the same name")
+	}
+}
+
+func TestValidateNamePrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: defaultNamePrefix},
+		{prefix: "nightly-run-"},
+		{prefix: ""},
+		{prefix: "Perf-", wantErr: true},
+		{prefix: "perf_", wantErr: true},
+		{prefix: "-perf-", wantErr: true},
+		// The name must stay a label value, at most 63 characters.
+		{prefix: strings.Repeat("p", 43)},
+		{prefix: strings.Repeat("p", 44), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			err := validateNamePrefix(tt.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateNamePrefix(%q) = %v, want error %v", tt.prefix, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package perf
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// backupSpecOptions customize the Velero backup a run creates so it can
+// match how real backups are configured. Flags override the spec of the
+// template, and the namespaces always come from the run.
+type backupSpecOptions struct {
+	// template is the path to a Backup YAML whose labels, annotations and
+	// spec the backup starts from.
+	template          string
+	selector          string
+	includedResources []string
+	excludedResources []string
+	snapshotVolumes   bool
+	fsBackup          bool
+	ttl               time.Duration
+	hooks             hookOptions
+
+	// snapshotVolumesSet and fsBackupSet record whether the flags were
+	// given, since their defaults must not override the template.
+	snapshotVolumesSet bool
+	fsBackupSet        bool
+}
+
+// changedFlags records which of the flags without a neutral default were
+// given on the command line.
+func (s *backupSpecOptions) changedFlags(flags *pflag.FlagSet) {
+	s.snapshotVolumesSet = flags.Changed("snapshot-volumes")
+	s.fsBackupSet = flags.Changed("default-volumes-to-fs-backup")
+}
+
+func (s *backupSpecOptions) validate() error {
+	if s.ttl < 0 {
+		return errors.New("ttl must not be negative")
+	}
+	err := s.hooks.validate()
+	if err != nil {
+		return err
+	}
+	_, err = s.backup()
+	return err
+}
+
+// backup returns the Backup the run's backup is created from: the template,
+// if any, with the flags applied.
+func (s *backupSpecOptions) backup() (*velerov1.Backup, error) {
+	b := &velerov1.Backup{}
+	if s.template != "" {
+		data, err := os.ReadFile(s.template)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read backup template %s", s.template)
+		}
+		template := velerov1.Backup{}
+		err = yaml.Unmarshal(data, &template)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse backup template %s", s.template)
+		}
+		b.Labels = template.Labels
+		b.Annotations = template.Annotations
+		b.Spec = template.Spec
+	}
+
+	if s.selector != "" {
+		selector, err := metav1.ParseToLabelSelector(s.selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid selector %q", s.selector)
+		}
+		b.Spec.LabelSelector = selector
+		b.Spec.OrLabelSelectors = nil
+	}
+	if len(s.includedResources) > 0 {
+		b.Spec.IncludedResources = s.includedResources
+	}
+	if len(s.excludedResources) > 0 {
+		b.Spec.ExcludedResources = s.excludedResources
+	}
+	if s.snapshotVolumesSet {
+		snapshotVolumes := s.snapshotVolumes
+		b.Spec.SnapshotVolumes = &snapshotVolumes
+	}
+	if s.fsBackupSet {
+		fsBackup := s.fsBackup
+		b.Spec.DefaultVolumesToFsBackup = &fsBackup
+	}
+	if s.ttl > 0 {
+		b.Spec.TTL = metav1.Duration{Duration: s.ttl}
+	}
+	// The hooks of the flags run alongside any of the template.
+	hooks, err := s.hooks.resources()
+	if err != nil {
+		return nil, err
+	}
+	b.Spec.Hooks.Resources = append(b.Spec.Hooks.Resources, hooks...)
+
+	if b.Spec.LabelSelector != nil && len(b.Spec.OrLabelSelectors) > 0 {
+		return nil, errors.New("the backup cannot have both a labelSelector and orLabelSelectors")
+	}
+	// Without snapshots there are no volumesnapshotcontents to move and
+	// the run would wait for them until it times out.
+	if b.Spec.SnapshotVolumes != nil && !*b.Spec.SnapshotVolumes {
+		return nil, errors.New("the backup must snapshot volumes for the data mover to have anything to move")
+	}
+	return b, nil
+}
@@ -0,0 +1,120 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// baselineDelta compares one timing of a run against the same timing of a
+// baseline run.
+type baselineDelta struct {
+	Metric   string
+	Baseline time.Duration
+	Current  time.Duration
+	// Percent is how much slower the run was than the baseline, negative
+	// if it was faster.
+	Percent   float64
+	Regressed bool
+}
+
+// compareBaseline compares the phase timings and the p50 and p95 VSB
+// durations of current against baseline. A timing regressed if it is more
+// than threshold percent slower. Timings missing from either run are left
+// out.
+func compareBaseline(current, baseline *runResults, threshold float64) []baselineDelta {
+	currentP50, currentP95 := vsbPercentiles(current)
+	baselineP50, baselineP95 := vsbPercentiles(baseline)
+	metrics := []struct {
+		name              string
+		baseline, current time.Duration
+	}{
+		{"snapshot time", baseline.SnapshotTime, current.SnapshotTime},
+		{"data mover time", baseline.DataMoverTime, current.DataMoverTime},
+		{"total time", baseline.TotalTime, current.TotalTime},
+		{"vsb p50", baselineP50, currentP50},
+		{"vsb p95", baselineP95, currentP95},
+	}
+
+	deltas := []baselineDelta{}
+	for _, m := range metrics {
+		if m.baseline <= 0 || m.current <= 0 {
+			continue
+		}
+		percent := 100 * float64(m.current-m.baseline) / float64(m.baseline)
+		deltas = append(deltas, baselineDelta{
+			Metric:    m.name,
+			Baseline:  m.baseline,
+			Current:   m.current,
+			Percent:   percent,
+			Regressed: percent > threshold,
+		})
+	}
+	return deltas
+}
+
+// vsbPercentiles returns the 50th and 95th percentile durations of the VSBs
+// that completed.
+func vsbPercentiles(r *runResults) (time.Duration, time.Duration) {
+	all := vsbDurationStats(r)[0]
+	return all.P50, all.P95
+}
+
+// printBaseline prints the deltas as a table.
+func printBaseline(out io.Writer, baseline string, deltas []baselineDelta) {
+	fmt.Fprintf(out, "Compared to baseline %s:\n", baseline)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tBASELINE\tCURRENT\tDELTA\t")
+	for _, d := range deltas {
+		regressed := ""
+		if d.Regressed {
+			regressed = "REGRESSED"
+		}
+		fmt.Fprintf(w, "%s\t%v\t%v\t%+.1f%%\t%s\n", d.Metric, d.Baseline.Round(time.Second), d.Current.Round(time.Second), d.Percent, regressed)
+	}
+	w.Flush()
+}
+
+// regressionError returns an error naming the timings that regressed by more
+// than threshold percent, or nil if none did.
+func regressionError(deltas []baselineDelta, threshold float64) error {
+	regressed := []string{}
+	for _, d := range deltas {
+		if d.Regressed {
+			regressed = append(regressed, fmt.Sprintf("%s %+.1f%%", d.Metric, d.Percent))
+		}
+	}
+	if len(regressed) == 0 {
+		return nil
+	}
+	return withExitCode(errors.Errorf("regressed more than %v%% against the baseline: %s", threshold, strings.Join(regressed, ", ")), exitThreshold)
+}
+
+// thresholdError returns an error naming the timings of r that are longer
+// than their limit, or nil if none are. A limit of 0 is not checked.
+func thresholdError(ctx context.Context, r *runResults, maxTotalTime, maxVSBP95 time.Duration) error {
+	_, p95 := vsbPercentiles(r)
+	limits := []struct {
+		name         string
+		value, limit time.Duration
+	}{
+		{"total time", r.TotalTime, maxTotalTime},
+		{"vsb p95", p95, maxVSBP95},
+	}
+	exceeded := []string{}
+	for _, l := range limits {
+		if l.limit > 0 && l.value > l.limit {
+			loggerFrom(ctx).Errorw("timing exceeded its limit", "metric", l.name, "value", l.value.String(), "limit", l.limit.String())
+			exceeded = append(exceeded, fmt.Sprintf("%s %v > %v", l.name, l.value.Round(time.Second), l.limit))
+		}
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+	return withExitCode(errors.Errorf("timings exceeded their limits: %s", strings.Join(exceeded, ", ")), exitThreshold)
+}
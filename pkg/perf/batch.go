@@ -0,0 +1,421 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	scheduleWindow = "window"
+	scheduleBatch  = "batch"
+)
+
+// What to do when a VSB fails.
+const (
+	onFailureAbort    = "abort"
+	onFailureContinue = "continue"
+)
+
+// errVSBFailed is returned while waiting on a VSB the data mover reports as
+// failed.
+var errVSBFailed = errors.New("volumesnapshotbackup failed")
+
+// errTooManyFailures is returned once maxFailures VSBs have failed.
+var errTooManyFailures = errors.New("too many volumesnapshotbackups failed")
+
+// vsbRunner creates a VolumeSnapshotBackup for every VSC of a run, keeping at
+// most concurrency of them running according to schedule.
+type vsbRunner struct {
+	client           client.Client
+	watcher          *runWatcher
+	veleroNamespace  string
+	name             string
+	resticSecretName string
+	// resticSecrets overrides resticSecretName for the VSBs of the
+	// namespaces it holds.
+	resticSecrets map[string]string
+	concurrency   int
+	schedule      string
+	results       *runResults
+	stalls        *stallTracker
+	// advanceThreshold is the share of a batch that must be done before
+	// the next one starts with schedule batch, if less than 1.
+	advanceThreshold float64
+	// artifacts collects diagnostics of VSBs that fail, stall or time
+	// out, if set.
+	artifacts *artifactCollector
+	// abortOnFailure stops the run at the first failed VSB instead of
+	// carrying on with the rest.
+	abortOnFailure bool
+	// createLimiter spaces out VSB creates, so the burst of creates at
+	// the start of a run or batch stays below API priority and fairness
+	// throttling, if set.
+	createLimiter flowcontrol.RateLimiter
+	// batchDelay pauses between the batches of schedule batch, and
+	// createJitter delays each VSB create by a random time up to it, to
+	// pace the run.
+	batchDelay   time.Duration
+	createJitter time.Duration
+	// maxFailures stops the run once this many VSBs could not be
+	// created, failed or stalled, if set. failures counts them.
+	maxFailures int
+	failures    int32
+
+	// existing holds the VSBs left behind by an earlier attempt at the run,
+	// keyed by VSC name. They are adopted instead of being created again.
+	existing map[string]*dmv1.VolumeSnapshotBackup
+}
+
+// vsbJob is a VSC queued for a VolumeSnapshotBackup along with the batch it
+// was scheduled in.
+type vsbJob struct {
+	vsc   v1.VolumeSnapshotContent
+	batch int
+}
+
+func (r *vsbRunner) run(ctx context.Context, vscs []v1.VolumeSnapshotContent) error {
+	s := &scheduler{
+		queue:            vsbQueue{runner: r, vscs: vscs},
+		concurrency:      r.concurrency,
+		schedule:         r.schedule,
+		advanceThreshold: r.advanceThreshold,
+		phase:            phaseDataMover,
+		objects:          "VSBs",
+		queued:           "vscs",
+	}
+	return s.run(ctx)
+}
+
+// vsbQueue queues the VSCs of a vsbRunner for its scheduler.
+type vsbQueue struct {
+	runner *vsbRunner
+	vscs   []v1.VolumeSnapshotContent
+}
+
+func (q vsbQueue) len() int { return len(q.vscs) }
+
+func (q vsbQueue) runJob(ctx context.Context, index, batch int, completed *int32) error {
+	return q.runner.runJob(ctx, vsbJob{vsc: q.vscs[index], batch: batch}, completed, len(q.vscs))
+}
+
+func (q vsbQueue) pauseBefore(ctx context.Context, batch int) bool {
+	return q.runner.pauseBetweenBatches(ctx, batch)
+}
+
+func (q vsbQueue) batchDone(batch, volumes int, elapsed time.Duration) {
+	q.runner.results.metrics.batchDuration.Observe(elapsed.Seconds())
+	q.runner.results.emit(event{Type: eventBatchDone, Batch: batch, Volumes: volumes, Seconds: elapsed.Seconds()})
+}
+
+// pauseBetweenBatches waits batchDelay before batch starts, returning false
+// if ctx is done first.
+func (r *vsbRunner) pauseBetweenBatches(ctx context.Context, batch int) bool {
+	if r.batchDelay <= 0 {
+		return true
+	}
+	loggerFrom(ctx).Infow("pausing before the next batch", "phase", phaseDataMover, "batch", batch, "delay", r.batchDelay.String())
+	return sleep(ctx, r.batchDelay)
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// runJob creates the VSB of job and waits for it to complete. VSBs that could
+// not be created or stalled are left behind, as are VSBs that failed unless
+// the run aborts on failure or too many have, so only errors that should stop
+// the run are returned.
+func (r *vsbRunner) runJob(ctx context.Context, job vsbJob, completed *int32, total int) error {
+	vsb, err := r.create(ctx, job)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return r.failed(ctx)
+	}
+	key := types.NamespacedName{Namespace: vsb.Namespace, Name: vsb.Name}
+	err = waitForVSBToComplete(ctx, r.watcher, key, job.vsc.Name, r.results, r.checkStalled)
+	if err == errVSBStalled {
+		// leave the VSB behind and move on to the next VSC
+		return r.failed(ctx)
+	}
+	if errors.Is(err, errVSBFailed) {
+		loggerFrom(ctx).Errorw("VSB failed", "phase", phaseDataMover, "namespace", vsb.Namespace, "vsb", vsb.Name, "batch", job.batch, "error", err)
+		r.artifacts.collect(ctx, key, err.Error())
+		if !r.abortOnFailure {
+			return r.failed(ctx)
+		}
+	}
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for VSB to complete", "phase", phaseDataMover, "namespace", vsb.Namespace, "vsb", vsb.Name, "batch", job.batch)
+			r.artifacts.collect(ctx, key, "timed out waiting for the volumesnapshotbackup to complete")
+		}
+		return err
+	}
+	loggerFrom(ctx).Infow("VSB completed", "phase", phaseDataMover, "namespace", vsb.Namespace, "vsb", vsb.Name, "batch", job.batch, "done", atomic.AddInt32(completed, 1), "total", total)
+	r.annotateVSB(ctx, job.vsc.Name)
+	return nil
+}
+
+// failed counts a VSB that could not be created, failed or stalled,
+// returning errTooManyFailures once maxFailures have.
+func (r *vsbRunner) failed(ctx context.Context) error {
+	n := int(atomic.AddInt32(&r.failures, 1))
+	if r.maxFailures > 0 && n == r.maxFailures {
+		loggerFrom(ctx).Errorw("too many VSBs failed, stopping the run", "phase", phaseDataMover, "failures", n)
+		return errors.Wrapf(errTooManyFailures, "%d of them", n)
+	}
+	return nil
+}
+
+// createBackoff spaces out the retries of a VSB create that failed with a
+// transient error, giving up after about a minute.
+var createBackoff = wait.Backoff{Steps: 6, Duration: time.Second, Factor: 2, Jitter: 0.1}
+
+// create creates the VSB for job, or adopts the one left behind by an
+// earlier attempt, and records its start time. Transient API errors are
+// retried with backoff, and creates that still fail are logged and recorded
+// against the VSC.
+func (r *vsbRunner) create(ctx context.Context, job vsbJob) (*dmv1.VolumeSnapshotBackup, error) {
+	if vsb, ok := r.existing[job.vsc.Name]; ok {
+		loggerFrom(ctx).Infow("resuming VSB", "phase", phaseDataMover, "namespace", vsb.Namespace, "vsb", vsb.Name, "vsc", job.vsc.Name, "batch", job.batch)
+		r.results.vsbStarted(job.vsc.Name, vsb.Name, job.batch, vsb.CreationTimestamp.Time)
+		return vsb, nil
+	}
+
+	resticSecretName := r.resticSecretName
+	if secret, ok := r.resticSecrets[job.vsc.Spec.VolumeSnapshotRef.Namespace]; ok {
+		resticSecretName = secret
+	}
+	if r.createJitter > 0 && !sleep(ctx, time.Duration(rand.Int63n(int64(r.createJitter)))) {
+		return nil, ctx.Err()
+	}
+	vsb := newVolumeSnapshotBackup(job.vsc, r.veleroNamespace, r.name, resticSecretName)
+	vsb.Annotations = r.vsbCreateAnnotations(job, time.Now())
+	attempts := 0
+	err := retry.OnError(createBackoff, isTransient, func() error {
+		attempts++
+		if attempts > 1 {
+			// The API server may have created the VSB before the
+			// error came back, so look for it before trying again.
+			existing, err := r.findVSB(ctx, job.vsc)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				vsb = existing
+				return nil
+			}
+			loggerFrom(ctx).Warnw("retrying VSB create", "phase", phaseDataMover, "vsc", job.vsc.Name, "batch", job.batch, "attempt", attempts)
+		}
+		if r.createLimiter != nil {
+			err := r.createLimiter.Wait(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		return r.client.Create(ctx, vsb)
+	})
+	if err != nil {
+		loggerFrom(ctx).Errorw("failed to create VSB", "phase", phaseDataMover, "vsc", job.vsc.Name, "batch", job.batch, "attempts", attempts, "error", err)
+		r.results.vsbCreateFailed(job.vsc.Name, job.batch, attempts, err)
+		return nil, err
+	}
+	r.results.vsbStarted(job.vsc.Name, vsb.Name, job.batch, vsb.CreationTimestamp.Time)
+	return vsb, nil
+}
+
+// findVSB looks up the VSB of the run for vsc on the API server, returning
+// nil if there is none.
+func (r *vsbRunner) findVSB(ctx context.Context, vsc v1.VolumeSnapshotContent) (*dmv1.VolumeSnapshotBackup, error) {
+	vsbList := dmv1.VolumeSnapshotBackupList{}
+	err := r.client.List(ctx, &vsbList, client.InNamespace(vsc.Spec.VolumeSnapshotRef.Namespace), client.MatchingLabels{"perf-test": r.name})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumesnapshotbackups")
+	}
+	for i := range vsbList.Items {
+		if vsbList.Items[i].Spec.VolumeSnapshotContent.Name == vsc.Name {
+			return &vsbList.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// isTransient reports whether err is likely to go away if the request is
+// retried, such as the API server being overloaded or restarting.
+func isTransient(err error) bool {
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsUnexpectedServerError(err) ||
+		// a generated name that collided with an existing object
+		apierrors.IsAlreadyExists(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsProbableEOF(err)
+}
+
+// resume looks up the VSBs created by an earlier attempt at the run and
+// returns the VSCs that still need processing. Completed VSBs are recorded in
+// the results and skipped, while unfinished ones are queued first so they are
+// adopted before any new VSB is created.
+func (r *vsbRunner) resume(ctx context.Context, vscs []v1.VolumeSnapshotContent) ([]v1.VolumeSnapshotContent, error) {
+	vsbList, err := listVolumeSnapshotBackups(ctx, r.client, r.name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumesnapshotbackups")
+	}
+	r.existing = map[string]*dmv1.VolumeSnapshotBackup{}
+	for i := range vsbList.Items {
+		vsb := &vsbList.Items[i]
+		r.existing[vsb.Spec.VolumeSnapshotContent.Name] = vsb
+	}
+
+	inFlight := []v1.VolumeSnapshotContent{}
+	remaining := []v1.VolumeSnapshotContent{}
+	completed := 0
+	for _, vsc := range vscs {
+		vsb, ok := r.existing[vsc.Name]
+		switch {
+		case !ok:
+			remaining = append(remaining, vsc)
+		case isVSBCompleted(vsb):
+			r.results.vsbStarted(vsc.Name, vsb.Name, 0, vsb.CreationTimestamp.Time)
+			r.results.vsbCompleted(vsc.Name, vsb.Status.SourcePVCData.Name, vsb.Status.SourcePVCData.Size, lastTransitionTime(vsb.Status.Conditions))
+			completed++
+		default:
+			inFlight = append(inFlight, vsc)
+		}
+	}
+	loggerFrom(ctx).Infow("resuming data mover", "phase", phaseDataMover, "completed", completed, "unfinished", len(inFlight), "withoutVSB", len(remaining))
+	return append(inFlight, remaining...), nil
+}
+
+// checkStalled reports whether vsb has stopped making progress. The first
+// time a VSB is found stalled its details are logged and it is recorded as
+// failed so the run can carry on without it.
+func (r *vsbRunner) checkStalled(ctx context.Context, vsb *dmv1.VolumeSnapshotBackup) bool {
+	if !r.stalls.stalled(vsb, time.Now()) {
+		return false
+	}
+	err := errors.Wrapf(errVSBStalled, "no progress in %v", r.stalls.timeout)
+	if r.results.vsbStalled(vsb.Spec.VolumeSnapshotContent.Name, err) {
+		logStuckVSB(ctx, r.client, r.veleroNamespace, vsb)
+		r.artifacts.collect(ctx, types.NamespacedName{Namespace: vsb.Namespace, Name: vsb.Name}, err.Error())
+	}
+	return true
+}
+
+func isVSBCompleted(vsb *dmv1.VolumeSnapshotBackup) bool {
+	return vsb.Status.Phase == dmv1.SnapMoverVolSyncPhaseCompleted || vsb.Status.Phase == dmv1.SnapMoverBackupPhaseCompleted
+}
+
+// vsbFailure returns an error wrapping errVSBFailed with the reason the data
+// mover gave if vsb failed, or nil if it has not.
+func vsbFailure(vsb *dmv1.VolumeSnapshotBackup) error {
+	if vsb.Status.Phase != dmv1.SnapMoverBackupPhaseFailed && vsb.Status.Phase != dmv1.SnapMoverBackupPhasePartiallyFailed {
+		return nil
+	}
+	reasons := []string{}
+	for _, condition := range vsb.Status.Conditions {
+		if condition.Status == metav1.ConditionFalse {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", condition.Reason, condition.Message))
+		}
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "no reason given")
+	}
+	return errors.Wrapf(errVSBFailed, "phase %s, %s", vsb.Status.Phase, strings.Join(reasons, "; "))
+}
+
+// lastTransitionTime returns the most recent transition time across
+// conditions, which is the best estimate of when a finished VSB completed.
+func lastTransitionTime(conditions []metav1.Condition) time.Time {
+	var last time.Time
+	for _, condition := range conditions {
+		if condition.LastTransitionTime.After(last) {
+			last = condition.LastTransitionTime.Time
+		}
+	}
+	return last
+}
+
+// waitForVSBToComplete waits for the VSB called key to complete. It returns
+// errVSBStalled as soon as stalled reports the VSB has stopped making progress
+// and an error wrapping errVSBFailed as soon as the VSB fails.
+func waitForVSBToComplete(ctx context.Context, w *runWatcher, key types.NamespacedName, vscName string, results *runResults, stalled func(context.Context, *dmv1.VolumeSnapshotBackup) bool) error {
+	timeout := 120 * time.Minute
+	return w.waitFor(ctx, timeout, func() (bool, error) {
+		vsb := dmv1.VolumeSnapshotBackup{}
+		err := w.cache.Get(ctx, key, &vsb)
+		if apierrors.IsNotFound(err) {
+			// the cache has not seen the VSB we just created yet
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get volumesnapshotbackup %s", key)
+		}
+		if isVSBCompleted(&vsb) {
+			results.vsbCompleted(vscName, vsb.Status.SourcePVCData.Name, vsb.Status.SourcePVCData.Size, time.Now())
+			return true, nil
+		}
+		if err := vsbFailure(&vsb); err != nil {
+			results.vsbFailed(vscName, err)
+			return false, err
+		}
+		if stalled(ctx, &vsb) {
+			return false, errVSBStalled
+		}
+		return false, nil
+	})
+}
+
+func newVolumeSnapshotBackup(vsc v1.VolumeSnapshotContent, veleroNamespace string, name string, resticSecretName string) *dmv1.VolumeSnapshotBackup {
+	return &dmv1.VolumeSnapshotBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "vsb-",
+			Namespace:    vsc.Spec.VolumeSnapshotRef.Namespace,
+			Labels: map[string]string{
+				"perf-test":             name,
+				"velero.io/backup-name": name,
+			},
+		},
+
+		Spec: dmv1.VolumeSnapshotBackupSpec{
+			VolumeSnapshotContent: corev1.ObjectReference{
+				Name: vsc.Name,
+			},
+			ProtectedNamespace: veleroNamespace,
+			ResticSecretRef: corev1.LocalObjectReference{
+				Name: resticSecretName,
+			},
+		},
+	}
+}
@@ -0,0 +1,272 @@
+package perf
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// bucketPrefix is the S3 bucket and prefix a restic repository is stored
+// under, with the credentials of its restic secret.
+type bucketPrefix struct {
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func (b *bucketPrefix) String() string {
+	return fmt.Sprintf("%s/%s/%s", b.endpoint.Host, b.bucket, b.prefix)
+}
+
+// bucketUsage is what a bucket prefix held at some point of the run.
+type bucketUsage struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// storageResult measures what the data mover uploaded to object storage by
+// listing the bucket prefixes of the restic repositories of the run before
+// the first VSB is created and once the data mover is done.
+type storageResult struct {
+	Prefixes []string    `json:"prefixes"`
+	Before   bucketUsage `json:"before"`
+	After    bucketUsage `json:"after"`
+	// UploadedBytes and NewObjects are how much the prefixes grew, every
+	// new object being a PUT request of the data mover that landed.
+	UploadedBytes int64 `json:"uploadedBytes"`
+	NewObjects    int   `json:"newObjects"`
+	// Bandwidth is the MiB uploaded per second of data mover time.
+	Bandwidth float64 `json:"bandwidthMiBPerSecond,omitempty"`
+}
+
+func (s *storageResult) summary() string {
+	return fmt.Sprintf("%s uploaded in %d new objects, %.2f MiB/s", formatBytes(s.UploadedBytes), s.NewObjects, s.Bandwidth)
+}
+
+// parseResticS3Repository returns the bucket prefix of a restic repository
+// such as s3:s3.amazonaws.com/bucket/prefix or s3:https://host/bucket/prefix,
+// with the credentials of the restic secret holding it.
+func parseResticS3Repository(repo string, data map[string][]byte) (*bucketPrefix, error) {
+	if !strings.HasPrefix(repo, "s3:") {
+		return nil, errors.Errorf("restic repository %q is not stored in S3", repo)
+	}
+	location := strings.TrimPrefix(repo, "s3:")
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		location = "https://" + location
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid restic repository %q", repo)
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, errors.Errorf("restic repository %q has no bucket", repo)
+	}
+	b := &bucketPrefix{
+		endpoint:     &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       string(data["AWS_DEFAULT_REGION"]),
+		accessKey:    string(data["AWS_ACCESS_KEY_ID"]),
+		secretKey:    string(data["AWS_SECRET_ACCESS_KEY"]),
+		sessionToken: string(data["AWS_SESSION_TOKEN"]),
+	}
+	if b.accessKey == "" || b.secretKey == "" {
+		return nil, errors.Errorf("restic repository %q has no AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY in its secret", repo)
+	}
+	if b.region == "" {
+		b.region = "us-east-1"
+	}
+	if b.endpoint.Host == "s3.amazonaws.com" {
+		// Buckets outside us-east-1 are only listed from their region.
+		b.endpoint.Host = fmt.Sprintf("s3.%s.amazonaws.com", b.region)
+	}
+	return b, nil
+}
+
+// resticBucketPrefixes returns the bucket prefixes of the restic repositories
+// of secrets, restic secrets in the Velero namespace, leaving out nested
+// prefixes so no object is counted twice.
+func resticBucketPrefixes(ctx context.Context, c client.Client, veleroNamespace string, secrets []string) ([]*bucketPrefix, error) {
+	prefixes := map[string]*bucketPrefix{}
+	for _, name := range secrets {
+		secret := corev1.Secret{}
+		err := c.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: name}, &secret)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get restic secret %s", name)
+		}
+		b, err := parseResticS3Repository(string(secret.Data["RESTIC_REPOSITORY"]), secret.Data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "restic secret %s", name)
+		}
+		prefixes[b.String()] = b
+	}
+	keys := make([]string, 0, len(prefixes))
+	for key := range prefixes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := []*bucketPrefix{}
+	for i, key := range keys {
+		nested := false
+		for _, parent := range keys[:i] {
+			if strings.HasPrefix(key, strings.TrimSuffix(parent, "/")+"/") {
+				nested = true
+			}
+		}
+		if !nested {
+			result = append(result, prefixes[key])
+		}
+	}
+	return result, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Size int64 `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// usage lists every object under the prefix with ListObjectsV2 and sums
+// their sizes.
+func (b *bucketPrefix) usage(ctx context.Context, httpClient *http.Client) (bucketUsage, error) {
+	usage := bucketUsage{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if b.prefix != "" {
+			query.Set("prefix", strings.TrimSuffix(b.prefix, "/")+"/")
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := *b.endpoint
+		u.Path = "/" + b.bucket
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return usage, errors.Wrapf(err, "failed to create list request for %s", b)
+		}
+		payloadHash := sha256Hex(nil)
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		if b.sessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+		}
+		req.Header.Set("Authorization", signV4(req, payloadHash, b.accessKey, b.secretKey, b.region, "s3", time.Now()))
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return usage, errors.Wrapf(err, "failed to list %s", b)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return usage, errors.Wrapf(err, "failed to read list of %s", b)
+		}
+		if resp.StatusCode >= 300 {
+			return usage, errors.Errorf("failed to list %s: %s", b, resp.Status)
+		}
+		page := listBucketResult{}
+		err = xml.Unmarshal(body, &page)
+		if err != nil {
+			return usage, errors.Wrapf(err, "failed to parse list of %s", b)
+		}
+		for _, object := range page.Contents {
+			usage.Objects++
+			usage.Bytes += object.Size
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return usage, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// bucketMeter measures the bucket prefixes of the restic repositories of a
+// run before and after its data mover phase.
+type bucketMeter struct {
+	client   *http.Client
+	prefixes []*bucketPrefix
+	before   bucketUsage
+}
+
+// newBucketMeter lists the bucket prefixes of the restic repositories of
+// secrets, the restic secret of each namespace, recording what they hold
+// before the data mover phase.
+func newBucketMeter(ctx context.Context, c client.Client, veleroNamespace string, secrets map[string]string) (*bucketMeter, error) {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, name := range secrets {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	prefixes, err := resticBucketPrefixes(ctx, c, veleroNamespace, names)
+	if err != nil {
+		return nil, err
+	}
+	m := &bucketMeter{client: &http.Client{Timeout: 5 * time.Minute}, prefixes: prefixes}
+	m.before, err = m.usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	loggerFrom(ctx).Infow("object storage before the data mover", "phase", phaseDataMover, "prefixes", len(prefixes), "objects", m.before.Objects, "size", formatBytes(m.before.Bytes))
+	return m, nil
+}
+
+func (m *bucketMeter) usage(ctx context.Context) (bucketUsage, error) {
+	total := bucketUsage{}
+	for _, b := range m.prefixes {
+		usage, err := b.usage(ctx, m.client)
+		if err != nil {
+			return total, err
+		}
+		total.Objects += usage.Objects
+		total.Bytes += usage.Bytes
+	}
+	return total, nil
+}
+
+// record lists the prefixes again once the data mover is done and records
+// how much they grew in results.
+func (m *bucketMeter) record(ctx context.Context, results *runResults) error {
+	after, err := m.usage(ctx)
+	if err != nil {
+		return err
+	}
+	storage := &storageResult{
+		Before:        m.before,
+		After:         after,
+		UploadedBytes: after.Bytes - m.before.Bytes,
+		NewObjects:    after.Objects - m.before.Objects,
+	}
+	for _, b := range m.prefixes {
+		storage.Prefixes = append(storage.Prefixes, b.String())
+	}
+	results.mu.Lock()
+	if results.DataMoverTime > 0 {
+		storage.Bandwidth = float64(storage.UploadedBytes) / (1 << 20) / results.DataMoverTime.Seconds()
+	}
+	results.Storage = storage
+	results.mu.Unlock()
+	loggerFrom(ctx).Infow("object storage after the data mover", "phase", phaseDataMover, "uploaded", formatBytes(storage.UploadedBytes), "newObjects", storage.NewObjects, "bandwidth", fmt.Sprintf("%.2f MiB/s", storage.Bandwidth))
+	return nil
+}
@@ -0,0 +1,296 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Chaos actions taken during the data mover phase.
+const (
+	// chaosKillMoverPods deletes a random running volsync mover pod.
+	chaosKillMoverPods = "kill-mover-pods"
+	// chaosRestartControllers restarts the Velero and volume snapshot
+	// mover deployments, as a node drain would.
+	chaosRestartControllers = "restart-controllers"
+)
+
+// controllerDeployments are the deployments in the Velero namespace that
+// restart-controllers restarts.
+var controllerDeployments = []string{"velero", "volume-snapshot-mover"}
+
+// moverJobPrefix prefixes the job-name label of the volsync mover pods of
+// ReplicationSources.
+const moverJobPrefix = "volsync-src-"
+
+// chaosEvent records a chaos action taken during a run and how long the data
+// mover took to recover from it.
+type chaosEvent struct {
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Time   time.Time `json:"time"`
+	// RecoveredTime is when the data mover was seen working again, zero
+	// if it was not before the next action or the end of the phase.
+	RecoveredTime time.Time     `json:"recoveredTime"`
+	RecoveryTime  time.Duration `json:"recoveryTime,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// chaosMonkey takes each of its actions every interval while the data mover
+// runs, so the resiliency of the data mover is measured along with its
+// performance.
+type chaosMonkey struct {
+	client          client.Client
+	veleroNamespace string
+	actions         []string
+	interval        time.Duration
+	results         *runResults
+	rand            *rand.Rand
+
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+// startChaos starts taking the chaos actions of the run, if any, returning a
+// function that stops them.
+func (o *backupOptions) startChaos(ctx context.Context, c client.Client, results *runResults) func() {
+	if len(o.chaos) == 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m := &chaosMonkey{
+		client:          c,
+		veleroNamespace: o.veleroNamespace,
+		actions:         o.chaos,
+		interval:        o.chaosInterval,
+		results:         results,
+		rand:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		cancel:          cancel,
+	}
+	loggerFrom(ctx).Infow("starting chaos", "phase", phaseDataMover, "actions", strings.Join(o.chaos, ","), "interval", o.chaosInterval.String())
+	m.done.Add(1)
+	go m.run(ctx)
+	return m.stop
+}
+
+func (m *chaosMonkey) stop() {
+	m.cancel()
+	m.done.Wait()
+}
+
+func (m *chaosMonkey) run(ctx context.Context) {
+	defer m.done.Done()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, action := range m.actions {
+			switch action {
+			case chaosKillMoverPods:
+				if event := m.killMoverPod(ctx); event != nil {
+					m.results.chaosEvent(*event)
+				}
+			case chaosRestartControllers:
+				for _, event := range m.restartControllers(ctx) {
+					m.results.chaosEvent(event)
+				}
+			}
+		}
+	}
+}
+
+// killMoverPod deletes a random running volsync mover pod and waits for its
+// Job to run a new pod, or to be done, for at most the chaos interval.
+// Nothing is recorded when no mover pod is running.
+func (m *chaosMonkey) killMoverPod(ctx context.Context) *chaosEvent {
+	pods := corev1.PodList{}
+	err := m.client.List(ctx, &pods, client.InNamespace(m.veleroNamespace), client.HasLabels{"job-name"})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return &chaosEvent{Action: chaosKillMoverPods, Time: time.Now(), Error: errors.Wrap(err, "failed to list mover pods").Error()}
+	}
+	running := []corev1.Pod{}
+	for _, pod := range pods.Items {
+		if strings.HasPrefix(pod.Labels["job-name"], moverJobPrefix) && pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			running = append(running, pod)
+		}
+	}
+	if len(running) == 0 {
+		loggerFrom(ctx).Infow("no mover pod running to kill", "phase", phaseDataMover)
+		return nil
+	}
+	pod := running[m.rand.Intn(len(running))]
+	event := &chaosEvent{Action: chaosKillMoverPods, Target: pod.Name, Time: time.Now()}
+	err = deleteObject(ctx, m.client, &pod)
+	if err != nil {
+		event.Error = err.Error()
+		return event
+	}
+	loggerFrom(ctx).Infow("killed mover pod", "phase", phaseDataMover, "pod", pod.Name, "job", pod.Labels["job-name"])
+
+	job := pod.Labels["job-name"]
+	err = wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		if time.Since(event.Time) > m.interval {
+			return false, wait.ErrWaitTimeout
+		}
+		replacements := corev1.PodList{}
+		err := m.client.List(ctx, &replacements, client.InNamespace(m.veleroNamespace), client.MatchingLabels{"job-name": job})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list mover pods")
+		}
+		for _, p := range replacements.Items {
+			if p.UID == pod.UID {
+				continue
+			}
+			if p.Status.Phase == corev1.PodRunning || p.Status.Phase == corev1.PodSucceeded {
+				return true, nil
+			}
+		}
+		// The ReplicationSource was cleaned up without needing a new pod.
+		return len(replacements.Items) == 0, nil
+	}, ctx.Done())
+	switch {
+	case err == nil:
+		event.RecoveredTime = time.Now()
+		event.RecoveryTime = event.RecoveredTime.Sub(event.Time)
+		loggerFrom(ctx).Infow("mover recovered", "phase", phaseDataMover, "job", job, "recovery", event.RecoveryTime.String())
+	case ctx.Err() == nil:
+		event.Error = err.Error()
+		loggerFrom(ctx).Warnw("mover did not recover", "phase", phaseDataMover, "job", job, "error", err)
+	}
+	return event
+}
+
+// restartControllers restarts every controller deployment at once, as
+// kubectl rollout restart does, and waits for each to roll out again for at
+// most the chaos interval. The time each took to roll out is the latency it
+// added to the run.
+func (m *chaosMonkey) restartControllers(ctx context.Context) []chaosEvent {
+	events := []chaosEvent{}
+	restarted := []*appsv1.Deployment{}
+	for _, name := range controllerDeployments {
+		event := chaosEvent{Action: chaosRestartControllers, Target: name, Time: time.Now()}
+		deployment := &appsv1.Deployment{}
+		err := m.client.Get(ctx, types.NamespacedName{Namespace: m.veleroNamespace, Name: name}, deployment)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err == nil {
+			original := deployment.DeepCopy()
+			if deployment.Spec.Template.Annotations == nil {
+				deployment.Spec.Template.Annotations = map[string]string{}
+			}
+			deployment.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = event.Time.Format(time.RFC3339)
+			err = m.client.Patch(ctx, deployment, client.MergeFrom(original))
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return events
+			}
+			event.Error = errors.Wrapf(err, "failed to restart deployment %s", name).Error()
+			loggerFrom(ctx).Warnw("failed to restart controller", "phase", phaseDataMover, "deployment", name, "error", err)
+			events = append(events, event)
+			continue
+		}
+		loggerFrom(ctx).Infow("restarted controller", "phase", phaseDataMover, "deployment", name)
+		events = append(events, event)
+		restarted = append(restarted, deployment)
+	}
+
+	for _, deployment := range restarted {
+		var event *chaosEvent
+		for i := range events {
+			if events[i].Target == deployment.Name {
+				event = &events[i]
+			}
+		}
+		err := wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+			if time.Since(event.Time) > m.interval {
+				return false, wait.ErrWaitTimeout
+			}
+			err := m.client.Get(ctx, client.ObjectKeyFromObject(deployment), deployment)
+			if err != nil {
+				return false, errors.Wrapf(err, "failed to get deployment %s", deployment.Name)
+			}
+			return isRolledOut(deployment), nil
+		}, ctx.Done())
+		switch {
+		case err == nil:
+			event.RecoveredTime = time.Now()
+			event.RecoveryTime = event.RecoveredTime.Sub(event.Time)
+			loggerFrom(ctx).Infow("controller rolled out", "phase", phaseDataMover, "deployment", deployment.Name, "recovery", event.RecoveryTime.String())
+		case ctx.Err() == nil:
+			event.Error = err.Error()
+			loggerFrom(ctx).Warnw("controller did not roll out", "phase", phaseDataMover, "deployment", deployment.Name, "error", err)
+		}
+	}
+	return events
+}
+
+// isRolledOut reports whether every replica of deployment runs its latest
+// template and is available.
+func isRolledOut(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	return status.ObservedGeneration >= deployment.Generation &&
+		status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas &&
+		status.AvailableReplicas == replicas
+}
+
+// chaosEvent records a chaos action taken during the run.
+func (r *runResults) chaosEvent(event chaosEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Chaos = append(r.Chaos, event)
+}
+
+// chaosSummary summarizes the chaos actions of the run per action, such as
+// "kill-mover-pods 3 (3 recovered, mean 41s)".
+func (r *runResults) chaosSummary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	actions := []string{}
+	counts := map[string]int{}
+	recovered := map[string]int{}
+	recovery := map[string]time.Duration{}
+	for _, e := range r.Chaos {
+		if _, ok := counts[e.Action]; !ok {
+			actions = append(actions, e.Action)
+		}
+		counts[e.Action]++
+		if !e.RecoveredTime.IsZero() {
+			recovered[e.Action]++
+			recovery[e.Action] += e.RecoveryTime
+		}
+	}
+	parts := []string{}
+	for _, action := range actions {
+		part := fmt.Sprintf("%s %d (%d recovered", action, counts[action], recovered[action])
+		if recovered[action] > 0 {
+			part += fmt.Sprintf(", mean %v", (recovery[action] / time.Duration(recovered[action])).Round(time.Second))
+		}
+		parts = append(parts, part+")")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,264 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	volsyncv1alpha1 "github.com/backube/volsync/api/v1alpha1"
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// vsbLabel is set by the volume snapshot mover on every resource it creates
+// in the protected namespace on behalf of a VolumeSnapshotBackup.
+const vsbLabel = "datamover.oadp.openshift.io/vsb"
+
+type cleanupOptions struct {
+	*rootOptions
+	run    string
+	dryRun bool
+}
+
+func newCleanupCommand(root *rootOptions) *cobra.Command {
+	o := &cleanupOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Delete the resources created by a run",
+		Long: `Delete the resources created by a run: its VolumeSnapshotRestores,
+VolumeSnapshotBackups, the ReplicationSources and PVCs (including volsync cache
+PVCs) the data mover created for them in the Velero namespace, the
+VolumeSnapshotContents created by the backup and finally the Velero backup
+itself, which is removed with a DeleteBackupRequest.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.run == "" {
+				return errors.New("missing run flag")
+			}
+			c, err := o.client(cmd.Context())
+			if err != nil {
+				return err
+			}
+			err = o.resolveVeleroNamespace(cmd.Context(), c)
+			if err != nil {
+				return err
+			}
+			return cleanupRun(cmd.Context(), c, o.veleroNamespace, o.run, o.dryRun)
+		},
+	}
+	cmd.Flags().StringVar(&o.run, "run", "", "name of the backup created by the run")
+	cmd.Flags().BoolVar(&o.dryRun, "dry-run", false, "list what would be removed without deleting anything")
+	return cmd
+}
+
+// cleanupRun deletes everything created for the run called name, or only
+// prints it when dryRun is set. Resources are removed in reverse order of
+// creation so nothing is recreated by a controller still reconciling a parent.
+func cleanupRun(ctx context.Context, c client.Client, veleroNamespace, name string, dryRun bool) error {
+	objs, err := listRunResources(ctx, c, veleroNamespace, name)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		desc := describeObject(c, obj)
+		if dryRun {
+			fmt.Printf("would delete %s\n", desc)
+			continue
+		}
+		if vsc, ok := obj.(*v1.VolumeSnapshotContent); ok {
+			err := releaseVSC(ctx, c, vsc)
+			if err != nil {
+				return err
+			}
+		}
+		err := deleteObject(ctx, c, obj)
+		if err != nil {
+			return err
+		}
+		loggerFrom(ctx).Infow("deleted", "object", desc)
+	}
+
+	backup := velerov1.Backup{}
+	err = c.Get(ctx, types.NamespacedName{Name: name, Namespace: veleroNamespace}, &backup)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get backup")
+	}
+	if dryRun {
+		fmt.Printf("would delete %s\n", describeObject(c, &backup))
+		return nil
+	}
+	err = createDeleteBackupRequest(ctx, c, veleroNamespace, name)
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Infow("requested deletion of backup", "backup", name, "veleroNamespace", veleroNamespace)
+	return nil
+}
+
+// clearDataMover deletes the VSRs and VSBs of the run called name and the
+// resources the data mover created for them, leaving its VSCs and backup in
+// place, and waits for the VSBs to be gone.
+func clearDataMover(ctx context.Context, c client.Client, veleroNamespace, name string) error {
+	objs, err := listRunResources(ctx, c, veleroNamespace, name)
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for _, obj := range objs {
+		if _, ok := obj.(*v1.VolumeSnapshotContent); ok {
+			continue
+		}
+		err := deleteObject(ctx, c, obj)
+		if err != nil {
+			return err
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		return nil
+	}
+	loggerFrom(ctx).Infow("deleting data mover resources", "run", name, "objects", deleted)
+	err = wait.PollImmediate(5*time.Second, 10*time.Minute, func() (bool, error) {
+		vsbList, err := listVolumeSnapshotBackups(ctx, c, name)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list volumesnapshotbackups")
+		}
+		return len(vsbList.Items) == 0, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed waiting for volumesnapshotbackups to be deleted")
+	}
+	return nil
+}
+
+// listRunResources returns the resources created by the run called name,
+// ordered so that children come before the parents that created them.
+func listRunResources(ctx context.Context, c client.Client, veleroNamespace, name string) ([]client.Object, error) {
+	objs := []client.Object{}
+
+	vsrList, err := listVolumeSnapshotRestores(ctx, c, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumesnapshotrestores")
+	}
+	for i := range vsrList.Items {
+		objs = append(objs, &vsrList.Items[i])
+	}
+
+	vsbList, err := listVolumeSnapshotBackups(ctx, c, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumesnapshotbackups")
+	}
+	vsbs := map[string]bool{}
+	for i := range vsbList.Items {
+		vsbs[vsbList.Items[i].Name] = true
+		objs = append(objs, &vsbList.Items[i])
+	}
+
+	// ReplicationSources and cloned PVCs are labeled with the VSB they
+	// belong to, while volsync cache PVCs are owned by their
+	// ReplicationSource.
+	rsList := volsyncv1alpha1.ReplicationSourceList{}
+	err = c.List(ctx, &rsList, client.InNamespace(veleroNamespace), client.HasLabels{vsbLabel})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list replicationsources")
+	}
+	replicationSources := map[types.UID]bool{}
+	for i := range rsList.Items {
+		if !vsbs[rsList.Items[i].Labels[vsbLabel]] {
+			continue
+		}
+		replicationSources[rsList.Items[i].UID] = true
+		objs = append(objs, &rsList.Items[i])
+	}
+
+	pvcList := corev1.PersistentVolumeClaimList{}
+	err = c.List(ctx, &pvcList, client.InNamespace(veleroNamespace))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list persistentvolumeclaims")
+	}
+	for i := range pvcList.Items {
+		pvc := &pvcList.Items[i]
+		if vsbs[pvc.Labels[vsbLabel]] || ownedByAny(pvc, replicationSources) {
+			objs = append(objs, pvc)
+		}
+	}
+
+	// restic secrets copied for the run with volume options
+	secretList := corev1.SecretList{}
+	err = c.List(ctx, &secretList, client.InNamespace(veleroNamespace), client.MatchingLabels{"perf-test": name})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list secrets")
+	}
+	for i := range secretList.Items {
+		objs = append(objs, &secretList.Items[i])
+	}
+
+	vscList, err := listVolumeSnapshotContents(ctx, c, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list volumesnapshotcontents")
+	}
+	for i := range vscList.Items {
+		objs = append(objs, &vscList.Items[i])
+	}
+	return objs, nil
+}
+
+func ownedByAny(obj client.Object, owners map[types.UID]bool) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if owners[ref.UID] {
+			return true
+		}
+	}
+	return false
+}
+
+// createDeleteBackupRequest asks Velero to delete the backup. Deleting the
+// Backup object directly would leave its data in object storage, and the
+// backup sync controller would then recreate it.
+func createDeleteBackupRequest(ctx context.Context, c client.Client, veleroNamespace, name string) error {
+	dbr := velerov1.DeleteBackupRequest{}
+	dbr.GenerateName = name + "-"
+	dbr.Namespace = veleroNamespace
+	dbr.Labels = map[string]string{
+		"perf-test":              name,
+		velerov1.BackupNameLabel: name,
+	}
+	dbr.Spec.BackupName = name
+	err := c.Create(ctx, &dbr)
+	if err != nil {
+		return errors.Wrap(err, "failed to create deletebackuprequest")
+	}
+	return nil
+}
+
+func deleteObject(ctx context.Context, c client.Client, obj client.Object) error {
+	err := c.Delete(ctx, obj)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete %s", describeObject(c, obj))
+	}
+	return nil
+}
+
+// describeObject formats obj as kind namespace/name for log output.
+func describeObject(c client.Client, obj client.Object) string {
+	kind := "object"
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err == nil {
+		kind = gvk.Kind
+	}
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%s %s", kind, obj.GetName())
+	}
+	return fmt.Sprintf("%s %s/%s", kind, obj.GetNamespace(), obj.GetName())
+}
@@ -0,0 +1,299 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+)
+
+// Clouds whose snapshots can be verified.
+const (
+	// cloudAWS verifies EBS snapshots with the EC2 DescribeSnapshots API.
+	cloudAWS = "aws"
+	// cloudAzure verifies Managed Disk snapshots with the Azure Resource
+	// Manager API.
+	cloudAzure = "azure"
+	// cloudGCP verifies Persistent Disk snapshots with the Compute Engine
+	// API.
+	cloudGCP = "gcp"
+)
+
+const (
+	// cloudPollInterval is how often the cloud is asked for the progress
+	// of the snapshots while waiting for the VSCs.
+	cloudPollInterval = 30 * time.Second
+	// cloudConcurrency bounds the requests made at once to clouds whose
+	// API describes a single snapshot per request.
+	cloudConcurrency = 10
+)
+
+// CloudSnapshot is what a cloud reports about the snapshot behind the
+// snapshotHandle of a VSC.
+type CloudSnapshot struct {
+	// State is the state of the snapshot in the terms of the cloud.
+	State string
+	// Progress is how much of the snapshot is done, such as 80%, empty if
+	// the cloud does not say.
+	Progress string
+	// Message explains the state, when the cloud gives a reason.
+	Message string
+	// Completed is set once the snapshot is usable.
+	Completed bool
+}
+
+// SnapshotVerifier looks up the snapshots CSI drivers took in the cloud they
+// were taken in, so a VSC reported ready is known to be backed by a usable
+// snapshot.
+type SnapshotVerifier interface {
+	// Name identifies the cloud in logs.
+	Name() string
+	// Describe returns what the cloud reports about the snapshots of
+	// handles, keyed by handle, leaving out those it does not know.
+	Describe(ctx context.Context, handles []string) (map[string]CloudSnapshot, error)
+}
+
+// snapshotVerifiers creates the verifier of each cloud of --cloud-verify.
+var snapshotVerifiers = map[string]func(ctx context.Context) (SnapshotVerifier, error){
+	cloudAWS:   newEBSVerifier,
+	cloudAzure: newAzureDiskVerifier,
+	cloudGCP:   newGCPDiskVerifier,
+}
+
+// newSnapshotVerifier creates the verifier of cloud.
+func newSnapshotVerifier(ctx context.Context, cloud string) (SnapshotVerifier, error) {
+	factory, ok := snapshotVerifiers[cloud]
+	if !ok {
+		return nil, errors.Errorf("unknown cloud-verify %q, must be one of %s", cloud, strings.Join(snapshotVerifierNames(), ", "))
+	}
+	return factory(ctx)
+}
+
+func snapshotVerifierNames() []string {
+	names := make([]string, 0, len(snapshotVerifiers))
+	for name := range snapshotVerifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// describeEach describes the snapshots of handles with up to cloudConcurrency
+// calls of describe at once, for clouds without a batch API. describe
+// returns false for snapshots the cloud does not know.
+func describeEach(ctx context.Context, handles []string, describe func(ctx context.Context, handle string) (CloudSnapshot, bool, error)) (map[string]CloudSnapshot, error) {
+	var mu sync.Mutex
+	snapshots := map[string]CloudSnapshot{}
+	var firstErr error
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < cloudConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for handle := range jobs {
+				s, ok, err := describe(ctx, handle)
+				mu.Lock()
+				switch {
+				case err != nil && firstErr == nil:
+					firstErr = err
+				case ok:
+					snapshots[handle] = s
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, handle := range handles {
+		jobs <- handle
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return snapshots, nil
+}
+
+// snapshotHandles returns the VSCs of vscs that have a snapshotHandle, keyed
+// by it.
+func snapshotHandles(vscs []v1.VolumeSnapshotContent) map[string]*v1.VolumeSnapshotContent {
+	handles := map[string]*v1.VolumeSnapshotContent{}
+	for i := range vscs {
+		vsc := &vscs[i]
+		if vsc.Status == nil || vsc.Status.SnapshotHandle == nil || *vsc.Status.SnapshotHandle == "" {
+			continue
+		}
+		handles[*vsc.Status.SnapshotHandle] = vsc
+	}
+	return handles
+}
+
+// recordCloudSnapshots asks the cloud about the snapshots of vscs and
+// records what it reports in the results. Snapshots already seen completed
+// are not asked about again. It returns how many snapshots are completed and
+// pending.
+func recordCloudSnapshots(ctx context.Context, verifier SnapshotVerifier, vscs []v1.VolumeSnapshotContent, results *runResults) (int, int, error) {
+	handles := snapshotHandles(vscs)
+	completed, pending := 0, 0
+	ids := make([]string, 0, len(handles))
+	for id, vsc := range handles {
+		if results.cloudSnapshotCompleted(vsc.Name) {
+			completed++
+			continue
+		}
+		ids = append(ids, id)
+	}
+	snapshots, err := verifier.Describe(ctx, ids)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, id := range ids {
+		vsc := handles[id]
+		s, ok := snapshots[id]
+		results.cloudSnapshot(vsc.Name, vsc.Spec.VolumeSnapshotRef.Namespace, id, s)
+		if s.Completed {
+			completed++
+		} else if ok {
+			pending++
+		}
+	}
+	return completed, pending, nil
+}
+
+// watchCloudSnapshots records the progress the cloud reports for the
+// snapshots of the run every cloudPollInterval until ctx is done, logging it
+// whenever it changes. Failing to reach the cloud is only logged.
+func watchCloudSnapshots(ctx context.Context, verifier SnapshotVerifier, w *runWatcher, name string, results *runResults) {
+	ticker := time.NewTicker(cloudPollInterval)
+	defer ticker.Stop()
+	lastCompleted, lastPending := -1, -1
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		vscList, err := listVolumeSnapshotContents(ctx, w.cache, name)
+		if err != nil {
+			continue
+		}
+		completed, pending, err := recordCloudSnapshots(ctx, verifier, vscList.Items, results)
+		if err != nil {
+			if ctx.Err() == nil {
+				loggerFrom(ctx).Warnw("failed to get the progress of the cloud snapshots", "phase", phaseSnapshot, "cloud", verifier.Name(), "error", err)
+			}
+			continue
+		}
+		if completed != lastCompleted || pending != lastPending {
+			loggerFrom(ctx).Infow("cloud snapshots", "phase", phaseSnapshot, "cloud", verifier.Name(), "completed", completed, "pending", pending, "progress", results.meanCloudProgress())
+			lastCompleted, lastPending = completed, pending
+		}
+	}
+}
+
+// verifyCloudSnapshots checks that the snapshot behind every VSC of vscs
+// exists and is completed in the cloud, so a VSC reported ready by its CSI
+// driver is known to be backed by a usable snapshot.
+func verifyCloudSnapshots(ctx context.Context, verifier SnapshotVerifier, vscs []v1.VolumeSnapshotContent, results *runResults) error {
+	_, _, err := recordCloudSnapshots(ctx, verifier, vscs, results)
+	if err != nil {
+		return err
+	}
+	bad := results.unverifiedCloudSnapshots()
+	for _, v := range bad {
+		loggerFrom(ctx).Errorw("cloud snapshot is not completed", "phase", phaseSnapshot, "cloud", verifier.Name(), "namespace", v.Namespace, "vsc", v.VolumeSnapshotContent, "snapshot", v.CloudSnapshotID, "state", v.CloudSnapshotState, "progress", v.CloudSnapshotProgress)
+	}
+	if len(bad) > 0 {
+		return errors.Errorf("%d of %d snapshots are not completed in %s", len(bad), len(snapshotHandles(vscs)), verifier.Name())
+	}
+	loggerFrom(ctx).Infow("cloud snapshots verified", "phase", phaseSnapshot, "cloud", verifier.Name(), "count", len(snapshotHandles(vscs)))
+	return nil
+}
+
+// cloudSnapshot records what the cloud reports about the snapshot of the VSC,
+// whose snapshotHandle is id.
+func (r *runResults) cloudSnapshot(vscName, namespace, id string, s CloudSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	if v.Namespace == "" {
+		v.Namespace = namespace
+	}
+	v.CloudSnapshotID = id
+	v.CloudSnapshotState = s.State
+	v.CloudSnapshotProgress = s.Progress
+	v.CloudSnapshotMessage = s.Message
+	v.CloudSnapshotCompleted = s.Completed
+}
+
+// cloudSnapshotCompleted reports whether the cloud was seen to complete the
+// snapshot of the VSC.
+func (r *runResults) cloudSnapshotCompleted(vscName string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, ok := r.volumes[vscName]
+	return ok && v.CloudSnapshotCompleted
+}
+
+// unverifiedCloudSnapshots returns the volumes whose snapshot the cloud
+// does not report as completed, missing ones included.
+func (r *runResults) unverifiedCloudSnapshots() []volumeResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	volumes := []volumeResult{}
+	for _, v := range r.Volumes {
+		if v.CloudSnapshotID != "" && !v.CloudSnapshotCompleted {
+			volumes = append(volumes, *v)
+		}
+	}
+	return volumes
+}
+
+// meanCloudProgress returns the mean progress the cloud reports for the
+// snapshots of the run, such as 80%, counting completed snapshots as 100%.
+func (r *runResults) meanCloudProgress() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total, count := 0, 0
+	for _, v := range r.Volumes {
+		if v.CloudSnapshotID == "" {
+			continue
+		}
+		percent, err := strconv.Atoi(strings.TrimSuffix(v.CloudSnapshotProgress, "%"))
+		switch {
+		case v.CloudSnapshotCompleted:
+			percent = 100
+		case err != nil:
+			continue
+		}
+		total += percent
+		count++
+	}
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d%%", total/count)
+}
+
+// cloudSnapshotCounts returns how many snapshots of r were checked with the
+// cloud and how many of those were not completed.
+func cloudSnapshotCounts(r *runResults) (int, int) {
+	checked, unverified := 0, 0
+	for _, v := range r.Volumes {
+		if v.CloudSnapshotID == "" {
+			continue
+		}
+		checked++
+		if !v.CloudSnapshotCompleted {
+			unverified++
+		}
+	}
+	return checked, unverified
+}
@@ -0,0 +1,290 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// modeCSI takes CSI snapshots without moving their data, the baseline
+	// the data movers are compared against.
+	modeCSI = "csi"
+	// modeFS backs volumes up with restic PodVolumeBackups instead of
+	// snapshots.
+	modeFS = "fs"
+)
+
+type compareOptions struct {
+	*rootOptions
+	namespaces       string
+	namespacesFile   string
+	modes            string
+	resticSecretName string
+	concurrency      int
+	schedule         string
+	output           string
+	cleanup          bool
+	skipPreflight    bool
+}
+
+// comparison is the outcome of running the namespaces through one mode.
+type comparison struct {
+	mode    string
+	results *runResults
+	err     error
+}
+
+func newCompareCommand(root *rootOptions) *cobra.Command {
+	o := &compareOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "compare",
+		Short: "Back up the same namespaces through several backup paths and compare their timings",
+		Long: `Back up the same namespaces through each of the given modes in turn and
+print a table of snapshot, transfer and total time per mode. The modes are
+csi (CSI snapshots only), vsm (OADP 1.2 volsync data mover), native (Velero
+1.12+ built-in data mover) and fs (restic PodVolumeBackups).`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd.Context(), cmd.Flags())
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.namespaces, "namespaces", "", "comma separated list of namespaces to backup")
+	flags.StringVar(&o.namespacesFile, "namespaces-file", "", "path to a file listing namespaces to backup, one per line")
+	flags.StringVar(&o.modes, "modes", strings.Join([]string{modeCSI, moverVSM, moverNative, modeFS}, ","), "comma separated list of modes to run, in order")
+	flags.StringVar(&o.resticSecretName, "restic-secret", defaultResticSecretName, "name of restic secret for volsync to use in vsm mode, <dpa-name>-volsync-restic of the DataProtectionApplication if not set")
+	flags.IntVar(&o.concurrency, "concurrency", defaultConcurrency, "number of concurrent volumesnapshotbackups to run in vsm mode, maxConcurrentBackupVolumes of the DataProtectionApplication if it is set")
+	flags.StringVar(&o.schedule, "schedule", scheduleWindow, "how volumesnapshotbackups are scheduled in vsm mode, window or batch")
+	flags.StringVar(&o.output, "output", "", "also write the results of each mode in this format, json, csv or junit")
+	flags.BoolVar(&o.cleanup, "cleanup", true, "delete the resources of each mode before starting the next")
+	flags.BoolVar(&o.skipPreflight, "skip-preflight", false, "do not run the preflight checks before the vsm and native modes")
+	return cmd
+}
+
+func (o *compareOptions) parseModes() ([]string, error) {
+	modes := []string{}
+	for _, mode := range strings.Split(o.modes, ",") {
+		mode = strings.TrimSpace(mode)
+		switch mode {
+		case modeCSI, moverVSM, moverNative, modeFS:
+			modes = append(modes, mode)
+		case "":
+		default:
+			return nil, errors.Errorf("unknown mode %q, must be one of %s, %s, %s or %s", mode, modeCSI, moverVSM, moverNative, modeFS)
+		}
+	}
+	if len(modes) == 0 {
+		return nil, errors.New("missing modes")
+	}
+	return modes, nil
+}
+
+func (o *compareOptions) run(ctx context.Context, flags *pflag.FlagSet) error {
+	modes, err := o.parseModes()
+	if err != nil {
+		return err
+	}
+	if o.concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if o.output != "" && o.output != outputJSON && o.output != outputCSV && o.output != outputJUnit {
+		return errors.Errorf("unknown output format %q, must be one of %s, %s or %s", o.output, outputJSON, outputCSV, outputJUnit)
+	}
+	namespaces, err := parseNamespaces(o.namespaces, o.namespacesFile)
+	if err != nil {
+		return err
+	}
+	c, err := o.client(ctx)
+	if err != nil {
+		return err
+	}
+	err = o.resolveVeleroNamespace(ctx, c)
+	if err != nil {
+		return err
+	}
+	resticSecretName, concurrency := unsetFlags(flags, &o.resticSecretName, &o.concurrency)
+	err = o.applyDPADefaults(ctx, c, resticSecretName, concurrency, false)
+	if err != nil {
+		return err
+	}
+	err = validateNamespaces(ctx, c, namespaces)
+	if err != nil {
+		return err
+	}
+
+	comparisons := []comparison{}
+	base := loggerFrom(ctx)
+	for _, mode := range modes {
+		ctx := withLogger(ctx, base.With("mode", mode))
+		loggerFrom(ctx).Infow("starting mode")
+		results, err := o.runMode(ctx, c, mode, namespaces)
+		if err != nil {
+			loggerFrom(ctx).Errorw("mode failed", "error", err)
+		}
+		comparisons = append(comparisons, comparison{mode: mode, results: results, err: err})
+		if o.output != "" && results != nil && results.Backup != "" {
+			path := fmt.Sprintf("results-%s.%s", results.Backup, resultsExtension(o.output))
+			err := results.write(o.output, path)
+			if err != nil {
+				loggerFrom(ctx).Errorw("failed to write results", "error", err)
+			} else {
+				loggerFrom(ctx).Infow("results written", "path", path)
+			}
+		}
+
+		if o.cleanup && results != nil && results.Backup != "" {
+			err := cleanupRun(ctx, c, o.veleroNamespace, results.Backup, false)
+			if err != nil {
+				loggerFrom(ctx).Errorw("failed to clean up", "error", err)
+			}
+		}
+	}
+
+	printComparison(comparisons)
+	return nil
+}
+
+// runMode backs up namespaces through mode and returns its results, which
+// are non-nil on failure as long as a backup was created.
+func (o *compareOptions) runMode(ctx context.Context, c client.Client, mode string, namespaces []string) (*runResults, error) {
+	switch mode {
+	case modeCSI:
+		return runCSIBackup(ctx, c, o.veleroNamespace, namespaces)
+	case modeFS:
+		return runFSBackup(ctx, c, o.veleroNamespace, namespaces)
+	}
+
+	b := newBackupOptions(o.rootOptions)
+	b.resticSecretName = o.resticSecretName
+	b.namespaces = strings.Join(namespaces, ",")
+	b.concurrency = o.concurrency
+	b.schedule = o.schedule
+	b.mover = mode
+	if !o.skipPreflight {
+		err := runPreflight(ctx, c, o.veleroNamespace, o.resticSecretName, mode, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.backup(ctx, c)
+}
+
+// runCSIBackup times a plain CSI snapshot backup. The snapshots are ready
+// once the backup completes, and no data is moved.
+func runCSIBackup(ctx context.Context, c client.Client, veleroNamespace string, namespaces []string) (*runResults, error) {
+	results := newRunResults(namespaces, 0, "")
+	results.Mover = modeCSI
+	name, err := createBackup(ctx, c, veleroNamespace, defaultNamePrefix, namespaces, false, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create backup")
+	}
+	results.Backup = name
+	loggerFrom(ctx).Infow("backup created", "run", name)
+
+	err = waitForBackupToComplete(ctx, c, veleroNamespace, name)
+	if err != nil {
+		return results, err
+	}
+	now := time.Now()
+	results.snapshotsDone(now)
+	results.dataMoverDone(now)
+
+	vscList, err := listVolumeSnapshotContents(ctx, c, name)
+	if err != nil {
+		return results, errors.Wrap(err, "failed to list volumesnapshotcontents")
+	}
+	for _, vsc := range vscList.Items {
+		var size int64
+		var ready time.Time
+		if vsc.Status != nil && vsc.Status.RestoreSize != nil {
+			size = *vsc.Status.RestoreSize
+		}
+		if vsc.Status != nil && vsc.Status.CreationTime != nil {
+			ready = time.Unix(0, *vsc.Status.CreationTime)
+		}
+		results.vscReady(vsc.Name, vsc.Spec.VolumeSnapshotRef.Namespace, size, ready)
+	}
+	return results, nil
+}
+
+// runFSBackup times a file system backup where every volume is copied by a
+// restic PodVolumeBackup. No snapshots are taken, so all of the time counts
+// as transfer time.
+func runFSBackup(ctx context.Context, c client.Client, veleroNamespace string, namespaces []string) (*runResults, error) {
+	results := newRunResults(namespaces, 0, "")
+	results.Mover = modeFS
+	results.snapshotsDone(results.StartTime)
+
+	defaultVolumesToFsBackup := true
+	b := velerov1.Backup{}
+	b.Name = newRunName(defaultNamePrefix, time.Now())
+	b.Namespace = veleroNamespace
+	b.Spec.IncludedNamespaces = namespaces
+	b.Spec.DefaultVolumesToFsBackup = &defaultVolumesToFsBackup
+	err := c.Create(ctx, &b)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create backup")
+	}
+	results.Backup = b.Name
+	loggerFrom(ctx).Infow("backup created", "run", b.Name)
+
+	err = waitForBackupToComplete(ctx, c, veleroNamespace, b.Name)
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for backup to complete", "phase", phaseBackup)
+		}
+		return results, err
+	}
+	results.dataMoverDone(time.Now())
+
+	pvbList := velerov1.PodVolumeBackupList{}
+	err = c.List(ctx, &pvbList, client.InNamespace(veleroNamespace), client.MatchingLabels{velerov1.BackupNameLabel: b.Name})
+	if err != nil {
+		return results, errors.Wrap(err, "failed to list podvolumebackups")
+	}
+	for _, pvb := range pvbList.Items {
+		if pvb.Status.StartTimestamp == nil {
+			continue
+		}
+		results.transferStarted(pvb.Name, pvb.Spec.Pod.Namespace, pvb.Status.Progress.TotalBytes, pvb.Status.StartTimestamp.Time)
+		switch {
+		case pvb.Status.Phase == velerov1.PodVolumeBackupPhaseFailed:
+			results.transferFailed(pvb.Name, errors.Errorf("podvolumebackup failed: %s", pvb.Status.Message))
+		case pvb.Status.CompletionTimestamp != nil:
+			results.bytesTransferred(pvb.Name, pvb.Status.Progress.BytesDone)
+			results.vsbCompleted(pvb.Name, pvb.Spec.Volume, "", pvb.Status.CompletionTimestamp.Time)
+		}
+	}
+	return results, nil
+}
+
+// printComparison prints a table with one row per mode.
+func printComparison(comparisons []comparison) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MODE\tBACKUP\tVOLUMES\tSNAPSHOT TIME\tTRANSFER TIME\tTOTAL TIME\tERROR")
+	for _, cmp := range comparisons {
+		backup, volumes := "", 0
+		var snapshot, transfer, total time.Duration
+		if cmp.results != nil {
+			backup = cmp.results.Backup
+			volumes = len(cmp.results.Volumes)
+			snapshot, transfer, total = cmp.results.SnapshotTime, cmp.results.DataMoverTime, cmp.results.TotalTime
+		}
+		errMsg := ""
+		if cmp.err != nil {
+			errMsg = cmp.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%v\t%v\t%v\t%s\n", cmp.mode, backup, volumes, snapshot.Round(time.Second), transfer.Round(time.Second), total.Round(time.Second), errMsg)
+	}
+	w.Flush()
+}
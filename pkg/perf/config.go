@@ -0,0 +1,90 @@
+package perf
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// applyConfigFile sets the flags of a command from the YAML file at path,
+// which maps flag names to values, so a run can be specified in a file that
+// is kept and reviewed alongside its results. Lists are joined with commas,
+// except for repeatable flags which are given each item in turn.
+// Flags given on the command line keep their value, and keys that are not
+// flags of the command are an error so typos do not go unnoticed.
+func applyConfigFile(flags *pflag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read config %s", path)
+	}
+	values := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse config %s", path)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		switch {
+		case name == "config":
+			return errors.Errorf("config %s cannot name another config", path)
+		case flag == nil:
+			return errors.Errorf("unknown flag %q in config %s", name, path)
+		case flag.Changed:
+			continue
+		}
+		items := []interface{}{values[name]}
+		// Each item of a repeatable flag is a value of its own, since
+		// they may contain commas.
+		if list, ok := values[name].([]interface{}); ok && flag.Value.Type() == "stringArray" {
+			items = list
+		}
+		for _, item := range items {
+			value, err := configValue(item)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s in config %s", name, path)
+			}
+			err = flags.Set(name, value)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s in config %s", name, path)
+			}
+		}
+	}
+	return nil
+}
+
+// configValue returns the flag value of a config file value.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", errors.New("must be a value or a list of values")
+	case float64:
+		// JSON numbers, which YAML ones are converted to, are floats
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
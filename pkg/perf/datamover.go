@@ -0,0 +1,113 @@
+package perf
+
+import (
+	"context"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	vsbGroupKind = dmv1.GroupVersion.WithKind("VolumeSnapshotBackup").GroupKind()
+	vsrGroupKind = dmv1.GroupVersion.WithKind("VolumeSnapshotRestore").GroupKind()
+)
+
+// servedDataMoverVersion returns the version of the data mover API the
+// cluster serves among groups. The tool is built against v1alpha1 and uses it
+// whenever it is served; once the API graduates and v1alpha1 is dropped, the
+// preferred version the cluster serves is used instead. Without the data
+// mover installed it falls back to v1alpha1 and leaves preflight to report
+// it.
+func servedDataMoverVersion(ctx context.Context, groups *metav1.APIGroupList) schema.GroupVersion {
+	for _, group := range groups.Groups {
+		if group.Name != dmv1.GroupVersion.Group {
+			continue
+		}
+		for _, version := range group.Versions {
+			if version.Version == dmv1.GroupVersion.Version {
+				return dmv1.GroupVersion
+			}
+		}
+		if group.PreferredVersion.Version == "" {
+			break
+		}
+		gv := schema.GroupVersion{Group: group.Name, Version: group.PreferredVersion.Version}
+		loggerFrom(ctx).Infow("data mover does not serve its built in API version, using the version it prefers", "builtIn", dmv1.GroupVersion.Version, "served", gv.Version)
+		return gv
+	}
+	return dmv1.GroupVersion
+}
+
+// addDataMoverToScheme registers the VolumeSnapshotBackup and
+// VolumeSnapshotRestore types under gv, the version the cluster serves. They
+// are only registered under that one version, so the client reads and writes
+// them in it, relying on the fields the tool uses carrying over between
+// versions as they do for graduations of an API.
+func addDataMoverToScheme(scheme *runtime.Scheme, gv schema.GroupVersion) error {
+	if gv == dmv1.GroupVersion {
+		return dmv1.AddToScheme(scheme)
+	}
+	scheme.AddKnownTypes(gv,
+		&dmv1.VolumeSnapshotBackup{}, &dmv1.VolumeSnapshotBackupList{},
+		&dmv1.VolumeSnapshotRestore{}, &dmv1.VolumeSnapshotRestoreList{})
+	metav1.AddToGroupVersion(scheme, gv)
+	return nil
+}
+
+// kindServed reports whether the API server serves gk, that is whether its
+// CRD is installed.
+func kindServed(c client.Client, gk schema.GroupKind) (bool, error) {
+	_, err := c.RESTMapper().RESTMapping(gk)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to look up %s", gk)
+	}
+	return true, nil
+}
+
+// fallBackWithoutDataMover adapts a run of mover vsm to a cluster that does
+// not serve VolumeSnapshotBackups, such as OADP 1.3 and later which dropped
+// the VolumeSnapshotMover, rather than failing on the first list of them.
+// The run falls back to mover native when Velero serves DataUploads and to
+// snapshot-only otherwise, as long as its other flags allow it. A mover that
+// was set explicitly is not second guessed.
+func (o *backupOptions) fallBackWithoutDataMover(ctx context.Context, c client.Client, moverSet bool) error {
+	if o.mover != moverVSM || o.snapshotOnly {
+		return nil
+	}
+	served, err := kindServed(c, vsbGroupKind)
+	if err != nil || served {
+		return err
+	}
+	if moverSet {
+		return errors.Errorf("%s is not served by the cluster, install the OADP operator with the data mover", vsbGroupKind)
+	}
+	native, err := kindServed(c, dataUploadGVK.GroupKind())
+	if err != nil {
+		return err
+	}
+	fallback := "snapshot-only"
+	if native {
+		fallback = "mover " + moverNative
+		o.mover = moverNative
+	} else {
+		o.snapshotOnly = true
+	}
+	err = o.validate()
+	if err != nil {
+		return errors.Wrapf(err, "%s is not served by the cluster and the run cannot fall back to %s", vsbGroupKind, fallback)
+	}
+	if native {
+		loggerFrom(ctx).Warnw("VolumeSnapshotBackups are not served by the cluster, falling back to the data mover built into Velero", "mover", o.mover)
+	} else {
+		loggerFrom(ctx).Warnw("neither VolumeSnapshotBackups nor DataUploads are served by the cluster, falling back to snapshot-only: only the snapshot time is measured", "snapshotOnly", true)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// deletionTimeout bounds how long deleteRun waits for Velero to delete the
+// backup and for its snapshots to be garbage collected.
+const deletionTimeout = 60 * time.Minute
+
+// deletionResult times the deletion of the backup of a run and the garbage
+// collection of its snapshots.
+type deletionResult struct {
+	RequestTime time.Time `json:"requestTime"`
+	// BackupDeletedTime is when the Backup object was gone.
+	BackupDeletedTime time.Time `json:"backupDeletedTime"`
+	// SnapshotsDeletedTime is when the last VSC of the backup was gone. The
+	// VSCs have the Delete deletionPolicy, so the storage snapshot of each
+	// is deleted before the VSC is.
+	SnapshotsDeletedTime   time.Time     `json:"snapshotsDeletedTime"`
+	BackupDeletionTime     time.Duration `json:"backupDeletionTime,omitempty"`
+	SnapshotGCTime         time.Duration `json:"snapshotGCTime,omitempty"`
+	VolumeSnapshotContents int           `json:"volumeSnapshotContents"`
+}
+
+func (d *deletionResult) summary() string {
+	return fmt.Sprintf("backup deleted in %v, %d snapshots deleted in %v", d.BackupDeletionTime.Round(time.Second), d.VolumeSnapshotContents, d.SnapshotGCTime.Round(time.Second))
+}
+
+// deleteRun removes the data mover resources of the run, then deletes its
+// backup with a DeleteBackupRequest and waits for both the Backup and its
+// VSCs to be gone, recording how long each took in results.
+func (o *backupOptions) deleteRun(ctx context.Context, c client.Client, results *runResults) error {
+	name := results.Backup
+	if o.mover == moverVSM {
+		err := clearDataMover(ctx, c, o.veleroNamespace, name)
+		if err != nil {
+			return err
+		}
+	}
+	vscs, err := countVolumeSnapshotContents(ctx, c, name)
+	if err != nil {
+		return err
+	}
+
+	d := &deletionResult{RequestTime: time.Now(), VolumeSnapshotContents: vscs}
+	err = createDeleteBackupRequest(ctx, c, o.veleroNamespace, name)
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Infow("requested deletion of backup", "phase", phaseDeletion, "volumeSnapshotContents", d.VolumeSnapshotContents)
+
+	lastRemaining := -1
+	err = wait.PollImmediateWithContext(ctx, 5*time.Second, deletionTimeout, func(ctx context.Context) (bool, error) {
+		now := time.Now()
+		if d.BackupDeletedTime.IsZero() {
+			backup := velerov1.Backup{}
+			err := c.Get(ctx, types.NamespacedName{Namespace: o.veleroNamespace, Name: name}, &backup)
+			switch {
+			case apierrors.IsNotFound(err):
+				d.BackupDeletedTime = now
+				d.BackupDeletionTime = now.Sub(d.RequestTime)
+				loggerFrom(ctx).Infow("backup deleted", "phase", phaseDeletion, "elapsed", d.BackupDeletionTime.String())
+			case err != nil:
+				return false, errors.Wrap(err, "failed to get backup")
+			}
+		}
+		if d.SnapshotsDeletedTime.IsZero() {
+			remaining, err := countVolumeSnapshotContents(ctx, c, name)
+			if err != nil {
+				return false, err
+			}
+			if remaining == 0 {
+				d.SnapshotsDeletedTime = now
+				d.SnapshotGCTime = now.Sub(d.RequestTime)
+				loggerFrom(ctx).Infow("snapshots deleted", "phase", phaseDeletion, "elapsed", d.SnapshotGCTime.String())
+			} else if remaining != lastRemaining {
+				loggerFrom(ctx).Infow("waiting for snapshots to be deleted", "phase", phaseDeletion, "remaining", remaining, "total", d.VolumeSnapshotContents)
+				lastRemaining = remaining
+			}
+		}
+		return !d.BackupDeletedTime.IsZero() && !d.SnapshotsDeletedTime.IsZero(), nil
+	})
+	results.mu.Lock()
+	results.Deletion = d
+	results.mu.Unlock()
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for the backup and its snapshots to be deleted", "phase", phaseDeletion)
+		}
+		return err
+	}
+	return o.writeResults(ctx, results)
+}
@@ -0,0 +1,242 @@
+package perf
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// errNoSnapshots is returned by waitForVSCsToBeReady when the backup has had
+// no volumesnapshotcontents for longer than the no-snapshots timeout.
+var errNoSnapshots = errors.New("the backup has no volumesnapshotcontents")
+
+// maxFindings bounds how many findings a diagnosis lists, so a run over
+// thousands of namespaces does not print a finding per PVC.
+const maxFindings = 20
+
+// veleroLogLines is how many lines at the end of the velero container log
+// are searched for the errors of the backup, of which the last
+// maxLogFindings are reported.
+var veleroLogLines = int64(5000)
+
+const maxLogFindings = 5
+
+// diagnoseNoSnapshots works out why the backup called name has no
+// volumesnapshotcontents and returns an error listing what was found. The
+// backup status, the CSI setup of the Velero deployment, the VolumeSnapshots
+// of the backup, the PVCs of its namespaces and the velero log are looked at.
+func (o *backupOptions) diagnoseNoSnapshots(ctx context.Context, c client.Client, name string) error {
+	loggerFrom(ctx).Errorw("no snapshots were created, diagnosing", "phase", phaseSnapshot, "waited", o.noSnapshotsTimeout.String())
+	findings := []string{}
+	backup := velerov1.Backup{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: o.veleroNamespace, Name: name}, &backup)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get backup %s", name)
+	}
+	findings = append(findings, diagnoseBackup(&backup)...)
+	findings = append(findings, diagnoseVeleroDeployment(ctx, c, o.veleroNamespace)...)
+	findings = append(findings, diagnoseVolumeSnapshots(ctx, c, name, backup.Spec.IncludedNamespaces)...)
+	clientset, err := o.clientset()
+	if err == nil {
+		findings = append(findings, diagnoseVeleroLog(ctx, c, clientset, o.veleroNamespace, name)...)
+	}
+	findings = append(findings, diagnosePVCs(ctx, c, backup.Spec.IncludedNamespaces)...)
+	if len(findings) == 0 {
+		findings = append(findings, "nothing obviously wrong was found, check the velero log and the CSI driver")
+	}
+	if len(findings) > maxFindings {
+		findings = append(findings[:maxFindings], fmt.Sprintf("and %d more", len(findings)-maxFindings))
+	}
+	for _, finding := range findings {
+		loggerFrom(ctx).Errorw("no snapshots diagnosis", "phase", phaseSnapshot, "finding", finding)
+	}
+	return errors.Wrapf(errNoSnapshots, "after %v: %s", o.noSnapshotsTimeout, strings.Join(findings, "; "))
+}
+
+func diagnoseBackup(backup *velerov1.Backup) []string {
+	findings := []string{}
+	if backup.Spec.SnapshotVolumes != nil && !*backup.Spec.SnapshotVolumes {
+		findings = append(findings, "the backup has snapshotVolumes false")
+	}
+	if backup.Spec.DefaultVolumesToFsBackup != nil && *backup.Spec.DefaultVolumesToFsBackup {
+		findings = append(findings, "the backup has defaultVolumesToFsBackup true, so pod volumes are backed up with the file system backup")
+	}
+	status := backup.Status
+	if status.Phase != velerov1.BackupPhaseCompleted {
+		findings = append(findings, fmt.Sprintf("the backup is %s with %d errors and %d warnings", status.Phase, status.Errors, status.Warnings))
+	}
+	if status.CSIVolumeSnapshotsAttempted == 0 && status.VolumeSnapshotsAttempted > 0 {
+		findings = append(findings, fmt.Sprintf("Velero took %d snapshots with a volume snapshot location plugin and none with CSI", status.VolumeSnapshotsAttempted))
+	}
+	if status.CSIVolumeSnapshotsAttempted > 0 {
+		findings = append(findings, fmt.Sprintf("Velero attempted %d CSI snapshots, %d completed", status.CSIVolumeSnapshotsAttempted, status.CSIVolumeSnapshotsCompleted))
+	}
+	return findings
+}
+
+// diagnoseVeleroDeployment checks Velero runs with the CSI plugin and the
+// EnableCSI feature, which the DPA sets when csi is one of its default
+// plugins.
+func diagnoseVeleroDeployment(ctx context.Context, c client.Client, veleroNamespace string) []string {
+	deployment := appsv1.Deployment{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: "velero"}, &deployment)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to get the velero deployment: %v", err)}
+	}
+	findings := []string{}
+	plugin := false
+	for _, container := range deployment.Spec.Template.Spec.InitContainers {
+		if strings.Contains(container.Image, "velero-plugin-for-csi") {
+			plugin = true
+		}
+	}
+	if !plugin {
+		findings = append(findings, "the velero deployment has no velero-plugin-for-csi init container, add csi to the defaultPlugins of the DPA")
+	}
+	csi := false
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		for _, arg := range container.Args {
+			if strings.HasPrefix(arg, "--features=") && strings.Contains(arg, "EnableCSI") {
+				csi = true
+			}
+		}
+	}
+	if !csi {
+		findings = append(findings, "velero does not run with --features=EnableCSI, add EnableCSI to the featureFlags of the DPA")
+	}
+	return findings
+}
+
+// diagnoseVolumeSnapshots reports the VolumeSnapshots of the backup that
+// failed or have no content.
+func diagnoseVolumeSnapshots(ctx context.Context, c client.Client, name string, namespaces []string) []string {
+	findings := []string{}
+	count := 0
+	for _, ns := range namespaces {
+		list := v1.VolumeSnapshotList{}
+		err := listAll(ctx, c, &list, client.InNamespace(ns), client.MatchingLabels{"velero.io/backup-name": name})
+		if err != nil {
+			return append(findings, fmt.Sprintf("failed to list volumesnapshots: %v", err))
+		}
+		count += len(list.Items)
+		for _, vs := range list.Items {
+			switch {
+			case vs.Status != nil && vs.Status.Error != nil && vs.Status.Error.Message != nil:
+				findings = append(findings, fmt.Sprintf("VolumeSnapshot %s/%s failed: %s", vs.Namespace, vs.Name, *vs.Status.Error.Message))
+			case vs.Status == nil || vs.Status.BoundVolumeSnapshotContentName == nil:
+				findings = append(findings, fmt.Sprintf("VolumeSnapshot %s/%s has no volumesnapshotcontent, is the snapshot controller running?", vs.Namespace, vs.Name))
+			}
+		}
+	}
+	if count == 0 {
+		findings = append(findings, "the backup created no VolumeSnapshots")
+	}
+	return findings
+}
+
+// diagnosePVCs reports the namespaces without PVCs and the PVCs CSI cannot
+// snapshot for Velero: those not bound, those of in-tree provisioners and
+// those of drivers without a VolumeSnapshotClass labeled for Velero.
+func diagnosePVCs(ctx context.Context, c client.Client, namespaces []string) []string {
+	classes := v1.VolumeSnapshotClassList{}
+	err := c.List(ctx, &classes, client.MatchingLabels{volumeSnapshotClassLabel: "true"})
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list volumesnapshotclasses: %v", err)}
+	}
+	drivers := map[string]bool{}
+	for _, class := range classes.Items {
+		drivers[class.Driver] = true
+	}
+	provisioners := map[string]string{}
+
+	findings := []string{}
+	for _, ns := range namespaces {
+		pvcs := corev1.PersistentVolumeClaimList{}
+		err := listAll(ctx, c, &pvcs, client.InNamespace(ns))
+		if err != nil {
+			return append(findings, fmt.Sprintf("failed to list PVCs: %v", err))
+		}
+		if len(pvcs.Items) == 0 {
+			findings = append(findings, fmt.Sprintf("no PVCs in namespace %s", ns))
+			continue
+		}
+		for _, pvc := range pvcs.Items {
+			if pvc.Status.Phase != corev1.ClaimBound {
+				findings = append(findings, fmt.Sprintf("PVC %s/%s is %s, not Bound", ns, pvc.Name, pvc.Status.Phase))
+				continue
+			}
+			if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+				findings = append(findings, fmt.Sprintf("PVC %s/%s has no storage class, so it was not CSI-provisioned", ns, pvc.Name))
+				continue
+			}
+			className := *pvc.Spec.StorageClassName
+			provisioner, ok := provisioners[className]
+			if !ok {
+				sc := storagev1.StorageClass{}
+				err := c.Get(ctx, types.NamespacedName{Name: className}, &sc)
+				if err != nil && !apierrors.IsNotFound(err) {
+					return append(findings, fmt.Sprintf("failed to get storage class %s: %v", className, err))
+				}
+				provisioner = sc.Provisioner
+				provisioners[className] = provisioner
+			}
+			switch {
+			case provisioner == "":
+				findings = append(findings, fmt.Sprintf("PVC %s/%s has storage class %s, which does not exist", ns, pvc.Name, className))
+			case strings.HasPrefix(provisioner, "kubernetes.io/"):
+				findings = append(findings, fmt.Sprintf("PVC %s/%s is provisioned by the in-tree %s, not by a CSI driver", ns, pvc.Name, provisioner))
+			case !drivers[provisioner]:
+				findings = append(findings, fmt.Sprintf("PVC %s/%s is provisioned by %s, which has no VolumeSnapshotClass labeled %s=true", ns, pvc.Name, provisioner, volumeSnapshotClassLabel))
+			}
+		}
+	}
+	return findings
+}
+
+// diagnoseVeleroLog returns the errors the velero log has for the backup,
+// where the CSI plugin logs why it did not snapshot a PVC.
+func diagnoseVeleroLog(ctx context.Context, c client.Client, clientset kubernetes.Interface, veleroNamespace, name string) []string {
+	pods := corev1.PodList{}
+	err := c.List(ctx, &pods, client.InNamespace(veleroNamespace), client.MatchingLabels{"component": "velero"})
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list velero pods: %v", err)}
+	}
+	findings := []string{}
+	for _, pod := range pods.Items {
+		if !strings.HasPrefix(pod.Name, "velero-") || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		logCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		out, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: "velero", TailLines: &veleroLogLines}).DoRaw(logCtx)
+		cancel()
+		if err != nil {
+			findings = append(findings, fmt.Sprintf("failed to read the log of %s: %v", pod.Name, err))
+			continue
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(out)))
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.Contains(line, name) && (strings.Contains(line, "level=error") || strings.Contains(line, "level=warning")) {
+				findings = append(findings, fmt.Sprintf("velero log: %s", line))
+			}
+		}
+	}
+	if len(findings) > maxLogFindings {
+		findings = findings[len(findings)-maxLogFindings:]
+	}
+	return findings
+}
@@ -0,0 +1,372 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type drTestOptions struct {
+	*rootOptions
+	namespaces       string
+	namespacesFile   string
+	resticSecretName string
+	concurrency      int
+	schedule         string
+	order            string
+	output           string
+	outputFile       string
+	deleteTimeout    time.Duration
+	readyTimeout     time.Duration
+	skipPreflight    bool
+	yes              bool
+}
+
+func newDRTestCommand(root *rootOptions) *cobra.Command {
+	o := &drTestOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "dr-test",
+		Short: "Back up namespaces, delete them, restore them and report how long until their workloads are ready again",
+		Long: `Simulate losing whole namespaces: back them up through the data mover,
+delete the namespaces, restore them with a Velero Restore and
+VolumeSnapshotRestores and wait for their Deployments and StatefulSets to be
+ready again. The recovery time objective (RTO) reported is the time from the
+namespaces being gone until their workloads are ready.
+
+The namespaces really are deleted, so --yes must be given.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd.Context(), cmd.Flags())
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.namespaces, "namespaces", "", "comma separated list of namespaces to back up, delete and restore")
+	flags.StringVar(&o.namespacesFile, "namespaces-file", "", "path to a file listing namespaces to back up, delete and restore, one per line")
+	flags.StringVar(&o.resticSecretName, "restic-secret", defaultResticSecretName, "name of restic secret for volsync to use, <dpa-name>-volsync-restic of the DataProtectionApplication if not set")
+	flags.IntVar(&o.concurrency, "concurrency", defaultConcurrency, "number of concurrent volumesnapshotbackups and volumesnapshotrestores to run")
+	flags.StringVar(&o.schedule, "schedule", scheduleWindow, "how volumesnapshotbackups and volumesnapshotrestores are scheduled, window or batch")
+	flags.StringVar(&o.order, "order", "", "order to queue volumes in by the size of their PVCs: largest-first, smallest-first or random")
+	flags.StringVar(&o.output, "output", "", "write machine readable results in this format, json, csv or junit")
+	flags.StringVar(&o.outputFile, "output-file", "", "path of the results file, defaults to results-<backup name>.<output>")
+	flags.DurationVar(&o.deleteTimeout, "delete-timeout", 15*time.Minute, "how long to wait for the namespaces to be deleted")
+	flags.DurationVar(&o.readyTimeout, "ready-timeout", 30*time.Minute, "how long to wait after the restore for the workloads to be ready")
+	flags.BoolVar(&o.skipPreflight, "skip-preflight", false, "do not run the preflight checks before starting")
+	flags.BoolVar(&o.yes, "yes", false, "confirm the namespaces are to be deleted")
+	return cmd
+}
+
+// backupOptions returns the options of the backup of the namespaces.
+func (o *drTestOptions) backupOptions() *backupOptions {
+	b := newBackupOptions(o.rootOptions)
+	b.resticSecretName = o.resticSecretName
+	b.namespaces = o.namespaces
+	b.namespacesFile = o.namespacesFile
+	b.concurrency = o.concurrency
+	b.schedule = o.schedule
+	b.order = o.order
+	b.output = o.output
+	b.outputFile = o.outputFile
+	b.skipPreflight = o.skipPreflight
+	return b
+}
+
+func (o *drTestOptions) run(ctx context.Context, flags *pflag.FlagSet) error {
+	if o.namespaces == "" && o.namespacesFile == "" {
+		return errors.New("missing namespaces or namespaces-file flag")
+	}
+	if !o.yes {
+		return errors.New("dr-test deletes the namespaces it backs up, pass --yes to confirm")
+	}
+	if o.deleteTimeout <= 0 || o.readyTimeout <= 0 {
+		return errors.New("delete-timeout and ready-timeout must be positive")
+	}
+	b := o.backupOptions()
+	b.flagConfig = runConfig(flags)
+	err := b.validate()
+	if err != nil {
+		return err
+	}
+	c, err := b.connect(ctx, flags)
+	if err != nil {
+		return err
+	}
+	namespaces, err := b.resolveNamespaces(ctx, c)
+	if err != nil {
+		return err
+	}
+	workloads, err := listWorkloads(ctx, c, namespaces)
+	if err != nil {
+		return err
+	}
+
+	results, err := b.backup(ctx, c)
+	if err != nil {
+		return errors.Wrap(err, "failed to back up the namespaces")
+	}
+	dr := &drResult{Namespaces: namespaces, Workloads: workloads}
+	results.DR = dr
+	err = o.recover(ctx, c, results)
+	if err != nil {
+		results.runFailed(err)
+	}
+	writeErr := b.writeResults(ctx, results)
+	if err == nil {
+		err = writeErr
+	}
+	printDRSummary(os.Stdout, results)
+	return err
+}
+
+// recover deletes the namespaces of the run, restores them and waits for
+// their workloads to be ready again, recording the timings in results.
+func (o *drTestOptions) recover(ctx context.Context, c client.Client, results *runResults) error {
+	dr := results.DR
+	// The VSBs live in the namespaces and go with them, so they are
+	// listed for the restore beforehand.
+	vsbList, err := listVolumeSnapshotBackups(ctx, c, results.Backup)
+	if err != nil {
+		return errors.Wrap(err, "failed to list volumesnapshotbackups")
+	}
+
+	dr.DeleteStartTime = time.Now()
+	err = deleteNamespaces(ctx, c, dr.Namespaces, o.deleteTimeout)
+	if err != nil {
+		return err
+	}
+	dr.NamespacesDeletedTime = time.Now()
+	dr.DeletionTime = dr.NamespacesDeletedTime.Sub(dr.DeleteStartTime)
+	loggerFrom(ctx).Infow("namespaces deleted", "phase", phaseDisaster, "namespaces", len(dr.Namespaces), "elapsed", dr.DeletionTime.String())
+
+	config, err := o.restConfig()
+	if err != nil {
+		return err
+	}
+	scheme, err := o.scheme(ctx, config)
+	if err != nil {
+		return err
+	}
+	r := &vsrRunner{
+		client:           c,
+		config:           config,
+		scheme:           scheme,
+		veleroNamespace:  o.veleroNamespace,
+		name:             results.Backup,
+		resticSecretName: o.resticSecretName,
+		concurrency:      o.concurrency,
+		schedule:         o.schedule,
+		order:            o.order,
+		vsbs:             vsbList.Items,
+		results:          results,
+	}
+	err = r.restore(ctx)
+	if err != nil {
+		return err
+	}
+	dr.RestoreEndTime = time.Now()
+	dr.RestoreTime = dr.RestoreEndTime.Sub(dr.NamespacesDeletedTime)
+
+	err = waitForWorkloadsReady(ctx, c, dr.Workloads, o.readyTimeout)
+	for _, w := range dr.Workloads {
+		if w.ReadyTime.IsZero() {
+			dr.NotReady++
+		}
+	}
+	if err != nil {
+		return err
+	}
+	dr.ReadyTime = time.Now()
+	dr.ReadyWaitTime = dr.ReadyTime.Sub(dr.RestoreEndTime)
+	dr.RTO = dr.ReadyTime.Sub(dr.NamespacesDeletedTime)
+	loggerFrom(ctx).Infow("workloads ready", "phase", phaseRestore, "workloads", len(dr.Workloads), "rto", dr.RTO.String())
+	return nil
+}
+
+// drResult holds the timings of a disaster recovery test: deleting the
+// namespaces of a run, restoring them and waiting for their workloads.
+type drResult struct {
+	Namespaces            []string      `json:"namespaces"`
+	Workloads             []*workload   `json:"workloads,omitempty"`
+	DeleteStartTime       time.Time     `json:"deleteStartTime"`
+	NamespacesDeletedTime time.Time     `json:"namespacesDeletedTime"`
+	RestoreEndTime        time.Time     `json:"restoreEndTime"`
+	ReadyTime             time.Time     `json:"readyTime"`
+	DeletionTime          time.Duration `json:"deletionTime,omitempty"`
+	RestoreTime           time.Duration `json:"restoreTime,omitempty"`
+	ReadyWaitTime         time.Duration `json:"readyWaitTime,omitempty"`
+	// RTO is the time from the namespaces being gone until their
+	// workloads were ready again.
+	RTO      time.Duration `json:"rto,omitempty"`
+	NotReady int           `json:"notReady,omitempty"`
+}
+
+// workload is a Deployment or StatefulSet that must have Replicas ready after
+// a restore.
+type workload struct {
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Replicas  int32     `json:"replicas"`
+	ReadyTime time.Time `json:"readyTime"`
+}
+
+func (d *drResult) summary() string {
+	if d.RTO == 0 {
+		ready := 0
+		for _, w := range d.Workloads {
+			if !w.ReadyTime.IsZero() {
+				ready++
+			}
+		}
+		return fmt.Sprintf("not recovered, namespaces deleted in %v, %d of %d workloads ready", d.DeletionTime.Round(time.Second), ready, len(d.Workloads))
+	}
+	return fmt.Sprintf("RTO %v: restore %v, %d workloads ready %v after it, namespaces deleted in %v", d.RTO.Round(time.Second), d.RestoreTime.Round(time.Second), len(d.Workloads), d.ReadyWaitTime.Round(time.Second), d.DeletionTime.Round(time.Second))
+}
+
+// printDRSummary prints the outcome of a disaster recovery test.
+func printDRSummary(out io.Writer, results *runResults) {
+	dr := results.DR
+	fmt.Fprintf(out, "Backup:             %s\n", results.Backup)
+	fmt.Fprintf(out, "Namespaces:         %v\n", dr.Namespaces)
+	fmt.Fprintf(out, "Backup time:        %v\n", results.TotalTime.Round(time.Second))
+	fmt.Fprintf(out, "Namespace deletion: %v\n", dr.DeletionTime.Round(time.Second))
+	if r := results.Restore; r != nil {
+		fmt.Fprintf(out, "Restore:            %s\n", r.summary())
+	}
+	fmt.Fprintf(out, "Workloads:          %d (%d not ready)\n", len(dr.Workloads), dr.NotReady)
+	if dr.RTO > 0 {
+		fmt.Fprintf(out, "Ready after:        %v\n", dr.ReadyWaitTime.Round(time.Second))
+		fmt.Fprintf(out, "RTO:                %v\n", dr.RTO.Round(time.Second))
+	}
+}
+
+// listWorkloads returns the Deployments and StatefulSets with replicas in
+// namespaces.
+func listWorkloads(ctx context.Context, c client.Client, namespaces []string) ([]*workload, error) {
+	replicas := func(r *int32) int32 {
+		if r == nil {
+			return 1
+		}
+		return *r
+	}
+	workloads := []*workload{}
+	for _, ns := range namespaces {
+		deployments := appsv1.DeploymentList{}
+		err := c.List(ctx, &deployments, client.InNamespace(ns))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list deployments in %s", ns)
+		}
+		for _, d := range deployments.Items {
+			if n := replicas(d.Spec.Replicas); n > 0 {
+				workloads = append(workloads, &workload{Kind: "Deployment", Namespace: ns, Name: d.Name, Replicas: n})
+			}
+		}
+		statefulSets := appsv1.StatefulSetList{}
+		err = c.List(ctx, &statefulSets, client.InNamespace(ns))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list statefulsets in %s", ns)
+		}
+		for _, s := range statefulSets.Items {
+			if n := replicas(s.Spec.Replicas); n > 0 {
+				workloads = append(workloads, &workload{Kind: "StatefulSet", Namespace: ns, Name: s.Name, Replicas: n})
+			}
+		}
+	}
+	return workloads, nil
+}
+
+// deleteNamespaces deletes namespaces and waits for them to be gone.
+func deleteNamespaces(ctx context.Context, c client.Client, namespaces []string, timeout time.Duration) error {
+	for _, ns := range namespaces {
+		loggerFrom(ctx).Infow("deleting namespace", "phase", phaseDisaster, "namespace", ns)
+		err := deleteObject(ctx, c, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})
+		if err != nil {
+			return err
+		}
+	}
+	err := wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		remaining := 0
+		for _, ns := range namespaces {
+			err := c.Get(ctx, types.NamespacedName{Name: ns}, &corev1.Namespace{})
+			switch {
+			case apierrors.IsNotFound(err):
+			case err != nil:
+				return false, errors.Wrapf(err, "failed to get namespace %s", ns)
+			default:
+				remaining++
+			}
+		}
+		if remaining > 0 {
+			loggerFrom(ctx).Infow("waiting for namespaces to be deleted", "phase", phaseDisaster, "remaining", remaining)
+		}
+		return remaining == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("namespaces were not deleted within %v", timeout)
+	}
+	return err
+}
+
+// waitForWorkloadsReady waits for every workload to have as many ready
+// replicas as before the namespaces were deleted, recording when each did.
+func waitForWorkloadsReady(ctx context.Context, c client.Client, workloads []*workload, timeout time.Duration) error {
+	err := wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		ready := 0
+		for _, w := range workloads {
+			if !w.ReadyTime.IsZero() {
+				ready++
+				continue
+			}
+			ok, err := w.ready(ctx, c)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				w.ReadyTime = time.Now()
+				ready++
+				loggerFrom(ctx).Infow("workload ready", "phase", phaseRestore, "kind", w.Kind, "namespace", w.Namespace, "name", w.Name)
+			}
+		}
+		loggerFrom(ctx).Infow("waiting for workloads", "phase", phaseRestore, "ready", ready, "total", len(workloads))
+		return ready == len(workloads), nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("workloads were not ready within %v of the restore", timeout)
+	}
+	return err
+}
+
+// ready reports whether w has as many ready replicas as it needs. A workload
+// not restored yet is not ready.
+func (w *workload) ready(ctx context.Context, c client.Client) (bool, error) {
+	key := types.NamespacedName{Namespace: w.Namespace, Name: w.Name}
+	var readyReplicas int32
+	var err error
+	if w.Kind == "StatefulSet" {
+		s := appsv1.StatefulSet{}
+		err = c.Get(ctx, key, &s)
+		readyReplicas = s.Status.ReadyReplicas
+	} else {
+		d := appsv1.Deployment{}
+		err = c.Get(ctx, key, &d)
+		readyReplicas = d.Status.ReadyReplicas
+	}
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get %s %s", w.Kind, key)
+	}
+	return readyReplicas >= w.Replicas, nil
+}
@@ -0,0 +1,41 @@
+package perf
+
+import "testing"
+
+func TestDRTestBackupOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		o    drTestOptions
+	}{
+		{
+			name: "defaults",
+			o: drTestOptions{
+				namespaces:       "perf-1",
+				resticSecretName: defaultResticSecretName,
+				concurrency:      defaultConcurrency,
+				schedule:         scheduleWindow,
+			},
+		},
+		{
+			name: "every backup flag",
+			o: drTestOptions{
+				namespaces:       "perf-1,perf-2",
+				resticSecretName: "restic-secret",
+				concurrency:      20,
+				schedule:         scheduleBatch,
+				order:            orderLargestFirst,
+				output:           outputJSON,
+				outputFile:       "results.json",
+				skipPreflight:    true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.o.rootOptions = &rootOptions{}
+			if err := tt.o.backupOptions().validate(); err != nil {
+				t.Fatalf("validate() = %v, want nil", err)
+			}
+		})
+	}
+}
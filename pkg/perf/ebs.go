@@ -0,0 +1,161 @@
+package perf
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ebsFilterValues is how many snapshot IDs are asked for per
+	// DescribeSnapshots request, the most a filter takes.
+	ebsFilterValues = 200
+	// ebsAPIVersion is the version of the EC2 query API.
+	ebsAPIVersion = "2016-11-15"
+	// ebsCompleted is the state of an EBS snapshot whose data is all
+	// copied.
+	ebsCompleted = "completed"
+)
+
+// ebsVerifier asks EC2 about the EBS snapshots of the run, signing requests
+// with the AWS credentials of the environment.
+type ebsVerifier struct {
+	client       *http.Client
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newEBSVerifier reads the credentials from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, the region from AWS_REGION or
+// AWS_DEFAULT_REGION and an EC2 endpoint other than the regional one from
+// AWS_ENDPOINT_URL_EC2.
+func newEBSVerifier(ctx context.Context) (SnapshotVerifier, error) {
+	e := &ebsVerifier{
+		client:       &http.Client{Timeout: time.Minute},
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       os.Getenv("AWS_REGION"),
+	}
+	if e.accessKey == "" || e.secretKey == "" {
+		return nil, errors.New("cloud-verify aws requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if e.region == "" {
+		e.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if e.region == "" {
+		return nil, errors.New("cloud-verify aws requires AWS_REGION or AWS_DEFAULT_REGION")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_EC2")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com/", e.region)
+	}
+	var err error
+	e.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid AWS_ENDPOINT_URL_EC2 %q", endpoint)
+	}
+	return e, nil
+}
+
+func (e *ebsVerifier) Name() string { return cloudAWS }
+
+type describeSnapshotsResponse struct {
+	Snapshots []struct {
+		ID       string `xml:"snapshotId"`
+		State    string `xml:"status"`
+		Progress string `xml:"progress"`
+		Message  string `xml:"statusMessage"`
+	} `xml:"snapshotSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+type ec2ErrorResponse struct {
+	Errors []struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Errors>Error"`
+}
+
+// Describe looks up the snapshot IDs of ids with a snapshot-id filter, which
+// leaves out unknown IDs rather than failing the whole request.
+func (e *ebsVerifier) Describe(ctx context.Context, ids []string) (map[string]CloudSnapshot, error) {
+	snapshots := map[string]CloudSnapshot{}
+	for start := 0; start < len(ids); start += ebsFilterValues {
+		end := start + ebsFilterValues
+		if end > len(ids) {
+			end = len(ids)
+		}
+		nextToken := ""
+		for {
+			query := url.Values{}
+			query.Set("Action", "DescribeSnapshots")
+			query.Set("Version", ebsAPIVersion)
+			query.Set("Filter.1.Name", "snapshot-id")
+			for i, id := range ids[start:end] {
+				query.Set("Filter.1.Value."+strconv.Itoa(i+1), id)
+			}
+			if nextToken != "" {
+				query.Set("NextToken", nextToken)
+			}
+			page, err := e.describePage(ctx, query)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range page.Snapshots {
+				snapshots[s.ID] = CloudSnapshot{State: s.State, Progress: s.Progress, Message: s.Message, Completed: s.State == ebsCompleted}
+			}
+			nextToken = page.NextToken
+			if nextToken == "" {
+				break
+			}
+		}
+	}
+	return snapshots, nil
+}
+
+func (e *ebsVerifier) describePage(ctx context.Context, query url.Values) (*describeSnapshotsResponse, error) {
+	u := *e.endpoint
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create DescribeSnapshots request")
+	}
+	if e.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", e.sessionToken)
+	}
+	req.Header.Set("Authorization", signV4(req, sha256Hex(nil), e.accessKey, e.secretKey, e.region, "ec2", time.Now()))
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to describe snapshots")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read DescribeSnapshots response")
+	}
+	if resp.StatusCode >= 300 {
+		failure := ec2ErrorResponse{}
+		if xml.Unmarshal(body, &failure) == nil && len(failure.Errors) > 0 {
+			return nil, errors.Errorf("failed to describe snapshots: %s: %s", failure.Errors[0].Code, failure.Errors[0].Message)
+		}
+		return nil, errors.Errorf("failed to describe snapshots: %s", resp.Status)
+	}
+	page := &describeSnapshotsResponse{}
+	err = xml.Unmarshal(body, page)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse DescribeSnapshots response")
+	}
+	return page, nil
+}
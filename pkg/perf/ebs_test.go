@@ -0,0 +1,61 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSessionToken = "AQoDYXdzEPT//////////wEXAMPLEtc764bNrC9SAPBSM22wDOk4x4HIZ8j4FZTwdQWLWsKWHGBuFqwAeMicRXmxfpSPfIeoIYRqTflfKD8YUuwthAx7mSEI/qkPpKPi/kMcGdQrmGdeehM4IC1NtBmUpp2wUE8phUZampKsburEDy0KPkyQDYwT7WZ0wq5VSXDvp75YU9HFvlRd8Tx6q6fE8YQcHNVXAkiY9q6d+xo0rKwT38xVqr7ZD0u0iPPkUL64lIZbqBAz+scqKmlzm8FDrypNC9Yjc8fPOLn9FX9KSYvKTr4rvx3iSIlTJabIQwj2ICCR/oLxBA=="
+
+// TestSignV4SessionToken checks the signing of the session token EC2
+// requests carry with temporary credentials against the AWS Signature
+// Version 4 test suite.
+func TestSignV4SessionToken(t *testing.T) {
+	testSignV4(t, []signV4Test{{
+		name:   "post-sts-header-before",
+		method: http.MethodPost, url: "https://example.amazonaws.com/",
+		headers:   map[string]string{"X-Amz-Security-Token": testSessionToken},
+		accessKey: testSuiteAccessKey, secretKey: testSuiteSecretKey, region: "us-east-1", service: "service", now: time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC),
+		want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date;x-amz-security-token, Signature=85d96828115b5dc0cfc3bd16ad9e210dd772bbebba041836c64533a82be05ead",
+	}})
+}
+
+func TestEBSDescribeSignsRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.Contains(auth, "/us-east-1/ec2/aws4_request, SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+			t.Errorf("got Authorization %s, want it scoped to ec2 in us-east-1 and signing the session token", auth)
+		}
+		if got := r.Header.Get("X-Amz-Security-Token"); got != testSessionToken {
+			t.Errorf("got session token %q, want %q", got, testSessionToken)
+		}
+		query := r.URL.Query()
+		if query.Get("Action") != "DescribeSnapshots" || query.Get("Filter.1.Value.1") != "snap-1" {
+			t.Errorf("got query %s, want DescribeSnapshots of snap-1", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `<DescribeSnapshotsResponse><snapshotSet><item><snapshotId>snap-1</snapshotId><status>completed</status><progress>100%</progress></item></snapshotSet></DescribeSnapshotsResponse>`)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", testSuiteAccessKey)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", testSuiteSecretKey)
+	t.Setenv("AWS_SESSION_TOKEN", testSessionToken)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ENDPOINT_URL_EC2", server.URL)
+
+	verifier, err := newEBSVerifier(context.Background())
+	if err != nil {
+		t.Fatalf("newEBSVerifier() = %v", err)
+	}
+	snapshots, err := verifier.Describe(context.Background(), []string{"snap-1"})
+	if err != nil {
+		t.Fatalf("Describe() = %v", err)
+	}
+	if s := snapshots["snap-1"]; !s.Completed || s.Progress != "100%" {
+		t.Errorf("got snap-1 %+v, want it completed", s)
+	}
+}
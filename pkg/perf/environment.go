@@ -0,0 +1,192 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// instanceTypeLabel is set on nodes by the cloud provider to the instance
+// type of the machine.
+const instanceTypeLabel = "node.kubernetes.io/instance-type"
+
+var (
+	clusterVersionGVK = schema.GroupVersionKind{Group: "config.openshift.io", Version: "v1", Kind: "ClusterVersion"}
+	csvListGVK        = schema.GroupVersionKind{Group: "operators.coreos.com", Version: "v1alpha1", Kind: "ClusterServiceVersionList"}
+)
+
+// clusterInfo describes the cluster a run was against, since its timings
+// mean little without it.
+type clusterInfo struct {
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+	// OpenShiftVersion is the version of the ClusterVersion, on OpenShift.
+	OpenShiftVersion string `json:"openshiftVersion,omitempty"`
+	VeleroNamespace  string `json:"veleroNamespace,omitempty"`
+	// Operators maps the ClusterServiceVersions of the Velero namespace,
+	// such as those of OADP and, when installed for every namespace,
+	// VolSync, to their versions.
+	Operators map[string]string `json:"operators,omitempty"`
+	// Images maps the deployments of the Velero namespace, such as velero
+	// and volume-snapshot-mover, to the image of their first container.
+	Images         map[string]string  `json:"images,omitempty"`
+	StorageClasses []storageClassInfo `json:"storageClasses,omitempty"`
+	CSIDrivers     []string           `json:"csiDrivers,omitempty"`
+	Nodes          int                `json:"nodes,omitempty"`
+	// InstanceTypes counts the nodes of each instance type.
+	InstanceTypes map[string]int `json:"instanceTypes,omitempty"`
+	// DataMoverAPIVersion is the version of the data mover API the run
+	// used, the one the cluster serves.
+	DataMoverAPIVersion string `json:"dataMoverAPIVersion,omitempty"`
+}
+
+type storageClassInfo struct {
+	Name        string `json:"name"`
+	Provisioner string `json:"provisioner"`
+	Default     bool   `json:"default,omitempty"`
+}
+
+// describeCluster returns what is known of the cluster. Each part that
+// cannot be read, such as the ClusterVersion off OpenShift, is logged and
+// left out rather than failing a run that does not depend on it.
+func describeCluster(ctx context.Context, c client.Client, clientset kubernetes.Interface, veleroNamespace string) *clusterInfo {
+	info := &clusterInfo{VeleroNamespace: veleroNamespace}
+	version, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to get the kubernetes version", "error", err)
+	} else {
+		info.KubernetesVersion = version.GitVersion
+	}
+
+	cv := &unstructured.Unstructured{}
+	cv.SetGroupVersionKind(clusterVersionGVK)
+	err = c.Get(ctx, types.NamespacedName{Name: "version"}, cv)
+	if err == nil {
+		info.OpenShiftVersion, _, _ = unstructured.NestedString(cv.Object, "status", "desired", "version")
+	}
+
+	csvs := &unstructured.UnstructuredList{}
+	csvs.SetGroupVersionKind(csvListGVK)
+	err = c.List(ctx, csvs, client.InNamespace(veleroNamespace))
+	if err == nil && len(csvs.Items) > 0 {
+		info.Operators = map[string]string{}
+		for _, csv := range csvs.Items {
+			info.Operators[csv.GetName()], _, _ = unstructured.NestedString(csv.Object, "spec", "version")
+		}
+	}
+
+	gvks, _, err := c.Scheme().ObjectKinds(&dmv1.VolumeSnapshotBackup{})
+	if err == nil {
+		info.DataMoverAPIVersion = gvks[0].GroupVersion().String()
+	}
+
+	deployments := appsv1.DeploymentList{}
+	err = c.List(ctx, &deployments, client.InNamespace(veleroNamespace))
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to list the deployments of the velero namespace", "error", err)
+	} else if len(deployments.Items) > 0 {
+		info.Images = map[string]string{}
+		for _, d := range deployments.Items {
+			if containers := d.Spec.Template.Spec.Containers; len(containers) > 0 {
+				info.Images[d.Name] = containers[0].Image
+			}
+		}
+	}
+
+	classes := storagev1.StorageClassList{}
+	err = c.List(ctx, &classes)
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to list storage classes", "error", err)
+	}
+	for _, sc := range classes.Items {
+		info.StorageClasses = append(info.StorageClasses, storageClassInfo{
+			Name:        sc.Name,
+			Provisioner: sc.Provisioner,
+			Default:     sc.Annotations["storageclass.kubernetes.io/is-default-class"] == "true",
+		})
+	}
+
+	drivers := storagev1.CSIDriverList{}
+	err = c.List(ctx, &drivers)
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to list CSI drivers", "error", err)
+	}
+	for _, d := range drivers.Items {
+		info.CSIDrivers = append(info.CSIDrivers, d.Name)
+	}
+
+	nodes := corev1.NodeList{}
+	err = listAll(ctx, c, &nodes)
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to list nodes", "error", err)
+	} else {
+		info.Nodes = len(nodes.Items)
+		for _, n := range nodes.Items {
+			if t := n.Labels[instanceTypeLabel]; t != "" {
+				if info.InstanceTypes == nil {
+					info.InstanceTypes = map[string]int{}
+				}
+				info.InstanceTypes[t]++
+			}
+		}
+	}
+	return info
+}
+
+// summary describes the versions of the cluster and its nodes.
+func (i *clusterInfo) summary() string {
+	parts := []string{}
+	if i.KubernetesVersion != "" {
+		parts = append(parts, "Kubernetes "+i.KubernetesVersion)
+	}
+	if i.OpenShiftVersion != "" {
+		parts = append(parts, "OpenShift "+i.OpenShiftVersion)
+	}
+	operators := []string{}
+	for name, version := range i.Operators {
+		operators = append(operators, fmt.Sprintf("%s %s", name, version))
+	}
+	sort.Strings(operators)
+	parts = append(parts, operators...)
+	if i.Nodes > 0 {
+		types := []string{}
+		for t, n := range i.InstanceTypes {
+			types = append(types, fmt.Sprintf("%d %s", n, t))
+		}
+		sort.Strings(types)
+		nodes := fmt.Sprintf("%d nodes", i.Nodes)
+		if len(types) > 0 {
+			nodes += " (" + strings.Join(types, ", ") + ")"
+		}
+		parts = append(parts, nodes)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// storageSummary describes the storage classes, marking the default, and the
+// CSI drivers of the cluster.
+func (i *clusterInfo) storageSummary() string {
+	classes := []string{}
+	for _, sc := range i.StorageClasses {
+		class := fmt.Sprintf("%s (%s)", sc.Name, sc.Provisioner)
+		if sc.Default {
+			class += " default"
+		}
+		classes = append(classes, class)
+	}
+	summary := strings.Join(classes, ", ")
+	if len(i.CSIDrivers) > 0 {
+		summary += "; CSI drivers " + strings.Join(i.CSIDrivers, ", ")
+	}
+	return summary
+}
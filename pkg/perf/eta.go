@@ -0,0 +1,122 @@
+package perf
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// etaWindow is how many of the latest VSBs to complete the ETA is estimated
+// from, so it follows the throughput as it changes rather than averaging
+// over the whole run.
+const etaWindow = 20
+
+// etaEstimate is how long the current batch and the rest of the run are
+// expected to take.
+type etaEstimate struct {
+	completed int
+	total     int
+	batch     int
+	batchLeft time.Duration
+	runLeft   time.Duration
+	// perVSB is the mean duration of the latest VSBs to complete.
+	perVSB time.Duration
+}
+
+// eta estimates the time left at now from the mean duration of the latest
+// etaWindow VSBs to complete and the VSBs still running or queued. A running
+// VSB is expected to take the mean, less how long it has run. Queued VSBs
+// get the slots of concurrency as they free up, all at once between batches
+// with schedule batch. It returns false until a VSB has completed. The caller
+// must hold r.mu.
+func (r *runResults) eta(now time.Time) (etaEstimate, bool) {
+	e := etaEstimate{total: len(r.Volumes)}
+	finished := []*volumeResult{}
+	running := []*volumeResult{}
+	pending := 0
+	for _, v := range r.Volumes {
+		switch {
+		case v.Error != "":
+			e.completed++
+		case !v.VSBCompletionTime.IsZero():
+			e.completed++
+			finished = append(finished, v)
+		case !v.VSBStartTime.IsZero():
+			running = append(running, v)
+			if v.Batch > e.batch {
+				e.batch = v.Batch
+			}
+		default:
+			pending++
+		}
+	}
+	if len(finished) == 0 || r.Concurrency < 1 {
+		return e, false
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].VSBCompletionTime.Before(finished[j].VSBCompletionTime)
+	})
+	if len(finished) > etaWindow {
+		finished = finished[len(finished)-etaWindow:]
+	}
+	var sum time.Duration
+	for _, v := range finished {
+		sum += v.VSBCompletionTime.Sub(v.VSBStartTime)
+	}
+	e.perVSB = sum / time.Duration(len(finished))
+
+	var runningLeft, longest time.Duration
+	for _, v := range running {
+		left := e.perVSB - now.Sub(v.VSBStartTime)
+		if left < 0 {
+			left = 0
+		}
+		runningLeft += left
+		if left > longest {
+			longest = left
+		}
+		if v.Batch == e.batch && left > e.batchLeft {
+			e.batchLeft = left
+		}
+	}
+	if r.Schedule == scheduleBatch {
+		batches := math.Ceil(float64(pending) / float64(r.Concurrency))
+		e.runLeft = longest + time.Duration(batches)*e.perVSB
+	} else {
+		e.runLeft = (runningLeft + time.Duration(pending)*e.perVSB) / time.Duration(r.Concurrency)
+		if e.runLeft < longest {
+			e.runLeft = longest
+		}
+	}
+	return e, true
+}
+
+// reportETA logs the estimated time left of the data mover every interval
+// until ctx is done, once the snapshots are done and a VSB has completed.
+func reportETA(ctx context.Context, results *runResults, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		results.mu.Lock()
+		e, ok := results.eta(now)
+		moving := !results.SnapshotEndTime.IsZero() && results.DataMoverEndTime.IsZero()
+		results.mu.Unlock()
+		if !moving {
+			continue
+		}
+		if !ok {
+			loggerFrom(ctx).Infow("no ETA until a VSB completes", "phase", phaseDataMover, "total", e.total)
+			continue
+		}
+		results.metrics.eta.Set(e.runLeft.Seconds())
+		loggerFrom(ctx).Infow("estimated time left", "phase", phaseDataMover, "completed", e.completed, "total", e.total, "perVSB", e.perVSB.Round(time.Second).String(),
+			"batch", e.batch, "batchLeft", e.batchLeft.Round(time.Second).String(), "runLeft", e.runLeft.Round(time.Second).String(), "finishAt", now.Add(e.runLeft).Format(time.Kitchen))
+	}
+}
@@ -0,0 +1,178 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Types of the events written to --events.
+const (
+	eventBackupCreated = "backup-created"
+	eventVSCReady      = "vsc-ready"
+	eventSnapshotsDone = "snapshots-done"
+	eventVSBCreated    = "vsb-created"
+	eventVSBCompleted  = "vsb-completed"
+	eventVSBFailed     = "vsb-failed"
+	eventVSBStalled    = "vsb-stalled"
+	eventBatchDone     = "batch-done"
+	eventDataMoverDone = "data-mover-done"
+	eventRunDone       = "run-done"
+)
+
+// eventWriteTimeout bounds how long a client of the events socket may hold
+// up the run before it is dropped.
+const eventWriteTimeout = time.Second
+
+// event is a line of the event stream. Only the fields that apply to its
+// type are set.
+type event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Run       string    `json:"run"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	VSC       string    `json:"vsc,omitempty"`
+	VSB       string    `json:"vsb,omitempty"`
+	PVC       string    `json:"pvc,omitempty"`
+	Batch     int       `json:"batch,omitempty"`
+	SizeBytes int64     `json:"sizeBytes,omitempty"`
+	Volumes   int       `json:"volumes,omitempty"`
+	// Seconds is how long the VSB, batch, phase or run took.
+	Seconds float64 `json:"seconds,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// eventStream writes events as newline delimited JSON to a file, to stdout or
+// to every client connected to a unix socket. A nil stream drops them.
+type eventStream struct {
+	// log is the logger of the command that opened the stream.
+	log      *zap.SugaredLogger
+	mu       sync.Mutex
+	w        io.Writer
+	file     *os.File
+	listener net.Listener
+	conns    []net.Conn
+}
+
+// openEventStream opens target, - for stdout, unix:<path> to listen on a
+// unix socket, or the path of a file to append to. Failures to write events
+// are logged to the logger of ctx.
+func openEventStream(ctx context.Context, target string) (*eventStream, error) {
+	s := &eventStream{log: loggerFrom(ctx)}
+	switch {
+	case target == "-":
+		s.w = os.Stdout
+	case strings.HasPrefix(target, "unix:"):
+		path := strings.TrimPrefix(target, "unix:")
+		// A socket left behind by an earlier run would fail the listen.
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to listen for event clients on %s", path)
+		}
+		s.listener = listener
+		go s.accept()
+	default:
+		f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open events file %s", target)
+		}
+		s.file = f
+		s.w = f
+	}
+	return s, nil
+}
+
+func (s *eventStream) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+	}
+}
+
+func (s *eventStream) emit(e event) {
+	if s == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w != nil {
+		_, err = s.w.Write(data)
+		if err != nil {
+			s.log.Warnw("failed to write event", "error", err)
+		}
+		return
+	}
+	conns := s.conns[:0]
+	for _, conn := range s.conns {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		_, err := conn.Write(data)
+		if err != nil {
+			s.log.Warnw("dropping events client", "error", err)
+			conn.Close()
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	s.conns = conns
+}
+
+func (s *eventStream) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+		s.conns = nil
+	}
+}
+
+// emitLocked sends e, stamped with the run, to the event stream of the
+// results. The caller holds r.mu.
+func (r *runResults) emitLocked(e event) {
+	if r.events == nil {
+		return
+	}
+	e.Run = r.Backup
+	e.Cluster = r.Cluster
+	r.events.emit(e)
+}
+
+func (r *runResults) emit(e event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emitLocked(e)
+}
@@ -0,0 +1,55 @@
+package perf
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Exit codes of the tool, so CI can tell why a run failed without parsing
+// the logs.
+const (
+	exitOK = 0
+	// exitFailed is the exit code of every error not given one below.
+	exitFailed = 1
+	// exitPreflight means a preflight check failed.
+	exitPreflight = 2
+	// exitVSCTimeout means the snapshots were not ready in time.
+	exitVSCTimeout = 3
+	// exitVSBFailed means a volumesnapshotbackup or dataupload failed.
+	exitVSBFailed = 4
+	// exitDataMoverTimeout means the data mover did not finish in time.
+	exitDataMoverTimeout = 5
+	// exitThreshold means the run finished but was slower than allowed by
+	// --max-total-time, --max-vsb-p95 or the baseline.
+	exitThreshold = 6
+)
+
+// exitError is an error the process exits with code for.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Cause() error  { return e.err }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode makes the process exit with code if err ends the command. It
+// returns nil if err is nil.
+func withExitCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// ExitCode returns the code the process exits with for err.
+func ExitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailed
+}
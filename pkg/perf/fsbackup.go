@@ -0,0 +1,111 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// modeDataMover snapshots the volumes and moves their data with the
+	// data mover picked by --mover.
+	modeDataMover = "data-mover"
+	// modeFSBackup backs the volumes up with Velero's file system backup
+	// instead, copying them with restic or kopia PodVolumeBackups.
+	modeFSBackup = "fs-backup"
+	// moverFSBackup is the mover of runs in modeFSBackup: the node agent
+	// moves the data of each volume through a PodVolumeBackup.
+	moverFSBackup = modeFSBackup
+)
+
+// runPodVolumeBackups times a file system backup. No snapshots are taken, so
+// the data mover phase starts with the backup and ends once the backup is done
+// and every PodVolumeBackup has finished, each recorded in place of a VSB.
+func (o *backupOptions) runPodVolumeBackups(ctx context.Context, w *runWatcher, results *runResults) error {
+	name := results.Backup
+	results.snapshotsDone(results.StartTime)
+	err := waitForPodVolumeBackupsToComplete(ctx, w, o.veleroNamespace, name, results, o.onFailure == onFailureAbort)
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for PodVolumeBackups to complete", "phase", phaseDataMover)
+			return withExitCode(err, exitDataMoverTimeout)
+		}
+		return err
+	}
+	dataMoverEndTime := time.Now()
+	results.dataMoverDone(dataMoverEndTime)
+	loggerFrom(ctx).Infow("file system backup done", "phase", phaseDataMover, "elapsed", results.DataMoverTime.String(), "total", results.TotalTime.String(), "throughput", fmt.Sprintf("%.2f GiB/min", results.Throughput))
+	return nil
+}
+
+// waitForPodVolumeBackupsToComplete waits for the backup to finish and for
+// every one of its PodVolumeBackups to be done, recording their timings in
+// the results keyed by their own name. Velero creates PodVolumeBackups as it
+// reaches each pod, so more may come until the backup is done. With abort
+// set, the first failed PodVolumeBackup is returned as an error.
+func waitForPodVolumeBackupsToComplete(ctx context.Context, w *runWatcher, veleroNamespace, name string, results *runResults, abort bool) error {
+	timeout := 120 * time.Minute
+	lastDone, lastRunning := -1, -1
+	return w.waitFor(ctx, timeout, func() (bool, error) {
+		backup := velerov1.Backup{}
+		err := w.cache.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: name}, &backup)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to get backup")
+		}
+		switch backup.Status.Phase {
+		case velerov1.BackupPhaseFailed, velerov1.BackupPhaseFailedValidation:
+			return false, errors.Errorf("backup %s %s: %s", name, backup.Status.Phase, backupFailureReason(&backup))
+		}
+
+		pvbList := velerov1.PodVolumeBackupList{}
+		err = w.cache.List(ctx, &pvbList, client.InNamespace(veleroNamespace), client.MatchingLabels{velerov1.BackupNameLabel: name})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list podvolumebackups")
+		}
+		done, running := 0, 0
+		for _, pvb := range pvbList.Items {
+			if pvb.Status.StartTimestamp != nil {
+				results.transferStarted(pvb.Name, pvb.Spec.Pod.Namespace, pvb.Status.Progress.TotalBytes, pvb.Status.StartTimestamp.Time)
+			}
+			switch pvb.Status.Phase {
+			case velerov1.PodVolumeBackupPhaseCompleted:
+				results.bytesTransferred(pvb.Name, pvb.Status.Progress.BytesDone)
+				completion := time.Now()
+				if pvb.Status.CompletionTimestamp != nil {
+					completion = pvb.Status.CompletionTimestamp.Time
+				}
+				results.vsbCompleted(pvb.Name, pvb.Spec.Volume, "", completion)
+				done++
+			case velerov1.PodVolumeBackupPhaseFailed:
+				failure := errors.Errorf("podvolumebackup failed: %s", pvb.Status.Message)
+				results.transferFailed(pvb.Name, failure)
+				if abort {
+					return false, withExitCode(errors.Wrapf(failure, "podvolumebackup %s", pvb.Name), exitVSBFailed)
+				}
+				done++
+			default:
+				running++
+			}
+		}
+		if done != lastDone || running != lastRunning {
+			loggerFrom(ctx).Infow("waiting for PodVolumeBackups", "phase", phaseDataMover, "backupPhase", backup.Status.Phase, "done", done, "running", running)
+			lastDone, lastRunning = done, running
+		}
+		switch backup.Status.Phase {
+		case velerov1.BackupPhaseCompleted:
+			return running == 0, nil
+		case velerov1.BackupPhasePartiallyFailed:
+			if running == 0 {
+				loggerFrom(ctx).Warnw("backup partially failed", "phase", phaseBackup, "errors", backup.Status.Errors, "warnings", backup.Status.Warnings)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
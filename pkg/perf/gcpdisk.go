@@ -0,0 +1,84 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// gcpComputeEndpoint is the endpoint of the Compute Engine API.
+	gcpComputeEndpoint = "https://compute.googleapis.com/compute/v1/"
+	// gcpComputeReadOnly is the OAuth scope snapshots are read with.
+	gcpComputeReadOnly = "https://www.googleapis.com/auth/compute.readonly"
+	// gcpReady is the status of a snapshot that can be used.
+	gcpReady = "READY"
+)
+
+// gcpDiskVerifier asks Compute Engine about the Persistent Disk snapshots of
+// the run, whose snapshotHandles are projects/<project>/global/snapshots/<name>,
+// authenticating with the application default credentials.
+type gcpDiskVerifier struct {
+	client   *http.Client
+	endpoint string
+}
+
+// newGCPDiskVerifier finds the application default credentials: the service
+// account key of GOOGLE_APPLICATION_CREDENTIALS, those of gcloud or those of
+// the metadata server. CLOUDSDK_API_ENDPOINT_OVERRIDES_COMPUTE replaces the
+// endpoint of the API.
+func newGCPDiskVerifier(ctx context.Context) (SnapshotVerifier, error) {
+	client, err := google.DefaultClient(ctx, gcpComputeReadOnly)
+	if err != nil {
+		return nil, errors.Wrap(err, "cloud-verify gcp requires application default credentials")
+	}
+	client.Timeout = time.Minute
+	endpoint := os.Getenv("CLOUDSDK_API_ENDPOINT_OVERRIDES_COMPUTE")
+	if endpoint == "" {
+		endpoint = gcpComputeEndpoint
+	}
+	return &gcpDiskVerifier{client: client, endpoint: strings.TrimSuffix(endpoint, "/") + "/"}, nil
+}
+
+func (g *gcpDiskVerifier) Name() string { return cloudGCP }
+
+// Describe gets the snapshot of each handle. Snapshots are usable once READY,
+// after CREATING and UPLOADING.
+func (g *gcpDiskVerifier) Describe(ctx context.Context, handles []string) (map[string]CloudSnapshot, error) {
+	return describeEach(ctx, handles, g.describe)
+}
+
+func (g *gcpDiskVerifier) describe(ctx context.Context, handle string) (CloudSnapshot, bool, error) {
+	if !strings.HasPrefix(handle, "projects/") {
+		return CloudSnapshot{}, false, errors.Errorf("snapshot handle %q is not a Compute Engine snapshot", handle)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.endpoint+handle, nil)
+	if err != nil {
+		return CloudSnapshot{}, false, errors.Wrapf(err, "failed to create request for snapshot %s", handle)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return CloudSnapshot{}, false, errors.Wrapf(err, "failed to get snapshot %s", handle)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return CloudSnapshot{}, false, nil
+	}
+	if resp.StatusCode >= 300 {
+		return CloudSnapshot{}, false, errors.Errorf("failed to get snapshot %s: %s", handle, resp.Status)
+	}
+	snapshot := struct {
+		Status string `json:"status"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	if err != nil {
+		return CloudSnapshot{}, false, errors.Wrapf(err, "failed to parse snapshot %s", handle)
+	}
+	return CloudSnapshot{State: snapshot.Status, Completed: snapshot.Status == gcpReady}, true, nil
+}
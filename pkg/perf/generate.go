@@ -0,0 +1,461 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// generatedLabel is set on everything created by generate so it can be
+	// found and removed later.
+	generatedLabel = "oadp-perf/generated"
+
+	dataRandom       = "random"
+	dataDedupe       = "dedupe"
+	dataCompressible = "compressible"
+
+	// filledMarker is written to the volume once it has been filled, so a
+	// restarted pod does not fill it again.
+	filledMarker = "/data/.oadp-perf-filled"
+	// changedMarkerPrefix, suffixed by the change ID, is written to the
+	// volume once change-percent of it has been rewritten.
+	changedMarkerPrefix = "/data/.oadp-perf-changed-"
+	// readyMarker is written once the pod is done writing to the volume.
+	readyMarker = "/tmp/oadp-perf-ready"
+)
+
+type generateOptions struct {
+	*rootOptions
+	namespaceCount   int
+	pvcsPerNamespace int
+	pvcSize          string
+	fillSize         string
+	storageClass     string
+	data             string
+	prefix           string
+	image            string
+	wait             bool
+	cleanup          bool
+	waitForPVs       bool
+	changePercent    int
+	// changeID tells the changes of one run of generate from those of
+	// earlier runs.
+	changeID string
+}
+
+func newGenerateCommand(root *rootOptions) *cobra.Command {
+	o := &generateOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Create namespaces with filled PVCs to back up",
+		Long: `Create namespace-count namespaces named <prefix><n>, each with
+pvcs-per-namespace PVCs of pvc-size and a pod per PVC that writes fill-size of
+data to it. Everything is labeled ` + generatedLabel + ` with the prefix so it
+can be found and removed later with --cleanup.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := o.validate()
+			if err != nil {
+				return err
+			}
+			c, err := o.client(cmd.Context())
+			if err != nil {
+				return err
+			}
+			return o.run(cmd.Context(), c)
+		},
+	}
+	flags := cmd.Flags()
+	flags.IntVar(&o.namespaceCount, "namespace-count", 1, "number of namespaces to create")
+	flags.IntVar(&o.pvcsPerNamespace, "pvcs-per-namespace", 1, "number of PVCs to create in each namespace")
+	flags.StringVar(&o.pvcSize, "pvc-size", "1Gi", "requested size of each PVC")
+	flags.StringVar(&o.fillSize, "fill-size", "512Mi", "amount of data to write to each PVC")
+	flags.StringVar(&o.storageClass, "storage-class", "", "storage class of the PVCs, the cluster default if empty")
+	flags.StringVar(&o.data, "data", dataRandom, "data to fill the PVCs with: random neither deduplicates nor compresses, dedupe repeats a single 1Mi random block, compressible writes a unique but repetitive text per 1Mi block")
+	flags.IntVar(&o.changePercent, "change-percent", 0, "rerun against PVCs filled by an earlier run to rewrite this percentage of the 1Mi blocks of each with new data, as an incremental backup would see, recreating the pods to do so")
+	flags.StringVar(&o.prefix, "prefix", "perf-", "prefix of the generated namespace names")
+	flags.StringVar(&o.image, "image", defaultImage, "image of the pods filling the PVCs, must provide sh, head, cat, yes and dd")
+	flags.BoolVar(&o.wait, "wait", true, "wait for every PVC to be filled before returning, or with cleanup for the namespaces to be deleted")
+	flags.BoolVar(&o.cleanup, "cleanup", false, "delete the filler pods, PVCs and namespaces generated with prefix instead of creating them")
+	flags.BoolVar(&o.waitForPVs, "wait-for-pvs", false, "with cleanup, wait for the persistent volumes of the deleted PVCs to be deleted and log how long they took to be reclaimed")
+	return cmd
+}
+
+func (o *generateOptions) validate() error {
+	if o.prefix == "" {
+		return errors.New("prefix must not be empty")
+	}
+	if o.cleanup {
+		return nil
+	}
+	if o.waitForPVs {
+		return errors.New("wait-for-pvs needs cleanup")
+	}
+	if o.namespaceCount < 1 {
+		return errors.New("namespace-count must be at least 1")
+	}
+	if o.pvcsPerNamespace < 1 {
+		return errors.New("pvcs-per-namespace must be at least 1")
+	}
+	if o.data != dataRandom && o.data != dataDedupe && o.data != dataCompressible {
+		return errors.Errorf("unknown data %q, must be one of %s, %s or %s", o.data, dataRandom, dataDedupe, dataCompressible)
+	}
+	if o.changePercent < 0 || o.changePercent > 100 {
+		return errors.New("change-percent must be between 0 and 100")
+	}
+	size, err := resource.ParseQuantity(o.pvcSize)
+	if err != nil {
+		return errors.Wrapf(err, "invalid pvc-size %q", o.pvcSize)
+	}
+	fill, err := resource.ParseQuantity(o.fillSize)
+	if err != nil {
+		return errors.Wrapf(err, "invalid fill-size %q", o.fillSize)
+	}
+	if fill.Cmp(size) > 0 {
+		return errors.Errorf("fill-size %s is larger than pvc-size %s", o.fillSize, o.pvcSize)
+	}
+	return nil
+}
+
+func (o *generateOptions) run(ctx context.Context, c client.Client) error {
+	if o.cleanup {
+		return o.teardown(ctx, c)
+	}
+	if o.changePercent > 0 {
+		o.changeID = time.Now().UTC().Format("20060102-150405")
+		err := o.deleteFillPods(ctx, c)
+		if err != nil {
+			return err
+		}
+	}
+	namespaces := []string{}
+	for n := 1; n <= o.namespaceCount; n++ {
+		ns := fmt.Sprintf("%s%d", o.prefix, n)
+		err := createIfMissing(ctx, c, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: ns, Labels: o.labels()},
+		})
+		if err != nil {
+			return err
+		}
+		for p := 1; p <= o.pvcsPerNamespace; p++ {
+			name := fmt.Sprintf("data-%d", p)
+			err := createIfMissing(ctx, c, o.newPVC(ns, name))
+			if err != nil {
+				return err
+			}
+			err = createIfMissing(ctx, c, o.newFillPod(ns, name))
+			if err != nil {
+				return err
+			}
+		}
+		loggerFrom(ctx).Infow("created namespace", "namespace", ns, "pvcs", o.pvcsPerNamespace)
+		namespaces = append(namespaces, ns)
+	}
+
+	if o.wait {
+		err := o.waitForFill(ctx, c)
+		if err != nil {
+			if err == wait.ErrWaitTimeout {
+				loggerFrom(ctx).Errorw("timed out waiting for PVCs to be filled")
+			}
+			return err
+		}
+	}
+	loggerFrom(ctx).Infow("back them up with oadp-perf backup --namespaces", "namespaces", strings.Join(namespaces, ","))
+	return nil
+}
+
+func (o *generateOptions) labels() map[string]string {
+	return map[string]string{generatedLabel: strings.TrimSuffix(o.prefix, "-")}
+}
+
+func (o *generateOptions) newPVC(namespace, name string) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: o.labels()},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: resource.MustParse(o.pvcSize),
+				},
+			},
+		},
+	}
+	if o.storageClass != "" {
+		pvc.Spec.StorageClassName = &o.storageClass
+	}
+	return pvc
+}
+
+// newFillPod returns a pod that fills the PVC called name once and then
+// keeps it mounted. The pod only becomes ready after the data is written.
+func (o *generateOptions) newFillPod(namespace, name string) *corev1.Pod {
+	allowPrivilegeEscalation := false
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: o.labels()},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:    "fill",
+				Image:   o.image,
+				Command: []string{"sh", "-c", o.fillScript()},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "data",
+					MountPath: "/data",
+				}},
+				ReadinessProbe: &corev1.Probe{
+					ProbeHandler: corev1.ProbeHandler{
+						Exec: &corev1.ExecAction{Command: []string{"test", "-f", readyMarker}},
+					},
+					PeriodSeconds: 10,
+				},
+				SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+					SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+				},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: name},
+				},
+			}},
+		},
+	}
+}
+
+// fillScript writes fill-size of data to /data in 1Mi blocks or, if the
+// volume was filled by an earlier run and change-percent is set, rewrites
+// that percentage of its blocks, spread evenly over it, with new data.
+// Random data gets no benefit from restic deduplication or compression,
+// dedupe data repeats the same block so it is stored only once, and
+// compressible data repeats a text unique to each block and change, so it
+// compresses well without deduplicating.
+func (o *generateOptions) fillScript() string {
+	fill := resource.MustParse(o.fillSize)
+	blocks := (fill.Value() + 1<<20 - 1) >> 20
+	write := "head -c 1048576 /dev/urandom"
+	switch o.data {
+	case dataDedupe:
+		write = "cat /tmp/block"
+	case dataCompressible:
+		write = `yes "oadp-perf $2 block $1" | head -c 1048576`
+	}
+	return fmt.Sprintf(`set -e
+block() { %[3]s; }
+head -c 1048576 /dev/urandom > /tmp/block
+if [ ! -f %[1]s ]; then
+  i=0
+  while [ $i -lt %[2]d ]; do block $i fill; i=$((i+1)); done > /data/fill
+  touch %[1]s
+elif [ %[5]d -gt 0 ] && [ ! -f %[4]s%[6]s ]; then
+  i=0
+  while [ $i -lt %[2]d ]; do
+    if [ $(((i + 1) * %[5]d / 100)) -gt $((i * %[5]d / 100)) ]; then
+      block $i %[6]s > /tmp/chunk
+      dd if=/tmp/chunk of=/data/fill bs=1048576 seek=$i count=1 conv=notrunc 2>/dev/null
+    fi
+    i=$((i+1))
+  done
+  touch %[4]s%[6]s
+fi
+touch %[7]s
+exec sleep infinity`, filledMarker, blocks, write, changedMarkerPrefix, o.changePercent, o.changeID, readyMarker)
+}
+
+// deleteFillPods deletes the pods generated with the prefix and waits for
+// them to be gone, so they are created again to rewrite their volumes.
+func (o *generateOptions) deleteFillPods(ctx context.Context, c client.Client) error {
+	pods := corev1.PodList{}
+	err := listAll(ctx, c, &pods, client.MatchingLabels(o.labels()))
+	if err != nil {
+		return errors.Wrap(err, "failed to list generated pods")
+	}
+	for i := range pods.Items {
+		err := deleteObject(ctx, c, &pods.Items[i])
+		if err != nil {
+			return err
+		}
+	}
+	loggerFrom(ctx).Infow("recreating pods to change their volumes", "pods", len(pods.Items), "changePercent", o.changePercent)
+	return wait.PollImmediate(5*time.Second, 30*time.Minute, func() (bool, error) {
+		left := corev1.PodList{}
+		err := c.List(ctx, &left, client.MatchingLabels(o.labels()))
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list generated pods")
+		}
+		return len(left.Items) == 0, nil
+	})
+}
+
+// waitForFill waits for every generated pod to report ready, which happens
+// once its PVC has been filled, or changed.
+func (o *generateOptions) waitForFill(ctx context.Context, c client.Client) error {
+	timeout := 120 * time.Minute
+	interval := 5 * time.Second
+	total := o.namespaceCount * o.pvcsPerNamespace
+	lastReady := -1
+	return wait.PollImmediate(interval, timeout, func() (bool, error) {
+		pods := corev1.PodList{}
+		err := c.List(ctx, &pods, client.MatchingLabels(o.labels()))
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list generated pods")
+		}
+		ready := 0
+		for _, pod := range pods.Items {
+			for _, condition := range pod.Status.Conditions {
+				if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+					ready++
+				}
+			}
+		}
+		if ready != lastReady {
+			loggerFrom(ctx).Infow("filling PVCs", "filled", ready, "total", total)
+			lastReady = ready
+		}
+		return ready >= total, nil
+	})
+}
+
+// createIfMissing creates obj, leaving it alone if it already exists so
+// generate can be rerun to top up an earlier run.
+func createIfMissing(ctx context.Context, c client.Client, obj client.Object) error {
+	err := c.Create(ctx, obj)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create %s", describeObject(c, obj))
+	}
+	return nil
+}
+
+// teardown deletes the filler pods, PVCs and namespaces generated with the
+// prefix, found by their label. Pods and PVCs are deleted on their own too,
+// since generate may have been run into namespaces it did not create. With
+// wait-for-pvs it then times how long the persistent volumes of the PVCs
+// take to be reclaimed.
+func (o *generateOptions) teardown(ctx context.Context, c client.Client) error {
+	startTime := time.Now()
+	pods := corev1.PodList{}
+	err := listAll(ctx, c, &pods, client.MatchingLabels(o.labels()))
+	if err != nil {
+		return errors.Wrap(err, "failed to list generated pods")
+	}
+	for i := range pods.Items {
+		err := deleteObject(ctx, c, &pods.Items[i])
+		if err != nil {
+			return err
+		}
+	}
+	pvcs := corev1.PersistentVolumeClaimList{}
+	err = listAll(ctx, c, &pvcs, client.MatchingLabels(o.labels()))
+	if err != nil {
+		return errors.Wrap(err, "failed to list generated PVCs")
+	}
+	pvs := []string{}
+	for i := range pvcs.Items {
+		if pv := pvcs.Items[i].Spec.VolumeName; pv != "" {
+			pvs = append(pvs, pv)
+		}
+		err := deleteObject(ctx, c, &pvcs.Items[i])
+		if err != nil {
+			return err
+		}
+	}
+	namespaces := corev1.NamespaceList{}
+	err = listAll(ctx, c, &namespaces, client.MatchingLabels(o.labels()))
+	if err != nil {
+		return errors.Wrap(err, "failed to list generated namespaces")
+	}
+	for i := range namespaces.Items {
+		err := deleteObject(ctx, c, &namespaces.Items[i])
+		if err != nil {
+			return err
+		}
+	}
+	loggerFrom(ctx).Infow("deleted generated workload", "prefix", o.prefix, "namespaces", len(namespaces.Items), "pvcs", len(pvcs.Items), "pods", len(pods.Items))
+
+	if o.wait {
+		err = o.waitForNamespacesDeleted(ctx, c, len(namespaces.Items))
+		if err != nil {
+			if err == wait.ErrWaitTimeout {
+				loggerFrom(ctx).Errorw("timed out waiting for generated namespaces to be deleted")
+			}
+			return err
+		}
+		loggerFrom(ctx).Infow("generated namespaces deleted", "namespaces", len(namespaces.Items), "elapsed", time.Since(startTime).Round(time.Second).String())
+	}
+	if o.waitForPVs {
+		err = waitForPVsReclaimed(ctx, c, pvs)
+		if err != nil {
+			if err == wait.ErrWaitTimeout {
+				loggerFrom(ctx).Errorw("timed out waiting for persistent volumes to be reclaimed")
+			}
+			return err
+		}
+		loggerFrom(ctx).Infow("persistent volumes reclaimed", "pvs", len(pvs), "reclaimTime", time.Since(startTime).Round(time.Second).String())
+	}
+	return nil
+}
+
+// waitForNamespacesDeleted waits for the total generated namespaces to be
+// gone.
+func (o *generateOptions) waitForNamespacesDeleted(ctx context.Context, c client.Client, total int) error {
+	timeout := 60 * time.Minute
+	interval := 5 * time.Second
+	lastLeft := -1
+	return wait.PollImmediate(interval, timeout, func() (bool, error) {
+		namespaces := corev1.NamespaceList{}
+		err := c.List(ctx, &namespaces, client.MatchingLabels(o.labels()))
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list generated namespaces")
+		}
+		if len(namespaces.Items) != lastLeft {
+			loggerFrom(ctx).Infow("deleting namespaces", "left", len(namespaces.Items), "total", total)
+			lastLeft = len(namespaces.Items)
+		}
+		return len(namespaces.Items) == 0, nil
+	})
+}
+
+// waitForPVsReclaimed waits for the persistent volumes called names to be
+// deleted. Volumes with the Retain reclaim policy are never deleted by the
+// cluster and are left out.
+func waitForPVsReclaimed(ctx context.Context, c client.Client, names []string) error {
+	timeout := 60 * time.Minute
+	interval := 5 * time.Second
+	left := map[string]bool{}
+	for _, name := range names {
+		left[name] = true
+	}
+	lastLeft := -1
+	return wait.PollImmediate(interval, timeout, func() (bool, error) {
+		for name := range left {
+			pv := corev1.PersistentVolume{}
+			err := c.Get(ctx, types.NamespacedName{Name: name}, &pv)
+			switch {
+			case apierrors.IsNotFound(err):
+				delete(left, name)
+			case err != nil:
+				return false, errors.Wrapf(err, "failed to get persistent volume %s", name)
+			case pv.Spec.PersistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimRetain:
+				loggerFrom(ctx).Warnw("persistent volume is retained, delete it by hand", "pv", name)
+				delete(left, name)
+			}
+		}
+		if len(left) != lastLeft {
+			loggerFrom(ctx).Infow("reclaiming persistent volumes", "left", len(left), "total", len(names))
+			lastLeft = len(left)
+		}
+		return len(left) == 0, nil
+	})
+}
@@ -0,0 +1,247 @@
+package perf
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	// Registers the pure Go sqlite driver, so the tool still builds without
+	// cgo.
+	_ "modernc.org/sqlite"
+)
+
+// historySchema creates the table of the history database, one row per run
+// with the JSON results of the run alongside the columns runs are looked up
+// and listed by.
+const historySchema = `CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	backup TEXT NOT NULL,
+	cluster TEXT NOT NULL,
+	mover TEXT NOT NULL,
+	started TIMESTAMP NOT NULL,
+	results TEXT NOT NULL
+)`
+
+// historyMu serializes writes to the history database by the backups run at
+// the same time with backups-per-run or against several clusters.
+var historyMu sync.Mutex
+
+// historyRun is a run read back from the history database, numbered from 1
+// in the order the runs were recorded.
+type historyRun struct {
+	ID      int
+	Results *runResults
+}
+
+// openHistory opens the SQLite history database at path, creating it, its
+// directory and its table if create is set.
+func openHistory(path string, create bool) (*sql.DB, error) {
+	if create {
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create directory of history database %s", path)
+		}
+	} else if _, err := os.Stat(path); err != nil {
+		return nil, errors.Wrapf(err, "failed to open history database %s", path)
+	}
+	// Wait for the backups of other processes recording their runs rather
+	// than failing on the lock they hold.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open history database %s", path)
+	}
+	if create {
+		_, err = db.Exec(historySchema)
+		if err != nil {
+			db.Close()
+			return nil, errors.Wrapf(err, "failed to create the tables of history database %s", path)
+		}
+	}
+	return db, nil
+}
+
+// recordHistory adds the results of a run to the history database at path,
+// creating it and its directory if needed.
+func recordHistory(path string, results *runResults) error {
+	results.mu.Lock()
+	data, err := json.Marshal(results)
+	backup, cluster, mover, started := results.Backup, results.Cluster, results.Mover, results.StartTime
+	results.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal results")
+	}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	db, err := openHistory(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO runs (backup, cluster, mover, started, results) VALUES (?, ?, ?, ?, ?)", backup, cluster, mover, started.UTC(), string(data))
+	if err != nil {
+		return errors.Wrapf(err, "failed to write history database %s", path)
+	}
+	return nil
+}
+
+// readHistory returns every run recorded in the history database at path,
+// oldest first.
+func readHistory(path string) ([]historyRun, error) {
+	db, err := openHistory(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT id, results FROM runs ORDER BY id")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read history database %s", path)
+	}
+	defer rows.Close()
+
+	runs := []historyRun{}
+	for rows.Next() {
+		var id int
+		var data string
+		err := rows.Scan(&id, &data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read history database %s", path)
+		}
+		r, err := decodeResults([]byte(data))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse run %d of history database %s", id, path)
+		}
+		runs = append(runs, historyRun{ID: id, Results: r})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read history database %s", path)
+	}
+	return runs, nil
+}
+
+// findHistoryRun returns the run with the given number, or the latest run of
+// the backup of that name.
+func findHistoryRun(runs []historyRun, ref string) (*historyRun, error) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		for i := range runs {
+			if runs[i].ID == id {
+				return &runs[i], nil
+			}
+		}
+		return nil, errors.Errorf("no run %d in the history, there are %d runs", id, len(runs))
+	}
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].Results.Backup == ref {
+			return &runs[i], nil
+		}
+	}
+	return nil, errors.Errorf("no run of backup %s in the history", ref)
+}
+
+type historyOptions struct {
+	db        string
+	threshold float64
+}
+
+func newHistoryCommand() *cobra.Command {
+	o := &historyOptions{}
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "List, show and diff the runs recorded with backup --history-db",
+		Long: `List, show and diff the runs the backup command recorded in a history
+database with --history-db, to track regressions across regular runs. Runs are
+referred to by their number in the list or by the name of their backup, which
+picks its latest run.`,
+	}
+	cmd.PersistentFlags().StringVar(&o.db, "db", "", "path of the history database given to backup --history-db")
+
+	load := func() ([]historyRun, error) {
+		if o.db == "" {
+			return nil, errors.New("missing db flag")
+		}
+		return readHistory(o.db)
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the recorded runs, oldest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			runs, err := load()
+			if err != nil {
+				return err
+			}
+			printHistory(os.Stdout, runs)
+			return nil
+		},
+	}
+	show := &cobra.Command{
+		Use:   "show <run>",
+		Short: "Summarize a recorded run",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			runs, err := load()
+			if err != nil {
+				return err
+			}
+			run, err := findHistoryRun(runs, args[0])
+			if err != nil {
+				return err
+			}
+			printReport(run.Results)
+			return nil
+		},
+	}
+	diff := &cobra.Command{
+		Use:   "diff <old run> <new run>",
+		Short: "Compare the timings of two recorded runs",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			runs, err := load()
+			if err != nil {
+				return err
+			}
+			old, err := findHistoryRun(runs, args[0])
+			if err != nil {
+				return err
+			}
+			current, err := findHistoryRun(runs, args[1])
+			if err != nil {
+				return err
+			}
+			deltas := compareBaseline(current.Results, old.Results, o.threshold)
+			printBaseline(os.Stdout, fmt.Sprintf("run %d (%s)", old.ID, old.Results.Backup), deltas)
+			return regressionError(deltas, o.threshold)
+		},
+	}
+	diff.Flags().Float64Var(&o.threshold, "regression-threshold", 10, "percentage by which a timing of the new run may be slower than the old run before the command fails")
+
+	cmd.AddCommand(list, show, diff)
+	return cmd
+}
+
+// printHistory prints a table with one row per recorded run.
+func printHistory(out io.Writer, runs []historyRun) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSTARTED\tRUN\tCLUSTER\tMOVER\tVOLUMES\tFAILED\tSNAPSHOT TIME\tDATA MOVER TIME\tTOTAL TIME\tGIB/MIN\tERROR")
+	for _, run := range runs {
+		r := run.Results
+		failed := 0
+		for _, v := range r.Volumes {
+			if v.Error != "" {
+				failed++
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%v\t%v\t%v\t%.2f\t%s\n", run.ID, r.StartTime.Local().Format("2006-01-02 15:04"), r.Backup, r.Cluster, r.Mover, len(r.Volumes), failed, r.SnapshotTime.Round(time.Second), r.DataMoverTime.Round(time.Second), r.TotalTime.Round(time.Second), r.Throughput, r.Error)
+	}
+	w.Flush()
+}
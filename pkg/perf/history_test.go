@@ -0,0 +1,53 @@
+package perf
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history", "runs.db")
+	for _, backup := range []string{"perf-1", "perf-2", "perf-1"} {
+		results := newRunResults([]string{"perf-target"}, 4, scheduleWindow)
+		results.Backup = backup
+		results.Mover = moverVSM
+		if err := recordHistory(path, results); err != nil {
+			t.Fatalf("recordHistory() = %v", err)
+		}
+	}
+
+	runs, err := readHistory(path)
+	if err != nil {
+		t.Fatalf("readHistory() = %v", err)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("got %d runs, want 3", len(runs))
+	}
+	for i, run := range runs {
+		if run.ID != i+1 {
+			t.Errorf("run %d has ID %d, want %d", i, run.ID, i+1)
+		}
+	}
+
+	run, err := findHistoryRun(runs, "perf-1")
+	if err != nil {
+		t.Fatalf("findHistoryRun(perf-1) = %v", err)
+	}
+	if run.ID != 3 {
+		t.Errorf("findHistoryRun(perf-1) found run %d, want the latest, 3", run.ID)
+	}
+	run, err = findHistoryRun(runs, "2")
+	if err != nil || run.Results.Backup != "perf-2" {
+		t.Errorf("findHistoryRun(2) = %v, %v, want run of perf-2", run, err)
+	}
+	if _, err := findHistoryRun(runs, "4"); err == nil {
+		t.Error("findHistoryRun(4) found a run that was never recorded")
+	}
+}
+
+func TestReadHistoryMissing(t *testing.T) {
+	_, err := readHistory(filepath.Join(t.TempDir(), "missing.db"))
+	if err == nil {
+		t.Fatal("readHistory() of a missing database succeeded")
+	}
+}
@@ -0,0 +1,127 @@
+package perf
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// hookAllNamespaces in place of a namespace runs a hook in every namespace
+// of the backup.
+const hookAllNamespaces = "*"
+
+// hookOptions add exec hooks to the backup so databases can be flushed or
+// quiesced before their volumes are snapshotted, as production backups do.
+// Velero runs the pre hooks of a pod before backing it up and the post hooks
+// once its volumes are snapshotted, so their time counts towards the
+// snapshot time.
+type hookOptions struct {
+	// pre and post are <namespace>[/<container>]=<command> specs.
+	pre      []string
+	post     []string
+	selector string
+	timeout  time.Duration
+	onError  string
+}
+
+// hook is a command to run in the pods of a namespace.
+type hook struct {
+	namespace string
+	container string
+	command   string
+}
+
+// parseHook parses <namespace>[/<container>]=<command>. Without a container
+// Velero runs the command in the first container of the pod.
+func parseHook(spec string) (hook, error) {
+	target, command, ok := strings.Cut(spec, "=")
+	if !ok || target == "" || strings.TrimSpace(command) == "" {
+		return hook{}, errors.Errorf("invalid hook %q, must be <namespace>[/<container>]=<command>", spec)
+	}
+	h := hook{namespace: target, command: command}
+	if namespace, container, ok := strings.Cut(target, "/"); ok {
+		if namespace == "" || container == "" {
+			return hook{}, errors.Errorf("invalid hook %q, must be <namespace>[/<container>]=<command>", spec)
+		}
+		h.namespace, h.container = namespace, container
+	}
+	return h, nil
+}
+
+func (h *hookOptions) validate() error {
+	switch velerov1.HookErrorMode(h.onError) {
+	case "", velerov1.HookErrorModeFail, velerov1.HookErrorModeContinue:
+	default:
+		return errors.Errorf("unknown hook-on-error %q, must be Fail or Continue", h.onError)
+	}
+	if h.timeout < 0 {
+		return errors.New("hook-timeout must not be negative")
+	}
+	_, err := h.resources()
+	return err
+}
+
+// resources returns a hook resource per namespace given a hook, in the order
+// the namespaces were first given, with the pre and post hooks of each in
+// the order they were given.
+func (h *hookOptions) resources() ([]velerov1.BackupResourceHookSpec, error) {
+	var selector *metav1.LabelSelector
+	if h.selector != "" {
+		var err error
+		selector, err = metav1.ParseToLabelSelector(h.selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid hook-selector %q", h.selector)
+		}
+	}
+
+	resources := []velerov1.BackupResourceHookSpec{}
+	index := map[string]int{}
+	add := func(specs []string, post bool) error {
+		for _, spec := range specs {
+			parsed, err := parseHook(spec)
+			if err != nil {
+				return err
+			}
+			i, ok := index[parsed.namespace]
+			if !ok {
+				r := velerov1.BackupResourceHookSpec{
+					Name:              "oadp-perf-" + parsed.namespace,
+					IncludedResources: []string{"pods"},
+					LabelSelector:     selector,
+				}
+				if parsed.namespace == hookAllNamespaces {
+					r.Name = "oadp-perf-all"
+				} else {
+					r.IncludedNamespaces = []string{parsed.namespace}
+				}
+				i = len(resources)
+				index[parsed.namespace] = i
+				resources = append(resources, r)
+			}
+			exec := velerov1.BackupResourceHook{Exec: &velerov1.ExecHook{
+				Container: parsed.container,
+				Command:   []string{"/bin/sh", "-c", parsed.command},
+				OnError:   velerov1.HookErrorMode(h.onError),
+				Timeout:   metav1.Duration{Duration: h.timeout},
+			}}
+			if post {
+				resources[i].PostHooks = append(resources[i].PostHooks, exec)
+			} else {
+				resources[i].PreHooks = append(resources[i].PreHooks, exec)
+			}
+		}
+		return nil
+	}
+	err := add(h.pre, false)
+	if err != nil {
+		return nil, err
+	}
+	err = add(h.post, true)
+	if err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
@@ -0,0 +1,253 @@
+package perf
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultImage is used by the pods the tool runs itself. It must provide sh,
+// head, cat and sha256sum.
+const defaultImage = "registry.access.redhat.com/ubi8/ubi-minimal"
+
+// verifyLabel is set on verification pods to the PVC they read.
+const verifyLabel = "oadp-perf/verify"
+
+// generatedPVCs returns the PVCs created by generate in namespaces. Only
+// their data is verified since it is the only data whose layout is known.
+func generatedPVCs(ctx context.Context, c client.Client, namespaces []string) ([]types.NamespacedName, error) {
+	pvcs := []types.NamespacedName{}
+	for _, ns := range namespaces {
+		pvcList := corev1.PersistentVolumeClaimList{}
+		err := c.List(ctx, &pvcList, client.InNamespace(ns), client.HasLabels{generatedLabel})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list persistentvolumeclaims in %s", ns)
+		}
+		for _, pvc := range pvcList.Items {
+			pvcs = append(pvcs, types.NamespacedName{Namespace: pvc.Namespace, Name: pvc.Name})
+		}
+	}
+	return pvcs, nil
+}
+
+// digestPVCs runs a pod per PVC that computes the SHA256 digest of the data
+// written by generate, and returns the digests along with the PVCs that could
+// not be read. Verification pods mount the PVC read only and are scheduled
+// next to any pod already using it so ReadWriteOnce volumes can be shared.
+func digestPVCs(ctx context.Context, c client.Client, clientset kubernetes.Interface, image string, pvcs []types.NamespacedName) (map[types.NamespacedName]string, map[types.NamespacedName]error, error) {
+	digests := map[types.NamespacedName]string{}
+	failures := map[types.NamespacedName]error{}
+	pods := map[types.NamespacedName]*corev1.Pod{}
+	for _, pvc := range pvcs {
+		nodeName, err := nodeUsingPVC(ctx, c, pvc)
+		if err != nil {
+			return nil, nil, err
+		}
+		pod := newVerifyPod(pvc, nodeName, image)
+		err = c.Create(ctx, pod)
+		if err != nil {
+			failures[pvc] = errors.Wrap(err, "failed to create verification pod")
+			continue
+		}
+		pods[pvc] = pod
+	}
+	defer func() {
+		for _, pod := range pods {
+			err := deleteObject(context.Background(), c, pod)
+			if err != nil {
+				loggerFrom(ctx).Errorw("failed to delete verification pod", "error", err)
+			}
+		}
+	}()
+
+	timeout := 30 * time.Minute
+	interval := 5 * time.Second
+	lastDone := -1
+	err := wait.PollImmediate(interval, timeout, func() (bool, error) {
+		done := 0
+		for _, pod := range pods {
+			err := c.Get(ctx, client.ObjectKeyFromObject(pod), pod)
+			if err != nil {
+				return false, errors.Wrapf(err, "failed to get pod %s/%s", pod.Namespace, pod.Name)
+			}
+			if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				done++
+			}
+		}
+		if done != lastDone {
+			loggerFrom(ctx).Infow("checksumming PVCs", "phase", phaseVerify, "done", done, "total", len(pods))
+			lastDone = done
+		}
+		return done == len(pods), nil
+	})
+	if err != nil && err != wait.ErrWaitTimeout {
+		return nil, nil, err
+	}
+
+	for pvc, pod := range pods {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			failures[pvc] = errors.Errorf("verification pod %s/%s finished in phase %s", pod.Namespace, pod.Name, pod.Status.Phase)
+			continue
+		}
+		out, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+		if err != nil {
+			failures[pvc] = errors.Wrapf(err, "failed to read logs of verification pod %s/%s", pod.Namespace, pod.Name)
+			continue
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 {
+			failures[pvc] = errors.Errorf("verification pod %s/%s printed no digest", pod.Namespace, pod.Name)
+			continue
+		}
+		digests[pvc] = fields[0]
+	}
+	return digests, failures, nil
+}
+
+// nodeUsingPVC returns the node of a running pod that mounts pvc, or an empty
+// string if no pod does.
+func nodeUsingPVC(ctx context.Context, c client.Client, pvc types.NamespacedName) (string, error) {
+	podList := corev1.PodList{}
+	err := c.List(ctx, &podList, client.InNamespace(pvc.Namespace))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list pods in %s", pvc.Namespace)
+	}
+	for _, pod := range podList.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvc.Name {
+				return pod.Spec.NodeName, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func newVerifyPod(pvc types.NamespacedName, nodeName, image string) *corev1.Pod {
+	allowPrivilegeEscalation := false
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "oadp-perf-verify-",
+			Namespace:    pvc.Namespace,
+			Labels:       map[string]string{verifyLabel: pvc.Name},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      nodeName,
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{{
+				Name:    "verify",
+				Image:   image,
+				Command: []string{"sha256sum", "/data/fill"},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "data",
+					MountPath: "/data",
+					ReadOnly:  true,
+				}},
+				SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+					SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+				},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: pvc.Name,
+						ReadOnly:  true,
+					},
+				},
+			}},
+		},
+	}
+}
+
+// recordSourceDigests digests the generated data in namespaces before it is
+// backed up. Verification pods are removed before returning so they are not
+// part of the backup.
+func recordSourceDigests(ctx context.Context, c client.Client, clientset kubernetes.Interface, image string, namespaces []string, results *runResults) error {
+	pvcs, err := generatedPVCs(ctx, c, namespaces)
+	if err != nil {
+		return err
+	}
+	if len(pvcs) == 0 {
+		loggerFrom(ctx).Warnw("no PVCs created by generate found, nothing to verify", "phase", phaseVerify)
+		return nil
+	}
+	loggerFrom(ctx).Infow("recording digests before the backup", "phase", phaseVerify, "pvcs", len(pvcs))
+	digests, failures, err := digestPVCs(ctx, c, clientset, image, pvcs)
+	if err != nil {
+		return err
+	}
+	for _, pvc := range pvcs {
+		results.sourceDigest(pvc.Namespace, pvc.Name, digests[pvc], failures[pvc])
+	}
+	return waitForVerifyPodsDeleted(ctx, c, namespaces)
+}
+
+// verifyRestoredDigests digests the restored PVCs and compares them with the
+// digests recorded before the backup, returning an error if any differ. The
+// PVCs are looked for in the namespaces mappings restored their namespaces
+// into, if any.
+func verifyRestoredDigests(ctx context.Context, c client.Client, clientset kubernetes.Interface, image string, results *runResults, mappings map[string]string) error {
+	pvcs := results.digestedPVCs()
+	if len(pvcs) == 0 {
+		return nil
+	}
+	restored := make([]types.NamespacedName, 0, len(pvcs))
+	for _, pvc := range pvcs {
+		restored = append(restored, types.NamespacedName{Namespace: mappedNamespace(mappings, pvc.Namespace), Name: pvc.Name})
+	}
+	loggerFrom(ctx).Infow("verifying digests of restored PVCs", "phase", phaseVerify, "pvcs", len(pvcs))
+	digests, failures, err := digestPVCs(ctx, c, clientset, image, restored)
+	if err != nil {
+		return err
+	}
+	for i, pvc := range pvcs {
+		results.restoredDigest(pvc.Namespace, pvc.Name, digests[restored[i]], failures[restored[i]])
+	}
+	corrupted, unverified := 0, 0
+	for _, v := range results.integrityResults() {
+		switch {
+		case v.Corrupted:
+			loggerFrom(ctx).Errorw("restored PVC is corrupted", "phase", phaseVerify, "namespace", v.Namespace, "pvc", v.PVC, "sourceSHA256", v.SourceSHA256, "restoredSHA256", v.RestoredSHA256)
+			corrupted++
+		case v.Error != "":
+			loggerFrom(ctx).Errorw("failed to verify PVC", "phase", phaseVerify, "namespace", v.Namespace, "pvc", v.PVC, "error", v.Error)
+			unverified++
+		}
+	}
+	if corrupted != 0 || unverified != 0 {
+		return errors.Errorf("%v restored PVCs do not match their data before the backup and %v could not be verified", corrupted, unverified)
+	}
+	loggerFrom(ctx).Infow("all restored PVCs match their data before the backup", "phase", phaseVerify, "pvcs", len(pvcs))
+	return nil
+}
+
+func waitForVerifyPodsDeleted(ctx context.Context, c client.Client, namespaces []string) error {
+	timeout := 5 * time.Minute
+	interval := 2 * time.Second
+	return wait.PollImmediate(interval, timeout, func() (bool, error) {
+		for _, ns := range namespaces {
+			podList := corev1.PodList{}
+			err := c.List(ctx, &podList, client.InNamespace(ns), client.HasLabels{verifyLabel})
+			if err != nil {
+				return false, errors.Wrapf(err, "failed to list verification pods in %s", ns)
+			}
+			if len(podList.Items) != 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
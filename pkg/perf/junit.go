@@ -0,0 +1,176 @@
+package perf
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// JUnit XML as read by Prow, Jenkins and Tekton: a suite per namespace with
+// a test case per volume, plus suites for the phases of the run and for the
+// data verification.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+
+	duration time.Duration
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// add appends c to the suite and counts it.
+func (s *junitTestSuite) add(c junitTestCase, d time.Duration) {
+	s.Cases = append(s.Cases, c)
+	s.Tests++
+	if c.Failure != nil {
+		s.Failures++
+	}
+	if c.Skipped != nil {
+		s.Skipped++
+	}
+	s.duration += d
+	s.Time = junitSeconds(s.duration)
+}
+
+// writeJUnit writes the results as JUnit XML. The phase a failed run ended
+// in, and failed, stalled and uncreated VSBs are failures, as are the volumes
+// a failed run never got to. The caller must hold r.mu.
+func (r *runResults) writeJUnit(w io.Writer) error {
+	// The phase the run failed in is the first that did not finish.
+	var runFailure *junitFailure
+	if r.Error != "" {
+		runFailure = &junitFailure{Message: r.Error, Type: "failed"}
+		if strings.Contains(r.Error, wait.ErrWaitTimeout.Error()) {
+			runFailure.Type = "timeout"
+		}
+	}
+	phases := junitTestSuite{Name: fmt.Sprintf("%s phases", r.Backup)}
+	phase := func(name string, end time.Time, d time.Duration) {
+		c := junitTestCase{Name: name, Classname: "phases", Time: junitSeconds(d)}
+		switch {
+		case !end.IsZero():
+		case runFailure != nil:
+			c.Failure, runFailure = runFailure, nil
+		default:
+			c.Skipped = &junitSkipped{Message: "the run failed before the phase finished"}
+		}
+		phases.add(c, d)
+	}
+	phase("snapshot", r.SnapshotEndTime, r.SnapshotTime)
+	if r.Mover != modeCSI {
+		phase("data mover", r.DataMoverEndTime, r.DataMoverTime)
+	}
+	if runFailure != nil {
+		// the run failed after moving the data, restoring or verifying it
+		phases.add(junitTestCase{Name: "run", Classname: "phases", Time: junitSeconds(r.TotalTime), Failure: runFailure}, 0)
+	}
+	suites := []junitTestSuite{phases}
+
+	byNamespace := map[string]*junitTestSuite{}
+	for _, v := range r.Volumes {
+		suite := byNamespace[v.Namespace]
+		if suite == nil {
+			suite = &junitTestSuite{Name: v.Namespace}
+			byNamespace[v.Namespace] = suite
+		}
+		name := v.PVC
+		if name == "" {
+			name = v.VolumeSnapshotContent
+		}
+		c := junitTestCase{Name: name, Classname: v.Namespace, Time: junitSeconds(v.VSBDuration)}
+		text := fmt.Sprintf("volumesnapshotcontent %s\nvolumesnapshotbackup %s\nbatch %d", v.VolumeSnapshotContent, v.VolumeSnapshotBackup, v.Batch)
+		switch {
+		case v.Stalled:
+			c.Failure = &junitFailure{Message: v.Error, Type: "stalled", Text: text}
+		case v.CreateFailed:
+			c.Failure = &junitFailure{Message: v.Error, Type: "createFailed", Text: text}
+		case v.Error != "":
+			c.Failure = &junitFailure{Message: v.Error, Type: "failed", Text: text}
+		case r.Mover != modeCSI && v.VSBCompletionTime.IsZero() && r.Error != "":
+			c.Failure = &junitFailure{Message: "the run ended before the data of the volume was moved", Type: "incomplete", Text: text}
+		case r.Mover != modeCSI && v.VSBCompletionTime.IsZero():
+			c.Skipped = &junitSkipped{Message: "the data of the volume was not moved"}
+		}
+		suite.add(c, v.VSBDuration)
+	}
+	namespaces := make([]string, 0, len(byNamespace))
+	for ns := range byNamespace {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		suites = append(suites, *byNamespace[ns])
+	}
+
+	if len(r.Integrity) > 0 {
+		integrity := junitTestSuite{Name: fmt.Sprintf("%s integrity", r.Backup)}
+		for _, v := range r.Integrity {
+			c := junitTestCase{Name: v.PVC, Classname: v.Namespace, Time: "0"}
+			switch {
+			case v.Corrupted:
+				c.Failure = &junitFailure{Message: "restored data differs from the source", Type: "corrupted", Text: fmt.Sprintf("source %s\nrestored %s", v.SourceSHA256, v.RestoredSHA256)}
+			case v.Error != "":
+				c.Failure = &junitFailure{Message: v.Error, Type: "unverified"}
+			}
+			integrity.add(c, 0)
+		}
+		suites = append(suites, integrity)
+	}
+
+	all := junitTestSuites{Name: r.Backup, Time: junitSeconds(r.TotalTime), Suites: suites}
+	for _, s := range suites {
+		all.Tests += s.Tests
+		all.Failures += s.Failures
+	}
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(all)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,63 @@
+package perf
+
+import (
+	"context"
+
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// listPageSize is how many objects each request of a paginated list asks the
+// API server for, so the thousands of snapshots of a large run are not
+// returned in one slow response.
+const listPageSize = 500
+
+// listAll lists every object matching opts into list, a page of listPageSize
+// at a time when reading from the API server. Informer caches already hold
+// every object and ignore continue tokens, so they are listed in one call.
+func listAll(ctx context.Context, c client.Reader, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := c.(cache.Cache); ok {
+		return c.List(ctx, list, opts...)
+	}
+
+	items := []runtime.Object{}
+	var page client.ObjectList
+	continueToken := ""
+	for {
+		page = list.DeepCopyObject().(client.ObjectList)
+		pageOpts := append([]client.ListOption{client.Limit(listPageSize), client.Continue(continueToken)}, opts...)
+		err := c.List(ctx, page, pageOpts...)
+		if err != nil {
+			return err
+		}
+		pageItems, err := apimeta.ExtractList(page)
+		if err != nil {
+			return errors.Wrap(err, "failed to read list")
+		}
+		items = append(items, pageItems...)
+		continueToken = page.GetContinue()
+		if continueToken == "" {
+			break
+		}
+	}
+	list.SetResourceVersion(page.GetResourceVersion())
+	list.SetContinue("")
+	return apimeta.SetList(list, items)
+}
+
+// countVolumeSnapshotContents returns how many VSCs the backup called name
+// has, listing only their metadata since nothing else of them is needed.
+func countVolumeSnapshotContents(ctx context.Context, c client.Reader, name string) (int, error) {
+	list := &metav1.PartialObjectMetadataList{}
+	list.SetGroupVersionKind(v1.SchemeGroupVersion.WithKind("VolumeSnapshotContentList"))
+	err := listAll(ctx, c, list, client.MatchingLabels{"velero.io/backup-name": name})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list volumesnapshotcontents")
+	}
+	return len(list.Items), nil
+}
@@ -0,0 +1,84 @@
+package perf
+
+import (
+	"context"
+
+	"github.com/go-logr/zapr"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Phases of a run, logged as the phase field.
+const (
+	phaseBackup    = "backup"
+	phaseSnapshot  = "snapshot"
+	phaseDataMover = "datamover"
+	phaseRestore   = "restore"
+	phaseVerify    = "verify"
+	phaseDeletion  = "deletion"
+	phaseDisaster  = "disaster"
+)
+
+// nopLogger is what work is logged to when its context carries no logger,
+// such as the runs of a Runner not given one.
+var nopLogger = zap.NewNop().Sugar()
+
+// logConfig is the config the logger of the command was built from, kept so
+// the status display can encode log messages the same way.
+var logConfig = zap.NewProductionConfig()
+
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx carrying l, which the work done under ctx
+// logs to.
+func withLogger(ctx context.Context, l *zap.SugaredLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger ctx carries, or one that drops everything if
+// it carries none.
+func loggerFrom(ctx context.Context) *zap.SugaredLogger {
+	if l, ok := ctx.Value(loggerKey{}).(*zap.SugaredLogger); ok {
+		return l
+	}
+	return nopLogger
+}
+
+// setupLogging builds the logger of the command from the log-level and
+// log-format flags. The controller-runtime logger is pointed at the same
+// output.
+func setupLogging(level, format string) (*zap.SugaredLogger, error) {
+	var lvl zapcore.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, errors.Errorf("unknown log level %q, must be one of debug, info, warn or error", level)
+	}
+
+	config := zap.NewProductionConfig()
+	config.Level = zap.NewAtomicLevelAt(lvl)
+	config.Sampling = nil
+	config.DisableStacktrace = true
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	switch format {
+	case logFormatJSON:
+	case logFormatText:
+		config.Encoding = "console"
+		config.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	default:
+		return nil, errors.Errorf("unknown log format %q, must be one of %s or %s", format, logFormatText, logFormatJSON)
+	}
+	z, err := config.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build logger")
+	}
+	logConfig = config
+	ctrllog.SetLogger(zapr.NewLogger(z))
+	return z.Sugar(), nil
+}
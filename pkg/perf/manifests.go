@@ -0,0 +1,189 @@
+package perf
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+type manifestsOptions struct {
+	namespace string
+	name      string
+	image     string
+}
+
+func newManifestsCommand() *cobra.Command {
+	o := &manifestsOptions{}
+	cmd := &cobra.Command{
+		Use:   "manifests --image <image> -- <command> [flags]",
+		Short: "Print the manifests to run a command of the tool as a Job in the cluster",
+		Long: `Print a Namespace, ServiceAccount, ClusterRole, ClusterRoleBinding and Job
+running the given command of the tool, with its flags, inside the cluster.
+Running in the cluster keeps the latency to the API server from skewing the
+timings. Apply the output with oc apply -f - and follow the run with
+oc logs -f job/<name>.
+
+The tool reads cluster scoped objects such as VolumeSnapshotContents and
+Namespaces, so it is granted a ClusterRole rather than a Role.`,
+		Example: `  oadp-perf manifests --image quay.io/example/oadp-perf:latest -- backup --namespaces perf-1,perf-2 --concurrency 20`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.image == "" {
+				return errors.New("missing image flag")
+			}
+			if len(args) == 0 {
+				return errors.New("missing command to run, pass it after --")
+			}
+			return o.write(os.Stdout, args)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.namespace, "namespace", "oadp-perf", "namespace to run the Job in")
+	flags.StringVar(&o.name, "name", "oadp-perf", "name of the Job and of the ServiceAccount and RBAC objects it runs with")
+	flags.StringVar(&o.image, "image", "", "image containing the oadp-perf binary")
+	return cmd
+}
+
+// write prints the manifests as a multi-document YAML stream.
+func (o *manifestsOptions) write(out io.Writer, args []string) error {
+	for _, obj := range o.objects(args) {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal manifest")
+		}
+		fmt.Fprintf(out, "---\n%s", data)
+	}
+	return nil
+}
+
+func (o *manifestsOptions) objects(args []string) []runtime.Object {
+	labels := map[string]string{"app.kubernetes.io/name": "oadp-perf"}
+	meta := func(namespace string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: o.name, Namespace: namespace, Labels: labels}
+	}
+	allVerbs := []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+	readVerbs := []string{"get", "list", "watch"}
+	backoffLimit := int32(0)
+	runAsNonRoot := true
+	allowPrivilegeEscalation := false
+
+	return []runtime.Object{
+		&corev1.Namespace{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.namespace, Labels: labels},
+		},
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: meta(o.namespace),
+		},
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+			ObjectMeta: meta(""),
+			Rules: []rbacv1.PolicyRule{
+				{
+					APIGroups: []string{"velero.io"},
+					Resources: []string{"backups", "restores", "deletebackuprequests", "podvolumebackups", "datauploads", "datadownloads"},
+					Verbs:     allVerbs,
+				},
+				{
+					APIGroups: []string{"datamover.oadp.openshift.io"},
+					Resources: []string{"volumesnapshotbackups", "volumesnapshotrestores"},
+					Verbs:     allVerbs,
+				},
+				{
+					APIGroups: []string{"snapshot.storage.k8s.io"},
+					Resources: []string{"volumesnapshotcontents", "volumesnapshots", "volumesnapshotclasses"},
+					Verbs:     allVerbs,
+				},
+				{
+					APIGroups: []string{"volsync.backube"},
+					Resources: []string{"replicationsources", "replicationdestinations"},
+					Verbs:     allVerbs,
+				},
+				{
+					APIGroups: []string{"perf.konveyor.io"},
+					Resources: []string{"perftests", "perftests/status"},
+					Verbs:     allVerbs,
+				},
+				{
+					APIGroups: []string{"oadp.openshift.io"},
+					Resources: []string{"dataprotectionapplications"},
+					Verbs:     readVerbs,
+				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"namespaces", "persistentvolumeclaims", "pods", "secrets"},
+					Verbs:     allVerbs,
+				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"pods/log", "persistentvolumes", "events"},
+					Verbs:     readVerbs,
+				},
+				{
+					APIGroups: []string{"storage.k8s.io"},
+					Resources: []string{"storageclasses"},
+					Verbs:     readVerbs,
+				},
+				{
+					APIGroups: []string{"apps"},
+					Resources: []string{"deployments"},
+					Verbs:     readVerbs,
+				},
+			},
+		},
+		&rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+			ObjectMeta: meta(""),
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "ClusterRole",
+				Name:     o.name,
+			},
+			Subjects: []rbacv1.Subject{
+				{Kind: "ServiceAccount", Name: o.name, Namespace: o.namespace},
+			},
+		},
+		&batchv1.Job{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+			ObjectMeta: meta(o.namespace),
+			Spec: batchv1.JobSpec{
+				// A failed run has already created objects in the
+				// cluster, so it is not retried.
+				BackoffLimit: &backoffLimit,
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec: corev1.PodSpec{
+						ServiceAccountName: o.name,
+						RestartPolicy:      corev1.RestartPolicyNever,
+						Containers: []corev1.Container{
+							{
+								Name:  "oadp-perf",
+								Image: o.image,
+								Args:  args,
+								// Results files are written to the working
+								// directory, which must be writable.
+								WorkingDir: "/tmp",
+								SecurityContext: &corev1.SecurityContext{
+									RunAsNonRoot:             &runAsNonRoot,
+									AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+									Capabilities: &corev1.Capabilities{
+										Drop: []corev1.Capability{"ALL"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,190 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metrics published on --metrics-addr while a run executes. They are updated
+// from runResults so every code path that records a timing also shows up in
+// Prometheus. Runs against several clusters or shards at once each record
+// theirs under their own cluster and shard labels, which are empty otherwise.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+	runLabels       = []string{"cluster", "shard"}
+
+	vscsReadyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "oadp_perf_vscs_ready",
+		Help: "Number of VolumeSnapshotContents of the run that are ready to use.",
+	}, runLabels)
+	vsbsPendingGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "oadp_perf_vsbs_pending",
+		Help: "Number of VolumeSnapshotContents still waiting for a VolumeSnapshotBackup.",
+	}, runLabels)
+	vsbsRunningGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "oadp_perf_vsbs_running",
+		Help: "Number of VolumeSnapshotBackups created but not yet completed.",
+	}, runLabels)
+	vsbsCompletedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "oadp_perf_vsbs_completed_total",
+		Help: "Number of VolumeSnapshotBackups that completed.",
+	}, runLabels)
+	vsbsFailedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "oadp_perf_vsbs_failed_total",
+		Help: "Number of VolumeSnapshotBackups that could not be created or stopped making progress.",
+	}, runLabels)
+	vsbDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oadp_perf_vsb_duration_seconds",
+		Help:    "Time from VolumeSnapshotBackup creation to completion.",
+		Buckets: prometheus.ExponentialBuckets(15, 2, 10),
+	}, runLabels)
+	batchDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oadp_perf_batch_duration_seconds",
+		Help:    "Time taken by each batch of VolumeSnapshotBackups when using the batch schedule.",
+		Buckets: prometheus.ExponentialBuckets(15, 2, 10),
+	}, runLabels)
+	etaGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "oadp_perf_eta_seconds",
+		Help: "Estimated time left until every VolumeSnapshotBackup of the run is done.",
+	}, runLabels)
+
+	runElapsed = &elapsedCollector{
+		desc:   prometheus.NewDesc("oadp_perf_elapsed_seconds", "Time elapsed since the run started.", runLabels, nil),
+		starts: map[[2]string]time.Time{},
+	}
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		vscsReadyGauge,
+		vsbsPendingGauge,
+		vsbsRunningGauge,
+		vsbsCompletedCounter,
+		vsbsFailedCounter,
+		vsbDurationHistogram,
+		batchDurationHistogram,
+		etaGauge,
+		runElapsed,
+	)
+}
+
+// runMetrics are the metrics of one run, labelled with its cluster and shard.
+type runMetrics struct {
+	cluster string
+	shard   string
+
+	vscsReady     prometheus.Gauge
+	vsbsPending   prometheus.Gauge
+	vsbsRunning   prometheus.Gauge
+	vsbsCompleted prometheus.Counter
+	vsbsFailed    prometheus.Counter
+	vsbDuration   prometheus.Observer
+	batchDuration prometheus.Observer
+	eta           prometheus.Gauge
+}
+
+func newRunMetrics(cluster, shard string) *runMetrics {
+	labels := prometheus.Labels{"cluster": cluster, "shard": shard}
+	return &runMetrics{
+		cluster:       cluster,
+		shard:         shard,
+		vscsReady:     vscsReadyGauge.With(labels),
+		vsbsPending:   vsbsPendingGauge.With(labels),
+		vsbsRunning:   vsbsRunningGauge.With(labels),
+		vsbsCompleted: vsbsCompletedCounter.With(labels),
+		vsbsFailed:    vsbsFailedCounter.With(labels),
+		vsbDuration:   vsbDurationHistogram.With(labels),
+		batchDuration: batchDurationHistogram.With(labels),
+		eta:           etaGauge.With(labels),
+	}
+}
+
+// started records the start of the run for oadp_perf_elapsed_seconds.
+func (m *runMetrics) started(t time.Time) {
+	runElapsed.mu.Lock()
+	defer runElapsed.mu.Unlock()
+	runElapsed.starts[[2]string{m.cluster, m.shard}] = t
+}
+
+// gatherer returns the metrics of the run alone, leaving out those of the
+// runs of other clusters and shards.
+func (m *runMetrics) gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := metricsRegistry.Gather()
+		if err != nil {
+			return nil, err
+		}
+		run := []*dto.MetricFamily{}
+		for _, family := range families {
+			metrics := []*dto.Metric{}
+			for _, metric := range family.Metric {
+				if hasRunLabels(metric, m.cluster, m.shard) {
+					metrics = append(metrics, metric)
+				}
+			}
+			if len(metrics) != 0 {
+				family.Metric = metrics
+				run = append(run, family)
+			}
+		}
+		return run, nil
+	})
+}
+
+func hasRunLabels(metric *dto.Metric, cluster, shard string) bool {
+	for _, label := range metric.GetLabel() {
+		switch label.GetName() {
+		case "cluster":
+			if label.GetValue() != cluster {
+				return false
+			}
+		case "shard":
+			if label.GetValue() != shard {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// elapsedCollector reports the time elapsed since the latest run of each
+// cluster and shard started, worked out when the metrics are scraped.
+type elapsedCollector struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	starts map[[2]string]time.Time
+}
+
+func (c *elapsedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *elapsedCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for labels, start := range c.starts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(start).Seconds(), labels[0], labels[1])
+	}
+}
+
+// serveMetrics publishes the run metrics on addr in the background. The
+// server lives until the process exits.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			loggerFrom(ctx).Errorw("failed to serve metrics", "addr", addr, "error", err)
+		}
+	}()
+	loggerFrom(ctx).Infow("serving metrics", "url", fmt.Sprintf("http://%s/metrics", addr))
+}
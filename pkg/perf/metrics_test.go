@@ -0,0 +1,47 @@
+package perf
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRunMetricsOfConcurrentRuns(t *testing.T) {
+	east := newRunMetrics("test-east", "")
+	west := newRunMetrics("test-west", "1")
+	east.vsbsCompleted.Add(3)
+	west.vsbsCompleted.Add(5)
+	east.started(time.Now().Add(-time.Hour))
+	west.started(time.Now())
+
+	families, err := east.gatherer().Gather()
+	if err != nil {
+		t.Fatalf("Gather() = %v", err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			if !hasRunLabels(metric, "test-east", "") {
+				t.Errorf("%s of the east run has labels %v", family.GetName(), metric.GetLabel())
+			}
+			values[family.GetName()] = metricValue(metric)
+		}
+	}
+	if got := values["oadp_perf_vsbs_completed_total"]; got != 3 {
+		t.Errorf("got %v VSBs completed, want 3", got)
+	}
+	if got := values["oadp_perf_elapsed_seconds"]; got < time.Hour.Seconds() {
+		t.Errorf("got %vs elapsed, want at least an hour", got)
+	}
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Counter != nil:
+		return metric.Counter.GetValue()
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue()
+	}
+	return 0
+}
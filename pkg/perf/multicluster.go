@@ -0,0 +1,123 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// clusterRun is the outcome of the backup of one cluster.
+type clusterRun struct {
+	cluster string
+	results *runResults
+	err     error
+}
+
+// clusterOptions returns the options of the backup of each cluster given with
+// --kubeconfigs or --contexts, named after its context or kubeconfig file.
+func (o *backupOptions) clusterOptions() []*backupOptions {
+	clusters := []*backupOptions{}
+	seen := map[string]int{}
+	add := func(name, kubeconfig, context string) {
+		seen[name]++
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, seen[name])
+		}
+		root := *o.rootOptions
+		root.kubeconfig = kubeconfig
+		root.context = context
+		clusterOptions := *o
+		clusterOptions.rootOptions = &root
+		clusterOptions.cluster = name
+		clusterOptions.sharded = true
+		clusters = append(clusters, &clusterOptions)
+	}
+	for _, kubeconfig := range o.kubeconfigs {
+		add(strings.TrimSuffix(filepath.Base(kubeconfig), filepath.Ext(kubeconfig)), kubeconfig, o.context)
+	}
+	for _, context := range o.contexts {
+		add(context, o.kubeconfig, context)
+	}
+	return clusters
+}
+
+// backupClusters runs the same backup against every cluster at the same time,
+// then prints their timings side by side so storage backends can be compared
+// across environments.
+func (o *backupOptions) backupClusters(ctx context.Context, flags *pflag.FlagSet, out io.Writer) error {
+	clusters := o.clusterOptions()
+	loggerFrom(ctx).Infow("running backups against clusters at once", "clusters", len(clusters))
+
+	runs := make([]clusterRun, len(clusters))
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		wg.Add(1)
+		go func(i int, o *backupOptions) {
+			defer wg.Done()
+			runs[i] = clusterRun{cluster: o.cluster}
+			c, err := o.connect(ctx, flags)
+			if err == nil {
+				runs[i].results, err = o.backup(ctx, c)
+			}
+			if err != nil {
+				loggerFrom(ctx).Errorw("backup failed", "cluster", o.cluster, "error", err)
+				runs[i].err = err
+				return
+			}
+			loggerFrom(ctx).Infow("backup done", "cluster", o.cluster, "run", runs[i].results.Backup, "total", runs[i].results.TotalTime.String())
+		}(i, cluster)
+	}
+	wg.Wait()
+
+	printClusters(out, runs)
+	failed := []string{}
+	for _, r := range runs {
+		if r.err != nil {
+			failed = append(failed, errors.Wrapf(r.err, "cluster %s", r.cluster).Error())
+		}
+	}
+	if len(failed) != 0 {
+		return errors.Errorf("%d of %d clusters failed: %s", len(failed), len(runs), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// printClusters prints the timings and throughput of the backup of each
+// cluster.
+func printClusters(out io.Writer, runs []clusterRun) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tRUN\tVOLUMES\tFAILED\tSNAPSHOT TIME\tDATA MOVER TIME\tTOTAL TIME\tVSB P95\tGIB/MIN\tERROR")
+	for _, r := range runs {
+		run, volumes, failed := "", 0, 0
+		var snapshot, transfer, total, p95 time.Duration
+		var throughput float64
+		if r.results != nil {
+			run = r.results.Backup
+			volumes = len(r.results.Volumes)
+			for _, v := range r.results.Volumes {
+				if v.Error != "" {
+					failed++
+				}
+			}
+			snapshot = r.results.SnapshotTime
+			transfer = r.results.DataMoverTime
+			total = r.results.TotalTime
+			_, p95 = vsbPercentiles(r.results)
+			throughput = r.results.Throughput
+		}
+		errMsg := ""
+		if r.err != nil {
+			errMsg = r.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%v\t%v\t%v\t%v\t%.2f\t%s\n", r.cluster, run, volumes, failed, snapshot.Round(time.Second), transfer.Round(time.Second), total.Round(time.Second), p95.Round(time.Second), throughput, errMsg)
+	}
+	w.Flush()
+}
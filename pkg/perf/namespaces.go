@@ -0,0 +1,98 @@
+package perf
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// resolveNamespaces returns the namespaces of the run: those listed by the
+// namespaces and namespaces-file flags followed by those whose labels match
+// namespace-selector, less those matching exclude-namespaces.
+func (o *backupOptions) resolveNamespaces(ctx context.Context, c client.Reader) ([]string, error) {
+	namespaces := []string{}
+	if o.namespaces != "" || o.namespacesFile != "" || o.namespaceSelector == "" {
+		listed, err := parseNamespaces(o.namespaces, o.namespacesFile)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = listed
+	}
+	if o.namespaceSelector != "" {
+		discovered, err := discoverNamespaces(ctx, c, o.namespaceSelector)
+		if err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, ns := range namespaces {
+			seen[ns] = true
+		}
+		for _, ns := range discovered {
+			if !seen[ns] {
+				namespaces = append(namespaces, ns)
+			}
+		}
+		loggerFrom(ctx).Infow("discovered namespaces", "selector", o.namespaceSelector, "count", len(discovered))
+	}
+	if o.excludeNamespaces != "" {
+		var excluded []string
+		namespaces, excluded = excludeNamespaces(namespaces, strings.Split(o.excludeNamespaces, ","))
+		if len(excluded) > 0 {
+			loggerFrom(ctx).Infow("excluded namespaces", "count", len(excluded), "namespaces", strings.Join(excluded, ","))
+		}
+	}
+	if len(namespaces) == 0 {
+		return nil, errors.New("no namespaces left to back up, check the namespace-selector and exclude-namespaces flags")
+	}
+	return namespaces, nil
+}
+
+// discoverNamespaces returns the namespaces whose labels match selector,
+// sorted by name.
+func discoverNamespaces(ctx context.Context, c client.Reader, selector string) ([]string, error) {
+	s, err := labels.Parse(selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid namespace-selector %q", selector)
+	}
+	list := corev1.NamespaceList{}
+	err = listAll(ctx, c, &list, client.MatchingLabelsSelector{Selector: s})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list namespaces")
+	}
+	namespaces := []string{}
+	for _, ns := range list.Items {
+		if ns.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+		namespaces = append(namespaces, ns.Name)
+	}
+	return namespaces, nil
+}
+
+// excludeNamespaces removes the namespaces matching any of patterns, which are
+// names or shell patterns such as perf-target-1*, returning the namespaces
+// kept and those removed.
+func excludeNamespaces(namespaces, patterns []string) ([]string, []string) {
+	kept, excluded := []string{}, []string{}
+	for _, ns := range namespaces {
+		match := false
+		for _, pattern := range patterns {
+			pattern = strings.TrimSpace(pattern)
+			if ok, _ := path.Match(pattern, ns); ok && pattern != "" {
+				match = true
+				break
+			}
+		}
+		if match {
+			excluded = append(excluded, ns)
+		} else {
+			kept = append(kept, ns)
+		}
+	}
+	return kept, excluded
+}
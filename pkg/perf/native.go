@@ -0,0 +1,246 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// moverVSM drives the OADP 1.2 volume snapshot mover, which moves
+	// snapshot data with volsync once the tool creates VolumeSnapshotBackups.
+	moverVSM = "vsm"
+	// moverNative relies on the data mover built into Velero 1.12+ (OADP
+	// 1.3+), which uploads snapshot data with kopia through DataUploads that
+	// Velero creates itself.
+	moverNative = "native"
+)
+
+// dataUploadGVK is newer than the Velero client the tool is built against, so
+// DataUploads are handled as unstructured objects.
+var dataUploadGVK = schema.GroupVersionKind{Group: "velero.io", Version: "v2alpha1", Kind: "DataUpload"}
+
+// Backup phases added after Velero 1.10 for asynchronous plugin operations
+// such as DataUploads.
+const (
+	backupPhaseWaitingForPluginOperations                = "WaitingForPluginOperations"
+	backupPhaseWaitingForPluginOperationsPartiallyFailed = "WaitingForPluginOperationsPartiallyFailed"
+	backupPhaseFinalizing                                = "Finalizing"
+	backupPhaseFinalizingPartiallyFailed                 = "FinalizingPartiallyFailed"
+)
+
+// DataUpload phases.
+const (
+	dataUploadPhaseCompleted = "Completed"
+	dataUploadPhaseFailed    = "Failed"
+	dataUploadPhaseCanceled  = "Canceled"
+)
+
+func newDataUpload() *unstructured.Unstructured {
+	du := &unstructured.Unstructured{}
+	du.SetGroupVersionKind(dataUploadGVK)
+	return du
+}
+
+func listDataUploads(ctx context.Context, c client.Reader, name string) (*unstructured.UnstructuredList, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(dataUploadGVK.GroupVersion().WithKind(dataUploadGVK.Kind + "List"))
+	err := c.List(ctx, list, client.MatchingLabels{"velero.io/backup-name": name})
+	return list, err
+}
+
+// runNative times a backup made with the native data mover. Velero creates
+// and schedules the DataUploads itself, so the tool only observes them: the
+// snapshot phase ends once the backup is waiting on its DataUploads and the
+// data mover phase ends once every DataUpload has finished.
+func (o *backupOptions) runNative(ctx context.Context, c client.Client, w *runWatcher, results *runResults) error {
+	name := results.Backup
+	err := waitForBackupPhase(ctx, c, o.veleroNamespace, name, backupPhaseWaitingForPluginOperations)
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for snapshots to be taken", "phase", phaseSnapshot)
+			return withExitCode(err, exitVSCTimeout)
+		}
+		return err
+	}
+	snapshotEndTime := time.Now()
+	results.snapshotsDone(snapshotEndTime)
+	loggerFrom(ctx).Infow("snapshots done", "phase", phaseSnapshot, "elapsed", snapshotEndTime.Sub(results.StartTime).String())
+	annotateBackup(ctx, c, o.veleroNamespace, results)
+
+	err = waitForDataUploadsToComplete(ctx, w, name, results, o.onFailure == onFailureAbort)
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for DataUploads to complete", "phase", phaseDataMover)
+			return withExitCode(err, exitDataMoverTimeout)
+		}
+		return err
+	}
+	dataMoverEndTime := time.Now()
+	results.dataMoverDone(dataMoverEndTime)
+	loggerFrom(ctx).Infow("data mover done", "phase", phaseDataMover, "elapsed", dataMoverEndTime.Sub(snapshotEndTime).String(), "total", dataMoverEndTime.Sub(results.StartTime).String(), "throughput", fmt.Sprintf("%.2f GiB/min", results.Throughput))
+
+	err = waitForBackupToComplete(ctx, c, o.veleroNamespace, name)
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for backup to complete", "phase", phaseBackup)
+		}
+		return err
+	}
+	return nil
+}
+
+// waitForBackupPhase waits for the backup to reach phase or any phase after
+// it. Backups that fail are reported as errors.
+func waitForBackupPhase(ctx context.Context, c client.Client, namespace, name string, phase velerov1.BackupPhase) error {
+	order := []velerov1.BackupPhase{
+		velerov1.BackupPhaseNew,
+		velerov1.BackupPhaseInProgress,
+		backupPhaseWaitingForPluginOperations,
+		backupPhaseFinalizing,
+		velerov1.BackupPhaseCompleted,
+	}
+	rank := func(p velerov1.BackupPhase) int {
+		switch p {
+		case backupPhaseWaitingForPluginOperationsPartiallyFailed:
+			p = backupPhaseWaitingForPluginOperations
+		case backupPhaseFinalizingPartiallyFailed:
+			p = backupPhaseFinalizing
+		case velerov1.BackupPhasePartiallyFailed:
+			p = velerov1.BackupPhaseCompleted
+		}
+		for i, candidate := range order {
+			if candidate == p {
+				return i
+			}
+		}
+		return 0
+	}
+
+	timeout := 120 * time.Minute
+	interval := 5 * time.Second
+	return wait.PollImmediate(interval, timeout, func() (bool, error) {
+		backup := velerov1.Backup{}
+		err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &backup)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to get backup")
+		}
+		switch backup.Status.Phase {
+		case velerov1.BackupPhaseFailed, velerov1.BackupPhaseFailedValidation:
+			return false, errors.Errorf("backup %s finished with phase %s", name, backup.Status.Phase)
+		}
+		if rank(backup.Status.Phase) >= rank(phase) {
+			return true, nil
+		}
+		loggerFrom(ctx).Infow("waiting for backup", "phase", phaseBackup, "backupPhase", backup.Status.Phase)
+		return false, nil
+	})
+}
+
+// waitForDataUploadsToComplete waits for every DataUpload of the backup to
+// finish, recording their timings in the results. DataUploads are recorded in
+// place of VSBs, keyed by their own name. With abort set, the first failed
+// DataUpload is returned as an error.
+func waitForDataUploadsToComplete(ctx context.Context, w *runWatcher, name string, results *runResults, abort bool) error {
+	timeout := 120 * time.Minute
+	lastDone, lastRunning := -1, -1
+	return w.waitFor(ctx, timeout, func() (bool, error) {
+		list, err := listDataUploads(ctx, w.cache, name)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list datauploads")
+		}
+		done, running := 0, 0
+		for _, du := range list.Items {
+			phase, _, _ := unstructured.NestedString(du.Object, "status", "phase")
+			namespace, _, _ := unstructured.NestedString(du.Object, "spec", "sourceNamespace")
+			pvc, _, _ := unstructured.NestedString(du.Object, "spec", "sourcePVC")
+			size, _, _ := unstructured.NestedInt64(du.Object, "status", "progress", "totalBytes")
+			start := nestedTime(du.Object, "status", "startTimestamp")
+			if !start.IsZero() {
+				results.transferStarted(du.GetName(), namespace, size, start)
+			}
+
+			switch phase {
+			case dataUploadPhaseCompleted:
+				if transferred, ok, _ := unstructured.NestedInt64(du.Object, "status", "progress", "bytesDone"); ok {
+					results.bytesTransferred(du.GetName(), transferred)
+				}
+				results.vsbCompleted(du.GetName(), pvc, "", nestedTime(du.Object, "status", "completionTimestamp"))
+				done++
+			case dataUploadPhaseFailed, dataUploadPhaseCanceled:
+				message, _, _ := unstructured.NestedString(du.Object, "status", "message")
+				failure := errors.Errorf("dataupload %s: %s", phase, message)
+				results.transferFailed(du.GetName(), failure)
+				if abort {
+					return false, withExitCode(errors.Wrapf(failure, "dataupload %s", du.GetName()), exitVSBFailed)
+				}
+				done++
+			default:
+				running++
+			}
+		}
+		if done != lastDone || running != lastRunning {
+			loggerFrom(ctx).Infow("waiting for DataUploads", "phase", phaseDataMover, "done", done, "running", running)
+			lastDone, lastRunning = done, running
+		}
+		// Velero creates every DataUpload before the backup starts waiting
+		// on them, so there are no more to come.
+		return running == 0, nil
+	})
+}
+
+// nestedTime reads an RFC 3339 timestamp from obj, returning the zero time
+// if it is missing or malformed.
+func nestedTime(obj map[string]interface{}, fields ...string) time.Time {
+	value, _, _ := unstructured.NestedString(obj, fields...)
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// runNativeRestore restores a native data mover backup. Velero creates the
+// DataDownloads itself, so this only times the Restore, recording it in
+// results.
+func runNativeRestore(ctx context.Context, c client.Client, veleroNamespace, name string, mappings map[string]string, results *runResults) error {
+	restoreStartTime := time.Now()
+	targets := []string{}
+	for _, target := range mappings {
+		targets = append(targets, target)
+	}
+	err := createTargetNamespaces(ctx, c, name, targets)
+	if err != nil {
+		return err
+	}
+	restoreName, err := createRestore(ctx, c, veleroNamespace, name, mappings)
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Infow("restore created, to monitor DataDownloads run oc get datadownloads -A -l velero.io/restore-name=<restore>", "phase", phaseRestore, "restore", restoreName, "veleroNamespace", veleroNamespace)
+	namespaces := []string{}
+	for _, ns := range results.Namespaces {
+		namespaces = append(namespaces, mappedNamespace(mappings, ns))
+	}
+	results.restoreStarted(restoreName, 0, "", "", mappings, namespaces, 0, restoreStartTime)
+
+	err = waitForRestoreToComplete(ctx, c, veleroNamespace, restoreName)
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for restore to complete", "phase", phaseRestore)
+		}
+		return err
+	}
+	restoreEndTime := time.Now()
+	results.restoreDone(restoreEndTime, restoreEndTime)
+	loggerFrom(ctx).Infow("restore done", "phase", phaseRestore, "total", restoreEndTime.Sub(restoreStartTime).String())
+	return nil
+}
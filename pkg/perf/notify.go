@@ -0,0 +1,147 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	notifyJSON  = "json"
+	notifySlack = "slack"
+
+	notifyTimeout = 30 * time.Second
+)
+
+// Outcomes of a run reported in notifications.
+const (
+	runSucceeded = "succeeded"
+	runFailed    = "failed"
+	runTimedOut  = "timed out"
+	runPanicked  = "panicked"
+)
+
+// notification is the summary of a run posted to --notify-url.
+type notification struct {
+	Run           string   `json:"run"`
+	Status        string   `json:"status"`
+	Error         string   `json:"error,omitempty"`
+	Namespaces    []string `json:"namespaces,omitempty"`
+	Mover         string   `json:"mover,omitempty"`
+	Concurrency   int      `json:"concurrency,omitempty"`
+	Volumes       int      `json:"volumes"`
+	Failures      int      `json:"failures"`
+	SnapshotTime  string   `json:"snapshotTime,omitempty"`
+	DataMoverTime string   `json:"dataMoverTime,omitempty"`
+	TotalTime     string   `json:"totalTime,omitempty"`
+	Throughput    float64  `json:"throughputGiBPerMinute,omitempty"`
+}
+
+// newNotification summarizes a run that ended with err, or panicked if
+// panicked is set. results may be nil if the run failed before it started.
+func newNotification(results *runResults, err error, panicked bool) *notification {
+	n := &notification{Status: runSucceeded}
+	switch {
+	case panicked:
+		n.Status = runPanicked
+	case errors.Cause(err) == wait.ErrWaitTimeout:
+		n.Status = runTimedOut
+	case err != nil:
+		n.Status = runFailed
+	}
+	if err != nil {
+		n.Error = err.Error()
+	}
+	if results == nil {
+		return n
+	}
+
+	results.mu.Lock()
+	defer results.mu.Unlock()
+	n.Run = results.Backup
+	n.Namespaces = results.Namespaces
+	n.Mover = results.Mover
+	n.Concurrency = results.Concurrency
+	n.Volumes = len(results.Volumes)
+	for _, v := range results.Volumes {
+		if v.Error != "" {
+			n.Failures++
+		}
+	}
+	// Runs that did not finish have no timings; report how long they ran.
+	total := results.TotalTime
+	if total == 0 {
+		total = time.Since(results.StartTime)
+	}
+	n.SnapshotTime = results.SnapshotTime.Round(time.Second).String()
+	n.DataMoverTime = results.DataMoverTime.Round(time.Second).String()
+	n.TotalTime = total.Round(time.Second).String()
+	n.Throughput = results.Throughput
+	return n
+}
+
+// slackText renders the notification as the text of a Slack message.
+func (n *notification) slackText() string {
+	run := n.Run
+	if run == "" {
+		run = "(not started)"
+	}
+	lines := []string{fmt.Sprintf("oadp-perf run %s %s", run, n.Status)}
+	if n.TotalTime != "" {
+		lines = append(lines,
+			fmt.Sprintf("Volumes: %d (%d failed)", n.Volumes, n.Failures),
+			fmt.Sprintf("Total time: %s (snapshots %s, data mover %s)", n.TotalTime, n.SnapshotTime, n.DataMoverTime),
+		)
+	}
+	if n.Throughput > 0 {
+		lines = append(lines, fmt.Sprintf("Throughput: %.2f GiB/min", n.Throughput))
+	}
+	if n.Error != "" {
+		lines = append(lines, fmt.Sprintf("Error: %s", n.Error))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// notify posts the summary of a run to url in format. Failures are logged to
+// the logger of ctx rather than returned so they do not change the outcome of
+// the run. The request is not cancelled with ctx, so a run cut short is still
+// reported.
+func notify(ctx context.Context, url, format string, n *notification) {
+	log := loggerFrom(ctx)
+	var payload interface{} = n
+	if format == notifySlack {
+		payload = map[string]string{"text": n.slackText()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorw("failed to marshal notification", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Errorw("failed to create notification request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Errorw("failed to send notification", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Errorw("notification rejected", "status", resp.Status)
+		return
+	}
+	log.Infow("notification sent", "status", n.Status)
+}
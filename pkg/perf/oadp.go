@@ -0,0 +1,319 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The OADP operator API pulls in most of OpenShift, so the tool carries the
+// few DataProtectionApplication fields it reads instead of importing it.
+
+var oadpGroupVersion = schema.GroupVersion{Group: "oadp.openshift.io", Version: "v1alpha1"}
+
+// dataProtectionApplication is the subset of the OADP
+// DataProtectionApplication the tool reads.
+type dataProtectionApplication struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              dpaSpec `json:"spec,omitempty"`
+}
+
+type dpaSpec struct {
+	Configuration *dpaConfiguration `json:"configuration,omitempty"`
+	Features      *dpaFeatures      `json:"features,omitempty"`
+}
+
+type dpaConfiguration struct {
+	Restic    *dpaNodeAgent `json:"restic,omitempty"`
+	NodeAgent *dpaNodeAgent `json:"nodeAgent,omitempty"`
+}
+
+type dpaNodeAgent struct {
+	Enable *bool `json:"enable,omitempty"`
+}
+
+type dpaFeatures struct {
+	DataMover *dpaDataMover `json:"dataMover,omitempty"`
+}
+
+type dpaDataMover struct {
+	Enable                      bool   `json:"enable,omitempty"`
+	CredentialName              string `json:"credentialName,omitempty"`
+	Timeout                     string `json:"timeout,omitempty"`
+	MaxConcurrentBackupVolumes  string `json:"maxConcurrentBackupVolumes,omitempty"`
+	MaxConcurrentRestoreVolumes string `json:"maxConcurrentRestoreVolumes,omitempty"`
+}
+
+type dataProtectionApplicationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []dataProtectionApplication `json:"items"`
+}
+
+func (in *dataProtectionApplication) DeepCopyObject() runtime.Object {
+	out := *in
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.Spec.Configuration != nil {
+		configuration := *in.Spec.Configuration
+		configuration.Restic = in.Spec.Configuration.Restic.deepCopy()
+		configuration.NodeAgent = in.Spec.Configuration.NodeAgent.deepCopy()
+		out.Spec.Configuration = &configuration
+	}
+	if in.Spec.Features != nil {
+		features := *in.Spec.Features
+		if in.Spec.Features.DataMover != nil {
+			dataMover := *in.Spec.Features.DataMover
+			features.DataMover = &dataMover
+		}
+		out.Spec.Features = &features
+	}
+	return &out
+}
+
+func (in *dpaNodeAgent) deepCopy() *dpaNodeAgent {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	if in.Enable != nil {
+		enable := *in.Enable
+		out.Enable = &enable
+	}
+	return &out
+}
+
+func (in *dataProtectionApplicationList) DeepCopyObject() runtime.Object {
+	out := *in
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	out.Items = make([]dataProtectionApplication, len(in.Items))
+	for i := range in.Items {
+		out.Items[i] = *in.Items[i].DeepCopyObject().(*dataProtectionApplication)
+	}
+	return &out
+}
+
+func addOADPToScheme(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypeWithName(oadpGroupVersion.WithKind("DataProtectionApplication"), &dataProtectionApplication{})
+	scheme.AddKnownTypeWithName(oadpGroupVersion.WithKind("DataProtectionApplicationList"), &dataProtectionApplicationList{})
+	metav1.AddToGroupVersion(scheme, oadpGroupVersion)
+	return nil
+}
+
+func (dpa *dataProtectionApplication) dataMoverEnabled() bool {
+	return dpa.Spec.Features != nil && dpa.Spec.Features.DataMover != nil && dpa.Spec.Features.DataMover.Enable
+}
+
+func (dpa *dataProtectionApplication) nodeAgentEnabled() bool {
+	if dpa.Spec.Configuration == nil {
+		return false
+	}
+	for _, agent := range []*dpaNodeAgent{dpa.Spec.Configuration.NodeAgent, dpa.Spec.Configuration.Restic} {
+		if agent != nil && agent.Enable != nil && *agent.Enable {
+			return true
+		}
+	}
+	return false
+}
+
+// volsyncResticSecretName is the secret the operator creates for volsync
+// from the data mover credential of the DPA.
+func (dpa *dataProtectionApplication) volsyncResticSecretName() string {
+	return dpa.Name + "-volsync-restic"
+}
+
+// maxConcurrentBackupVolumes returns the number of VSBs the data mover runs
+// at once, or 0 if the DPA leaves it to the default.
+func (dpa *dataProtectionApplication) maxConcurrentBackupVolumes() int {
+	if !dpa.dataMoverEnabled() {
+		return 0
+	}
+	return parseConcurrency(dpa.Spec.Features.DataMover.MaxConcurrentBackupVolumes)
+}
+
+// maxConcurrentRestoreVolumes returns the number of VSRs the data mover runs
+// at once, or 0 if the DPA leaves it to the default.
+func (dpa *dataProtectionApplication) maxConcurrentRestoreVolumes() int {
+	if !dpa.dataMoverEnabled() {
+		return 0
+	}
+	return parseConcurrency(dpa.Spec.Features.DataMover.MaxConcurrentRestoreVolumes)
+}
+
+// parseConcurrency parses a concurrency limit, which the DPA stores as a
+// string, returning 0 if it is unset or invalid.
+func parseConcurrency(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// unsetFlags returns resticSecretName and concurrency for applyDPADefaults,
+// with those set on the command line replaced by nil.
+func unsetFlags(flags *pflag.FlagSet, resticSecretName *string, concurrency *int) (*string, *int) {
+	if flags.Changed("restic-secret") {
+		resticSecretName = nil
+	}
+	if flags.Changed("concurrency") || flags.Changed("concurrent") {
+		concurrency = nil
+	}
+	return resticSecretName, concurrency
+}
+
+// findDPA returns the DataProtectionApplication in namespace, or in any
+// namespace if namespace is empty. When there are several, the one with the
+// data mover enabled is preferred. It returns nil if OADP is not installed or
+// there is no DPA.
+func findDPA(ctx context.Context, c client.Client, namespace string) (*dataProtectionApplication, error) {
+	dpas := dataProtectionApplicationList{}
+	err := c.List(ctx, &dpas, client.InNamespace(namespace))
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list dataprotectionapplications")
+	}
+
+	candidates := dpas.Items
+	if len(candidates) > 1 {
+		enabled := []dataProtectionApplication{}
+		for _, dpa := range candidates {
+			if dpa.dataMoverEnabled() {
+				enabled = append(enabled, dpa)
+			}
+		}
+		if len(enabled) != 0 {
+			candidates = enabled
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &candidates[0], nil
+	}
+	names := []string{}
+	for _, dpa := range candidates {
+		names = append(names, dpa.Namespace+"/"+dpa.Name)
+	}
+	return nil, errors.Errorf("found several dataprotectionapplications %s, set the velero-namespace and restic-secret flags", strings.Join(names, ", "))
+}
+
+// applyDPADefaults replaces the restic secret and concurrency defaults with
+// the settings of the DPA in the Velero namespace. Either may be nil to leave
+// it alone, and restore selects the DPA's restore limit rather than its
+// backup limit.
+func (o *rootOptions) applyDPADefaults(ctx context.Context, c client.Client, resticSecretName *string, concurrency *int, restore bool) error {
+	dpa, err := findDPA(ctx, c, o.veleroNamespace)
+	if err != nil {
+		return err
+	}
+	if dpa == nil || !dpa.dataMoverEnabled() {
+		return nil
+	}
+	if resticSecretName != nil {
+		*resticSecretName = dpa.volsyncResticSecretName()
+		loggerFrom(ctx).Infow("using restic secret from DataProtectionApplication", "dpa", dpa.Name, "resticSecret", *resticSecretName)
+	}
+	if concurrency == nil {
+		return nil
+	}
+	limit := dpa.maxConcurrentBackupVolumes()
+	if restore {
+		limit = dpa.maxConcurrentRestoreVolumes()
+	}
+	if limit != 0 {
+		*concurrency = limit
+		loggerFrom(ctx).Infow("using concurrency from DataProtectionApplication", "dpa", dpa.Name, "concurrency", limit)
+	}
+	return nil
+}
+
+// applyDPALimit holds the concurrency of a vsm run, across all of its
+// backups, to the maxConcurrentBackupVolumes of the DPA, above which the data
+// mover queues VSBs rather than running them. With exceed-dpa-limit the
+// concurrency is kept, so the queueing the limit causes can be measured.
+func (o *backupOptions) applyDPALimit(ctx context.Context, c client.Client) error {
+	if o.mover != moverVSM {
+		return nil
+	}
+	dpa, err := findDPA(ctx, c, o.veleroNamespace)
+	if err != nil || dpa == nil {
+		return err
+	}
+	limit := dpa.maxConcurrentBackupVolumes()
+	if limit == 0 {
+		return nil
+	}
+	o.dpaLimit = limit
+	total := o.concurrency * o.backupsPerRun
+	switch {
+	case total <= limit:
+	case o.exceedDPALimit:
+		loggerFrom(ctx).Warnw("concurrency exceeds the limit of the DataProtectionApplication, volumesnapshotbackups beyond it will queue in the data mover", "dpa", dpa.Name, "concurrency", total, "maxConcurrentBackupVolumes", limit)
+	default:
+		o.concurrency = limit / o.backupsPerRun
+		if o.concurrency < 1 {
+			o.concurrency = 1
+		}
+		loggerFrom(ctx).Infow("holding concurrency to the limit of the DataProtectionApplication, set exceed-dpa-limit to go above it", "dpa", dpa.Name, "concurrency", o.concurrency, "maxConcurrentBackupVolumes", limit)
+	}
+	return nil
+}
+
+// controllerQueueSummary summarizes how long the VSBs of r waited after being
+// created until the data mover took them in progress, and how many waited at
+// once, such as "limit 10, peak 4 waiting, mean wait 12s, max 1m3s". It is
+// empty if the run had no DPA limit or no VSB was seen in progress.
+func controllerQueueSummary(r *runResults) string {
+	if r.DPAConcurrencyLimit == 0 {
+		return ""
+	}
+	type change struct {
+		t     time.Time
+		delta int
+	}
+	changes := []change{}
+	waits := []time.Duration{}
+	for _, v := range r.Volumes {
+		if _, ok := v.PhaseTimes[dmv1.SnapMoverBackupPhaseInProgress]; !ok || v.VSBStartTime.IsZero() {
+			continue
+		}
+		waits = append(waits, v.QueueDuration)
+		changes = append(changes, change{v.VSBStartTime, 1}, change{v.VSBStartTime.Add(v.QueueDuration), -1})
+	}
+	if len(waits) == 0 {
+		return ""
+	}
+	// A VSB taken in progress at the time another is created no longer
+	// waits alongside it.
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].t.Equal(changes[j].t) {
+			return changes[i].delta < changes[j].delta
+		}
+		return changes[i].t.Before(changes[j].t)
+	})
+	waiting, peak := 0, 0
+	for _, c := range changes {
+		waiting += c.delta
+		if waiting > peak {
+			peak = waiting
+		}
+	}
+	stats := newDurationStats(statsGroupAll, waits)
+	return fmt.Sprintf("limit %d, peak %d waiting, mean wait %v, max %v", r.DPAConcurrencyLimit, peak, stats.Mean.Round(time.Second), stats.Max.Round(time.Second))
+}
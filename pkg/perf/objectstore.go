@@ -0,0 +1,209 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// uploadTimeout bounds each upload to the object store.
+const uploadTimeout = 5 * time.Minute
+
+// objectStore uploads files to an s3://bucket/prefix URL, signing requests
+// with the AWS credentials of the environment, or with plain PUTs under an
+// http(s):// URL such as a presigned prefix or a WebDAV server.
+type objectStore struct {
+	url    *url.URL
+	client *http.Client
+	// endpoint, region and the credentials are only used for s3 URLs.
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newObjectStore parses rawURL. For s3 URLs the credentials are read from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, the region
+// from AWS_REGION or AWS_DEFAULT_REGION and an S3 compatible endpoint such
+// as MinIO or NooBaa from AWS_ENDPOINT_URL.
+func newObjectStore(rawURL string) (*objectStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid results-url %q", rawURL)
+	}
+	s := &objectStore{url: u, client: http.DefaultClient}
+	switch u.Scheme {
+	case "http", "https":
+		return s, nil
+	case "s3":
+	default:
+		return nil, errors.Errorf("invalid results-url %q, must be an s3://, http:// or https:// URL", rawURL)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("invalid results-url %q, missing bucket", rawURL)
+	}
+	s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("results-url is an s3 URL but AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY is not set")
+	}
+	s.region = os.Getenv("AWS_REGION")
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		s.endpoint, err = url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid AWS_ENDPOINT_URL %q", endpoint)
+		}
+	}
+	return s, nil
+}
+
+// objectURL returns the URL of key under the prefix of the store.
+func (s *objectStore) objectURL(key string) *url.URL {
+	if s.url.Scheme != "s3" {
+		u := *s.url
+		u.Path = path.Join("/", u.Path, key)
+		return &u
+	}
+	key = path.Join(strings.TrimPrefix(s.url.Path, "/"), key)
+	if s.endpoint != nil {
+		// S3 compatible stores are addressed by path.
+		u := *s.endpoint
+		u.Path = path.Join("/", u.Path, s.url.Host, key)
+		return &u
+	}
+	return &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", s.url.Host, s.region), Path: "/" + key}
+}
+
+// put uploads data as key.
+func (s *objectStore) put(ctx context.Context, key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	u := s.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create upload request for %s", key)
+	}
+	if s.url.Scheme == "s3" {
+		s.sign(req, data, time.Now())
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to upload %s", key)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("failed to upload %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 for S3 to req.
+func (s *objectStore) sign(req *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	req.Header.Set("Authorization", signV4(req, payloadHash, s.accessKey, s.secretKey, s.region, "s3", now))
+}
+
+// signV4 sets the X-Amz-Date header of req and returns its Authorization
+// header, signing the host and every X-Amz- header.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uploadFile uploads the file at path as key.
+func (s *objectStore) uploadFile(ctx context.Context, path, key string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", path)
+	}
+	return s.put(ctx, key, data)
+}
+
+// uploadDir uploads every file under dir, keyed by its path relative to dir
+// under prefix.
+func (s *objectStore) uploadDir(ctx context.Context, dir, prefix string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return s.uploadFile(ctx, p, path.Join(prefix, filepath.ToSlash(rel)))
+	})
+}
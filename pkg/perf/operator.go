@@ -0,0 +1,209 @@
+package perf
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+type operatorOptions struct {
+	*rootOptions
+	printCRD    bool
+	metricsAddr string
+}
+
+func newOperatorCommand(root *rootOptions) *cobra.Command {
+	o := &operatorOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "operator",
+		Short: "Run the backups described by PerfTest resources as they are created",
+		Long: `Watch PerfTest resources in every namespace and run a backup for each new
+one, as the backup command would with the flags in its spec, recording the
+phase timings and per-VSB results in its status. PerfTests are run one at a
+time so they do not skew each other. Install the CRD first with
+oadp-perf operator --print-crd | oc apply -f -.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.printCRD {
+				_, err := os.Stdout.Write(perfTestCRD)
+				return err
+			}
+			return o.run(withLogger(signals.SetupSignalHandler(), loggerFrom(cmd.Context())))
+		},
+	}
+	flags := cmd.Flags()
+	flags.BoolVar(&o.printCRD, "print-crd", false, "print the PerfTest CustomResourceDefinition and exit")
+	flags.StringVar(&o.metricsAddr, "metrics-addr", "", "address such as :8080 to serve Prometheus metrics for the current run on, disabled if empty")
+	return cmd
+}
+
+func (o *operatorOptions) run(ctx context.Context) error {
+	c, err := o.client(ctx)
+	if err != nil {
+		return err
+	}
+	err = o.resolveVeleroNamespace(ctx, c)
+	if err != nil {
+		return err
+	}
+	config, err := o.restConfig()
+	if err != nil {
+		return err
+	}
+	scheme, err := o.scheme(ctx, config)
+	if err != nil {
+		return err
+	}
+	mgr, err := manager.New(config, manager.Options{
+		Scheme:             scheme,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create manager")
+	}
+	err = builder.ControllerManagedBy(mgr).
+		For(&perfTest{}).
+		WithEventFilter(predicate.GenerationChangedPredicate{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: 1}).
+		Complete(&perfTestReconciler{rootOptions: o.rootOptions, client: c})
+	if err != nil {
+		return errors.Wrap(err, "failed to create perftest controller")
+	}
+	if o.metricsAddr != "" {
+		serveMetrics(ctx, o.metricsAddr)
+	}
+	loggerFrom(ctx).Infow("watching perftests", "veleroNamespace", o.veleroNamespace)
+	return mgr.Start(ctx)
+}
+
+// perfTestReconciler runs each new PerfTest to completion inside Reconcile.
+// It reads and writes through an uncached client since the backup reads
+// objects the manager does not watch.
+type perfTestReconciler struct {
+	*rootOptions
+	client client.Client
+}
+
+func (r *perfTestReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	pt := &perfTest{}
+	err := r.client.Get(ctx, req.NamespacedName, pt)
+	if apierrors.IsNotFound(err) {
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "failed to get perftest %s", req.NamespacedName)
+	}
+
+	switch pt.Status.Phase {
+	case perfTestPhaseCompleted, perfTestPhaseFailed:
+		return reconcile.Result{}, nil
+	case perfTestPhaseRunning:
+		// Runs only live in the process driving them, so a PerfTest
+		// left running was cut short by a restart.
+		return reconcile.Result{}, r.finish(ctx, pt, nil, errors.New("interrupted by a restart of the operator"))
+	}
+
+	original := pt.DeepCopyObject().(*perfTest)
+	now := metav1.Now()
+	pt.Status.Phase = perfTestPhaseRunning
+	pt.Status.StartTime = &now
+	err = r.client.Status().Patch(ctx, pt, client.MergeFrom(original))
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "failed to update perftest %s", req.NamespacedName)
+	}
+
+	results, err := r.run(ctx, pt)
+	return reconcile.Result{}, r.finish(ctx, pt, results, err)
+}
+
+// run carries out the backup described by the spec of pt.
+func (r *perfTestReconciler) run(ctx context.Context, pt *perfTest) (*runResults, error) {
+	ctx = withLogger(ctx, loggerFrom(ctx).With("perfTest", pt.Namespace+"/"+pt.Name))
+	loggerFrom(ctx).Infow("starting perftest")
+
+	spec := pt.Spec
+	b, resticSecretName, concurrency := spec.backupOptions(r.rootOptions)
+	err := b.validate()
+	if err != nil {
+		return nil, err
+	}
+	err = r.applyDPADefaults(ctx, r.client, resticSecretName, concurrency, false)
+	if err != nil {
+		return nil, err
+	}
+	if !spec.SkipPreflight {
+		err = runPreflight(ctx, r.client, r.veleroNamespace, b.resticSecretName, b.mover, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.backup(ctx, r.client)
+}
+
+// backupOptions returns the options of the backup spec describes, with the
+// defaults of the backup command for what it leaves out. The restic secret
+// and concurrency are also returned when left out, for the
+// DataProtectionApplication to set.
+func (spec *perfTestSpec) backupOptions(root *rootOptions) (b *backupOptions, resticSecretName *string, concurrency *int) {
+	b = newBackupOptions(root)
+	b.namespaces = strings.Join(spec.Namespaces, ",")
+	b.restore = spec.Restore
+	if spec.ResticSecret != "" {
+		b.resticSecretName = spec.ResticSecret
+	} else {
+		resticSecretName = &b.resticSecretName
+	}
+	if spec.Concurrency != 0 {
+		b.concurrency = spec.Concurrency
+	} else {
+		concurrency = &b.concurrency
+	}
+	if spec.Schedule != "" {
+		b.schedule = spec.Schedule
+	}
+	if spec.Mover != "" {
+		b.mover = spec.Mover
+	}
+	if spec.OnFailure != "" {
+		b.onFailure = spec.OnFailure
+	}
+	if spec.VSBStallTimeout != nil {
+		b.stallTimeout = spec.VSBStallTimeout.Duration
+	}
+	return b, resticSecretName, concurrency
+}
+
+// finish records the outcome of the run in the status of pt.
+func (r *perfTestReconciler) finish(ctx context.Context, pt *perfTest, results *runResults, runErr error) error {
+	original := pt.DeepCopyObject().(*perfTest)
+	now := metav1.Now()
+	pt.Status.CompletionTime = &now
+	if results != nil {
+		pt.Status.setResults(results)
+	}
+	pt.Status.Phase = perfTestPhaseCompleted
+	pt.Status.Message = ""
+	if runErr != nil {
+		pt.Status.Phase = perfTestPhaseFailed
+		pt.Status.Message = runErr.Error()
+		loggerFrom(ctx).Errorw("perftest failed", "perfTest", pt.Namespace+"/"+pt.Name, "error", runErr)
+	} else {
+		loggerFrom(ctx).Infow("perftest completed", "perfTest", pt.Namespace+"/"+pt.Name, "run", pt.Status.Backup)
+	}
+	err := r.client.Status().Patch(ctx, pt, client.MergeFrom(original))
+	if err != nil {
+		return errors.Wrapf(err, "failed to update perftest %s/%s", pt.Namespace, pt.Name)
+	}
+	return nil
+}
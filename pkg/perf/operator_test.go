@@ -0,0 +1,62 @@
+package perf
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPerfTestSpecBackupOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		spec perfTestSpec
+	}{
+		{
+			name: "minimal",
+			spec: perfTestSpec{Namespaces: []string{"perf-1"}},
+		},
+		{
+			name: "every field",
+			spec: perfTestSpec{
+				Namespaces:      []string{"perf-1", "perf-2"},
+				Mover:           moverVSM,
+				Concurrency:     20,
+				Schedule:        scheduleBatch,
+				ResticSecret:    "restic-secret",
+				VSBStallTimeout: &metav1.Duration{Duration: 20 * time.Minute},
+				OnFailure:       onFailureContinue,
+				Restore:         true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _, _ := tt.spec.backupOptions(&rootOptions{})
+			if err := b.validate(); err != nil {
+				t.Fatalf("validate() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestPerfTestSpecBackupOptionsDefaults(t *testing.T) {
+	spec := perfTestSpec{Namespaces: []string{"perf-1"}}
+	b, resticSecretName, concurrency := spec.backupOptions(&rootOptions{})
+	if resticSecretName == nil || concurrency == nil {
+		t.Fatal("restic secret and concurrency left out of the spec should be left to the DataProtectionApplication")
+	}
+	if b.concurrency != defaultConcurrency || b.schedule != scheduleWindow || b.mover != moverVSM || b.onFailure != onFailureAbort {
+		t.Errorf("got concurrency %d, schedule %q, mover %q, on failure %q, want the defaults of the backup command", b.concurrency, b.schedule, b.mover, b.onFailure)
+	}
+
+	spec.Concurrency = 5
+	spec.ResticSecret = "restic-secret"
+	b, resticSecretName, concurrency = spec.backupOptions(&rootOptions{})
+	if resticSecretName != nil || concurrency != nil {
+		t.Error("restic secret and concurrency set in the spec must not be overridden")
+	}
+	if b.concurrency != 5 || b.resticSecretName != "restic-secret" {
+		t.Errorf("got concurrency %d and restic secret %q, want those of the spec", b.concurrency, b.resticSecretName)
+	}
+}
@@ -0,0 +1,125 @@
+package perf
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Orders the VSCs of a run can be queued for VSBs in.
+const (
+	orderLargestFirst  = "largest-first"
+	orderSmallestFirst = "smallest-first"
+	orderRandom        = "random"
+)
+
+// resolveVSCSources records the source PVC of every VSC and the storage it
+// requests, and returns the requested bytes and the PVC keyed by VSC name. A
+// VSC points at its VolumeSnapshot, which names the PVC in the same namespace,
+// so both are listed once per namespace rather than fetched per VSC. VSCs
+// whose VolumeSnapshot or PVC is gone are left out.
+func resolveVSCSources(ctx context.Context, c client.Client, vscs []v1.VolumeSnapshotContent, results *runResults) (map[string]int64, map[string]*corev1.PersistentVolumeClaim, error) {
+	byNamespace := map[string][]v1.VolumeSnapshotContent{}
+	for _, vsc := range vscs {
+		ns := vsc.Spec.VolumeSnapshotRef.Namespace
+		byNamespace[ns] = append(byNamespace[ns], vsc)
+	}
+
+	sizes := map[string]int64{}
+	pvcsByVSC := map[string]*corev1.PersistentVolumeClaim{}
+	for ns, vscs := range byNamespace {
+		snapshots := v1.VolumeSnapshotList{}
+		err := c.List(ctx, &snapshots, client.InNamespace(ns))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to list volumesnapshots in %s", ns)
+		}
+		pvcs := corev1.PersistentVolumeClaimList{}
+		err = c.List(ctx, &pvcs, client.InNamespace(ns))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to list persistentvolumeclaims in %s", ns)
+		}
+		sources := map[string]string{}
+		for _, vs := range snapshots.Items {
+			if vs.Spec.Source.PersistentVolumeClaimName != nil {
+				sources[vs.Name] = *vs.Spec.Source.PersistentVolumeClaimName
+			}
+		}
+		byName := map[string]*corev1.PersistentVolumeClaim{}
+		for i := range pvcs.Items {
+			byName[pvcs.Items[i].Name] = &pvcs.Items[i]
+		}
+
+		for _, vsc := range vscs {
+			pvc, ok := sources[vsc.Spec.VolumeSnapshotRef.Name]
+			if !ok {
+				loggerFrom(ctx).Warnw("could not resolve the source PVC of VSC", "phase", phaseDataMover, "vsc", vsc.Name, "volumeSnapshot", vsc.Spec.VolumeSnapshotRef.Name)
+				continue
+			}
+			source, ok := byName[pvc]
+			if !ok {
+				loggerFrom(ctx).Warnw("source PVC of VSC not found", "phase", phaseDataMover, "vsc", vsc.Name, "namespace", ns, "pvc", pvc)
+				continue
+			}
+			requested := source.Spec.Resources.Requests[corev1.ResourceStorage]
+			results.vscSource(vsc.Name, ns, pvc, requested.Value())
+			sizes[vsc.Name] = requested.Value()
+			pvcsByVSC[vsc.Name] = source
+		}
+	}
+	return sizes, pvcsByVSC, nil
+}
+
+// orderVSCs returns vscs in the given order of the sizes of their source
+// PVCs, or shuffled for random. VSCs of unknown size count as empty.
+func orderVSCs(vscs []v1.VolumeSnapshotContent, sizes map[string]int64, order string) []v1.VolumeSnapshotContent {
+	ordered := append([]v1.VolumeSnapshotContent(nil), vscs...)
+	switch order {
+	case orderLargestFirst:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return sizes[ordered[i].Name] > sizes[ordered[j].Name]
+		})
+	case orderSmallestFirst:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return sizes[ordered[i].Name] < sizes[ordered[j].Name]
+		})
+	case orderRandom:
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		r.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	}
+	return ordered
+}
+
+// orderVSBs returns vsbs in the given order of the sizes of the PVCs they
+// backed up, or shuffled for random, so VSRs are queued the way the VSBs
+// were. VSBs of unknown size count as empty.
+func orderVSBs(vsbs []dmv1.VolumeSnapshotBackup, order string) []dmv1.VolumeSnapshotBackup {
+	ordered := append([]dmv1.VolumeSnapshotBackup(nil), vsbs...)
+	size := func(i int) int64 {
+		return parseSize(ordered[i].Status.SourcePVCData.Size)
+	}
+	switch order {
+	case orderLargestFirst:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return size(i) > size(j)
+		})
+	case orderSmallestFirst:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return size(i) < size(j)
+		})
+	case orderRandom:
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		r.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	}
+	return ordered
+}
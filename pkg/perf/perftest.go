@@ -0,0 +1,135 @@
+package perf
+
+import (
+	"github.com/dymurray/perf/config/crd"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// perfTestCRD is the CustomResourceDefinition of PerfTest, printed by
+// operator --print-crd.
+var perfTestCRD = crd.PerfTest
+
+var perfGroupVersion = schema.GroupVersion{Group: "perf.konveyor.io", Version: "v1alpha1"}
+
+// PerfTest phases.
+const (
+	perfTestPhaseRunning   = "Running"
+	perfTestPhaseCompleted = "Completed"
+	perfTestPhaseFailed    = "Failed"
+)
+
+// perfTest describes a run of the backup command for the operator to carry
+// out, and records its results.
+type perfTest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              perfTestSpec   `json:"spec,omitempty"`
+	Status            perfTestStatus `json:"status,omitempty"`
+}
+
+// perfTestSpec mirrors the flags of the backup command.
+type perfTestSpec struct {
+	Namespaces      []string         `json:"namespaces"`
+	Mover           string           `json:"mover,omitempty"`
+	Concurrency     int              `json:"concurrency,omitempty"`
+	Schedule        string           `json:"schedule,omitempty"`
+	ResticSecret    string           `json:"resticSecret,omitempty"`
+	VSBStallTimeout *metav1.Duration `json:"vsbStallTimeout,omitempty"`
+	OnFailure       string           `json:"onFailure,omitempty"`
+	Restore         bool             `json:"restore,omitempty"`
+	SkipPreflight   bool             `json:"skipPreflight,omitempty"`
+}
+
+type perfTestStatus struct {
+	Phase          string           `json:"phase,omitempty"`
+	Message        string           `json:"message,omitempty"`
+	Backup         string           `json:"backup,omitempty"`
+	StartTime      *metav1.Time     `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time     `json:"completionTime,omitempty"`
+	SnapshotTime   *metav1.Duration `json:"snapshotTime,omitempty"`
+	DataMoverTime  *metav1.Duration `json:"dataMoverTime,omitempty"`
+	TotalTime      *metav1.Duration `json:"totalTime,omitempty"`
+	Volumes        []perfTestVolume `json:"volumes,omitempty"`
+}
+
+// perfTestVolume is the result of a single VSB.
+type perfTestVolume struct {
+	VolumeSnapshotContent string          `json:"volumeSnapshotContent"`
+	Namespace             string          `json:"namespace,omitempty"`
+	PVC                   string          `json:"pvc,omitempty"`
+	VolumeSnapshotBackup  string          `json:"volumeSnapshotBackup,omitempty"`
+	SizeBytes             int64           `json:"sizeBytes,omitempty"`
+	Duration              metav1.Duration `json:"duration,omitempty"`
+	Stalled               bool            `json:"stalled,omitempty"`
+	Error                 string          `json:"error,omitempty"`
+}
+
+type perfTestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []perfTest `json:"items"`
+}
+
+func (in *perfTest) DeepCopyObject() runtime.Object {
+	out := *in
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec.Namespaces = append([]string(nil), in.Spec.Namespaces...)
+	out.Spec.VSBStallTimeout = copyDuration(in.Spec.VSBStallTimeout)
+	out.Status.StartTime = in.Status.StartTime.DeepCopy()
+	out.Status.CompletionTime = in.Status.CompletionTime.DeepCopy()
+	out.Status.SnapshotTime = copyDuration(in.Status.SnapshotTime)
+	out.Status.DataMoverTime = copyDuration(in.Status.DataMoverTime)
+	out.Status.TotalTime = copyDuration(in.Status.TotalTime)
+	out.Status.Volumes = append([]perfTestVolume(nil), in.Status.Volumes...)
+	return &out
+}
+
+func copyDuration(in *metav1.Duration) *metav1.Duration {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	return &out
+}
+
+func (in *perfTestList) DeepCopyObject() runtime.Object {
+	out := *in
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	out.Items = make([]perfTest, len(in.Items))
+	for i := range in.Items {
+		out.Items[i] = *in.Items[i].DeepCopyObject().(*perfTest)
+	}
+	return &out
+}
+
+func addPerfTestToScheme(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypeWithName(perfGroupVersion.WithKind("PerfTest"), &perfTest{})
+	scheme.AddKnownTypeWithName(perfGroupVersion.WithKind("PerfTestList"), &perfTestList{})
+	metav1.AddToGroupVersion(scheme, perfGroupVersion)
+	return nil
+}
+
+// setResults copies the timings of a finished run into the status.
+func (s *perfTestStatus) setResults(r *runResults) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.Backup = r.Backup
+	s.SnapshotTime = &metav1.Duration{Duration: r.SnapshotTime}
+	s.DataMoverTime = &metav1.Duration{Duration: r.DataMoverTime}
+	s.TotalTime = &metav1.Duration{Duration: r.TotalTime}
+	s.Volumes = nil
+	for _, v := range r.Volumes {
+		s.Volumes = append(s.Volumes, perfTestVolume{
+			VolumeSnapshotContent: v.VolumeSnapshotContent,
+			Namespace:             v.Namespace,
+			PVC:                   v.PVC,
+			VolumeSnapshotBackup:  v.VolumeSnapshotBackup,
+			SizeBytes:             v.SizeBytes,
+			Duration:              metav1.Duration{Duration: v.VSBDuration},
+			Stalled:               v.Stalled,
+			Error:                 v.Error,
+		})
+	}
+}
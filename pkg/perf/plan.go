@@ -0,0 +1,174 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// namespacePlan is what a run is expected to back up in one namespace.
+type namespacePlan struct {
+	namespace string
+	pvcs      int
+	// snapshots is the number of PVCs bound to CSI volumes, each of which
+	// Velero snapshots into a VSC.
+	snapshots int
+	sizeBytes int64
+	// volumes are the PVCs counted in snapshots, along with their CSI
+	// drivers, and skipped those that are not, with why.
+	volumes []plannedVolume
+	skipped []allocatedPVC
+}
+
+type plannedVolume struct {
+	pvc    string
+	labels map[string]string
+	driver string
+}
+
+// plan prints what a run with these options would do without creating
+// anything: the PVCs found in each namespace, the number of VSCs to expect,
+// the Velero backup, the VSB schedule and the amount of data to move.
+func (o *backupOptions) plan(ctx context.Context, c client.Client, out io.Writer) error {
+	namespaces, err := o.resolveNamespaces(ctx, c)
+	if err != nil {
+		return err
+	}
+	err = validateNamespaces(ctx, c, namespaces)
+	if err != nil {
+		return err
+	}
+
+	plans := []namespacePlan{}
+	snapshots := 0
+	var sizeBytes int64
+	for _, ns := range namespaces {
+		p, err := planNamespace(ctx, c, ns)
+		if err != nil {
+			return err
+		}
+		plans = append(plans, p)
+		snapshots += p.snapshots
+		sizeBytes += p.sizeBytes
+	}
+
+	fmt.Fprintf(out, "Velero namespace: %s\n", o.veleroNamespace)
+	fmt.Fprintf(out, "Mover:            %s\n", o.mover)
+	if o.mover == moverVSM {
+		fmt.Fprintf(out, "Restic secret:    %s\n", o.resticSecretName)
+	}
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPVCS\tSNAPSHOTS\tSIZE\t")
+	for _, p := range plans {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t\n", p.namespace, p.pvcs, p.snapshots, formatBytes(p.sizeBytes))
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nExpected VolumeSnapshotContents: %d\n", snapshots)
+	fmt.Fprintf(out, "Estimated data:                  %s\n\n", formatBytes(sizeBytes))
+
+	template, err := o.spec.backup()
+	if err != nil {
+		return err
+	}
+	backup, err := newBackup(o.veleroNamespace, "<generated>", namespaces, o.mover == moverNative, template)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(backup)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal backup")
+	}
+	fmt.Fprintf(out, "Backup:\n%s\n", data)
+
+	fmt.Fprintf(out, "Schedule: %s\n", o.describeSchedule(snapshots))
+	return nil
+}
+
+// planNamespace counts the PVCs of namespace and those Velero would
+// snapshot, along with their size. Unbound PVCs and PVCs bound to volumes
+// that are not CSI volumes are not snapshotted.
+func planNamespace(ctx context.Context, c client.Client, namespace string) (namespacePlan, error) {
+	p := namespacePlan{namespace: namespace}
+	pvcList := corev1.PersistentVolumeClaimList{}
+	err := c.List(ctx, &pvcList, client.InNamespace(namespace))
+	if err != nil {
+		return p, errors.Wrapf(err, "failed to list persistentvolumeclaims in %s", namespace)
+	}
+	p.pvcs = len(pvcList.Items)
+	for _, pvc := range pvcList.Items {
+		if pvc.Status.Phase != corev1.ClaimBound || pvc.Spec.VolumeName == "" {
+			loggerFrom(ctx).Warnw("persistentvolumeclaim is not bound and will not be snapshotted", "namespace", namespace, "pvc", pvc.Name)
+			p.skipped = append(p.skipped, allocatedPVC{Namespace: namespace, PVC: pvc.Name, Reason: "not bound"})
+			continue
+		}
+		pv := corev1.PersistentVolume{}
+		err := c.Get(ctx, types.NamespacedName{Name: pvc.Spec.VolumeName}, &pv)
+		if apierrors.IsNotFound(err) {
+			loggerFrom(ctx).Warnw("persistentvolume of persistentvolumeclaim not found", "namespace", namespace, "pvc", pvc.Name, "pv", pvc.Spec.VolumeName)
+			p.skipped = append(p.skipped, allocatedPVC{Namespace: namespace, PVC: pvc.Name, Reason: "persistentvolume not found"})
+			continue
+		}
+		if err != nil {
+			return p, errors.Wrapf(err, "failed to get persistentvolume %s", pvc.Spec.VolumeName)
+		}
+		if pv.Spec.CSI == nil {
+			loggerFrom(ctx).Warnw("persistentvolumeclaim is not a CSI volume and will not be snapshotted", "namespace", namespace, "pvc", pvc.Name)
+			p.skipped = append(p.skipped, allocatedPVC{Namespace: namespace, PVC: pvc.Name, Reason: "not a CSI volume"})
+			continue
+		}
+		p.volumes = append(p.volumes, plannedVolume{pvc: pvc.Name, labels: pvc.Labels, driver: pv.Spec.CSI.Driver})
+		p.snapshots++
+		p.sizeBytes += pvcSize(&pvc).Value()
+	}
+	return p, nil
+}
+
+// pvcSize returns the capacity of pvc, or its request if it has no capacity
+// yet.
+func pvcSize(pvc *corev1.PersistentVolumeClaim) *resource.Quantity {
+	if size, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+		return &size
+	}
+	size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	return &size
+}
+
+func formatBytes(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+// describeSchedule describes how the VSBs of snapshots VSCs would be
+// scheduled.
+func (o *backupOptions) describeSchedule(snapshots int) string {
+	switch o.mover {
+	case moverNative:
+		return "DataUploads are scheduled by Velero"
+	case moverFSBackup:
+		return "PodVolumeBackups are scheduled by the node agent"
+	}
+	if snapshots == 0 {
+		return "no volumesnapshotbackups to create"
+	}
+	if o.schedule == scheduleWindow {
+		return fmt.Sprintf("window of %d concurrent volumesnapshotbackups over %d volumesnapshotcontents", o.concurrency, snapshots)
+	}
+	if o.batchAdvanceThreshold > 0 && o.batchAdvanceThreshold < 1 {
+		return fmt.Sprintf("batches of up to %d volumesnapshotbackups over %d volumesnapshotcontents, each started once %.0f%% of the previous one is done", o.concurrency, snapshots, o.batchAdvanceThreshold*100)
+	}
+	full, last := snapshots/o.concurrency, snapshots%o.concurrency
+	if last == 0 {
+		return fmt.Sprintf("%d batches of %d volumesnapshotbackups", full, o.concurrency)
+	}
+	return fmt.Sprintf("%d batches of %d volumesnapshotbackups and a last batch of %d", full, o.concurrency, last)
+}
@@ -0,0 +1,284 @@
+package perf
+
+import (
+	"context"
+	"strings"
+
+	volsyncv1alpha1 "github.com/backube/volsync/api/v1alpha1"
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// volumeSnapshotClassLabel marks the VolumeSnapshotClass Velero and the data
+// mover use for CSI snapshots.
+const volumeSnapshotClassLabel = "velero.io/csi-volumesnapshot-class"
+
+// volumeSnapshotClassAnnotationPrefix, suffixed by a CSI driver, annotates a
+// backup with the VolumeSnapshotClass Velero 1.12+ uses for that driver.
+const volumeSnapshotClassAnnotationPrefix = volumeSnapshotClassLabel + "_"
+
+// defaultClassAnnotation marks the default VolumeSnapshotClass of a driver,
+// which the volume snapshot mover needs set on the class it snapshots with.
+const defaultClassAnnotation = "snapshot.storage.kubernetes.io/is-default-class"
+
+type preflightOptions struct {
+	*rootOptions
+	resticSecretName string
+	mover            string
+	namespaces       string
+	namespacesFile   string
+	checkRBAC        bool
+}
+
+func newPreflightCommand(root *rootOptions) *cobra.Command {
+	o := &preflightOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "preflight",
+		Short: "Check the cluster is set up for a data mover run",
+		Long: `Check the cluster is set up for a data mover run: the data mover and volsync
+CRDs are installed, the DataProtectionApplication has the data mover enabled,
+the restic secret exists in the Velero namespace, a VolumeSnapshotClass is
+labeled for Velero and, if given, the namespaces to back up exist.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client(cmd.Context())
+			if err != nil {
+				return err
+			}
+			err = o.resolveVeleroNamespace(cmd.Context(), c)
+			if err != nil {
+				return err
+			}
+			resticSecretName, _ := unsetFlags(cmd.Flags(), &o.resticSecretName, nil)
+			err = o.applyDPADefaults(cmd.Context(), c, resticSecretName, nil, false)
+			if err != nil {
+				return err
+			}
+			var namespaces []string
+			if o.namespaces != "" || o.namespacesFile != "" {
+				namespaces, err = parseNamespaces(o.namespaces, o.namespacesFile)
+				if err != nil {
+					return err
+				}
+			}
+			if o.mover != moverVSM && o.mover != moverNative && o.mover != moverFSBackup {
+				return errors.Errorf("unknown mover %q, must be one of %s, %s or %s", o.mover, moverVSM, moverNative, moverFSBackup)
+			}
+			err = runPreflight(cmd.Context(), c, o.veleroNamespace, o.resticSecretName, o.mover, namespaces)
+			if err != nil || !o.checkRBAC {
+				return err
+			}
+			clientset, err := o.clientset()
+			if err != nil {
+				return err
+			}
+			return checkRBAC(cmd.Context(), clientset, o.veleroNamespace, o.mover, namespaces)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.resticSecretName, "restic-secret", defaultResticSecretName, "name of restic secret for volsync to use, <dpa-name>-volsync-restic of the DataProtectionApplication if not set")
+	flags.StringVar(&o.mover, "mover", moverVSM, "data mover to check for, vsm, native or fs-backup for the file system backup")
+	flags.StringVar(&o.namespaces, "namespaces", "", "comma separated list of namespaces to check exist")
+	flags.StringVar(&o.namespacesFile, "namespaces-file", "", "path to a file listing namespaces to check exist, one per line")
+	flags.BoolVar(&o.checkRBAC, "check-rbac", false, "also check with SelfSubjectAccessReviews that the current identity has the access a backup with mover needs, in the namespaces if given")
+	return cmd
+}
+
+// preflightCheck is a single named check run by runPreflight.
+type preflightCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// runPreflight runs every check for mover, logging each result, and returns
+// an error listing the checks that failed.
+func runPreflight(ctx context.Context, c client.Client, veleroNamespace, resticSecretName, mover string, namespaces []string) error {
+	var checks []preflightCheck
+	switch mover {
+	case moverFSBackup:
+		checks = []preflightCheck{
+			{"node agent enabled", func(ctx context.Context) error {
+				return checkNodeAgentEnabled(ctx, c, veleroNamespace)
+			}},
+		}
+	case moverNative:
+		checks = []preflightCheck{
+			{"DataUpload CRD", func(ctx context.Context) error {
+				return checkKindInstalled(c, dataUploadGVK.GroupKind(), "install Velero 1.12 or later (OADP 1.3 or later)")
+			}},
+			{"node agent enabled", func(ctx context.Context) error {
+				return checkNodeAgentEnabled(ctx, c, veleroNamespace)
+			}},
+		}
+	default:
+		checks = []preflightCheck{
+			{"VolumeSnapshotBackup CRD", func(ctx context.Context) error {
+				return checkKindInstalled(c, vsbGroupKind, "install the OADP operator with the data mover")
+			}},
+			{"VolumeSnapshotRestore CRD", func(ctx context.Context) error {
+				return checkKindInstalled(c, vsrGroupKind, "install the OADP operator with the data mover")
+			}},
+			{"volsync operator", func(ctx context.Context) error {
+				return checkKindInstalled(c, volsyncv1alpha1.GroupVersion.WithKind("ReplicationSource").GroupKind(), "install the VolSync operator")
+			}},
+			{"data mover enabled", func(ctx context.Context) error {
+				return checkDataMoverEnabled(ctx, c, veleroNamespace)
+			}},
+			{"restic secret", func(ctx context.Context) error {
+				return checkResticSecret(ctx, c, veleroNamespace, resticSecretName)
+			}},
+		}
+	}
+	if mover != moverFSBackup {
+		checks = append(checks, preflightCheck{"VolumeSnapshotClass", func(ctx context.Context) error {
+			return checkVolumeSnapshotClass(ctx, c)
+		}})
+	}
+	if len(namespaces) != 0 {
+		checks = append(checks, preflightCheck{"namespaces", func(ctx context.Context) error {
+			return validateNamespaces(ctx, c, namespaces)
+		}})
+	}
+
+	failed := []string{}
+	for _, check := range checks {
+		err := check.check(ctx)
+		if err != nil {
+			loggerFrom(ctx).Errorw("preflight check failed", "check", check.name, "error", err)
+			failed = append(failed, check.name)
+			continue
+		}
+		loggerFrom(ctx).Infow("preflight check passed", "check", check.name)
+	}
+	if len(failed) != 0 {
+		return withExitCode(errors.Errorf("preflight checks failed: %s", strings.Join(failed, ", ")), exitPreflight)
+	}
+	return nil
+}
+
+// checkKindInstalled checks the API server serves gk, which means its CRD is
+// installed. hint tells the user how to fix it.
+func checkKindInstalled(c client.Client, gk schema.GroupKind, hint string) error {
+	_, err := c.RESTMapper().RESTMapping(gk)
+	if meta.IsNoMatchError(err) {
+		return errors.Errorf("%s is not served by the cluster, %s", gk, hint)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up %s", gk)
+	}
+	return nil
+}
+
+func checkDataMoverEnabled(ctx context.Context, c client.Client, veleroNamespace string) error {
+	return checkDPAEnables(ctx, c, veleroNamespace, "spec.features.dataMover.enable", (*dataProtectionApplication).dataMoverEnabled)
+}
+
+// checkNodeAgentEnabled checks the node agent is enabled since it runs the
+// native data mover's uploads.
+func checkNodeAgentEnabled(ctx context.Context, c client.Client, veleroNamespace string) error {
+	return checkDPAEnables(ctx, c, veleroNamespace, "spec.configuration.nodeAgent.enable", (*dataProtectionApplication).nodeAgentEnabled)
+}
+
+// checkDPAEnables checks a DataProtectionApplication in the Velero namespace
+// enables field.
+func checkDPAEnables(ctx context.Context, c client.Client, veleroNamespace, field string, enabled func(*dataProtectionApplication) bool) error {
+	dpas := dataProtectionApplicationList{}
+	err := c.List(ctx, &dpas, client.InNamespace(veleroNamespace))
+	if meta.IsNoMatchError(err) {
+		return errors.New("DataProtectionApplication is not served by the cluster, install the OADP operator")
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to list dataprotectionapplications")
+	}
+	if len(dpas.Items) == 0 {
+		return errors.Errorf("no DataProtectionApplication found in namespace %s", veleroNamespace)
+	}
+	for i := range dpas.Items {
+		if enabled(&dpas.Items[i]) {
+			return nil
+		}
+	}
+	return errors.Errorf("no DataProtectionApplication in namespace %s sets %s to true", veleroNamespace, field)
+}
+
+// checkResticSecret checks the secret the data mover reads the restic
+// repository and password from. The operator creates it in the Velero
+// namespace when the data mover is enabled.
+func checkResticSecret(ctx context.Context, c client.Client, veleroNamespace, name string) error {
+	secret := corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: veleroNamespace}, &secret)
+	if apierrors.IsNotFound(err) {
+		return errors.Errorf("secret %s/%s not found, set the restic-secret flag to the <dpa-name>-volsync-restic secret", veleroNamespace, name)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get secret %s/%s", veleroNamespace, name)
+	}
+	for _, key := range []string{"RESTIC_REPOSITORY", "RESTIC_PASSWORD"} {
+		if len(secret.Data[key]) == 0 {
+			return errors.Errorf("secret %s/%s has no %s", veleroNamespace, name, key)
+		}
+	}
+	return nil
+}
+
+func checkVolumeSnapshotClass(ctx context.Context, c client.Client) error {
+	classes := v1.VolumeSnapshotClassList{}
+	err := c.List(ctx, &classes, client.MatchingLabels{volumeSnapshotClassLabel: "true"})
+	if err != nil {
+		return errors.Wrap(err, "failed to list volumesnapshotclasses")
+	}
+	if len(classes.Items) == 0 {
+		return errors.Errorf("no VolumeSnapshotClass is labeled %s=true", volumeSnapshotClassLabel)
+	}
+	for _, class := range classes.Items {
+		if class.DeletionPolicy != v1.VolumeSnapshotContentRetain {
+			loggerFrom(ctx).Warnw("VolumeSnapshotClass deletionPolicy should be Retain for the data mover", "volumeSnapshotClass", class.Name, "deletionPolicy", class.DeletionPolicy)
+		}
+	}
+	return nil
+}
+
+// checkSelectedVolumeSnapshotClass checks the VolumeSnapshotClass name is one
+// the snapshots of a run with mover can use, returning its CSI driver. A class
+// without the label is never picked by Velero, so the backup ends up with no
+// volumesnapshotcontents for the data mover.
+func checkSelectedVolumeSnapshotClass(ctx context.Context, c client.Client, name, mover string) (string, error) {
+	class := v1.VolumeSnapshotClass{}
+	err := c.Get(ctx, types.NamespacedName{Name: name}, &class)
+	if apierrors.IsNotFound(err) {
+		return "", errors.Errorf("VolumeSnapshotClass %s not found", name)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get volumesnapshotclass %s", name)
+	}
+	if class.Labels[volumeSnapshotClassLabel] != "true" {
+		return "", errors.Errorf("VolumeSnapshotClass %s is not labeled %s=true, so Velero will not snapshot with it", name, volumeSnapshotClassLabel)
+	}
+	if mover == moverVSM && class.Annotations[defaultClassAnnotation] != "true" {
+		return "", errors.Errorf("VolumeSnapshotClass %s is not annotated %s=true, which the volume snapshot mover needs", name, defaultClassAnnotation)
+	}
+	if class.DeletionPolicy != v1.VolumeSnapshotContentRetain {
+		loggerFrom(ctx).Warnw("VolumeSnapshotClass deletionPolicy should be Retain for the data mover", "volumeSnapshotClass", name, "deletionPolicy", class.DeletionPolicy)
+	}
+
+	// Velero picks any of the labeled classes of a driver, so another one
+	// may be used instead.
+	classes := v1.VolumeSnapshotClassList{}
+	err = c.List(ctx, &classes, client.MatchingLabels{volumeSnapshotClassLabel: "true"})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list volumesnapshotclasses")
+	}
+	for _, other := range classes.Items {
+		if other.Name != name && other.Driver == class.Driver {
+			loggerFrom(ctx).Warnw("another VolumeSnapshotClass of the driver is labeled for Velero, set set-volume-snapshot-class or remove its label", "volumeSnapshotClass", name, "other", other.Name, "driver", class.Driver)
+		}
+	}
+	loggerFrom(ctx).Infow("using VolumeSnapshotClass", "volumeSnapshotClass", name, "driver", class.Driver)
+	return class.Driver, nil
+}
@@ -0,0 +1,139 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	volsyncv1alpha1 "github.com/backube/volsync/api/v1alpha1"
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// rbacRule is access a run needs. An empty namespace means every namespace,
+// which the watches of a run need since its informers are not namespaced.
+type rbacRule struct {
+	verbs     []string
+	group     string
+	resource  string
+	namespace string
+	// inTargets asks for the access in each namespace backed up, if they
+	// are known, rather than in namespace.
+	inTargets bool
+}
+
+func (r rbacRule) describe() string {
+	if r.group == "" {
+		return r.resource
+	}
+	return r.resource + "." + r.group
+}
+
+// rbacRules returns the access a backup run with mover needs.
+func rbacRules(veleroNamespace, mover string) []rbacRule {
+	rules := []rbacRule{
+		{verbs: []string{"create", "get", "patch"}, group: velerov1.SchemeGroupVersion.Group, resource: "backups", namespace: veleroNamespace},
+		{verbs: []string{"list", "watch"}, group: velerov1.SchemeGroupVersion.Group, resource: "backups"},
+	}
+	switch mover {
+	case moverVSM:
+		rules = append(rules,
+			rbacRule{verbs: []string{"get", "list", "watch"}, group: v1.SchemeGroupVersion.Group, resource: "volumesnapshotcontents"},
+			rbacRule{verbs: []string{"create", "get", "delete"}, group: dmv1.GroupVersion.Group, resource: "volumesnapshotbackups", inTargets: true},
+			rbacRule{verbs: []string{"list", "watch"}, group: dmv1.GroupVersion.Group, resource: "volumesnapshotbackups"},
+			rbacRule{verbs: []string{"list", "watch"}, group: volsyncv1alpha1.GroupVersion.Group, resource: "replicationsources"},
+		)
+	case moverNative:
+		rules = append(rules, rbacRule{verbs: []string{"list", "watch"}, group: dataUploadGVK.Group, resource: "datauploads"})
+	case moverFSBackup:
+		rules = append(rules, rbacRule{verbs: []string{"list", "watch"}, group: velerov1.SchemeGroupVersion.Group, resource: "podvolumebackups"})
+	}
+	return rules
+}
+
+// checkRBAC asks the API server, through SelfSubjectAccessReviews, whether
+// the identity of the client may do what a run with mover does, returning an
+// error listing every verb it is missing and where. Access granted in every
+// namespace saves checking each namespace backed up.
+func checkRBAC(ctx context.Context, clientset kubernetes.Interface, veleroNamespace, mover string, namespaces []string) error {
+	missing := []string{}
+	for _, rule := range rbacRules(veleroNamespace, mover) {
+		for _, verb := range rule.verbs {
+			allowed, err := canI(ctx, clientset, verb, rule.group, rule.resource, rule.namespace)
+			if err != nil {
+				return err
+			}
+			if allowed {
+				continue
+			}
+			if !rule.inTargets || len(namespaces) == 0 {
+				where := "in every namespace"
+				if rule.namespace != "" {
+					where = "in namespace " + rule.namespace
+				}
+				missing = append(missing, fmt.Sprintf("%s %s %s", verb, rule.describe(), where))
+				continue
+			}
+			denied := []string{}
+			for _, ns := range namespaces {
+				allowed, err := canI(ctx, clientset, verb, rule.group, rule.resource, ns)
+				if err != nil {
+					return err
+				}
+				if !allowed {
+					denied = append(denied, ns)
+				}
+			}
+			if len(denied) > 0 {
+				missing = append(missing, fmt.Sprintf("%s %s in namespaces %s", verb, rule.describe(), strings.Join(denied, ",")))
+			}
+		}
+	}
+	for _, m := range missing {
+		loggerFrom(ctx).Errorw("missing permission", "permission", m)
+	}
+	if len(missing) > 0 {
+		return withExitCode(errors.Errorf("the current identity is missing %d permissions: %s", len(missing), strings.Join(missing, "; ")), exitPreflight)
+	}
+	loggerFrom(ctx).Infow("rbac check passed", "mover", mover, "namespaces", len(namespaces))
+	return nil
+}
+
+// checkRBAC checks the access of the client in the namespaces of the run.
+func (o *backupOptions) checkRBAC(ctx context.Context, c client.Client) error {
+	namespaces, err := o.resolveNamespaces(ctx, c)
+	if err != nil {
+		return err
+	}
+	clientset, err := o.clientset()
+	if err != nil {
+		return err
+	}
+	return checkRBAC(ctx, clientset, o.veleroNamespace, o.mover, namespaces)
+}
+
+// canI reports whether the identity of clientset may verb resource of group
+// in namespace, every namespace if empty.
+func canI(ctx context.Context, clientset kubernetes.Interface, verb, group, resource, namespace string) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     group,
+				Resource:  resource,
+			},
+		},
+	}
+	review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to review access to %s %s", verb, resource)
+	}
+	return review.Status.Allowed, nil
+}
@@ -0,0 +1,233 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxValidationOutput bounds how much of the output of a validation command
+// is kept in the results, the end of it being the most telling.
+const maxValidationOutput = 1024
+
+// readinessOptions ask for the applications of the restored namespaces to be
+// waited for, and optionally validated, once a restore is done.
+type readinessOptions struct {
+	waitReady bool
+	timeout   time.Duration
+	// validateCommand is run through sh in every restored namespace once
+	// its applications are ready, with NAMESPACE and RUN set.
+	validateCommand string
+}
+
+// enabled reports whether the restored applications are to be waited for.
+// A validation command implies waiting for them.
+func (o *readinessOptions) enabled() bool {
+	return o.waitReady || o.validateCommand != ""
+}
+
+func (o *readinessOptions) validate() error {
+	if o.enabled() && o.timeout <= 0 {
+		return errors.New("ready-timeout must be positive")
+	}
+	return nil
+}
+
+// readinessResult holds how long after the start of the restore the PVCs and
+// the applications of each restored namespace took to be ready.
+type readinessResult struct {
+	Namespaces []*namespaceReadiness `json:"namespaces"`
+}
+
+type namespaceReadiness struct {
+	Namespace string      `json:"namespace"`
+	PVCs      int         `json:"pvcs"`
+	Workloads []*workload `json:"workloads,omitempty"`
+	// PVCsBound is the time from the start of the restore until every PVC
+	// of the namespace was bound and AppReady until, after that, every
+	// Deployment and StatefulSet had its replicas ready.
+	PVCsBound time.Duration `json:"pvcsBound,omitempty"`
+	AppReady  time.Duration `json:"appReady,omitempty"`
+	// Validation* are the outcome of the validation command, if one was
+	// given.
+	ValidationTime   time.Duration `json:"validationTime,omitempty"`
+	ValidationOutput string        `json:"validationOutput,omitempty"`
+	ValidationError  string        `json:"validationError,omitempty"`
+	Error            string        `json:"error,omitempty"`
+}
+
+func (n *namespaceReadiness) ready() bool {
+	return n.AppReady > 0
+}
+
+// summary gives the slowest namespace to have its PVCs bound and its
+// applications ready and how many passed validation.
+func (r *readinessResult) summary() string {
+	var bound, ready time.Duration
+	notReady, validated, failed := 0, 0, 0
+	for _, n := range r.Namespaces {
+		if n.PVCsBound > bound {
+			bound = n.PVCsBound
+		}
+		if n.AppReady > ready {
+			ready = n.AppReady
+		}
+		if !n.ready() {
+			notReady++
+		}
+		switch {
+		case n.ValidationError != "":
+			failed++
+		case n.ValidationTime > 0:
+			validated++
+		}
+	}
+	summary := fmt.Sprintf("PVCs bound after %v, apps ready after %v, %d of %d namespaces not ready", bound.Round(time.Second), ready.Round(time.Second), notReady, len(r.Namespaces))
+	if validated+failed > 0 {
+		summary += fmt.Sprintf(", validation passed in %d and failed in %d", validated, failed)
+	}
+	return summary
+}
+
+// waitForApps waits for the PVCs of namespaces to be bound and then for their
+// Deployments and StatefulSets to be ready, timing both from since, the start
+// of the restore, and runs the validation command in every namespace that got
+// ready. It records what it found in results and returns an error if a
+// namespace did not get ready or failed validation.
+func waitForApps(ctx context.Context, c client.Client, results *runResults, namespaces []string, since time.Time, o readinessOptions) error {
+	readiness := &readinessResult{}
+	results.mu.Lock()
+	results.Readiness = readiness
+	results.mu.Unlock()
+	workloads := map[string][]*workload{}
+	for _, ns := range namespaces {
+		listed, err := listWorkloads(ctx, c, []string{ns})
+		if err != nil {
+			return err
+		}
+		workloads[ns] = listed
+		readiness.Namespaces = append(readiness.Namespaces, &namespaceReadiness{Namespace: ns, Workloads: listed})
+	}
+
+	loggerFrom(ctx).Infow("waiting for restored applications", "phase", phaseRestore, "namespaces", len(namespaces))
+	err := wait.PollImmediate(5*time.Second, o.timeout, func() (bool, error) {
+		done := 0
+		for _, n := range readiness.Namespaces {
+			if n.ready() {
+				done++
+				continue
+			}
+			if n.PVCsBound == 0 {
+				pvcs := corev1.PersistentVolumeClaimList{}
+				err := c.List(ctx, &pvcs, client.InNamespace(n.Namespace))
+				if err != nil {
+					return false, errors.Wrapf(err, "failed to list persistentvolumeclaims in %s", n.Namespace)
+				}
+				n.PVCs = len(pvcs.Items)
+				if !allBound(pvcs.Items) {
+					continue
+				}
+				n.PVCsBound = time.Since(since)
+				loggerFrom(ctx).Infow("restored PVCs bound", "phase", phaseRestore, "namespace", n.Namespace, "pvcs", n.PVCs, "elapsed", n.PVCsBound.String())
+			}
+			ready, err := workloadsReady(ctx, c, workloads[n.Namespace])
+			if err != nil {
+				return false, err
+			}
+			if !ready {
+				continue
+			}
+			n.AppReady = time.Since(since)
+			done++
+			loggerFrom(ctx).Infow("restored applications ready", "phase", phaseRestore, "namespace", n.Namespace, "workloads", len(n.Workloads), "elapsed", n.AppReady.String())
+		}
+		return done == len(readiness.Namespaces), nil
+	})
+	if err != nil && err != wait.ErrWaitTimeout {
+		return err
+	}
+
+	failures := []string{}
+	for _, n := range readiness.Namespaces {
+		if !n.ready() {
+			n.Error = fmt.Sprintf("not ready within %v", o.timeout)
+			failures = append(failures, fmt.Sprintf("%s %s", n.Namespace, n.Error))
+			continue
+		}
+		if o.validateCommand == "" {
+			continue
+		}
+		runValidation(ctx, n, results.Backup, o.validateCommand)
+		if n.ValidationError != "" {
+			failures = append(failures, fmt.Sprintf("%s failed validation: %s", n.Namespace, n.ValidationError))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("restored applications are not healthy: %s", strings.Join(failures, "; "))
+	}
+	loggerFrom(ctx).Infow("restored applications healthy", "phase", phaseRestore, "readiness", readiness.summary())
+	return nil
+}
+
+func allBound(pvcs []corev1.PersistentVolumeClaim) bool {
+	for _, pvc := range pvcs {
+		if pvc.Status.Phase != corev1.ClaimBound {
+			return false
+		}
+	}
+	return true
+}
+
+// workloadsReady reports whether every workload has its replicas ready,
+// recording when each first did.
+func workloadsReady(ctx context.Context, c client.Client, workloads []*workload) (bool, error) {
+	ready := true
+	for _, w := range workloads {
+		if !w.ReadyTime.IsZero() {
+			continue
+		}
+		ok, err := w.ready(ctx, c)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			w.ReadyTime = time.Now()
+		} else {
+			ready = false
+		}
+	}
+	return ready, nil
+}
+
+// runValidation runs command through sh for the namespace of n, recording how
+// long it took, the end of its output and whether it failed.
+func runValidation(ctx context.Context, n *namespaceReadiness, run, command string) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "NAMESPACE="+n.Namespace, "RUN="+run)
+	out := bytes.Buffer{}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	start := time.Now()
+	err := cmd.Run()
+	n.ValidationTime = time.Since(start)
+	output := strings.TrimSpace(out.String())
+	if len(output) > maxValidationOutput {
+		output = output[len(output)-maxValidationOutput:]
+	}
+	n.ValidationOutput = output
+	if err != nil {
+		n.ValidationError = err.Error()
+		loggerFrom(ctx).Errorw("validation failed", "phase", phaseRestore, "namespace", n.Namespace, "error", err, "output", output)
+		return
+	}
+	loggerFrom(ctx).Infow("validation passed", "phase", phaseRestore, "namespace", n.Namespace, "elapsed", n.ValidationTime.String())
+}
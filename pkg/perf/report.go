@@ -0,0 +1,862 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	reportText     = "text"
+	reportMarkdown = "markdown"
+	reportHTML     = "html"
+
+	// histogramBuckets is the number of bars in the VSB duration histogram.
+	histogramBuckets = 10
+	// slowestVolumes is the number of volumes listed as the slowest.
+	slowestVolumes = 10
+)
+
+type reportOptions struct {
+	*rootOptions
+	file       string
+	run        string
+	output     string
+	outputFile string
+	baseline   string
+	threshold  float64
+}
+
+func newReportCommand(root *rootOptions) *cobra.Command {
+	o := &reportOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Summarize a JSON results file written by the backup command",
+		Long: `Summarize a JSON results file written by the backup command, or with --run
+the timings the backup command recorded in annotations on the Backup and
+VolumeSnapshotBackups of a run, for runs whose client died before writing its
+results. The text summary is printed to the terminal, while the markdown and
+html reports add per-phase timings, a histogram of VSB durations, throughput
+and the slowest volumes, for attaching to a ticket.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (o.file == "") == (o.run == "") {
+				return errors.New("set exactly one of the file and run flags")
+			}
+			if o.output != reportText && o.output != reportMarkdown && o.output != reportHTML {
+				return errors.Errorf("unknown output format %q, must be one of %s, %s or %s", o.output, reportText, reportMarkdown, reportHTML)
+			}
+			results, err := o.results(cmd.Context())
+			if err != nil {
+				return err
+			}
+			var deltas []baselineDelta
+			if o.baseline != "" {
+				baseline, err := readResults(o.baseline)
+				if err != nil {
+					return err
+				}
+				deltas = compareBaseline(results, baseline, o.threshold)
+			}
+			if o.output == reportText {
+				printReport(results)
+				if o.baseline != "" {
+					fmt.Println()
+					printBaseline(os.Stdout, o.baseline, deltas)
+				}
+				return regressionError(deltas, o.threshold)
+			}
+
+			var w io.Writer = os.Stdout
+			if o.outputFile != "" {
+				f, err := os.Create(o.outputFile)
+				if err != nil {
+					return errors.Wrapf(err, "failed to create report file %s", o.outputFile)
+				}
+				defer f.Close()
+				w = f
+			}
+			d := newReportData(results)
+			d.Baseline, d.Deltas = o.baseline, deltas
+			err = writeReport(w, o.output, d)
+			if err != nil {
+				return err
+			}
+			return regressionError(deltas, o.threshold)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.file, "file", "", "path of a results file written with --output json")
+	flags.StringVar(&o.run, "run", "", "ID of a run to reassemble the results of from the annotations on its Backup and volumesnapshotbackups instead of reading a file")
+	flags.StringVar(&o.output, "output", reportText, "format of the report: text, markdown or html")
+	flags.StringVar(&o.outputFile, "output-file", "", "path to write the markdown or html report to, stdout if not set")
+	flags.StringVar(&o.baseline, "baseline", "", "JSON results file of a previous run to compare against")
+	flags.Float64Var(&o.threshold, "regression-threshold", 10, "percentage by which a timing may be slower than the baseline before the command fails")
+	return cmd
+}
+
+// results reads the results file or reassembles the results of the run from
+// the cluster.
+func (o *reportOptions) results(ctx context.Context) (*runResults, error) {
+	if o.file != "" {
+		return readResults(o.file)
+	}
+	c, err := o.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = o.resolveVeleroNamespace(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return resultsFromCluster(ctx, c, o.veleroNamespace, o.run)
+}
+
+// printReport prints the summary of r to stdout. r must not be changing,
+// such as results read from a file or the snapshot the sinks are given.
+func printReport(r *runResults) {
+	failed, stalled, notCreated := 0, 0, 0
+	var total time.Duration
+	var throughput float64
+	var slowest *volumeResult
+	for _, v := range r.Volumes {
+		if v.Stalled {
+			stalled++
+		}
+		if v.CreateFailed {
+			notCreated++
+		}
+		if v.Error != "" {
+			failed++
+			continue
+		}
+		total += v.VSBDuration
+		throughput += v.Throughput
+		if slowest == nil || v.VSBDuration > slowest.VSBDuration {
+			slowest = v
+		}
+	}
+
+	fmt.Printf("Backup:             %s\n", r.Backup)
+	if r.Cluster != "" {
+		fmt.Printf("Cluster:            %s\n", r.Cluster)
+	}
+	if info := r.ClusterInfo; info != nil {
+		fmt.Printf("Environment:        %s\n", info.summary())
+		if len(info.StorageClasses) > 0 {
+			fmt.Printf("Storage:            %s\n", info.storageSummary())
+		}
+	}
+	if r.ToolVersion != "" {
+		fmt.Printf("Tool version:       %s (results schema %d)\n", r.ToolVersion, r.SchemaVersion)
+	}
+	fmt.Printf("Namespaces:         %v\n", r.Namespaces)
+	if r.Mover != "" {
+		fmt.Printf("Mover:              %s\n", r.Mover)
+	}
+	fmt.Printf("Concurrency:        %v (%s)\n", r.Concurrency, r.Schedule)
+	if r.BatchAdvanceThreshold > 0 {
+		fmt.Printf("Batch advance:      at %.0f%% done\n", r.BatchAdvanceThreshold*100)
+	}
+	if queue := controllerQueueSummary(r); queue != "" {
+		fmt.Printf("Controller queue:   %s\n", queue)
+	}
+	if r.VSBCreateRate > 0 {
+		fmt.Printf("VSB create rate:    %v/s\n", r.VSBCreateRate)
+	}
+	if r.BatchDelay > 0 || r.CreateJitter > 0 {
+		fmt.Printf("Pacing:             %v batch delay, %v create jitter\n", r.BatchDelay, r.CreateJitter)
+	}
+	if len(r.ResticSecrets) > 0 {
+		fmt.Printf("Restic secrets:     %s\n", resticSecretsSummary(r.ResticSecrets))
+	}
+	if r.VeleroSchedule != "" {
+		fmt.Printf("Velero schedule:    %s\n", r.VeleroSchedule)
+	}
+	if b := r.VeleroBackup; b != nil {
+		fmt.Printf("Velero backup:      %s\n", b.summary())
+		fmt.Printf("Backup phases:      %s\n", b.transitions())
+		if len(b.Resources) > 0 || b.ListedItems > 0 {
+			fmt.Printf("Backup items:       %s\n", b.resourcesSummary())
+		}
+	}
+	if a := r.Allocation; a != nil {
+		fmt.Printf("Snapshots:          %s\n", a.summary())
+		for _, pvc := range a.Missing {
+			fmt.Printf("  missing:          %s\n", pvc)
+		}
+	}
+	fmt.Printf("Snapshot time:      %v\n", r.SnapshotTime)
+	fmt.Printf("Data Mover time:    %v\n", r.DataMoverTime)
+	fmt.Printf("Total time:         %v\n", r.TotalTime)
+	if r.Restore != nil {
+		fmt.Printf("Restore:            %s\n", r.Restore.summary())
+	}
+	if r.Readiness != nil {
+		fmt.Printf("App readiness:      %s\n", r.Readiness.summary())
+	}
+	if r.DR != nil {
+		fmt.Printf("Disaster recovery:  %s\n", r.DR.summary())
+	}
+	if r.Deletion != nil {
+		fmt.Printf("Deletion:           %s\n", r.Deletion.summary())
+	}
+	if len(r.Chaos) > 0 {
+		fmt.Printf("Chaos:              %s\n", r.chaosSummary())
+	}
+	if r.Storage != nil {
+		fmt.Printf("Object storage:     %s\n", r.Storage.summary())
+	}
+	if r.RepoStats != nil {
+		fmt.Printf("Repositories:       %s\n", r.RepoStats.summary())
+	}
+	fmt.Printf("Volumes:            %v (%v failed, %v stalled, %v not created)\n", len(r.Volumes), failed, stalled, notCreated)
+	if checked, unverified := cloudSnapshotCounts(r); checked > 0 {
+		fmt.Printf("Cloud snapshots:    %v checked, %v not completed\n", checked, unverified)
+	}
+	if succeeded := len(r.Volumes) - failed; succeeded > 0 {
+		fmt.Printf("Mean VSB duration:  %v\n", total/time.Duration(succeeded))
+		fmt.Printf("Slowest VSB:        %s/%s %v\n", slowest.Namespace, slowest.VolumeSnapshotBackup, slowest.VSBDuration)
+	}
+	if queue, setup, transfer, cleanup := r.meanVSBPhases(); queue+setup+transfer+cleanup > 0 {
+		fmt.Printf("Mean VSB phases:    queue %v, setup %v, transfer %v, cleanup %v\n", queue.Round(time.Second), setup.Round(time.Second), transfer.Round(time.Second), cleanup.Round(time.Second))
+	}
+	if aggregate := dataMoverThroughput(r); aggregate > 0 {
+		fmt.Printf("Throughput:         %.2f GiB/min\n", aggregate)
+	}
+	if succeeded := len(r.Volumes) - failed; succeeded > 0 && throughput > 0 {
+		fmt.Printf("VSB throughput:     %.2f GiB/min mean\n", throughput/float64(succeeded))
+	}
+	if stats := vsbDurationStats(r); stats[0].Count > 0 {
+		fmt.Println()
+		printDurationStats(os.Stdout, "VSB durations", stats)
+	}
+	if stats := vsrDurationStats(r); stats[0].Count > 0 {
+		fmt.Println()
+		printDurationStats(os.Stdout, "VSR durations", stats)
+	}
+	if stats := vscReadyStats(r); stats[0].Count > 0 {
+		fmt.Println()
+		printDurationStats(os.Stdout, "VSC ready latency", stats)
+	}
+	if stats := snapshotLatencyStats(r); stats[0].Count > 0 {
+		fmt.Println()
+		printDurationStats(os.Stdout, "Snapshot latency", stats)
+	}
+	if stats := queueDurationStats(r); stats[0].Count > 0 {
+		fmt.Println()
+		printDurationStats(os.Stdout, "VSB queue times", stats)
+	}
+	if stats := syncDurationStats(r); stats[0].Count > 0 {
+		fmt.Println()
+		printDurationStats(os.Stdout, "Volsync sync durations", stats)
+	}
+	if summaries := namespaceSummaries(r); len(summaries) > 1 {
+		fmt.Println()
+		printNamespaceSummaries(os.Stdout, summaries)
+	}
+	if len(r.ResourceUsage) > 0 {
+		fmt.Println()
+		printResourceUsage(os.Stdout, r.ResourceUsage)
+	}
+	if len(r.Integrity) > 0 {
+		corrupted, unverified := 0, 0
+		for _, v := range r.Integrity {
+			switch {
+			case v.Corrupted:
+				corrupted++
+			case v.Error != "" || v.RestoredSHA256 == "":
+				unverified++
+			}
+		}
+		fmt.Printf("Verified PVCs:      %v (%v corrupted, %v unverified)\n", len(r.Integrity), corrupted, unverified)
+	}
+}
+
+// reportData is what the markdown and html reports are rendered from.
+type reportData struct {
+	Results    *runResults
+	Failed     int
+	Stalled    int
+	NotCreated int
+	Throughput float64
+	// VeleroBackup and BackupPhases describe the Velero Backup, if it
+	// was watched.
+	VeleroBackup string
+	BackupPhases string
+	// BackupItems summarizes the log and the resource list of the Backup,
+	// when they were collected.
+	BackupItems string
+	// Allocation compares the expected snapshots with those created, if
+	// they were counted.
+	Allocation string
+	// Restore times the VolumeSnapshotRestores, if the run was restored.
+	Restore string
+	// Readiness summarizes how long the restored applications took to be
+	// ready, if they were waited for.
+	Readiness string
+	// DR summarizes the recovery of a dr-test.
+	DR string
+	// Deletion times the deletion of the backup, if it was deleted.
+	Deletion string
+	// Environment and Storage describe the cluster, if it was recorded.
+	Environment string
+	Storage     string
+	// ResticSecrets counts the namespaces of each restic secret, when the
+	// namespaces did not all use the same one.
+	ResticSecrets string
+	// ControllerQueue summarizes how VSBs queued in the data mover under
+	// the limit of the DPA.
+	ControllerQueue string
+	Phases          []reportBar
+	VSBPhases       []reportBar
+	Histogram       []reportBar
+	// VSBStats, VSCReadyStats, SnapshotStats and QueueStats are set when
+	// there are durations to summarize.
+	VSBStats      []durationStats
+	VSCReadyStats []durationStats
+	SnapshotStats []durationStats
+	QueueStats    []durationStats
+	// VSRStats summarizes the VSRs of a restored run alongside VSBStats.
+	VSRStats []durationStats
+	// ByNamespace is set when the run covered more than one namespace.
+	ByNamespace []namespaceSummary
+	Slowest     []*volumeResult
+	Corrupted   int
+	Unverified  int
+	Baseline    string
+	Deltas      []baselineDelta
+}
+
+// reportBar is one bar of a chart, with Percent relative to the largest bar.
+type reportBar struct {
+	Label   string
+	Value   string
+	Percent int
+}
+
+// newReportData gathers what the report of r shows. Like printReport, r must
+// not be changing.
+func newReportData(r *runResults) *reportData {
+	d := &reportData{Results: r, Throughput: dataMoverThroughput(r)}
+	if b := r.VeleroBackup; b != nil {
+		d.VeleroBackup = b.summary()
+		d.BackupPhases = b.transitions()
+		if len(b.Resources) > 0 || b.ListedItems > 0 {
+			d.BackupItems = b.resourcesSummary()
+		}
+	}
+	if r.Allocation != nil {
+		d.Allocation = r.Allocation.summary()
+	}
+	if info := r.ClusterInfo; info != nil {
+		d.Environment = info.summary()
+		d.Storage = info.storageSummary()
+	}
+	if r.Restore != nil {
+		d.Restore = r.Restore.summary()
+	}
+	if r.Readiness != nil {
+		d.Readiness = r.Readiness.summary()
+	}
+	if r.DR != nil {
+		d.DR = r.DR.summary()
+	}
+	if r.Deletion != nil {
+		d.Deletion = r.Deletion.summary()
+	}
+	d.ControllerQueue = controllerQueueSummary(r)
+	if len(r.ResticSecrets) > 0 {
+		d.ResticSecrets = resticSecretsSummary(r.ResticSecrets)
+	}
+	durations := []time.Duration{}
+	completed := []*volumeResult{}
+	for _, v := range r.Volumes {
+		if v.Stalled {
+			d.Stalled++
+		}
+		if v.CreateFailed {
+			d.NotCreated++
+		}
+		if v.Error != "" {
+			d.Failed++
+			continue
+		}
+		if v.VSBCompletionTime.IsZero() {
+			continue
+		}
+		durations = append(durations, v.VSBDuration)
+		completed = append(completed, v)
+	}
+	for _, v := range r.Integrity {
+		switch {
+		case v.Corrupted:
+			d.Corrupted++
+		case v.Error != "" || v.RestoredSHA256 == "":
+			d.Unverified++
+		}
+	}
+
+	d.Phases = durationBars([]string{"Snapshot", "Data mover", "Total"}, []time.Duration{r.SnapshotTime, r.DataMoverTime, r.TotalTime})
+	d.Histogram = histogram(durations, histogramBuckets)
+	if queue, setup, transfer, cleanup := r.meanVSBPhases(); queue+setup+transfer+cleanup > 0 {
+		d.VSBPhases = durationBars([]string{"Queue", "Setup", "Transfer", "Cleanup"}, []time.Duration{queue, setup, transfer, cleanup})
+	}
+
+	if stats := vsbDurationStats(r); stats[0].Count > 0 {
+		d.VSBStats = stats
+	}
+	if stats := vsrDurationStats(r); stats[0].Count > 0 {
+		d.VSRStats = stats
+	}
+	if stats := vscReadyStats(r); stats[0].Count > 0 {
+		d.VSCReadyStats = stats
+	}
+	if stats := snapshotLatencyStats(r); stats[0].Count > 0 {
+		d.SnapshotStats = stats
+	}
+	if stats := queueDurationStats(r); stats[0].Count > 0 {
+		d.QueueStats = stats
+	}
+	if summaries := namespaceSummaries(r); len(summaries) > 1 {
+		d.ByNamespace = summaries
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].VSBDuration > completed[j].VSBDuration
+	})
+	if len(completed) > slowestVolumes {
+		completed = completed[:slowestVolumes]
+	}
+	d.Slowest = completed
+	return d
+}
+
+func durationBars(labels []string, durations []time.Duration) []reportBar {
+	var max time.Duration
+	for _, d := range durations {
+		if d > max {
+			max = d
+		}
+	}
+	bars := []reportBar{}
+	for i, d := range durations {
+		bar := reportBar{Label: labels[i], Value: d.Round(time.Second).String()}
+		if max > 0 {
+			bar.Percent = int(100 * d / max)
+		}
+		bars = append(bars, bar)
+	}
+	return bars
+}
+
+// histogram splits durations into up to buckets equal ranges between the
+// shortest and the longest, counting the volumes in each.
+func histogram(durations []time.Duration, buckets int) []reportBar {
+	if len(durations) == 0 {
+		return nil
+	}
+	min, max := durations[0], durations[0]
+	for _, d := range durations {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	width := time.Duration(math.Ceil(float64(max-min+1) / float64(buckets)))
+	if width < time.Second {
+		width = time.Second
+	}
+	width = width.Round(time.Second)
+	counts := make([]int, buckets)
+	for _, d := range durations {
+		i := int((d - min) / width)
+		if i >= buckets {
+			i = buckets - 1
+		}
+		counts[i]++
+	}
+	for len(counts) > 1 && counts[len(counts)-1] == 0 {
+		counts = counts[:len(counts)-1]
+	}
+
+	most := 0
+	for _, count := range counts {
+		if count > most {
+			most = count
+		}
+	}
+	bars := []reportBar{}
+	for i, count := range counts {
+		low := (min + time.Duration(i)*width).Round(time.Second)
+		high := (min + time.Duration(i+1)*width).Round(time.Second)
+		bars = append(bars, reportBar{
+			Label:   fmt.Sprintf("%v - %v", low, high),
+			Value:   fmt.Sprint(count),
+			Percent: 100 * count / most,
+		})
+	}
+	return bars
+}
+
+func writeReport(w io.Writer, format string, d *reportData) error {
+	var err error
+	switch format {
+	case reportMarkdown:
+		err = markdownReport.Execute(w, d)
+	case reportHTML:
+		err = htmlReport.Execute(w, d)
+	default:
+		err = errors.Errorf("unknown report format %q", format)
+	}
+	return errors.Wrap(err, "failed to write report")
+}
+
+var reportFuncs = map[string]interface{}{
+	"bar": func(percent int) string {
+		return strings.Repeat("█", percent/5)
+	},
+	"round": func(d time.Duration) time.Duration {
+		return d.Round(time.Second)
+	},
+	"gib": func(bytes int64) string {
+		return fmt.Sprintf("%.2f", float64(bytes)/(1<<30))
+	},
+	"bytes": formatBytes,
+	// The html charts are drawn as horizontal bars in rows of chartRow
+	// pixels, with the labels to the left of the bars.
+	"chartHeight": func(bars []reportBar) int {
+		return len(bars) * chartRow
+	},
+	"barX": func() int {
+		return chartLabelWidth
+	},
+	"barY": func(i, offset int) int {
+		return i*chartRow + offset
+	},
+	"barWidth": func(percent int) int {
+		return percent * 4
+	},
+	"valueX": func(percent int) int {
+		return chartLabelWidth + percent*4 + 6
+	},
+}
+
+const (
+	chartRow        = 22
+	chartLabelWidth = 160
+)
+
+var markdownReport = texttemplate.Must(texttemplate.New("markdown").Funcs(reportFuncs).Parse(`# Data mover performance report: {{ .Results.Backup }}
+
+| | |
+|---|---|
+{{- if .Results.Cluster }}
+| Cluster | {{ .Results.Cluster }} |
+{{- end }}
+| Namespaces | {{ range $i, $ns := .Results.Namespaces }}{{ if $i }}, {{ end }}{{ $ns }}{{ end }} |
+{{- if .Results.Mover }}
+| Mover | {{ .Results.Mover }} |
+{{- end }}
+| Concurrency | {{ .Results.Concurrency }} ({{ .Results.Schedule }}) |
+{{- if .ControllerQueue }}
+| Controller queue | {{ .ControllerQueue }} |
+{{- end }}
+{{- if .ResticSecrets }}
+| Restic secrets | {{ .ResticSecrets }} |
+{{- end }}
+{{- if .Environment }}
+| Environment | {{ .Environment }} |
+{{- end }}
+{{- if .Storage }}
+| Storage | {{ .Storage }} |
+{{- end }}
+| Started | {{ .Results.StartTime.Format "2006-01-02 15:04:05 MST" }} |
+{{- if .VeleroBackup }}
+| Velero backup | {{ .VeleroBackup }} |
+| Backup phases | {{ .BackupPhases }} |
+{{- end }}
+{{- if .BackupItems }}
+| Backup items | {{ .BackupItems }} |
+{{- end }}
+{{- if .Allocation }}
+| Snapshots | {{ .Allocation }} |
+{{- end }}
+| Volumes | {{ len .Results.Volumes }} ({{ .Failed }} failed, {{ .Stalled }} stalled, {{ .NotCreated }} not created) |
+| Throughput | {{ printf "%.2f" .Throughput }} GiB/min |
+{{- if .Restore }}
+| Restore | {{ .Restore }} |
+{{- end }}
+{{- if .Readiness }}
+| App readiness | {{ .Readiness }} |
+{{- end }}
+{{- if .DR }}
+| Disaster recovery | {{ .DR }} |
+{{- end }}
+{{- if .Deletion }}
+| Deletion | {{ .Deletion }} |
+{{- end }}
+{{- if .Results.Integrity }}
+| Verified PVCs | {{ len .Results.Integrity }} ({{ .Corrupted }} corrupted, {{ .Unverified }} unverified) |
+{{- end }}
+
+## Phase timings
+
+| Phase | Duration | |
+|---|---|---|
+{{- range .Phases }}
+| {{ .Label }} | {{ .Value }} | {{ bar .Percent }} |
+{{- end }}
+{{ if .VSBPhases }}
+## Mean time per VSB phase
+
+| Phase | Duration | |
+|---|---|---|
+{{- range .VSBPhases }}
+| {{ .Label }} | {{ .Value }} | {{ bar .Percent }} |
+{{- end }}
+{{ end -}}
+{{ if .Histogram }}
+## VSB durations
+
+| Duration | Volumes | |
+|---|---|---|
+{{- range .Histogram }}
+| {{ .Label }} | {{ .Value }} | {{ bar .Percent }} |
+{{- end }}
+
+## Slowest volumes
+
+| Namespace | PVC | VSB | Size (GiB) | Duration | GiB/min |
+|---|---|---|---|---|---|
+{{- range .Slowest }}
+| {{ .Namespace }} | {{ .PVC }} | {{ .VolumeSnapshotBackup }} | {{ gib .SizeBytes }} | {{ round .VSBDuration }} | {{ printf "%.2f" .Throughput }} |
+{{- end }}
+{{ end -}}
+{{ if .VSBStats }}
+## VSB duration percentiles
+{{ template "stats" .VSBStats }}
+{{ end -}}
+{{ if .VSRStats }}
+## VSR duration percentiles
+{{ template "stats" .VSRStats }}
+{{ end -}}
+{{ if .VSCReadyStats }}
+## VSC ready latency percentiles
+{{ template "stats" .VSCReadyStats }}
+{{ end -}}
+{{ if .SnapshotStats }}
+## Snapshot latency percentiles
+{{ template "stats" .SnapshotStats }}
+{{ end -}}
+{{ if .QueueStats }}
+## VSB queue time percentiles
+{{ template "stats" .QueueStats }}
+{{ end -}}
+{{ if .ByNamespace }}
+## Namespaces
+
+| Namespace | Volumes | Failed | Size (GiB) | VSB time | VSB P95 | GiB/min |
+|---|---|---|---|---|---|---|
+{{- range .ByNamespace }}
+| {{ .Namespace }} | {{ .Volumes }} | {{ .Failed }} | {{ gib .SizeBytes }} | {{ round .VSBTime }} | {{ round .P95 }} | {{ printf "%.2f" .Throughput }} |
+{{- end }}
+{{ end -}}
+{{ if .Results.ResourceUsage }}
+## Resource usage
+
+| Component | Samples | CPU peak | CPU mean | Memory peak | Memory mean | CPU s/GiB |
+|---|---|---|---|---|---|---|
+{{- range .Results.ResourceUsage }}
+| {{ .Component }} | {{ .Samples }} | {{ .PeakCPUMillis }}m | {{ .MeanCPUMillis }}m | {{ bytes .PeakMemoryBytes }} | {{ bytes .MeanMemoryBytes }} | {{ printf "%.2f" .CPUPerGiB }} |
+{{- end }}
+{{ end -}}
+{{ if .Baseline }}
+## Compared to baseline {{ .Baseline }}
+
+| Metric | Baseline | Current | Delta | |
+|---|---|---|---|---|
+{{- range .Deltas }}
+| {{ .Metric }} | {{ round .Baseline }} | {{ round .Current }} | {{ printf "%+.1f%%" .Percent }} | {{ if .Regressed }}**REGRESSED**{{ end }} |
+{{- end }}
+{{ end -}}
+{{ define "stats" }}
+| Group | Count | Min | Mean | P50 | P90 | P95 | P99 | Max |
+|---|---|---|---|---|---|---|---|---|
+{{- range . }}
+| {{ .Group }} | {{ .Count }} | {{ round .Min }} | {{ round .Mean }} | {{ round .P50 }} | {{ round .P90 }} | {{ round .P95 }} | {{ round .P99 }} | {{ round .Max }} |
+{{- end }}
+{{ end -}}
+`))
+
+var htmlReport = htmltemplate.Must(htmltemplate.New("html").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Data mover performance report: {{ .Results.Backup }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+svg { display: block; }
+</style>
+</head>
+<body>
+<h1>Data mover performance report: {{ .Results.Backup }}</h1>
+<table>
+{{- if .Results.Cluster }}
+<tr><th>Cluster</th><td>{{ .Results.Cluster }}</td></tr>
+{{- end }}
+<tr><th>Namespaces</th><td>{{ range $i, $ns := .Results.Namespaces }}{{ if $i }}, {{ end }}{{ $ns }}{{ end }}</td></tr>
+{{- if .Results.Mover }}
+<tr><th>Mover</th><td>{{ .Results.Mover }}</td></tr>
+{{- end }}
+<tr><th>Concurrency</th><td>{{ .Results.Concurrency }} ({{ .Results.Schedule }})</td></tr>
+{{- if .ControllerQueue }}
+<tr><th>Controller queue</th><td>{{ .ControllerQueue }}</td></tr>
+{{- end }}
+{{- if .ResticSecrets }}
+<tr><th>Restic secrets</th><td>{{ .ResticSecrets }}</td></tr>
+{{- end }}
+{{- if .Environment }}
+<tr><th>Environment</th><td>{{ .Environment }}</td></tr>
+{{- end }}
+{{- if .Storage }}
+<tr><th>Storage</th><td>{{ .Storage }}</td></tr>
+{{- end }}
+<tr><th>Started</th><td>{{ .Results.StartTime.Format "2006-01-02 15:04:05 MST" }}</td></tr>
+{{- if .VeleroBackup }}
+<tr><th>Velero backup</th><td>{{ .VeleroBackup }}</td></tr>
+<tr><th>Backup phases</th><td>{{ .BackupPhases }}</td></tr>
+{{- end }}
+{{- if .BackupItems }}
+<tr><th>Backup items</th><td>{{ .BackupItems }}</td></tr>
+{{- end }}
+{{- if .Allocation }}
+<tr><th>Snapshots</th><td>{{ .Allocation }}</td></tr>
+{{- end }}
+<tr><th>Volumes</th><td>{{ len .Results.Volumes }} ({{ .Failed }} failed, {{ .Stalled }} stalled, {{ .NotCreated }} not created)</td></tr>
+<tr><th>Throughput</th><td>{{ printf "%.2f" .Throughput }} GiB/min</td></tr>
+{{- if .Restore }}
+<tr><th>Restore</th><td>{{ .Restore }}</td></tr>
+{{- end }}
+{{- if .Readiness }}
+<tr><th>App readiness</th><td>{{ .Readiness }}</td></tr>
+{{- end }}
+{{- if .DR }}
+<tr><th>Disaster recovery</th><td>{{ .DR }}</td></tr>
+{{- end }}
+{{- if .Deletion }}
+<tr><th>Deletion</th><td>{{ .Deletion }}</td></tr>
+{{- end }}
+{{- if .Results.Integrity }}
+<tr><th>Verified PVCs</th><td>{{ len .Results.Integrity }} ({{ .Corrupted }} corrupted, {{ .Unverified }} unverified)</td></tr>
+{{- end }}
+</table>
+
+<h2>Phase timings</h2>
+{{ template "chart" .Phases }}
+{{- if .VSBPhases }}
+
+<h2>Mean time per VSB phase</h2>
+{{ template "chart" .VSBPhases }}
+{{- end }}
+{{- if .Histogram }}
+
+<h2>VSB durations</h2>
+{{ template "chart" .Histogram }}
+
+<h2>Slowest volumes</h2>
+<table>
+<tr><th>Namespace</th><th>PVC</th><th>VSB</th><th>Size (GiB)</th><th>Duration</th><th>GiB/min</th></tr>
+{{- range .Slowest }}
+<tr><td>{{ .Namespace }}</td><td>{{ .PVC }}</td><td>{{ .VolumeSnapshotBackup }}</td><td>{{ gib .SizeBytes }}</td><td>{{ round .VSBDuration }}</td><td>{{ printf "%.2f" .Throughput }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .VSBStats }}
+
+<h2>VSB duration percentiles</h2>
+{{ template "stats" .VSBStats }}
+{{- end }}
+{{- if .VSRStats }}
+
+<h2>VSR duration percentiles</h2>
+{{ template "stats" .VSRStats }}
+{{- end }}
+{{- if .VSCReadyStats }}
+
+<h2>VSC ready latency percentiles</h2>
+{{ template "stats" .VSCReadyStats }}
+{{- end }}
+{{- if .SnapshotStats }}
+
+<h2>Snapshot latency percentiles</h2>
+{{ template "stats" .SnapshotStats }}
+{{- end }}
+{{- if .QueueStats }}
+
+<h2>VSB queue time percentiles</h2>
+{{ template "stats" .QueueStats }}
+{{- end }}
+{{- if .ByNamespace }}
+
+<h2>Namespaces</h2>
+<table>
+<tr><th>Namespace</th><th>Volumes</th><th>Failed</th><th>Size (GiB)</th><th>VSB time</th><th>VSB P95</th><th>GiB/min</th></tr>
+{{- range .ByNamespace }}
+<tr><td>{{ .Namespace }}</td><td>{{ .Volumes }}</td><td>{{ .Failed }}</td><td>{{ gib .SizeBytes }}</td><td>{{ round .VSBTime }}</td><td>{{ round .P95 }}</td><td>{{ printf "%.2f" .Throughput }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .Results.ResourceUsage }}
+
+<h2>Resource usage</h2>
+<table>
+<tr><th>Component</th><th>Samples</th><th>CPU peak</th><th>CPU mean</th><th>Memory peak</th><th>Memory mean</th><th>CPU s/GiB</th></tr>
+{{- range .Results.ResourceUsage }}
+<tr><td>{{ .Component }}</td><td>{{ .Samples }}</td><td>{{ .PeakCPUMillis }}m</td><td>{{ .MeanCPUMillis }}m</td><td>{{ bytes .PeakMemoryBytes }}</td><td>{{ bytes .MeanMemoryBytes }}</td><td>{{ printf "%.2f" .CPUPerGiB }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .Baseline }}
+
+<h2>Compared to baseline {{ .Baseline }}</h2>
+<table>
+<tr><th>Metric</th><th>Baseline</th><th>Current</th><th>Delta</th><th></th></tr>
+{{- range .Deltas }}
+<tr><td>{{ .Metric }}</td><td>{{ round .Baseline }}</td><td>{{ round .Current }}</td><td>{{ printf "%+.1f%%" .Percent }}</td><td>{{ if .Regressed }}<strong>REGRESSED</strong>{{ end }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+</body>
+</html>
+{{ define "chart" -}}
+<svg width="720" height="{{ chartHeight . }}" xmlns="http://www.w3.org/2000/svg" font-size="12">
+{{- range $i, $bar := . }}
+<text x="0" y="{{ barY $i 13 }}">{{ $bar.Label }}</text>
+<rect x="{{ barX }}" y="{{ barY $i 0 }}" width="{{ barWidth $bar.Percent }}" height="16" fill="#3b7dd8"></rect>
+<text x="{{ valueX $bar.Percent }}" y="{{ barY $i 13 }}">{{ $bar.Value }}</text>
+{{- end }}
+</svg>
+{{- end }}
+{{ define "stats" -}}
+<table>
+<tr><th>Group</th><th>Count</th><th>Min</th><th>Mean</th><th>P50</th><th>P90</th><th>P95</th><th>P99</th><th>Max</th></tr>
+{{- range . }}
+<tr><td>{{ .Group }}</td><td>{{ .Count }}</td><td>{{ round .Min }}</td><td>{{ round .Mean }}</td><td>{{ round .P50 }}</td><td>{{ round .P90 }}</td><td>{{ round .P95 }}</td><td>{{ round .P99 }}</td><td>{{ round .Max }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+`))
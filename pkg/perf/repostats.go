@@ -0,0 +1,272 @@
+package perf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultResticImage is used by the pods that read the statistics of the
+// restic repositories of a run. It must provide sh and restic.
+const defaultResticImage = "docker.io/restic/restic:0.15.1"
+
+// repoStatsTimeout bounds how long the repository statistics pods may run.
+const repoStatsTimeout = 30 * time.Minute
+
+// repoStatsScript prints a JSON line per restic repository given as an
+// argument, with the statistics of its deduplicated data and of the data
+// its snapshots restore to. The repositories are read without locking them
+// so the data mover cleaning up is not held up.
+const repoStatsScript = `for repo in "$@"; do
+  raw=$(restic -r "$repo" --no-cache --no-lock stats --json --mode raw-data) || raw=null
+  restore=$(restic -r "$repo" --no-cache --no-lock stats --json --mode restore-size) || restore=null
+  echo "{\"repository\":\"$repo\",\"rawData\":$raw,\"restoreSize\":$restore}"
+done`
+
+// repoStatsResult holds the statistics of the restic repositories the VSBs
+// of a run backed up to, read once they completed.
+type repoStatsResult struct {
+	Repositories int `json:"repositories"`
+	// Failed is how many repositories could not be read.
+	Failed    int `json:"failed,omitempty"`
+	Snapshots int `json:"snapshots,omitempty"`
+	// StoredBytes is the deduplicated data of the repositories, what they
+	// hold in object storage less the overhead of restic.
+	StoredBytes int64 `json:"storedBytes"`
+	// RestoreBytes is the data every snapshot of the repositories restores
+	// to.
+	RestoreBytes int64 `json:"restoreBytes"`
+	// DedupRatio is RestoreBytes over StoredBytes.
+	DedupRatio float64 `json:"dedupRatio,omitempty"`
+	// GrowthBytes is how much StoredBytes grew since the previous run in
+	// the history database, when there is one. LandedThroughput is the GiB
+	// of that growth per minute of data mover time.
+	GrowthBytes      *int64  `json:"growthBytes,omitempty"`
+	LandedThroughput float64 `json:"landedThroughputGiBPerMinute,omitempty"`
+}
+
+func (s *repoStatsResult) summary() string {
+	summary := fmt.Sprintf("%d repositories, %s stored, %s restorable, dedup %.2fx", s.Repositories, formatBytes(s.StoredBytes), formatBytes(s.RestoreBytes), s.DedupRatio)
+	if s.GrowthBytes != nil {
+		summary += fmt.Sprintf(", %s grown since the previous run", formatBytes(*s.GrowthBytes))
+	}
+	if s.LandedThroughput > 0 {
+		summary += fmt.Sprintf(" at %.2f GiB/min", s.LandedThroughput)
+	}
+	if s.Failed > 0 {
+		summary += fmt.Sprintf(" (%d could not be read)", s.Failed)
+	}
+	return summary
+}
+
+// resticStats is what restic stats --json prints.
+type resticStats struct {
+	TotalSize      int64 `json:"total_size"`
+	SnapshotsCount int   `json:"snapshots_count"`
+}
+
+type repoStatsLine struct {
+	Repository  string       `json:"repository"`
+	RawData     *resticStats `json:"rawData"`
+	RestoreSize *resticStats `json:"restoreSize"`
+}
+
+// recordRepoStats reads the statistics of the restic repositories the VSBs
+// of the run backed up to, with a pod per restic secret in the Velero
+// namespace, and records them in results. The growth of the repositories is
+// taken from the latest run with repository statistics in the history
+// database at historyDB, if set.
+func recordRepoStats(ctx context.Context, c client.Client, clientset kubernetes.Interface, veleroNamespace, image, historyDB string, results *runResults) error {
+	vsbList, err := listVolumeSnapshotBackups(ctx, c, results.Backup)
+	if err != nil {
+		return errors.Wrap(err, "failed to list volumesnapshotbackups")
+	}
+	repos := resticRepositories(vsbList.Items)
+	if len(repos) == 0 {
+		loggerFrom(ctx).Warnw("no volumesnapshotbackup reported a restic repository, no repository statistics to read", "phase", phaseDataMover)
+		return nil
+	}
+
+	stats := &repoStatsResult{}
+	for secret, secretRepos := range repos {
+		lines, err := runRepoStatsPod(ctx, c, clientset, veleroNamespace, image, secret, secretRepos)
+		if err != nil {
+			return err
+		}
+		stats.Repositories += len(secretRepos)
+		for _, line := range lines {
+			if line.RawData == nil || line.RestoreSize == nil {
+				loggerFrom(ctx).Warnw("failed to read the statistics of a restic repository", "phase", phaseDataMover, "repository", line.Repository)
+				stats.Failed++
+				continue
+			}
+			stats.StoredBytes += line.RawData.TotalSize
+			stats.RestoreBytes += line.RestoreSize.TotalSize
+			stats.Snapshots += line.RawData.SnapshotsCount
+		}
+		stats.Failed += len(secretRepos) - len(lines)
+	}
+	if stats.StoredBytes > 0 {
+		stats.DedupRatio = float64(stats.RestoreBytes) / float64(stats.StoredBytes)
+	}
+	if historyDB != "" {
+		previous, err := previousRepoStats(historyDB)
+		if err != nil {
+			loggerFrom(ctx).Warnw("failed to read the previous repository statistics", "phase", phaseDataMover, "error", err)
+		} else if previous != nil {
+			growth := stats.StoredBytes - previous.StoredBytes
+			stats.GrowthBytes = &growth
+		}
+	}
+
+	results.mu.Lock()
+	defer results.mu.Unlock()
+	if stats.GrowthBytes != nil && *stats.GrowthBytes > 0 && results.DataMoverTime > 0 {
+		stats.LandedThroughput = float64(*stats.GrowthBytes) / (1 << 30) / results.DataMoverTime.Minutes()
+	}
+	results.RepoStats = stats
+	return nil
+}
+
+// resticRepositories returns the restic repositories the completed VSBs of
+// vsbs backed up to, grouped by the restic secret holding their credentials.
+func resticRepositories(vsbs []dmv1.VolumeSnapshotBackup) map[string][]string {
+	repos := map[string][]string{}
+	seen := map[string]bool{}
+	for _, vsb := range vsbs {
+		repo := vsb.Status.ResticRepository
+		if !isVSBCompleted(&vsb) || repo == "" || seen[repo] {
+			continue
+		}
+		seen[repo] = true
+		secret := vsb.Spec.ResticSecretRef.Name
+		repos[secret] = append(repos[secret], repo)
+	}
+	for _, r := range repos {
+		sort.Strings(r)
+	}
+	return repos
+}
+
+// runRepoStatsPod runs restic stats against repos with the credentials of the
+// restic secret and returns what it printed for each repository.
+func runRepoStatsPod(ctx context.Context, c client.Client, clientset kubernetes.Interface, namespace, image, secret string, repos []string) ([]repoStatsLine, error) {
+	pod := newRepoStatsPod(namespace, image, secret, repos)
+	err := c.Create(ctx, pod)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create repository statistics pod")
+	}
+	defer func() {
+		err := deleteObject(context.Background(), c, pod)
+		if err != nil {
+			loggerFrom(ctx).Errorw("failed to delete repository statistics pod", "error", err)
+		}
+	}()
+	loggerFrom(ctx).Infow("reading restic repository statistics", "phase", phaseDataMover, "pod", pod.Name, "repositories", len(repos))
+
+	err = wait.PollImmediate(5*time.Second, repoStatsTimeout, func() (bool, error) {
+		err := c.Get(ctx, client.ObjectKeyFromObject(pod), pod)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get pod %s/%s", pod.Namespace, pod.Name)
+		}
+		return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pod.Status.Phase != corev1.PodSucceeded {
+		return nil, errors.Errorf("repository statistics pod %s/%s finished in phase %s", pod.Namespace, pod.Name, pod.Status.Phase)
+	}
+	out, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read logs of repository statistics pod %s/%s", pod.Namespace, pod.Name)
+	}
+	lines := []repoStatsLine{}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := repoStatsLine{}
+		if json.Unmarshal(scanner.Bytes(), &line) != nil || line.Repository == "" {
+			// restic itself may print warnings.
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+func newRepoStatsPod(namespace, image, secret string, repos []string) *corev1.Pod {
+	allowPrivilegeEscalation := false
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "oadp-perf-repo-stats-",
+			Namespace:    namespace,
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{{
+				Name:    "stats",
+				Image:   image,
+				Command: append([]string{"/bin/sh", "-c", repoStatsScript, "sh"}, repos...),
+				EnvFrom: []corev1.EnvFromSource{{
+					SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: secret}},
+				}},
+				SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+					SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+				},
+			}},
+		},
+	}
+}
+
+// previousRepoStats returns the repository statistics of the latest run in
+// the history database at path that has them, nil if none does or there is
+// no database yet.
+func previousRepoStats(path string) (*repoStatsResult, error) {
+	runs, err := readHistory(path)
+	if err != nil {
+		if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for i := len(runs) - 1; i >= 0; i-- {
+		if stats := runs[i].Results.RepoStats; stats != nil {
+			return stats, nil
+		}
+	}
+	return nil, nil
+}
+
+// logRepoStats records and logs the statistics of the restic repositories of
+// the run. Failing to read them does not fail the run.
+func (o *backupOptions) logRepoStats(ctx context.Context, c client.Client, results *runResults) {
+	clientset, err := o.clientset()
+	if err == nil {
+		err = recordRepoStats(ctx, c, clientset, o.veleroNamespace, o.repoStatsImage, o.historyDB, results)
+	}
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to read the restic repository statistics", "phase", phaseDataMover, "error", err)
+		return
+	}
+	results.mu.Lock()
+	stats := results.RepoStats
+	results.mu.Unlock()
+	if stats != nil {
+		loggerFrom(ctx).Infow("restic repositories", "phase", phaseDataMover, "repositories", stats.Repositories, "stored", formatBytes(stats.StoredBytes), "restorable", formatBytes(stats.RestoreBytes), "dedup", fmt.Sprintf("%.2fx", stats.DedupRatio))
+	}
+}
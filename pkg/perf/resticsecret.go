@@ -0,0 +1,112 @@
+package perf
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// resticPasswordEnv is the environment variable the restic password of
+// provisioned secrets is read from.
+const resticPasswordEnv = "RESTIC_PASSWORD"
+
+// readResticSecretTemplate reads the Secret YAML that restic secrets are
+// provisioned from. stringData is folded into data, and RESTIC_REPOSITORY
+// must be set to the repository the per namespace prefixes are added to.
+func readResticSecretTemplate(path string) (*corev1.Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read restic secret template %s", path)
+	}
+	secret := &corev1.Secret{}
+	err = yaml.Unmarshal(data, secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse restic secret template %s", path)
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for key, value := range secret.StringData {
+		secret.Data[key] = []byte(value)
+	}
+	secret.StringData = nil
+	if len(secret.Data["RESTIC_REPOSITORY"]) == 0 {
+		return nil, errors.Errorf("restic secret template %s has no RESTIC_REPOSITORY", path)
+	}
+	return secret, nil
+}
+
+// provisionResticSecrets creates the restic secrets of the namespaces to back
+// up from the template.
+func (o *backupOptions) provisionResticSecrets(ctx context.Context, c client.Client) error {
+	template, err := readResticSecretTemplate(o.secretTemplate)
+	if err != nil {
+		return err
+	}
+	namespaces, err := o.resolveNamespaces(ctx, c)
+	if err != nil {
+		return err
+	}
+	secrets, err := o.vsb.secretNames(o.resticSecretName, namespaces)
+	if err != nil {
+		return err
+	}
+	return provisionResticSecrets(ctx, c, template, secrets)
+}
+
+// provisionResticSecrets creates the restic secret the VSBs of each
+// namespace read, named by secrets keyed by namespace, from template. Each
+// namespace gets its own repository under RESTIC_REPOSITORY of the template.
+// The password is taken from $RESTIC_PASSWORD, else from the template, else
+// generated once for all of them. Secrets that already exist are left alone.
+func provisionResticSecrets(ctx context.Context, c client.Client, template *corev1.Secret, secrets map[string]string) error {
+	password := []byte(os.Getenv(resticPasswordEnv))
+	if len(password) == 0 {
+		password = template.Data["RESTIC_PASSWORD"]
+	}
+	if len(password) == 0 {
+		generated := make([]byte, 32)
+		_, err := rand.Read(generated)
+		if err != nil {
+			return errors.Wrap(err, "failed to generate restic password")
+		}
+		password = []byte(hex.EncodeToString(generated))
+		loggerFrom(ctx).Infow("generated restic password for provisioned secrets")
+	}
+	repository := strings.TrimRight(string(template.Data["RESTIC_REPOSITORY"]), "/")
+
+	for ns, name := range secrets {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   ns,
+				Labels:      map[string]string{"app.kubernetes.io/managed-by": "oadp-perf"},
+				Annotations: template.Annotations,
+			},
+			Type: template.Type,
+			Data: map[string][]byte{},
+		}
+		for key, value := range template.Labels {
+			secret.Labels[key] = value
+		}
+		for key, value := range template.Data {
+			secret.Data[key] = value
+		}
+		secret.Data["RESTIC_REPOSITORY"] = []byte(repository + "/" + ns)
+		secret.Data["RESTIC_PASSWORD"] = password
+		err := createIfMissing(ctx, c, secret)
+		if err != nil {
+			return err
+		}
+	}
+	loggerFrom(ctx).Infow("provisioned restic secrets", "namespaces", len(secrets))
+	return nil
+}
@@ -0,0 +1,460 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type restoreOptions struct {
+	*rootOptions
+	run              string
+	resticSecretName string
+	concurrency      int
+	schedule         string
+	order            string
+	advanceThreshold float64
+	// namespaceMappings restores namespaces into others, as
+	// source:target pairs.
+	namespaceMappings string
+	ready             readinessOptions
+}
+
+func newRestoreCommand(root *rootOptions) *cobra.Command {
+	o := &restoreOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a previous run with VolumeSnapshotRestores",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.run == "" {
+				return errors.New("missing run flag")
+			}
+			if o.concurrency < 1 {
+				return errors.New("concurrency must be at least 1")
+			}
+			if o.schedule != scheduleWindow && o.schedule != scheduleBatch {
+				return errors.Errorf("unknown schedule %q, must be one of %s or %s", o.schedule, scheduleWindow, scheduleBatch)
+			}
+			if o.advanceThreshold < 0 || o.advanceThreshold > 1 {
+				return errors.New("batch-advance-threshold must be between 0 and 1")
+			}
+			if o.advanceThreshold > 0 && o.advanceThreshold < 1 && o.schedule != scheduleBatch {
+				return errors.Errorf("batch-advance-threshold needs schedule %s", scheduleBatch)
+			}
+			switch o.order {
+			case "", orderLargestFirst, orderSmallestFirst, orderRandom:
+			default:
+				return errors.Errorf("unknown order %q, must be one of %s, %s or %s", o.order, orderLargestFirst, orderSmallestFirst, orderRandom)
+			}
+			mappings, err := parseNamespaceMappings(o.namespaceMappings)
+			if err != nil {
+				return err
+			}
+			err = o.ready.validate()
+			if err != nil {
+				return err
+			}
+			c, err := o.client(cmd.Context())
+			if err != nil {
+				return err
+			}
+			err = o.resolveVeleroNamespace(cmd.Context(), c)
+			if err != nil {
+				return err
+			}
+			resticSecretName, concurrency := unsetFlags(cmd.Flags(), &o.resticSecretName, &o.concurrency)
+			err = o.applyDPADefaults(cmd.Context(), c, resticSecretName, concurrency, true)
+			if err != nil {
+				return err
+			}
+			config, err := o.restConfig()
+			if err != nil {
+				return err
+			}
+			scheme, err := o.scheme(cmd.Context(), config)
+			if err != nil {
+				return err
+			}
+			ctx := withLogger(cmd.Context(), loggerFrom(cmd.Context()).With("run", o.run))
+			results := newRunResults(nil, o.concurrency, o.schedule)
+			results.Backup = o.run
+			r := &vsrRunner{
+				client:           c,
+				config:           config,
+				scheme:           scheme,
+				veleroNamespace:  o.veleroNamespace,
+				name:             o.run,
+				resticSecretName: o.resticSecretName,
+				concurrency:      o.concurrency,
+				schedule:         o.schedule,
+				order:            o.order,
+				advanceThreshold: o.advanceThreshold,
+				mappings:         mappings,
+				results:          results,
+			}
+			err = r.restore(ctx)
+			if err != nil || !o.ready.enabled() {
+				return err
+			}
+			return waitForApps(ctx, c, results, results.Restore.Namespaces, results.Restore.StartTime, o.ready)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.run, "run", "", "name of the backup created by the run to restore")
+	flags.StringVar(&o.resticSecretName, "restic-secret", defaultResticSecretName, "name of restic secret for volsync to use, <dpa-name>-volsync-restic of the DataProtectionApplication if not set")
+	flags.IntVar(&o.concurrency, "concurrency", defaultConcurrency, "number of concurrent volumesnapshotrestores to run, maxConcurrentRestoreVolumes of the DataProtectionApplication if it is set")
+	flags.StringVar(&o.schedule, "schedule", scheduleWindow, "how volumesnapshotrestores are scheduled: window keeps concurrency running at all times, batch waits for each batch of concurrency to complete")
+	flags.Float64Var(&o.advanceThreshold, "batch-advance-threshold", 1, "with schedule batch, start the next batch once this share of the current one is done, e.g. 0.8, carrying the stragglers forward into the slots of the next batch")
+	flags.StringVar(&o.order, "order", "", "order to queue volumesnapshotbackups for volumesnapshotrestores in by the size of their PVCs: largest-first, smallest-first or random. Defaults to the order they are listed in")
+	flags.BoolVar(&o.ready.waitReady, "wait-ready", false, "once restored, wait for the PVCs of the restored namespaces to be bound and their deployments and statefulsets to be ready, timing each")
+	flags.DurationVar(&o.ready.timeout, "ready-timeout", 30*time.Minute, "how long to wait for the restored applications to be ready")
+	flags.StringVar(&o.ready.validateCommand, "validate-command", "", "shell command to run for every restored namespace once its applications are ready, with NAMESPACE and RUN set, such as a row count query; a non-zero exit fails the restore. Implies wait-ready")
+	flags.StringVar(&o.namespaceMappings, "namespace-mappings", "", "comma separated source:target pairs of namespaces to restore into other namespaces, which are created if missing, so the backed up namespaces can be left in place")
+	return cmd
+}
+
+// vsrResticSecret returns the restic secret the VSB was backed up with, which
+// holds the credentials of its repository, or resticSecretName if it names
+// none.
+func vsrResticSecret(vsb *dmv1.VolumeSnapshotBackup, resticSecretName string) corev1.LocalObjectReference {
+	if vsb.Spec.ResticSecretRef.Name != "" {
+		return vsb.Spec.ResticSecretRef
+	}
+	return corev1.LocalObjectReference{Name: resticSecretName}
+}
+
+// restoreResult holds the timings of restoring the backup of a run with
+// VolumeSnapshotRestores. The VSRs are scheduled with the same concurrency,
+// schedule and order as the VSBs were, so the two compare.
+type restoreResult struct {
+	Restore          string        `json:"restore"`
+	Concurrency      int           `json:"concurrency"`
+	Schedule         string        `json:"schedule"`
+	Order            string        `json:"order,omitempty"`
+	StartTime        time.Time     `json:"startTime"`
+	DataMoverEndTime time.Time     `json:"dataMoverEndTime"`
+	EndTime          time.Time     `json:"endTime"`
+	DataMoverTime    time.Duration `json:"dataMoverTime"`
+	TotalTime        time.Duration `json:"totalTime"`
+	// Throughput is the GiB restored per minute of data mover time.
+	Throughput float64 `json:"throughputGiBPerMinute,omitempty"`
+	Volumes    int     `json:"volumes"`
+	Failed     int     `json:"failed,omitempty"`
+	// Skipped counts the VSBs that did not complete, which have nothing
+	// to restore from.
+	Skipped int `json:"skipped,omitempty"`
+
+	// NamespaceMapping holds the namespaces restored into others and
+	// Namespaces those the VSRs were created in.
+	NamespaceMapping map[string]string `json:"namespaceMapping,omitempty"`
+	Namespaces       []string          `json:"namespaces,omitempty"`
+}
+
+func (r *restoreResult) summary() string {
+	summary := fmt.Sprintf("%d volumes (%d failed), concurrency %d (%s), data mover %v, total %v, %.2f GiB/min",
+		r.Volumes, r.Failed, r.Concurrency, r.Schedule, r.DataMoverTime.Round(time.Second), r.TotalTime.Round(time.Second), r.Throughput)
+	if r.Skipped > 0 {
+		summary += fmt.Sprintf(", %d VSBs not completed skipped", r.Skipped)
+	}
+	if len(r.NamespaceMapping) == 0 {
+		return summary
+	}
+	mappings := []string{}
+	for source, target := range r.NamespaceMapping {
+		mappings = append(mappings, source+"->"+target)
+	}
+	sort.Strings(mappings)
+	return summary + ", into " + strings.Join(mappings, ", ")
+}
+
+// restoreStarted records the start of the restore of the run.
+func (r *runResults) restoreStarted(restore string, concurrency int, schedule, order string, mappings map[string]string, namespaces []string, volumes int, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Restore = &restoreResult{Restore: restore, Concurrency: concurrency, Schedule: schedule, Order: order, NamespaceMapping: mappings, Namespaces: namespaces, Volumes: volumes, StartTime: t}
+}
+
+// vsrCreated records the VSR created for vsb, filling in what the results do
+// not know of the volume yet when the run is restored on its own.
+func (r *runResults) vsrCreated(vsb *dmv1.VolumeSnapshotBackup, vsr string, batch int, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vsb.Spec.VolumeSnapshotContent.Name)
+	if v.Namespace == "" {
+		v.Namespace = vsb.Namespace
+		v.PVC = vsb.Status.SourcePVCData.Name
+		v.VolumeSnapshotBackup = vsb.Name
+		v.RequestedBytes = parseSize(vsb.Status.SourcePVCData.Size)
+	}
+	v.VolumeSnapshotRestore = vsr
+	v.RestoreBatch = batch
+	v.VSRStartTime = t
+}
+
+// vsrSkipped records that vsb did not complete, so no VSR was created for
+// it.
+func (r *runResults) vsrSkipped(vsb *dmv1.VolumeSnapshotBackup) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vsb.Spec.VolumeSnapshotContent.Name)
+	if v.Namespace == "" {
+		v.Namespace = vsb.Namespace
+		v.PVC = vsb.Status.SourcePVCData.Name
+		v.VolumeSnapshotBackup = vsb.Name
+	}
+	v.RestoreError = fmt.Sprintf("not restored, volumesnapshotbackup %s has phase %q", vsb.Name, vsb.Status.Phase)
+	r.Restore.Skipped++
+}
+
+// vsrDone records the VSR of the VSC as done at t, failed if err is set.
+func (r *runResults) vsrDone(vscName string, t time.Time, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	if err != nil {
+		v.RestoreError = err.Error()
+		r.Restore.Failed++
+		return
+	}
+	v.VSRCompletionTime = t
+	v.VSRDuration = t.Sub(v.VSRStartTime)
+}
+
+// restoreDone records the end of the VSRs and of the Velero Restore.
+func (r *runResults) restoreDone(dataMoverEnd, end time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.Restore
+	res.DataMoverEndTime = dataMoverEnd
+	res.EndTime = end
+	res.DataMoverTime = dataMoverEnd.Sub(res.StartTime)
+	res.TotalTime = end.Sub(res.StartTime)
+	var bytes int64
+	for _, v := range r.Volumes {
+		if v.RestoreError == "" && !v.VSRCompletionTime.IsZero() {
+			bytes += v.bytes()
+		}
+	}
+	res.Throughput = gibPerMinute(bytes, res.DataMoverTime)
+}
+
+// restore drives the restore half of the data mover round trip for the
+// backup of the run. A Velero Restore is created first since the VSR
+// controller looks it up by the velero.io/restore-name label, then a
+// VolumeSnapshotRestore is created for every completed VSB, scheduled like
+// the VSBs were. Namespaces mapped to others are restored into them, with
+// the VSRs of their volumes created there, and namespaces that are gone are
+// created again first.
+func (r *vsrRunner) restore(ctx context.Context) error {
+	restoreStartTime := time.Now()
+	served, err := kindServed(r.client, vsrGroupKind)
+	if err != nil {
+		return err
+	}
+	if !served {
+		return errors.Errorf("%s is not served by the cluster, install the OADP operator with the data mover", vsrGroupKind)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r.watcher, err = newRestoreWatcher(ctx, r.config, r.scheme, r.name)
+	if err != nil {
+		return err
+	}
+
+	vsbs := r.vsbs
+	if vsbs == nil {
+		vsbList, err := listVolumeSnapshotBackups(ctx, r.client, r.name)
+		if err != nil {
+			return errors.Wrap(err, "failed to list volumesnapshotbackups")
+		}
+		vsbs = vsbList.Items
+	}
+	vsbs, skipped := splitCompletedVSBs(vsbs)
+	vsbs = orderVSBs(vsbs, r.order)
+	namespaces := []string{}
+	seen := map[string]bool{}
+	for _, vsb := range vsbs {
+		ns := mappedNamespace(r.mappings, vsb.Namespace)
+		if !seen[ns] {
+			seen[ns] = true
+			namespaces = append(namespaces, ns)
+		}
+	}
+	err = createTargetNamespaces(ctx, r.client, r.name, namespaces)
+	if err != nil {
+		return err
+	}
+
+	restoreName, err := createRestore(ctx, r.client, r.veleroNamespace, r.name, r.mappings)
+	if err != nil {
+		return err
+	}
+	r.restoreName = restoreName
+	loggerFrom(ctx).Infow("restore created, to monitor VSRs run oc get volumesnapshotrestores -A -l perf-test=<run>", "phase", phaseRestore, "restore", restoreName, "veleroNamespace", r.veleroNamespace)
+	r.results.restoreStarted(restoreName, r.concurrency, r.schedule, r.order, r.mappings, namespaces, len(vsbs), restoreStartTime)
+	for i := range skipped {
+		loggerFrom(ctx).Warnw("skipping VSB that did not complete", "phase", phaseRestore, "namespace", skipped[i].Namespace, "vsb", skipped[i].Name, "vsbPhase", skipped[i].Status.Phase)
+		r.results.vsrSkipped(&skipped[i])
+	}
+
+	err = r.run(ctx, vsbs)
+	if err != nil {
+		return err
+	}
+	volsyncTimeComplete := time.Now()
+
+	err = waitForRestoreToComplete(ctx, r.client, r.veleroNamespace, restoreName)
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			loggerFrom(ctx).Errorw("timed out waiting for restore to complete", "phase", phaseRestore)
+		}
+		return err
+	}
+
+	restoreEndTime := time.Now()
+	r.results.restoreDone(volsyncTimeComplete, restoreEndTime)
+	loggerFrom(ctx).Infow("restore done", "phase", phaseRestore, "dataMoverElapsed", volsyncTimeComplete.Sub(restoreStartTime).String(), "total", restoreEndTime.Sub(restoreStartTime).String())
+	r.results.mu.Lock()
+	all := vsrDurationStats(r.results)[0]
+	failed := r.results.Restore.Failed
+	r.results.mu.Unlock()
+	if all.Count > 0 {
+		loggerFrom(ctx).Infow("VSR durations", "phase", phaseRestore, "count", all.Count, "min", all.Min.String(), "mean", all.Mean.String(), "p50", all.P50.String(), "p90", all.P90.String(), "p95", all.P95.String(), "p99", all.P99.String(), "max", all.Max.String())
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d volumesnapshotrestores failed", failed, len(vsbs))
+	}
+	return nil
+}
+
+// splitCompletedVSBs splits vsbs into those that completed, which have a
+// restic repository to restore from, and the rest.
+func splitCompletedVSBs(vsbs []dmv1.VolumeSnapshotBackup) (completed, rest []dmv1.VolumeSnapshotBackup) {
+	for i := range vsbs {
+		if isVSBCompleted(&vsbs[i]) {
+			completed = append(completed, vsbs[i])
+		} else {
+			rest = append(rest, vsbs[i])
+		}
+	}
+	return completed, rest
+}
+
+func waitForRestoreToComplete(ctx context.Context, c client.Client, namespace, name string) error {
+	timeout := 120 * time.Minute
+	interval := 5 * time.Second
+	err := wait.PollImmediate(interval, timeout, func() (bool, error) {
+		restore := velerov1.Restore{}
+		err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &restore)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to get restore")
+		}
+		switch restore.Status.Phase {
+		case velerov1.RestorePhaseCompleted:
+			return true, nil
+		case velerov1.RestorePhaseFailed, velerov1.RestorePhasePartiallyFailed, velerov1.RestorePhaseFailedValidation:
+			return false, errors.Errorf("restore %s finished with phase %s", name, restore.Status.Phase)
+		}
+		loggerFrom(ctx).Infow("waiting for restore", "phase", phaseRestore, "restorePhase", restore.Status.Phase)
+
+		return false, nil
+	})
+	return err
+}
+
+// listVolumeSnapshotRestores lists the VSRs of the run called name, none when
+// the cluster does not serve them.
+func listVolumeSnapshotRestores(ctx context.Context, c client.Client, name string) (*dmv1.VolumeSnapshotRestoreList, error) {
+	vsr := dmv1.VolumeSnapshotRestoreList{}
+	labels := map[string]string{
+		"perf-test": name,
+	}
+	listOptions := client.MatchingLabels(labels)
+	err := c.List(ctx, &vsr, listOptions)
+	if meta.IsNoMatchError(err) {
+		return &vsr, nil
+	}
+	return &vsr, err
+}
+
+// createRestore creates a Velero Restore of the backup called backupName,
+// restoring the namespaces mappings names into those it maps them to, and
+// returns its name. The name is generated from backupName so the same run
+// can be restored again.
+func createRestore(ctx context.Context, c client.Client, veleroNamespace, backupName string, mappings map[string]string) (string, error) {
+	r := velerov1.Restore{}
+	r.Spec.BackupName = backupName
+	r.Spec.NamespaceMapping = mappings
+	r.Namespace = veleroNamespace
+	r.GenerateName = backupName + "-"
+	r.Labels = map[string]string{
+		"perf-test": backupName,
+	}
+	err := c.Create(ctx, &r)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create restore")
+	}
+	return r.Name, nil
+}
+
+// parseNamespaceMappings parses comma separated source:target pairs of
+// namespaces, as velero restore create --namespace-mappings takes them.
+func parseNamespaceMappings(value string) (map[string]string, error) {
+	mappings := map[string]string{}
+	if value == "" {
+		return mappings, nil
+	}
+	sources := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		source, target, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || source == "" || target == "" {
+			return nil, errors.Errorf("invalid namespace-mappings entry %q, must be source:target", pair)
+		}
+		if errs := validation.IsDNS1123Label(target); len(errs) > 0 {
+			return nil, errors.Errorf("invalid target namespace %q: %s", target, strings.Join(errs, ", "))
+		}
+		if other, ok := sources[target]; ok {
+			return nil, errors.Errorf("namespaces %s and %s are both mapped to %s", other, source, target)
+		}
+		sources[target] = source
+		mappings[source] = target
+	}
+	return mappings, nil
+}
+
+// mappedNamespace returns the namespace mappings restores namespace into.
+func mappedNamespace(mappings map[string]string, namespace string) string {
+	if target, ok := mappings[namespace]; ok {
+		return target
+	}
+	return namespace
+}
+
+// createTargetNamespaces creates those of namespaces that are missing,
+// labelled with the run, so the VSRs can be created in them before Velero
+// restores the namespaces themselves.
+func createTargetNamespaces(ctx context.Context, c client.Client, name string, namespaces []string) error {
+	for _, target := range namespaces {
+		err := createIfMissing(ctx, c, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: target, Labels: map[string]string{"perf-test": name}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package perf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestVSB(name string, phase dmv1.VolumeSnapshotBackupPhase) dmv1.VolumeSnapshotBackup {
+	return dmv1.VolumeSnapshotBackup{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "perf-target"},
+		Spec: dmv1.VolumeSnapshotBackupSpec{
+			VolumeSnapshotContent: corev1.ObjectReference{Name: "vsc-" + name},
+		},
+		Status: dmv1.VolumeSnapshotBackupStatus{Phase: phase},
+	}
+}
+
+func TestSplitCompletedVSBs(t *testing.T) {
+	vsbs := []dmv1.VolumeSnapshotBackup{
+		newTestVSB("vsb-1", dmv1.SnapMoverBackupPhaseCompleted),
+		newTestVSB("vsb-2", dmv1.SnapMoverBackupPhaseFailed),
+		newTestVSB("vsb-3", dmv1.SnapMoverVolSyncPhaseCompleted),
+		newTestVSB("vsb-4", dmv1.SnapMoverBackupPhaseInProgress),
+	}
+	completed, rest := splitCompletedVSBs(vsbs)
+	if len(completed) != 2 || completed[0].Name != "vsb-1" || completed[1].Name != "vsb-3" {
+		t.Errorf("got completed %v, want vsb-1 and vsb-3", vsbNames(completed))
+	}
+	if len(rest) != 2 || rest[0].Name != "vsb-2" || rest[1].Name != "vsb-4" {
+		t.Errorf("got rest %v, want vsb-2 and vsb-4", vsbNames(rest))
+	}
+
+	results := newRunResults(nil, 1, scheduleWindow)
+	results.restoreStarted("perf-1-abcde", 1, scheduleWindow, "", nil, []string{"perf-target"}, len(completed), time.Now())
+	for i := range rest {
+		results.vsrSkipped(&rest[i])
+	}
+	if results.Restore.Skipped != 2 || results.Restore.Failed != 0 {
+		t.Errorf("got %d skipped and %d failed, want 2 skipped and none failed", results.Restore.Skipped, results.Restore.Failed)
+	}
+	for _, v := range results.Volumes {
+		if v.RestoreError == "" {
+			t.Errorf("skipped volume %s has no restore error", v.VolumeSnapshotContent)
+		}
+	}
+}
+
+func TestParseNamespaceMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: map[string]string{}},
+		{name: "one", value: "perf-1:perf-1-restored", want: map[string]string{"perf-1": "perf-1-restored"}},
+		{
+			name:  "several with spaces",
+			value: "perf-1:restored-1, perf-2:restored-2",
+			want:  map[string]string{"perf-1": "restored-1", "perf-2": "restored-2"},
+		},
+		{name: "no separator", value: "perf-1", wantErr: true},
+		{name: "missing source", value: ":restored", wantErr: true},
+		{name: "missing target", value: "perf-1:", wantErr: true},
+		{name: "invalid target", value: "perf-1:Restored_1", wantErr: true},
+		{name: "same target", value: "perf-1:restored,perf-2:restored", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNamespaceMappings(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNamespaceMappings(%q) = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func vsbNames(vsbs []dmv1.VolumeSnapshotBackup) []string {
+	names := []string{}
+	for _, vsb := range vsbs {
+		names = append(names, vsb.Name)
+	}
+	return names
+}
@@ -0,0 +1,166 @@
+package perf
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// vsrRunner creates a VolumeSnapshotRestore for every VSB of a run, keeping at
+// most concurrency of them running according to schedule as vsbRunner does
+// for the VSBs, so the restore of a run is timed the same way as its backup.
+type vsrRunner struct {
+	client client.Client
+	// config and scheme are those of client, for the watch the VSRs are
+	// waited on through.
+	config           *rest.Config
+	scheme           *runtime.Scheme
+	watcher          *runWatcher
+	veleroNamespace  string
+	name             string
+	restoreName      string
+	resticSecretName string
+	concurrency      int
+	schedule         string
+	order            string
+	// advanceThreshold is the share of a batch that must be done before
+	// the next one starts, as with the VSBs.
+	advanceThreshold float64
+	// mappings restores the namespaces it holds into the namespaces it
+	// maps them to.
+	mappings map[string]string
+	// vsbs are the VSBs to restore, listed from the run if nil. They are
+	// listed up front when their namespaces are deleted before the
+	// restore, taking the VSBs with them.
+	vsbs    []dmv1.VolumeSnapshotBackup
+	results *runResults
+}
+
+// vsrJob is a VSB queued for a VolumeSnapshotRestore along with the batch it
+// was scheduled in.
+type vsrJob struct {
+	vsb   dmv1.VolumeSnapshotBackup
+	batch int
+}
+
+func (r *vsrRunner) run(ctx context.Context, vsbs []dmv1.VolumeSnapshotBackup) error {
+	s := &scheduler{
+		queue:            vsrQueue{runner: r, vsbs: vsbs},
+		concurrency:      r.concurrency,
+		schedule:         r.schedule,
+		advanceThreshold: r.advanceThreshold,
+		phase:            phaseRestore,
+		objects:          "VSRs",
+		queued:           "vsbs",
+	}
+	return s.run(ctx)
+}
+
+// vsrQueue queues the VSBs of a vsrRunner for its scheduler. Restores do not
+// pause between batches.
+type vsrQueue struct {
+	runner *vsrRunner
+	vsbs   []dmv1.VolumeSnapshotBackup
+}
+
+func (q vsrQueue) len() int { return len(q.vsbs) }
+
+func (q vsrQueue) runJob(ctx context.Context, index, batch int, completed *int32) error {
+	return q.runner.runJob(ctx, vsrJob{vsb: q.vsbs[index], batch: batch}, completed, len(q.vsbs))
+}
+
+func (q vsrQueue) pauseBefore(ctx context.Context, batch int) bool { return true }
+
+func (q vsrQueue) batchDone(batch, volumes int, elapsed time.Duration) {}
+
+// runJob creates the VSR of a VSB and waits for it to complete. A VSR that
+// cannot be created or fails is recorded and the restore carries on with the
+// rest; only timing out waiting on one stops it.
+func (r *vsrRunner) runJob(ctx context.Context, job vsrJob, completed *int32, total int) error {
+	vsb := &job.vsb
+	vscName := vsb.Spec.VolumeSnapshotContent.Name
+	vsr := r.newVolumeSnapshotRestore(vsb)
+	err := r.client.Create(ctx, vsr)
+	if err != nil {
+		loggerFrom(ctx).Errorw("failed to create VSR", "phase", phaseRestore, "namespace", vsb.Namespace, "vsb", vsb.Name, "batch", job.batch, "error", err)
+		r.results.vsrDone(vscName, time.Now(), errors.Wrap(err, "failed to create volumesnapshotrestore"))
+		return nil
+	}
+	r.results.vsrCreated(vsb, vsr.Name, job.batch, time.Now())
+
+	err = waitForVSRToComplete(ctx, r.watcher, types.NamespacedName{Namespace: vsr.Namespace, Name: vsr.Name})
+	if err == wait.ErrWaitTimeout {
+		loggerFrom(ctx).Errorw("timed out waiting for VSR to complete", "phase", phaseRestore, "namespace", vsr.Namespace, "vsr", vsr.Name, "batch", job.batch)
+		return err
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	r.results.vsrDone(vscName, time.Now(), err)
+	if err != nil {
+		loggerFrom(ctx).Errorw("VSR failed", "phase", phaseRestore, "namespace", vsr.Namespace, "vsr", vsr.Name, "batch", job.batch, "error", err)
+		return nil
+	}
+	done := atomic.AddInt32(completed, 1)
+	loggerFrom(ctx).Infow("VSR completed", "phase", phaseRestore, "namespace", vsr.Namespace, "vsr", vsr.Name, "batch", job.batch, "completed", done, "total", total)
+	return nil
+}
+
+// newVolumeSnapshotRestore returns the VSR restoring the volume vsb backed up,
+// in the namespace the namespace of vsb is restored into.
+func (r *vsrRunner) newVolumeSnapshotRestore(vsb *dmv1.VolumeSnapshotBackup) *dmv1.VolumeSnapshotRestore {
+	return &dmv1.VolumeSnapshotRestore{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "vsr-",
+			Namespace:    mappedNamespace(r.mappings, vsb.Namespace),
+			Labels: map[string]string{
+				"perf-test":              r.name,
+				"velero.io/restore-name": r.restoreName,
+			},
+		},
+		Spec: dmv1.VolumeSnapshotRestoreSpec{
+			ResticSecretRef: vsrResticSecret(vsb, r.resticSecretName),
+			VolumeSnapshotMoverBackupref: dmv1.VSBRef{
+				BackedUpPVCData:         vsb.Status.SourcePVCData,
+				ResticRepository:        vsb.Status.ResticRepository,
+				VolumeSnapshotClassName: vsb.Status.VolumeSnapshotClassName,
+			},
+			ProtectedNamespace: r.veleroNamespace,
+		},
+	}
+}
+
+// waitForVSRToComplete follows the VSR called key through the watch of w
+// until the data mover reports it completed or failed. It returns the error
+// of ctx once it is done.
+func waitForVSRToComplete(ctx context.Context, w *runWatcher, key types.NamespacedName) error {
+	timeout := 120 * time.Minute
+	return w.waitFor(ctx, timeout, func() (bool, error) {
+		vsr := dmv1.VolumeSnapshotRestore{}
+		err := w.cache.Get(ctx, key, &vsr)
+		if apierrors.IsNotFound(err) {
+			// the cache has not seen the VSR we just created yet
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get volumesnapshotrestore %s", key)
+		}
+		switch vsr.Status.Phase {
+		case dmv1.SnapMoverRestoreVolSyncPhaseCompleted, dmv1.SnapMoverRestorePhaseCompleted:
+			return true, nil
+		case dmv1.SnapMoverRestorePhaseFailed, dmv1.SnapMoverRestorePhasePartiallyFailed:
+			return false, errors.Errorf("volumesnapshotrestore %s finished with phase %s", key, vsr.Status.Phase)
+		}
+		return false, nil
+	})
+}
@@ -0,0 +1,931 @@
+package perf
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	volsyncv1alpha1 "github.com/backube/volsync/api/v1alpha1"
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	outputJSON  = "json"
+	outputCSV   = "csv"
+	outputJUnit = "junit"
+)
+
+// resultsExtension returns the file extension of results written in format.
+func resultsExtension(format string) string {
+	if format == outputJUnit {
+		return "xml"
+	}
+	return format
+}
+
+// runResults collects the timings of a single run so they can be written out
+// in a machine readable format once it finishes. It is safe for concurrent
+// use by the VSB workers.
+//
+// While the run goes, the workers and the run watcher, which keeps recording
+// the phases VSBs go through until the run returns, write its fields under
+// mu. Anything else reading them, such as the stats helpers, must hold mu,
+// go through the methods that take it, or read a snapshot. Results loaded
+// from a file can be read freely.
+type runResults struct {
+	mu sync.Mutex
+
+	// SchemaVersion is the ResultsSchemaVersion the results were written
+	// with and ToolVersion the version of oadp-perf that wrote them.
+	SchemaVersion int    `json:"schemaVersion"`
+	ToolVersion   string `json:"toolVersion,omitempty"`
+	// ClusterInfo describes the cluster of the run and Config holds the
+	// flags it was run with, those that may carry credentials redacted.
+	ClusterInfo *clusterInfo      `json:"clusterInfo,omitempty"`
+	Config      map[string]string `json:"config,omitempty"`
+	// Cluster names the cluster of runs against several clusters at once.
+	Cluster     string   `json:"cluster,omitempty"`
+	Backup      string   `json:"backup"`
+	Namespaces  []string `json:"namespaces"`
+	Concurrency int      `json:"concurrency"`
+	Schedule    string   `json:"schedule"`
+	Mover       string   `json:"mover,omitempty"`
+	Order       string   `json:"order,omitempty"`
+	// VSBCreateRate is the limit on VSB creates per second, if any.
+	VSBCreateRate float64 `json:"vsbCreateRate,omitempty"`
+	// BatchAdvanceThreshold is the share of a batch that was done before
+	// the next one started, when it was less than all of it.
+	BatchAdvanceThreshold float64 `json:"batchAdvanceThreshold,omitempty"`
+	// BatchDelay is the pause between batches and CreateJitter the most
+	// each VSB create was delayed by, if the run was paced.
+	BatchDelay   time.Duration `json:"batchDelay,omitempty"`
+	CreateJitter time.Duration `json:"createJitter,omitempty"`
+	// DPAConcurrencyLimit is the maxConcurrentBackupVolumes of the
+	// DataProtectionApplication, if it sets one.
+	DPAConcurrencyLimit int `json:"dpaConcurrencyLimit,omitempty"`
+	// VeleroSchedule is the Velero Schedule that fired the backup, if the
+	// run did not create it.
+	VeleroSchedule string `json:"veleroSchedule,omitempty"`
+	// ResticSecrets is the restic secret the VSBs of each namespace used,
+	// when they did not all use the same one.
+	ResticSecrets map[string]string `json:"resticSecrets,omitempty"`
+	// Reused is set when the run moved the data of an existing backup
+	// rather than creating one.
+	Reused           bool          `json:"reused,omitempty"`
+	StartTime        time.Time     `json:"startTime"`
+	SnapshotEndTime  time.Time     `json:"snapshotEndTime"`
+	DataMoverEndTime time.Time     `json:"dataMoverEndTime"`
+	SnapshotTime     time.Duration `json:"snapshotTime"`
+	DataMoverTime    time.Duration `json:"dataMoverTime"`
+	TotalTime        time.Duration `json:"totalTime"`
+	// Throughput is the GiB moved per minute of data mover time.
+	Throughput float64         `json:"throughputGiBPerMinute,omitempty"`
+	Volumes    []*volumeResult `json:"volumes"`
+	// ByNamespace aggregates the volumes per namespace once the data
+	// mover is done.
+	ByNamespace []namespaceSummary `json:"byNamespace,omitempty"`
+	// Error is why the run did not finish, when it failed.
+	Error string `json:"error,omitempty"`
+	// VeleroBackup holds what Velero reported about the Backup itself.
+	VeleroBackup *veleroBackupResult `json:"veleroBackup,omitempty"`
+	// Restore times the VolumeSnapshotRestores of the run, when it was
+	// restored.
+	Restore *restoreResult `json:"restore,omitempty"`
+	// Allocation compares the PVCs expected to be snapshotted with the
+	// VSCs the backup created.
+	Allocation *allocationResult `json:"allocation,omitempty"`
+	// Readiness times the applications of the restored namespaces
+	// becoming ready, when they were waited for.
+	Readiness *readinessResult `json:"readiness,omitempty"`
+	// DR times deleting the namespaces of the run, restoring them and
+	// waiting for their workloads, for dr-test.
+	DR *drResult `json:"dr,omitempty"`
+	// Deletion times the deletion of the backup after the run, when it
+	// was asked for.
+	Deletion *deletionResult `json:"deletion,omitempty"`
+	// RepoStats holds the statistics of the restic repositories the run
+	// backed up to, when they were asked for.
+	RepoStats *repoStatsResult `json:"repoStats,omitempty"`
+	// Storage measures what the data mover uploaded to object storage,
+	// when it was asked for.
+	Storage *storageResult `json:"storage,omitempty"`
+	// Chaos holds the chaos actions taken during the run.
+	Chaos []chaosEvent `json:"chaos,omitempty"`
+	// ResourceUsage is the CPU and memory the Velero pods and the nodes
+	// used during the run, when they were sampled.
+	ResourceUsage []resourceUsage `json:"resourceUsage,omitempty"`
+
+	// Integrity holds the data verification of generated PVCs, when the
+	// run was asked to verify its restore.
+	Integrity []*integrityResult `json:"integrity,omitempty"`
+
+	volumes map[string]*volumeResult
+	// events receives the progress of the run, when --events is set.
+	events *eventStream
+	// sampler samples the resource usage of the run until it finishes.
+	sampler *resourceSampler
+	// metrics are the Prometheus metrics the run records its progress in.
+	metrics *runMetrics
+}
+
+// volumeResult holds the timings for a single volume, keyed by the name of
+// its VolumeSnapshotContent.
+type volumeResult struct {
+	VolumeSnapshotContent string `json:"volumeSnapshotContent"`
+	Namespace             string `json:"namespace"`
+	PVC                   string `json:"pvc,omitempty"`
+	SizeBytes             int64  `json:"sizeBytes,omitempty"`
+	// RequestedBytes is the storage requested by the source PVC.
+	RequestedBytes int64 `json:"requestedBytes,omitempty"`
+	// TransferredBytes is the amount of data the mover reported moving,
+	// when it reports it at all.
+	TransferredBytes int64 `json:"transferredBytes,omitempty"`
+	// Throughput is the GiB moved per minute of VSB duration.
+	Throughput   float64   `json:"throughputGiBPerMinute,omitempty"`
+	Batch        int       `json:"batch,omitempty"`
+	VSCReadyTime time.Time `json:"vscReadyTime"`
+	// VolumeSnapshot is the VolumeSnapshot Velero's CSI plugin created for
+	// the PVC. SnapshotRequestTime is when it was created,
+	// SnapshotCreationTime when the storage cut the snapshot and
+	// SnapshotReadyTime when the snapshot controller reported it ready.
+	VolumeSnapshot       string    `json:"volumeSnapshot,omitempty"`
+	SnapshotRequestTime  time.Time `json:"snapshotRequestTime"`
+	SnapshotCreationTime time.Time `json:"snapshotCreationTime"`
+	SnapshotReadyTime    time.Time `json:"snapshotReadyTime"`
+	// SnapshotLatency is the time from SnapshotRequestTime until
+	// SnapshotReadyTime.
+	SnapshotLatency time.Duration `json:"snapshotLatency,omitempty"`
+	// CloudSnapshotID is the snapshotHandle of the VSC and the rest what the
+	// cloud last reported about it, when the run was asked to verify its
+	// snapshots with the cloud.
+	CloudSnapshotID        string        `json:"cloudSnapshotID,omitempty"`
+	CloudSnapshotState     string        `json:"cloudSnapshotState,omitempty"`
+	CloudSnapshotProgress  string        `json:"cloudSnapshotProgress,omitempty"`
+	CloudSnapshotMessage   string        `json:"cloudSnapshotMessage,omitempty"`
+	CloudSnapshotCompleted bool          `json:"cloudSnapshotCompleted,omitempty"`
+	VolumeSnapshotBackup   string        `json:"volumeSnapshotBackup,omitempty"`
+	VSBStartTime           time.Time     `json:"vsbStartTime"`
+	VSBCompletionTime      time.Time     `json:"vsbCompletionTime"`
+	VSBDuration            time.Duration `json:"vsbDuration,omitempty"`
+	// PhaseTimes holds the first time the VSB was seen in each phase.
+	PhaseTimes map[dmv1.VolumeSnapshotBackupPhase]time.Time `json:"phaseTimes,omitempty"`
+	// MoverStartTime is when the ReplicationSource of the VSB started
+	// syncing.
+	MoverStartTime time.Time `json:"moverStartTime"`
+	// QueueDuration is the time from creating the VSB until the data mover
+	// took it in progress, spent waiting behind the other VSBs the
+	// controller was running.
+	QueueDuration time.Duration `json:"queueDuration,omitempty"`
+	// SetupDuration is the time from the VSB being taken in progress until
+	// volsync started syncing, spent cloning the snapshot and creating the
+	// ReplicationSource.
+	SetupDuration time.Duration `json:"setupDuration,omitempty"`
+	// TransferDuration is the time volsync spent copying the data, from
+	// MoverStartTime or, if the sync was not seen starting, from the VSB
+	// being taken in progress.
+	TransferDuration time.Duration `json:"transferDuration,omitempty"`
+	// CleanupDuration is the time from volsync finishing until the data
+	// mover removed its resources.
+	CleanupDuration time.Duration `json:"cleanupDuration,omitempty"`
+	// ReplicationSource is the volsync ReplicationSource the data mover
+	// created for the VSB.
+	ReplicationSource string `json:"replicationSource,omitempty"`
+	// SyncStatus is the reason of the Synchronizing condition of the
+	// ReplicationSource when it was last seen, such as SyncInProgress.
+	SyncStatus string `json:"syncStatus,omitempty"`
+	// LastSyncTime and LastSyncDuration are when volsync finished syncing
+	// the volume and how long it reported the sync took.
+	LastSyncTime     time.Time     `json:"lastSyncTime"`
+	LastSyncDuration time.Duration `json:"lastSyncDuration,omitempty"`
+	Stalled          bool          `json:"stalled,omitempty"`
+	// CreateFailed is set when no VSB could be created for the VSC, after
+	// CreateAttempts tries.
+	CreateFailed   bool   `json:"createFailed,omitempty"`
+	CreateAttempts int    `json:"createAttempts,omitempty"`
+	Error          string `json:"error,omitempty"`
+
+	// VolumeSnapshotRestore is the VSR that restored the volume, created
+	// in RestoreBatch as the VSB was in Batch, when the run was restored.
+	VolumeSnapshotRestore string        `json:"volumeSnapshotRestore,omitempty"`
+	RestoreBatch          int           `json:"restoreBatch,omitempty"`
+	VSRStartTime          time.Time     `json:"vsrStartTime"`
+	VSRCompletionTime     time.Time     `json:"vsrCompletionTime"`
+	VSRDuration           time.Duration `json:"vsrDuration,omitempty"`
+	RestoreError          string        `json:"restoreError,omitempty"`
+}
+
+// veleroBackupResult holds the phases the Velero Backup of a run went through
+// and the counts Velero reported in its status.
+type veleroBackupResult struct {
+	// Phases holds the phases the Backup was seen in, in order, with the
+	// time each was first seen.
+	Phases                      []backupPhaseTransition `json:"phases,omitempty"`
+	StartTimestamp              time.Time               `json:"startTimestamp"`
+	CompletionTimestamp         time.Time               `json:"completionTimestamp"`
+	TotalItems                  int                     `json:"totalItems,omitempty"`
+	ItemsBackedUp               int                     `json:"itemsBackedUp,omitempty"`
+	Warnings                    int                     `json:"warnings,omitempty"`
+	Errors                      int                     `json:"errors,omitempty"`
+	CSIVolumeSnapshotsAttempted int                     `json:"csiVolumeSnapshotsAttempted,omitempty"`
+	CSIVolumeSnapshotsCompleted int                     `json:"csiVolumeSnapshotsCompleted,omitempty"`
+	FailureReason               string                  `json:"failureReason,omitempty"`
+
+	// ListedItems, Resources, LogErrors and LogWarnings come from the
+	// resource list and the log of the Backup, when they were collected
+	// into the artifacts directory.
+	ListedItems int              `json:"listedItems,omitempty"`
+	Resources   []backupResource `json:"resources,omitempty"`
+	LogErrors   int              `json:"logErrors,omitempty"`
+	LogWarnings int              `json:"logWarnings,omitempty"`
+}
+
+type backupPhaseTransition struct {
+	Phase velerov1.BackupPhase `json:"phase"`
+	Time  time.Time            `json:"time"`
+}
+
+// integrityResult compares the digest of a generated PVC's data before the
+// backup with the digest after it was restored.
+type integrityResult struct {
+	Namespace      string `json:"namespace"`
+	PVC            string `json:"pvc"`
+	SourceSHA256   string `json:"sourceSHA256,omitempty"`
+	RestoredSHA256 string `json:"restoredSHA256,omitempty"`
+	Corrupted      bool   `json:"corrupted,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+func newRunResults(namespaces []string, concurrency int, schedule string) *runResults {
+	return &runResults{
+		SchemaVersion: ResultsSchemaVersion,
+		ToolVersion:   toolVersion(),
+		Namespaces:    namespaces,
+		Concurrency:   concurrency,
+		Schedule:      schedule,
+		StartTime:     time.Now(),
+		volumes:       map[string]*volumeResult{},
+		metrics:       newRunMetrics("", ""),
+	}
+}
+
+// volume returns the result for the named VSC, creating it if needed. The
+// caller must hold r.mu.
+func (r *runResults) volume(vscName string) *volumeResult {
+	v, ok := r.volumes[vscName]
+	if !ok {
+		v = &volumeResult{VolumeSnapshotContent: vscName}
+		r.volumes[vscName] = v
+		r.Volumes = append(r.Volumes, v)
+	}
+	return v
+}
+
+// vscReady records the first time the VSC was seen ready to use.
+func (r *runResults) vscReady(vscName, namespace string, sizeBytes int64, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	if !v.VSCReadyTime.IsZero() {
+		return
+	}
+	v.Namespace = namespace
+	v.SizeBytes = sizeBytes
+	v.VSCReadyTime = t
+	r.metrics.vscsReady.Inc()
+	r.emitLocked(event{Time: t, Type: eventVSCReady, Namespace: namespace, VSC: vscName, SizeBytes: sizeBytes})
+}
+
+// vscSource records the source PVC of the VSC and the storage it requests.
+func (r *runResults) vscSource(vscName, namespace, pvc string, requestedBytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	v.Namespace = namespace
+	v.PVC = pvc
+	v.RequestedBytes = requestedBytes
+}
+
+// excludeVolumes drops the VSCs called names from the results, for volumes
+// the run does not move the data of.
+func (r *runResults) excludeVolumes(names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	excluded := map[string]bool{}
+	for _, name := range names {
+		excluded[name] = true
+		delete(r.volumes, name)
+	}
+	volumes := []*volumeResult{}
+	for _, v := range r.Volumes {
+		if !excluded[v.VolumeSnapshotContent] {
+			volumes = append(volumes, v)
+		}
+	}
+	r.Volumes = volumes
+}
+
+// resticSecretsUsed records the restic secret of each namespace, keyed by
+// namespace, if the namespaces did not all use the same one.
+func (r *runResults) resticSecretsUsed(secrets map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	distinct := map[string]bool{}
+	for _, secret := range secrets {
+		distinct[secret] = true
+	}
+	if len(distinct) > 1 {
+		r.ResticSecrets = secrets
+	}
+}
+
+func (r *runResults) vsbStarted(vscName, vsbName string, batch int, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	v.VolumeSnapshotBackup = vsbName
+	v.Batch = batch
+	v.VSBStartTime = t
+	r.metrics.vsbsPending.Dec()
+	r.metrics.vsbsRunning.Inc()
+	r.emitLocked(event{Time: t, Type: eventVSBCreated, Namespace: v.Namespace, VSC: vscName, VSB: vsbName, Batch: batch})
+}
+
+// vsbCreateFailed records that no VSB could be created for the VSC after
+// attempts tries.
+func (r *runResults) vsbCreateFailed(vscName string, batch, attempts int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	v.Batch = batch
+	v.CreateFailed = true
+	v.CreateAttempts = attempts
+	v.Error = err.Error()
+	r.metrics.vsbsPending.Dec()
+	r.metrics.vsbsFailed.Inc()
+	r.emitLocked(event{Type: eventVSBFailed, Namespace: v.Namespace, VSC: vscName, Batch: batch, Error: v.Error})
+}
+
+// vsbPhaseSeen records the first time the VSB of the VSC was seen in phase and
+// works out how long it spent in the phases before it.
+func (r *runResults) vsbPhaseSeen(vscName string, phase dmv1.VolumeSnapshotBackupPhase, t time.Time) {
+	if phase == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	if _, ok := v.PhaseTimes[phase]; ok {
+		return
+	}
+	if v.PhaseTimes == nil {
+		v.PhaseTimes = map[dmv1.VolumeSnapshotBackupPhase]time.Time{}
+	}
+	v.PhaseTimes[phase] = t
+	v.phaseDurations()
+}
+
+// phaseDurations works out how long the VSB of v spent queued, setting up,
+// transferring and cleaning up from the times it was seen in each phase and
+// the time its ReplicationSource started syncing.
+func (v *volumeResult) phaseDurations() {
+	between := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return 0
+		}
+		return to.Sub(from)
+	}
+	inProgress := v.PhaseTimes[dmv1.SnapMoverBackupPhaseInProgress]
+	synced := v.PhaseTimes[dmv1.SnapMoverVolSyncPhaseCompleted]
+	transferStart := inProgress
+	if !v.MoverStartTime.IsZero() {
+		transferStart = v.MoverStartTime
+	}
+	v.QueueDuration = between(v.VSBStartTime, inProgress)
+	v.SetupDuration = between(inProgress, v.MoverStartTime)
+	v.TransferDuration = between(transferStart, synced)
+	v.CleanupDuration = between(synced, v.PhaseTimes[dmv1.SnapMoverBackupPhaseCompleted])
+}
+
+// replicationSourceSeen records the sync status and last sync duration of
+// rs, the ReplicationSource of the VSB called vsbName, logging them when they
+// change.
+func (r *runResults) replicationSourceSeen(log *zap.SugaredLogger, vsbName string, rs *volsyncv1alpha1.ReplicationSource) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var v *volumeResult
+	for _, candidate := range r.Volumes {
+		if candidate.VolumeSnapshotBackup == vsbName {
+			v = candidate
+			break
+		}
+	}
+	if v == nil {
+		return
+	}
+	v.ReplicationSource = rs.Name
+	c := meta.FindStatusCondition(rs.Status.Conditions, volsyncv1alpha1.ConditionSynchronizing)
+	if v.MoverStartTime.IsZero() {
+		// A sync that finished before the ReplicationSource was seen
+		// syncing started about when it was created.
+		switch {
+		case c != nil && c.Reason == volsyncv1alpha1.SynchronizingReasonSync:
+			v.MoverStartTime = c.LastTransitionTime.Time
+		case rs.Status.LastSyncTime != nil:
+			v.MoverStartTime = rs.CreationTimestamp.Time
+		}
+		v.phaseDurations()
+	}
+	if c != nil && c.Reason != v.SyncStatus {
+		v.SyncStatus = c.Reason
+		log.Infow("replicationsource sync status changed", "phase", phaseDataMover, "namespace", v.Namespace, "vsb", vsbName, "replicationsource", rs.Name, "syncStatus", c.Reason, "message", c.Message)
+	}
+	if d := rs.Status.LastSyncDuration; d != nil && rs.Status.LastSyncTime != nil && !rs.Status.LastSyncTime.Time.Equal(v.LastSyncTime) {
+		v.LastSyncTime = rs.Status.LastSyncTime.Time
+		v.LastSyncDuration = d.Duration
+		log.Infow("replicationsource synced", "phase", phaseDataMover, "namespace", v.Namespace, "vsb", vsbName, "replicationsource", rs.Name, "lastSyncDuration", d.Duration.String())
+	}
+}
+
+// backupSeen records the phase of the Velero Backup of the run when it
+// changes, along with the latest counts from its status.
+func (r *runResults) backupSeen(log *zap.SugaredLogger, status *velerov1.BackupStatus, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.VeleroBackup
+	if b == nil {
+		b = &veleroBackupResult{}
+		r.VeleroBackup = b
+	}
+	phase := status.Phase
+	if phase == "" {
+		phase = velerov1.BackupPhaseNew
+	}
+	if n := len(b.Phases); n == 0 || b.Phases[n-1].Phase != phase {
+		b.Phases = append(b.Phases, backupPhaseTransition{Phase: phase, Time: t})
+		log.Infow("backup phase changed", "phase", phaseBackup, "backupPhase", phase)
+	}
+	if status.StartTimestamp != nil {
+		b.StartTimestamp = status.StartTimestamp.Time
+	}
+	if status.CompletionTimestamp != nil {
+		b.CompletionTimestamp = status.CompletionTimestamp.Time
+	}
+	if status.Progress != nil {
+		b.TotalItems = status.Progress.TotalItems
+		b.ItemsBackedUp = status.Progress.ItemsBackedUp
+	}
+	b.Warnings = status.Warnings
+	b.Errors = status.Errors
+	b.CSIVolumeSnapshotsAttempted = status.CSIVolumeSnapshotsAttempted
+	b.CSIVolumeSnapshotsCompleted = status.CSIVolumeSnapshotsCompleted
+	b.FailureReason = status.FailureReason
+}
+
+// summary describes the final phase of the Backup and what Velero backed up.
+func (b *veleroBackupResult) summary() string {
+	phase := velerov1.BackupPhaseNew
+	if n := len(b.Phases); n > 0 {
+		phase = b.Phases[n-1].Phase
+	}
+	return fmt.Sprintf("%s, %d/%d items, %d warnings, %d errors", phase, b.ItemsBackedUp, b.TotalItems, b.Warnings, b.Errors)
+}
+
+// transitions describes the phases the Backup went through with how long
+// after the first one each was seen.
+func (b *veleroBackupResult) transitions() string {
+	parts := []string{}
+	for _, p := range b.Phases {
+		parts = append(parts, fmt.Sprintf("%s +%v", p.Phase, p.Time.Sub(b.Phases[0].Time).Round(time.Second)))
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// meanVSBPhases returns the mean time VSBs spent queued, setting up,
+// transferring and cleaning up, counting only the VSBs each phase was seen to
+// finish for.
+func (r *runResults) meanVSBPhases() (time.Duration, time.Duration, time.Duration, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mean := func(duration func(*volumeResult) time.Duration) time.Duration {
+		var total time.Duration
+		n := 0
+		for _, v := range r.Volumes {
+			if d := duration(v); d > 0 {
+				total += d
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return total / time.Duration(n)
+	}
+	return mean(func(v *volumeResult) time.Duration { return v.QueueDuration }),
+		mean(func(v *volumeResult) time.Duration { return v.SetupDuration }),
+		mean(func(v *volumeResult) time.Duration { return v.TransferDuration }),
+		mean(func(v *volumeResult) time.Duration { return v.CleanupDuration })
+}
+
+// vsbFailed records the failure of the VSB, returning false if it was
+// already recorded.
+func (r *runResults) vsbFailed(vscName string, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	if v.Error != "" || !v.VSBCompletionTime.IsZero() {
+		return false
+	}
+	v.Error = err.Error()
+	if !v.VSBStartTime.IsZero() {
+		r.metrics.vsbsRunning.Dec()
+	}
+	r.metrics.vsbsFailed.Inc()
+	r.emitLocked(event{Type: eventVSBFailed, Namespace: v.Namespace, VSC: vscName, VSB: v.VolumeSnapshotBackup, Batch: v.Batch, Error: v.Error})
+	return true
+}
+
+// vsbStalled marks the VSB as stuck, returning false if it already was.
+func (r *runResults) vsbStalled(vscName string, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	if v.Stalled || !v.VSBCompletionTime.IsZero() {
+		return false
+	}
+	v.Stalled = true
+	v.Error = err.Error()
+	r.metrics.vsbsRunning.Dec()
+	r.metrics.vsbsFailed.Inc()
+	r.emitLocked(event{Type: eventVSBStalled, Namespace: v.Namespace, VSC: vscName, VSB: v.VolumeSnapshotBackup, Batch: v.Batch, Error: v.Error})
+	return true
+}
+
+// transferStarted records a transfer the tool does not drive itself, such as
+// a DataUpload of the native data mover, in place of a VSC and its VSB the
+// first time it is seen started.
+func (r *runResults) transferStarted(name, namespace string, sizeBytes int64, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(name)
+	if !v.VSBStartTime.IsZero() {
+		return
+	}
+	v.Namespace = namespace
+	v.SizeBytes = sizeBytes
+	v.VolumeSnapshotBackup = name
+	v.VSBStartTime = t
+	r.metrics.vsbsRunning.Inc()
+	r.emitLocked(event{Time: t, Type: eventVSBCreated, Namespace: namespace, VSB: name, SizeBytes: sizeBytes})
+}
+
+// transferFailed records the first time a transfer was seen failed.
+func (r *runResults) transferFailed(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(name)
+	if v.Error != "" {
+		return
+	}
+	v.Error = err.Error()
+	if !v.VSBStartTime.IsZero() {
+		r.metrics.vsbsRunning.Dec()
+	}
+	r.metrics.vsbsFailed.Inc()
+	r.emitLocked(event{Type: eventVSBFailed, Namespace: v.Namespace, VSB: name, Error: v.Error})
+}
+
+// vsbCompleted records the first time the VSB was seen completed along with
+// the source PVC details reported in its status. VSBs already given up on as
+// stalled are left as they are.
+func (r *runResults) vsbCompleted(vscName, pvc, size string, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	if v.Stalled || !v.VSBCompletionTime.IsZero() {
+		return
+	}
+	v.PVC = pvc
+	if v.SizeBytes == 0 {
+		v.SizeBytes = parseSize(size)
+	}
+	v.VSBCompletionTime = t
+	v.VSBDuration = t.Sub(v.VSBStartTime)
+	v.Throughput = gibPerMinute(v.bytes(), v.VSBDuration)
+	r.metrics.vsbsRunning.Dec()
+	r.metrics.vsbsCompleted.Inc()
+	r.metrics.vsbDuration.Observe(v.VSBDuration.Seconds())
+	r.emitLocked(event{Time: t, Type: eventVSBCompleted, Namespace: v.Namespace, VSC: v.VolumeSnapshotContent, VSB: v.VolumeSnapshotBackup, PVC: pvc, Batch: v.Batch, SizeBytes: v.bytes(), Seconds: v.VSBDuration.Seconds()})
+}
+
+// bytesTransferred records the amount of data the mover reported moving for
+// a transfer it drives itself.
+func (r *runResults) bytesTransferred(name string, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.volume(name).TransferredBytes = bytes
+}
+
+// bytes returns the best known amount of data in the volume: what the mover
+// reported moving, else the snapshot size, else the storage requested by the
+// PVC.
+func (v *volumeResult) bytes() int64 {
+	switch {
+	case v.TransferredBytes != 0:
+		return v.TransferredBytes
+	case v.SizeBytes != 0:
+		return v.SizeBytes
+	}
+	return v.RequestedBytes
+}
+
+// gibPerMinute returns bytes moved in d in GiB per minute, or 0 if either is
+// unknown.
+func gibPerMinute(bytes int64, d time.Duration) float64 {
+	if bytes <= 0 || d <= 0 {
+		return 0
+	}
+	return float64(bytes) / (1 << 30) / d.Minutes()
+}
+
+// dataMoverThroughput returns the GiB of completed volumes moved per minute
+// of data mover time, or 0 if it cannot be worked out. The caller must hold
+// r.mu if the run is still going.
+func dataMoverThroughput(r *runResults) float64 {
+	var bytes int64
+	for _, v := range r.Volumes {
+		if v.Error == "" && !v.VSBCompletionTime.IsZero() {
+			bytes += v.bytes()
+		}
+	}
+	return gibPerMinute(bytes, r.DataMoverTime)
+}
+
+// createFailures returns the volumes no VSB could be created for.
+func (r *runResults) createFailures() []*volumeResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failed := []*volumeResult{}
+	for _, v := range r.Volumes {
+		if v.CreateFailed {
+			failed = append(failed, v)
+		}
+	}
+	return failed
+}
+
+// stragglers returns the volumes whose VSB stalled.
+func (r *runResults) stragglers() []*volumeResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stalled := []*volumeResult{}
+	for _, v := range r.Volumes {
+		if v.Stalled {
+			stalled = append(stalled, v)
+		}
+	}
+	return stalled
+}
+
+// integrity returns the integrity result for the PVC, creating it if needed.
+// The caller must hold r.mu.
+func (r *runResults) integrity(namespace, pvc string) *integrityResult {
+	for _, v := range r.Integrity {
+		if v.Namespace == namespace && v.PVC == pvc {
+			return v
+		}
+	}
+	v := &integrityResult{Namespace: namespace, PVC: pvc}
+	r.Integrity = append(r.Integrity, v)
+	return v
+}
+
+func (r *runResults) sourceDigest(namespace, pvc, digest string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.integrity(namespace, pvc)
+	v.SourceSHA256 = digest
+	if err != nil {
+		v.Error = err.Error()
+	}
+}
+
+// restoredDigest records the digest of the restored PVC and whether it
+// differs from the one recorded before the backup.
+func (r *runResults) restoredDigest(namespace, pvc, digest string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.integrity(namespace, pvc)
+	v.RestoredSHA256 = digest
+	if err != nil {
+		v.Error = err.Error()
+		return
+	}
+	v.Corrupted = v.SourceSHA256 != digest
+}
+
+// digestedPVCs returns the PVCs whose digest was recorded before the backup.
+func (r *runResults) digestedPVCs() []types.NamespacedName {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pvcs := []types.NamespacedName{}
+	for _, v := range r.Integrity {
+		if v.SourceSHA256 != "" {
+			pvcs = append(pvcs, types.NamespacedName{Namespace: v.Namespace, Name: v.PVC})
+		}
+	}
+	return pvcs
+}
+
+func (r *runResults) integrityResults() []integrityResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := []integrityResult{}
+	for _, v := range r.Integrity {
+		results = append(results, *v)
+	}
+	return results
+}
+
+func (r *runResults) snapshotsDone(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.SnapshotEndTime = t
+	r.SnapshotTime = t.Sub(r.StartTime)
+	r.emitLocked(event{Time: t, Type: eventSnapshotsDone, Volumes: len(r.Volumes), Seconds: r.SnapshotTime.Seconds()})
+}
+
+// runFailed records why the run did not finish.
+func (r *runResults) runFailed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Error = err.Error()
+}
+
+func (r *runResults) dataMoverDone(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DataMoverEndTime = t
+	r.DataMoverTime = t.Sub(r.SnapshotEndTime)
+	r.TotalTime = t.Sub(r.StartTime)
+	r.Throughput = dataMoverThroughput(r)
+	r.ByNamespace = namespaceSummaries(r)
+	r.emitLocked(event{Time: t, Type: eventDataMoverDone, Volumes: len(r.Volumes), Seconds: r.DataMoverTime.Seconds()})
+}
+
+// snapshot returns a copy of r taken under r.mu, which can be read without
+// the lock while the run goes on changing r. It shares the metrics of r.
+func (r *runResults) snapshot() (*runResults, error) {
+	r.mu.Lock()
+	data, err := json.Marshal(r)
+	r.mu.Unlock()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to copy results")
+	}
+	s, err := decodeResults(data)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics = r.metrics
+	return s, nil
+}
+
+// write saves the results to path in the given format.
+func (r *runResults) write(format, path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.Slice(r.Volumes, func(i, j int) bool {
+		if r.Volumes[i].Batch != r.Volumes[j].Batch {
+			return r.Volumes[i].Batch < r.Volumes[j].Batch
+		}
+		return r.Volumes[i].VolumeSnapshotContent < r.Volumes[j].VolumeSnapshotContent
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create results file %s", path)
+	}
+	defer f.Close()
+
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	case outputCSV:
+		err = r.writeCSV(csv.NewWriter(f))
+	case outputJUnit:
+		err = r.writeJUnit(f)
+	default:
+		err = errors.Errorf("unknown output format %q", format)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write results file %s", path)
+	}
+	return nil
+}
+
+func (r *runResults) writeCSV(w *csv.Writer) error {
+	err := w.Write([]string{
+		"backup", "batch", "namespace", "pvc", "size_bytes", "requested_bytes", "transferred_bytes", "volumesnapshotcontent",
+		"vsc_ready_time", "volumesnapshotbackup", "vsb_start_time", "vsb_completion_time",
+		"vsb_duration_seconds", "throughput_gib_per_minute", "queue_seconds", "setup_seconds", "transfer_seconds", "cleanup_seconds",
+		"replicationsource", "sync_status", "last_sync_seconds",
+		"stalled", "create_failed", "error", "source_sha256", "restored_sha256", "corrupted",
+		"restore_batch", "volumesnapshotrestore", "vsr_start_time", "vsr_completion_time", "vsr_duration_seconds", "restore_error",
+	})
+	if err != nil {
+		return err
+	}
+	integrity := map[types.NamespacedName]*integrityResult{}
+	for _, v := range r.Integrity {
+		integrity[types.NamespacedName{Namespace: v.Namespace, Name: v.PVC}] = v
+	}
+	for _, v := range r.Volumes {
+		digests := integrity[types.NamespacedName{Namespace: v.Namespace, Name: v.PVC}]
+		if digests == nil {
+			digests = &integrityResult{}
+		}
+		err := w.Write([]string{
+			r.Backup,
+			strconv.Itoa(v.Batch),
+			v.Namespace,
+			v.PVC,
+			strconv.FormatInt(v.SizeBytes, 10),
+			strconv.FormatInt(v.RequestedBytes, 10),
+			strconv.FormatInt(v.TransferredBytes, 10),
+			v.VolumeSnapshotContent,
+			formatTime(v.VSCReadyTime),
+			v.VolumeSnapshotBackup,
+			formatTime(v.VSBStartTime),
+			formatTime(v.VSBCompletionTime),
+			strconv.FormatFloat(v.VSBDuration.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(v.Throughput, 'f', 3, 64),
+			strconv.FormatFloat(v.QueueDuration.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(v.SetupDuration.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(v.TransferDuration.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(v.CleanupDuration.Seconds(), 'f', 3, 64),
+			v.ReplicationSource,
+			v.SyncStatus,
+			strconv.FormatFloat(v.LastSyncDuration.Seconds(), 'f', 3, 64),
+			strconv.FormatBool(v.Stalled),
+			strconv.FormatBool(v.CreateFailed),
+			v.Error,
+			digests.SourceSHA256,
+			digests.RestoredSHA256,
+			strconv.FormatBool(digests.Corrupted),
+			strconv.Itoa(v.RestoreBatch),
+			v.VolumeSnapshotRestore,
+			formatTime(v.VSRStartTime),
+			formatTime(v.VSRCompletionTime),
+			strconv.FormatFloat(v.VSRDuration.Seconds(), 'f', 3, 64),
+			v.RestoreError,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// readResults loads a results file previously written in JSON format.
+func readResults(path string) (*runResults, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read results file %s", path)
+	}
+	r, err := decodeResults(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse results file %s", path)
+	}
+	return r, nil
+}
+
+// parseSize converts a PVC size such as 10Gi to bytes, returning 0 if it
+// cannot be parsed.
+func parseSize(size string) int64 {
+	q, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0
+	}
+	return q.Value()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
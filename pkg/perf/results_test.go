@@ -0,0 +1,29 @@
+package perf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunResultsSnapshot(t *testing.T) {
+	r := newRunResults([]string{"perf-target"}, 4, scheduleWindow)
+	r.Backup = "perf-1"
+	start := time.Now()
+	r.vscReady("vsc-1", "perf-target", 1<<30, start)
+
+	snapshot, err := r.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot() = %v", err)
+	}
+	r.vscReady("vsc-2", "perf-target", 1<<30, start)
+	r.mu.Lock()
+	r.volume("vsc-1").Error = "failed"
+	r.mu.Unlock()
+
+	if snapshot.Backup != "perf-1" || len(snapshot.Volumes) != 1 {
+		t.Fatalf("got backup %q with %d volumes, want perf-1 with 1", snapshot.Backup, len(snapshot.Volumes))
+	}
+	if v := snapshot.Volumes[0]; v.VolumeSnapshotContent != "vsc-1" || v.Error != "" {
+		t.Errorf("got volume %s with error %q, want vsc-1 as it was when the snapshot was taken", v.VolumeSnapshotContent, v.Error)
+	}
+}
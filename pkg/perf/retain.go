@@ -0,0 +1,55 @@
+package perf
+
+import (
+	"context"
+
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// retainedAnnotation marks the VSCs whose deletionPolicy the tool switched to
+// Retain, so cleanup switches them back before deleting them and the storage
+// snapshots go with them.
+const retainedAnnotation = "oadp-perf/retained"
+
+// retainVSCs sets the deletionPolicy of vscs to Retain, so deleting the Velero
+// backup of the run does not delete the snapshots and later runs can move
+// their data again with use-existing-backup.
+func retainVSCs(ctx context.Context, c client.Client, vscs []v1.VolumeSnapshotContent) error {
+	patched := 0
+	for i := range vscs {
+		vsc := &vscs[i]
+		if vsc.Spec.DeletionPolicy == v1.VolumeSnapshotContentRetain {
+			continue
+		}
+		original := vsc.DeepCopy()
+		vsc.Spec.DeletionPolicy = v1.VolumeSnapshotContentRetain
+		if vsc.Annotations == nil {
+			vsc.Annotations = map[string]string{}
+		}
+		vsc.Annotations[retainedAnnotation] = "true"
+		err := c.Patch(ctx, vsc, client.MergeFrom(original))
+		if err != nil {
+			return errors.Wrapf(err, "failed to retain volumesnapshotcontent %s", vsc.Name)
+		}
+		patched++
+	}
+	loggerFrom(ctx).Infow("set deletionPolicy of volumesnapshotcontents to Retain", "phase", phaseSnapshot, "patched", patched, "total", len(vscs))
+	return nil
+}
+
+// releaseVSC restores the Delete deletionPolicy of vsc if retainVSCs changed
+// it, so deleting vsc also deletes its snapshot.
+func releaseVSC(ctx context.Context, c client.Client, vsc *v1.VolumeSnapshotContent) error {
+	if vsc.Annotations[retainedAnnotation] != "true" || vsc.Spec.DeletionPolicy == v1.VolumeSnapshotContentDelete {
+		return nil
+	}
+	original := vsc.DeepCopy()
+	vsc.Spec.DeletionPolicy = v1.VolumeSnapshotContentDelete
+	err := c.Patch(ctx, vsc, client.MergeFrom(original))
+	if err != nil {
+		return errors.Wrapf(err, "failed to restore the deletionPolicy of volumesnapshotcontent %s", vsc.Name)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+// Package perf drives and times the OADP data mover. NewRootCommand is the
+// oadp-perf command line, and Runner runs a backup from Go code.
+package perf
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// rootOptions holds the flags shared by every subcommand.
+type rootOptions struct {
+	kubeconfig      string
+	context         string
+	veleroNamespace string
+	logLevel        string
+	logFormat       string
+	config          string
+	// qps and burst limit the requests to the API server, client-go's
+	// defaults if 0.
+	qps   float32
+	burst int
+	// clusterConfig is used instead of the kubeconfig when set, by
+	// callers of Runner that already have one.
+	clusterConfig *rest.Config
+	// dataMoverVersion is the version of the data mover API the cluster
+	// serves, discovered with the first client.
+	dataMoverVersion *schema.GroupVersion
+}
+
+// NewRootCommand returns the oadp-perf command with every subcommand.
+func NewRootCommand() *cobra.Command {
+	o := &rootOptions{}
+	cmd := &cobra.Command{
+		Use:          "oadp-perf",
+		Short:        "Drive and time the OADP data mover outside of a Velero backup",
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if o.config != "" {
+				err := applyConfigFile(cmd.Flags(), o.config)
+				if err != nil {
+					return err
+				}
+			}
+			if o.qps < 0 || o.burst < 0 {
+				return errors.New("qps and burst must not be negative")
+			}
+			l, err := setupLogging(o.logLevel, o.logFormat)
+			if err != nil {
+				return err
+			}
+			cmd.SetContext(withLogger(cmd.Context(), l))
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().StringVar(&o.kubeconfig, "kubeconfig", "", "path to the kubeconfig file, $KUBECONFIG or ~/.kube/config if not set, falling back to the in-cluster config when there is none")
+	cmd.PersistentFlags().StringVar(&o.context, "context", "", "kubeconfig context to use instead of the current context")
+
+	cmd.PersistentFlags().StringVar(&o.veleroNamespace, "velero-namespace", "", "namespace Velero and the data mover run in, detected from the DataProtectionApplication or velero deployment if not set")
+	cmd.PersistentFlags().StringVar(&o.logLevel, "log-level", "info", "minimum level of log messages: debug, info, warn or error")
+	cmd.PersistentFlags().StringVar(&o.logFormat, "log-format", logFormatText, "format of log messages: text or json")
+	cmd.PersistentFlags().Float32Var(&o.qps, "qps", 0, "maximum queries per second to the API server, raise it for large runs that client-go would otherwise throttle; client-go's default of 5 if 0")
+	cmd.PersistentFlags().IntVar(&o.burst, "burst", 0, "maximum burst of queries to the API server above qps, client-go's default of 10 if 0")
+	cmd.PersistentFlags().StringVar(&o.config, "config", "", "path to a YAML file of flag names and values to run with, overridden by flags given on the command line")
+
+	cmd.AddCommand(
+		newBackupCommand(o),
+		newRestoreCommand(o),
+		newDRTestCommand(o),
+		newStatusCommand(o),
+		newAttachCommand(o),
+		newCleanupCommand(o),
+		newPreflightCommand(o),
+		newGenerateCommand(o),
+		newCompareCommand(o),
+		newSweepCommand(o),
+		newReportCommand(o),
+		newHistoryCommand(),
+		newManifestsCommand(),
+		newOperatorCommand(o),
+	)
+	return cmd
+}
+
+// restConfig loads the selected context of the kubeconfig, or the in-cluster
+// config when there is no kubeconfig so the tool can run as a Job.
+func (o *rootOptions) restConfig() (*rest.Config, error) {
+	if o.clusterConfig != nil {
+		return o.limit(o.clusterConfig), nil
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: o.context}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if clientcmd.IsEmptyConfig(err) && o.context == "" {
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "no kubeconfig found and not running in a cluster")
+		}
+		return o.limit(config), nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load kubeconfig")
+	}
+	return o.limit(config), nil
+}
+
+// limit returns config with the qps and burst flags applied, leaving config
+// itself alone since it may belong to a caller of Runner.
+func (o *rootOptions) limit(config *rest.Config) *rest.Config {
+	if o.qps == 0 && o.burst == 0 {
+		return config
+	}
+	config = rest.CopyConfig(config)
+	if o.qps != 0 {
+		config.QPS = o.qps
+	}
+	if o.burst != 0 {
+		config.Burst = o.burst
+	}
+	return config
+}
+
+// client builds a controller-runtime client for the cluster restConfig
+// selects with every API the tool works with registered.
+func (o *rootOptions) client(ctx context.Context) (client.Client, error) {
+	config, err := o.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := o.scheme(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return client.New(config, client.Options{Scheme: scheme})
+}
+
+// scheme returns the scheme of the clients of the cluster config points to,
+// with the data mover types registered under the version it serves. It fails
+// if the cluster does not serve the APIs every run needs.
+func (o *rootOptions) scheme(ctx context.Context, config *rest.Config) (*runtime.Scheme, error) {
+	if o.dataMoverVersion == nil {
+		gv, err := discoverAPIs(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		o.dataMoverVersion = &gv
+	}
+	return newScheme(*o.dataMoverVersion)
+}
+
+// clientset builds a client-go clientset for the APIs the controller-runtime
+// client does not cover, such as pod logs.
+func (o *rootOptions) clientset() (kubernetes.Interface, error) {
+	config, err := o.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// resolveVeleroNamespace fills in the Velero namespace when it was not set on
+// the command line, from the namespace of the DataProtectionApplication or,
+// without OADP, of the velero deployment.
+func (o *rootOptions) resolveVeleroNamespace(ctx context.Context, c client.Client) error {
+	if o.veleroNamespace != "" {
+		return nil
+	}
+	dpa, err := findDPA(ctx, c, "")
+	if err != nil {
+		return err
+	}
+	if dpa != nil {
+		o.veleroNamespace = dpa.Namespace
+		loggerFrom(ctx).Infow("using velero namespace from DataProtectionApplication", "veleroNamespace", o.veleroNamespace, "dpa", dpa.Name)
+		return nil
+	}
+	deployments := appsv1.DeploymentList{}
+	err = c.List(ctx, &deployments, client.MatchingLabels{"component": "velero"})
+	if err != nil {
+		return errors.Wrap(err, "failed to list velero deployments, set the velero-namespace flag")
+	}
+	namespaces := []string{}
+	for _, deployment := range deployments.Items {
+		if deployment.Name == "velero" {
+			namespaces = append(namespaces, deployment.Namespace)
+		}
+	}
+	switch len(namespaces) {
+	case 0:
+		return errors.New("could not find a velero deployment, set the velero-namespace flag")
+	case 1:
+		o.veleroNamespace = namespaces[0]
+		loggerFrom(ctx).Infow("using velero namespace", "veleroNamespace", o.veleroNamespace)
+		return nil
+	}
+	return errors.Errorf("found velero deployments in namespaces %s, set the velero-namespace flag", strings.Join(namespaces, ", "))
+}
+
+// parseNamespaces merges the comma separated namespaces flag with the
+// contents of the namespaces file. Blank lines and lines starting with # in
+// the file are ignored, and duplicates are dropped.
+func parseNamespaces(input, file string) ([]string, error) {
+	entries := []string{}
+	if input != "" {
+		entries = append(entries, strings.Split(input, ",")...)
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read namespaces file %s", file)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "#") {
+				continue
+			}
+			entries = append(entries, line)
+		}
+	}
+
+	namespaces := []string{}
+	seen := map[string]bool{}
+	for _, ns := range entries {
+		ns = strings.TrimSpace(ns)
+		if ns == "" || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		namespaces = append(namespaces, ns)
+	}
+	if len(namespaces) == 0 {
+		return nil, errors.New("missing namespaces, set the namespaces or namespaces-file flag")
+	}
+	return namespaces, nil
+}
+
+func validateNamespaces(ctx context.Context, c client.Client, namespaces []string) error {
+	missing := []string{}
+	for _, ns := range namespaces {
+		namespace := corev1.Namespace{}
+		err := c.Get(ctx, types.NamespacedName{Name: ns}, &namespace)
+		if apierrors.IsNotFound(err) {
+			missing = append(missing, ns)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to get namespace %s", ns)
+		}
+	}
+	if len(missing) != 0 {
+		return errors.Errorf("namespaces do not exist: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
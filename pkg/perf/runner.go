@@ -0,0 +1,287 @@
+package perf
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"k8s.io/client-go/rest"
+)
+
+// Data movers, modes, schedules and failure handling a Runner can be given.
+const (
+	MoverVSM    = moverVSM
+	MoverNative = moverNative
+
+	ModeDataMover = modeDataMover
+	ModeFSBackup  = modeFSBackup
+
+	ScheduleWindow = scheduleWindow
+	ScheduleBatch  = scheduleBatch
+
+	OnFailureAbort    = onFailureAbort
+	OnFailureContinue = onFailureContinue
+)
+
+// Results are the timings of a run, as written to its JSON results file.
+type Results = runResults
+
+// Runner runs a backup through the data mover the way the backup command
+// does, for Go test harnesses that embed the tool instead of running it.
+type Runner struct {
+	options *backupOptions
+	// resticSecretSet and concurrencySet keep the values given to the
+	// runner from being replaced by those of the DataProtectionApplication.
+	resticSecretSet bool
+	concurrencySet  bool
+	// moverSet keeps a run of the mover given to the runner from falling
+	// back to another on clusters without the VolumeSnapshotMover.
+	moverSet bool
+	logger   *zap.SugaredLogger
+}
+
+// Option configures a Runner.
+type Option func(*Runner)
+
+// NewRunner returns a Runner with the defaults of the backup command,
+// changed by opts.
+func NewRunner(opts ...Option) *Runner {
+	r := &Runner{options: newBackupOptions(&rootOptions{})}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// WithRestConfig connects to the cluster config points at instead of loading
+// a kubeconfig.
+func WithRestConfig(config *rest.Config) Option {
+	return func(r *Runner) { r.options.clusterConfig = config }
+}
+
+// WithKubeconfig loads context of the kubeconfig at path. Either may be empty
+// for the defaults of the backup command.
+func WithKubeconfig(path, context string) Option {
+	return func(r *Runner) {
+		r.options.kubeconfig = path
+		r.options.context = context
+	}
+}
+
+// WithVeleroNamespace sets the namespace Velero and the data mover run in.
+func WithVeleroNamespace(namespace string) Option {
+	return func(r *Runner) { r.options.veleroNamespace = namespace }
+}
+
+// WithNamespaces sets the namespaces to back up.
+func WithNamespaces(namespaces ...string) Option {
+	return func(r *Runner) { r.options.namespaces = strings.Join(namespaces, ",") }
+}
+
+// WithNamespaceSelector adds the namespaces whose labels match selector, such
+// as app=perf-target, to those to back up.
+func WithNamespaceSelector(selector string) Option {
+	return func(r *Runner) { r.options.namespaceSelector = selector }
+}
+
+// WithExcludeNamespaces leaves the namespaces matching patterns, names or
+// shell patterns such as perf-target-1*, out of the backup.
+func WithExcludeNamespaces(patterns ...string) Option {
+	return func(r *Runner) { r.options.excludeNamespaces = strings.Join(patterns, ",") }
+}
+
+// WithNamePrefix starts the name of the backup, and so of the run, with
+// prefix instead of perf-.
+func WithNamePrefix(prefix string) Option {
+	return func(r *Runner) { r.options.namePrefix = prefix }
+}
+
+// WithConcurrency sets the number of concurrent volumesnapshotbackups.
+func WithConcurrency(concurrency int) Option {
+	return func(r *Runner) {
+		r.options.concurrency = concurrency
+		r.concurrencySet = true
+	}
+}
+
+// WithVSBCreateRate creates at most rate volumesnapshotbackups per second,
+// after a first burst of them.
+func WithVSBCreateRate(rate float64, burst int) Option {
+	return func(r *Runner) {
+		r.options.createRate = rate
+		r.options.createBurst = burst
+	}
+}
+
+// WithAPILimits sets the queries per second and burst of the requests to the
+// API server, client-go's defaults if 0.
+func WithAPILimits(qps float32, burst int) Option {
+	return func(r *Runner) {
+		r.options.qps = qps
+		r.options.burst = burst
+	}
+}
+
+// WithSchedule sets how volumesnapshotbackups are scheduled, ScheduleWindow
+// or ScheduleBatch.
+func WithSchedule(schedule string) Option {
+	return func(r *Runner) { r.options.schedule = schedule }
+}
+
+// WithBatchAdvanceThreshold starts the next batch of ScheduleBatch once
+// threshold of the current one is done, e.g. 0.8.
+func WithBatchAdvanceThreshold(threshold float64) Option {
+	return func(r *Runner) { r.options.batchAdvanceThreshold = threshold }
+}
+
+// WithPacing pauses delay between the batches of ScheduleBatch and delays
+// each volumesnapshotbackup create by a random time up to jitter.
+func WithPacing(delay, jitter time.Duration) Option {
+	return func(r *Runner) {
+		r.options.batchDelay = delay
+		r.options.createJitter = jitter
+	}
+}
+
+// WithMover sets the data mover to benchmark, MoverVSM or MoverNative.
+func WithMover(mover string) Option {
+	return func(r *Runner) {
+		r.options.mover = mover
+		r.moverSet = true
+	}
+}
+
+// WithMode sets what to benchmark, ModeDataMover or ModeFSBackup.
+func WithMode(mode string) Option {
+	return func(r *Runner) { r.options.mode = mode }
+}
+
+// WithResticSecret sets the restic secret for volsync to use.
+func WithResticSecret(name string) Option {
+	return func(r *Runner) {
+		r.options.resticSecretName = name
+		r.resticSecretSet = true
+	}
+}
+
+// WithResticSecrets maps namespaces, or shell patterns of them, to the
+// restic secret their volumesnapshotbackups use instead of the one of
+// WithResticSecret.
+func WithResticSecrets(secrets map[string]string) Option {
+	return func(r *Runner) {
+		pairs := make([]string, 0, len(secrets))
+		for ns, secret := range secrets {
+			pairs = append(pairs, ns+"="+secret)
+		}
+		sort.Strings(pairs)
+		r.options.vsb.resticSecrets = strings.Join(pairs, ",")
+	}
+}
+
+// WithOnFailure sets what to do when a volumesnapshotbackup fails,
+// OnFailureAbort or OnFailureContinue.
+func WithOnFailure(onFailure string) Option {
+	return func(r *Runner) { r.options.onFailure = onFailure }
+}
+
+// WithStallTimeout gives up on volumesnapshotbackups whose status has not
+// changed for timeout.
+func WithStallTimeout(timeout time.Duration) Option {
+	return func(r *Runner) { r.options.stallTimeout = timeout }
+}
+
+// WithOutput also writes the results in format, json, csv or junit, to file
+// or to results-<backup name>.<format> if file is empty.
+func WithOutput(format, file string) Option {
+	return func(r *Runner) {
+		r.options.output = format
+		r.options.outputFile = file
+	}
+}
+
+// WithRestore restores the backup once the data mover is done.
+func WithRestore() Option {
+	return func(r *Runner) { r.options.restore = true }
+}
+
+// WithExistingBackup runs the data mover against the snapshots of a completed
+// backup instead of creating one.
+func WithExistingBackup(name string) Option {
+	return func(r *Runner) { r.options.existingBackup = name }
+}
+
+// WithSnapshotOnly stops once the snapshots are ready.
+func WithSnapshotOnly() Option {
+	return func(r *Runner) { r.options.snapshotOnly = true }
+}
+
+// WithVolumeSnapshotClass checks before the backup is created that the
+// VolumeSnapshotClass called name is one the snapshots of the run can use,
+// and with set also names it on the backup for its CSI driver.
+func WithVolumeSnapshotClass(name string, set bool) Option {
+	return func(r *Runner) {
+		r.options.volumeSnapshotClass = name
+		r.options.setVolumeSnapshotClass = set
+	}
+}
+
+// WithoutPreflight skips the preflight checks.
+func WithoutPreflight() Option {
+	return func(r *Runner) { r.options.skipPreflight = true }
+}
+
+// WithSinks hands the results of the run to sinks once it ends, after the
+// sinks of the options that configure them.
+func WithSinks(sinks ...ResultSink) Option {
+	return func(r *Runner) { r.options.sinks = append(r.options.sinks, sinks...) }
+}
+
+// WithEvents writes progress events as newline delimited JSON to target, a
+// file, - for stdout or unix:<path> for the clients of a unix socket.
+func WithEvents(target string) Option {
+	return func(r *Runner) { r.options.events = target }
+}
+
+// WithLogger logs the run to logger.
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(r *Runner) { r.logger = logger }
+}
+
+// Run runs the backup and returns its results. The error can be passed to
+// ExitCode to tell why the run failed.
+func (r *Runner) Run(ctx context.Context) (*Results, error) {
+	o := r.options
+	if r.logger != nil {
+		ctx = withLogger(ctx, r.logger)
+	}
+	if o.namespaces == "" && o.namespaceSelector == "" && o.existingBackup == "" {
+		return nil, errors.New("missing namespaces, use WithNamespaces or WithNamespaceSelector")
+	}
+	err := o.validate()
+	if err != nil {
+		return nil, err
+	}
+	var resticSecretName *string
+	var concurrency *int
+	if !r.resticSecretSet {
+		resticSecretName = &o.resticSecretName
+	}
+	if !r.concurrencySet {
+		concurrency = &o.concurrency
+	}
+	c, err := o.connectWith(ctx, resticSecretName, concurrency, r.moverSet)
+	if err != nil {
+		return nil, err
+	}
+	if o.events != "" {
+		o.eventStream, err = openEventStream(ctx, o.events)
+		if err != nil {
+			return nil, err
+		}
+		defer o.eventStream.close()
+	}
+	return o.backup(ctx, c)
+}
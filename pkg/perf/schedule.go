@@ -0,0 +1,243 @@
+package perf
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// jobQueue is the work a scheduler goes through, such as the VSCs to create
+// VolumeSnapshotBackups for or the VSBs to create VolumeSnapshotRestores for.
+type jobQueue interface {
+	// len returns the number of jobs in the queue.
+	len() int
+	// runJob runs the job at index in the queue, scheduled in batch, adding
+	// it to completed once it is done. An error stops the schedule.
+	runJob(ctx context.Context, index, batch int, completed *int32) error
+	// pauseBefore waits before batch starts with schedule batch, returning
+	// false if ctx is done first.
+	pauseBefore(ctx context.Context, batch int) bool
+	// batchDone records that the volumes jobs of batch were all done
+	// elapsed after it started.
+	batchDone(batch, volumes int, elapsed time.Duration)
+}
+
+// scheduler runs the jobs of queue, keeping at most concurrency of them
+// running according to schedule. The VSBs of a backup and the VSRs of its
+// restore share it, so the two are scheduled and timed the same way.
+type scheduler struct {
+	queue       jobQueue
+	concurrency int
+	schedule    string
+	// advanceThreshold is the share of a batch that must be done before
+	// the next one starts with schedule batch, if less than 1.
+	advanceThreshold float64
+	// phase is the phase of the run the jobs are logged under, objects
+	// what they wait on, such as VSBs, and queued the log key of the
+	// number of jobs in a batch, such as vscs.
+	phase   string
+	objects string
+	queued  string
+}
+
+func (s *scheduler) run(ctx context.Context) error {
+	switch s.schedule {
+	case scheduleWindow:
+		return s.runWindowed(ctx)
+	case scheduleBatch:
+		return s.runBatched(ctx)
+	}
+	return errors.Errorf("unknown schedule %q, must be one of %s or %s", s.schedule, scheduleWindow, scheduleBatch)
+}
+
+// runWindowed keeps concurrency jobs in flight at all times. Each worker owns
+// one job from start to end and picks up the next one as soon as it is done,
+// so a single slow volume only holds up its own worker instead of the whole
+// batch. The batch a job is recorded in is the window it was scheduled in,
+// i.e. its position in the queue divided by concurrency.
+func (s *scheduler) runWindowed(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	errs := make(chan error, s.concurrency)
+	var wg sync.WaitGroup
+	var completed int32
+	for w := 0; w < s.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				err := s.queue.runJob(ctx, i, i/s.concurrency+1, &completed)
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for i := 0; i < s.queue.len(); i++ {
+		select {
+		case jobs <- i:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// runBatched runs the jobs in batches of concurrency, waiting for each batch
+// to complete before starting the next. Every job of a batch gets its own
+// goroutine, so each is timed on its own rather than by when the whole batch
+// is.
+func (s *scheduler) runBatched(ctx context.Context) error {
+	if s.advanceThreshold > 0 && s.advanceThreshold < 1 {
+		return s.runPipelined(ctx)
+	}
+	var completed int32
+	total := s.queue.len()
+	for i := 0; i < total; i += s.concurrency {
+		end := i + s.concurrency
+		if end > total {
+			end = total
+		}
+		batch := i/s.concurrency + 1
+		if batch > 1 && !s.queue.pauseBefore(ctx, batch) {
+			return ctx.Err()
+		}
+		loggerFrom(ctx).Infow("starting batch", "phase", s.phase, "batch", batch, s.queued, end-i)
+		batchStartTime := time.Now()
+		err := s.runBatch(ctx, i, end, batch, &completed)
+		if err != nil {
+			if err == wait.ErrWaitTimeout {
+				loggerFrom(ctx).Errorw("timed out waiting for "+s.objects+" to complete", "phase", s.phase, "batch", batch)
+			}
+			return err
+		}
+		s.queue.batchDone(batch, end-i, time.Since(batchStartTime))
+	}
+	return nil
+}
+
+// runBatch runs the jobs from start up to end at once and waits for all of
+// them. The first error cancels the rest of the batch and is returned, as an
+// errgroup would.
+func (s *scheduler) runBatch(ctx context.Context, start, end, batch int, completed *int32) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := start; i < end; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := s.queue.runJob(ctx, i, batch, completed)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// runPipelined runs batches like runBatched, except that the next batch
+// starts as soon as advanceThreshold of the current one is done. The jobs
+// still running, the stragglers, carry on alongside the next batch, which
+// only gets the slots they leave so no more than concurrency jobs run at once.
+// A batch is recorded as done when its last job is. The first error cancels
+// every batch and is returned.
+func (s *scheduler) runPipelined(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	var completed, running int32
+	total := s.queue.len()
+	for next, batch := 0, 1; next < total; batch++ {
+		if batch > 1 && !s.queue.pauseBefore(ctx, batch) {
+			break
+		}
+		size := s.concurrency - int(atomic.LoadInt32(&running))
+		if size > total-next {
+			size = total - next
+		}
+		start := next
+		next += size
+		loggerFrom(ctx).Infow("starting batch", "phase", s.phase, "batch", batch, s.queued, size, "stragglers", atomic.LoadInt32(&running))
+
+		batchStartTime := time.Now()
+		finished := make(chan struct{}, size)
+		var batchWG sync.WaitGroup
+		for i := start; i < next; i++ {
+			wg.Add(1)
+			batchWG.Add(1)
+			atomic.AddInt32(&running, 1)
+			go func(i, batch int) {
+				defer wg.Done()
+				defer batchWG.Done()
+				err := s.queue.runJob(ctx, i, batch, &completed)
+				atomic.AddInt32(&running, -1)
+				finished <- struct{}{}
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}(i, batch)
+		}
+		wg.Add(1)
+		go func(batch, volumes int) {
+			defer wg.Done()
+			batchWG.Wait()
+			if ctx.Err() != nil {
+				return
+			}
+			s.queue.batchDone(batch, volumes, time.Since(batchStartTime))
+		}(batch, size)
+
+		// Wait for enough of the batch to be done before starting the
+		// next one.
+		need := int(math.Ceil(s.advanceThreshold * float64(size)))
+		for done := 0; done < need && ctx.Err() == nil; {
+			select {
+			case <-finished:
+				done++
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	wg.Wait()
+	if firstErr == wait.ErrWaitTimeout {
+		loggerFrom(ctx).Errorw("timed out waiting for "+s.objects+" to complete", "phase", s.phase)
+	}
+	return firstErr
+}
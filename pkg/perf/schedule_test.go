@@ -0,0 +1,113 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQueue records how a scheduler runs its jobs.
+type fakeQueue struct {
+	jobs int
+	// fail makes the job at this index fail, if not negative.
+	fail int
+
+	mu      sync.Mutex
+	running int
+	peak    int
+	batches map[int]int
+	done    []int
+}
+
+var errJobFailed = errors.New("job failed")
+
+func newFakeQueue(jobs int) *fakeQueue {
+	return &fakeQueue{jobs: jobs, fail: -1, batches: map[int]int{}}
+}
+
+func (q *fakeQueue) len() int { return q.jobs }
+
+func (q *fakeQueue) runJob(ctx context.Context, index, batch int, completed *int32) error {
+	q.mu.Lock()
+	q.running++
+	if q.running > q.peak {
+		q.peak = q.running
+	}
+	q.batches[index] = batch
+	q.mu.Unlock()
+
+	// Later jobs take longer so batches have stragglers.
+	time.Sleep(time.Duration(index%3+1) * time.Millisecond)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	if index == q.fail {
+		return errJobFailed
+	}
+	q.done = append(q.done, index)
+	return nil
+}
+
+func (q *fakeQueue) pauseBefore(ctx context.Context, batch int) bool { return true }
+
+func (q *fakeQueue) batchDone(batch, volumes int, elapsed time.Duration) {}
+
+func TestSchedulerRunsEveryJob(t *testing.T) {
+	tests := []struct {
+		name             string
+		schedule         string
+		advanceThreshold float64
+	}{
+		{name: "window", schedule: scheduleWindow},
+		{name: "batch", schedule: scheduleBatch, advanceThreshold: 1},
+		{name: "pipelined batch", schedule: scheduleBatch, advanceThreshold: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newFakeQueue(10)
+			s := &scheduler{queue: q, concurrency: 3, schedule: tt.schedule, advanceThreshold: tt.advanceThreshold}
+			if err := s.run(context.Background()); err != nil {
+				t.Fatalf("run() = %v", err)
+			}
+			if len(q.done) != q.jobs {
+				t.Errorf("ran %d jobs, want %d", len(q.done), q.jobs)
+			}
+			if q.peak > s.concurrency {
+				t.Errorf("ran %d jobs at once, want at most %d", q.peak, s.concurrency)
+			}
+			if tt.advanceThreshold == 0 || tt.advanceThreshold == 1 {
+				for index, batch := range q.batches {
+					if want := index/s.concurrency + 1; batch != want {
+						t.Errorf("job %d ran in batch %d, want %d", index, batch, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulerStopsAtFirstError(t *testing.T) {
+	for _, schedule := range []string{scheduleWindow, scheduleBatch} {
+		t.Run(schedule, func(t *testing.T) {
+			q := newFakeQueue(10)
+			q.fail = 1
+			s := &scheduler{queue: q, concurrency: 2, schedule: schedule, advanceThreshold: 1}
+			if err := s.run(context.Background()); !errors.Is(err, errJobFailed) {
+				t.Fatalf("run() = %v, want %v", err, errJobFailed)
+			}
+			if len(q.done) == q.jobs {
+				t.Error("every job ran after one failed")
+			}
+		})
+	}
+}
+
+func TestSchedulerUnknownSchedule(t *testing.T) {
+	s := &scheduler{queue: newFakeQueue(1), concurrency: 1, schedule: "serial"}
+	if err := s.run(context.Background()); err == nil {
+		t.Fatal("run() of an unknown schedule succeeded")
+	}
+}
@@ -0,0 +1,84 @@
+package perf
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// ResultsSchemaVersion is the version of the layout of the JSON results,
+// raised whenever a field is renamed, removed or changes meaning so readers
+// can tell the files they understand. Adding a field does not change it.
+// Files written before the layout was versioned read as version 0.
+const ResultsSchemaVersion = 1
+
+// Version is the version of oadp-perf recorded in its results, set at build
+// time with -ldflags "-X github.com/dymurray/perf/pkg/perf.Version=v1.2.3".
+// The module version is used when it is not set.
+var Version = ""
+
+// toolVersion returns the version of oadp-perf.
+func toolVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// redactedFlags holds words of the names of flags whose values may carry
+// credentials, such as webhook tokens, and so are left out of the results.
+var redactedFlags = []string{"url", "endpoint", "sink"}
+
+// runConfig returns the flags given on the command line with their values,
+// as the configuration the run was made with.
+func runConfig(flags *pflag.FlagSet) map[string]string {
+	config := map[string]string{}
+	flags.Visit(func(f *pflag.Flag) {
+		value := f.Value.String()
+		for _, word := range redactedFlags {
+			if strings.Contains(f.Name, word) {
+				value = "<redacted>"
+			}
+		}
+		config[f.Name] = value
+	})
+	return config
+}
+
+// decodeResults parses the JSON results of a run, rejecting those written
+// with a newer schema than this version of the tool reads and migrating
+// older ones.
+func decodeResults(data []byte) (*runResults, error) {
+	header := struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}{}
+	err := json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.SchemaVersion > ResultsSchemaVersion {
+		return nil, errors.Errorf("results have schema version %d, this oadp-perf reads up to %d, upgrade it", header.SchemaVersion, ResultsSchemaVersion)
+	}
+	r := &runResults{}
+	err = json.Unmarshal(data, r)
+	if err != nil {
+		return nil, err
+	}
+	migrateResults(r)
+	return r, nil
+}
+
+// migrateResults brings results of an older schema up to the current one.
+// Version 0 has the same layout as version 1 less the fields version 1
+// added, so there is nothing to move.
+func migrateResults(r *runResults) {
+	if r.SchemaVersion == 0 {
+		r.SchemaVersion = ResultsSchemaVersion
+	}
+}
@@ -0,0 +1,69 @@
+package perf
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// shardNamespaces deals namespaces out round robin into at most n shards.
+func shardNamespaces(namespaces []string, n int) [][]string {
+	if n > len(namespaces) {
+		n = len(namespaces)
+	}
+	shards := make([][]string, n)
+	for i, ns := range namespaces {
+		shards[i%n] = append(shards[i%n], ns)
+	}
+	return shards
+}
+
+// backupShards runs a backup for each shard of the namespaces at the same
+// time and waits for all of them. Each backup gets its own VSBs, concurrency
+// and results file.
+func (o *backupOptions) backupShards(ctx context.Context, c client.Client) error {
+	namespaces, err := o.resolveNamespaces(ctx, c)
+	if err != nil {
+		return err
+	}
+	shards := shardNamespaces(namespaces, o.backupsPerRun)
+	loggerFrom(ctx).Infow("running backups at once", "backups", len(shards), "namespaces", len(namespaces))
+
+	start := time.Now()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := []string{}
+	for i, shard := range shards {
+		shardOptions := *o
+		shardOptions.namespaces = strings.Join(shard, ",")
+		shardOptions.namespacesFile = ""
+		shardOptions.namespaceSelector = ""
+		shardOptions.excludeNamespaces = ""
+		shardOptions.sharded = true
+		shardOptions.shard = strconv.Itoa(i)
+		wg.Add(1)
+		go func(i int, o *backupOptions) {
+			defer wg.Done()
+			results, err := o.backup(ctx, c)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				loggerFrom(ctx).Errorw("backup failed", "shard", i, "namespaces", o.namespaces, "error", err)
+				failed = append(failed, errors.Wrapf(err, "shard %d", i).Error())
+				return
+			}
+			loggerFrom(ctx).Infow("backup done", "shard", i, "run", results.Backup, "total", results.TotalTime.String())
+		}(i, &shardOptions)
+	}
+	wg.Wait()
+	loggerFrom(ctx).Infow("all backups done", "backups", len(shards), "failed", len(failed), "elapsed", time.Since(start).String())
+	if len(failed) != 0 {
+		return errors.Errorf("%d of %d backups failed: %s", len(failed), len(shards), strings.Join(failed, "; "))
+	}
+	return nil
+}
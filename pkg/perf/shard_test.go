@@ -0,0 +1,29 @@
+package perf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShardNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		n          int
+		want       [][]string
+	}{
+		{name: "none", namespaces: []string{}, n: 3, want: [][]string{}},
+		{name: "one shard", namespaces: []string{"a", "b", "c"}, n: 1, want: [][]string{{"a", "b", "c"}}},
+		{name: "even", namespaces: []string{"a", "b", "c", "d"}, n: 2, want: [][]string{{"a", "c"}, {"b", "d"}}},
+		{name: "uneven", namespaces: []string{"a", "b", "c", "d", "e"}, n: 3, want: [][]string{{"a", "d"}, {"b", "e"}, {"c"}}},
+		{name: "more shards than namespaces", namespaces: []string{"a", "b"}, n: 4, want: [][]string{{"a"}, {"b"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shardNamespaces(tt.namespaces, tt.n)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("shardNamespaces(%v, %d) = %v, want %v", tt.namespaces, tt.n, got, tt.want)
+			}
+		})
+	}
+}
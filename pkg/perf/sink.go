@@ -0,0 +1,334 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// RunOutput is what a ResultSink is given once a run ends.
+type RunOutput struct {
+	// Results is a snapshot of the results of the run, which can be read
+	// without locking.
+	Results *Results
+	// Err is why the run failed, nil if it succeeded.
+	Err error
+	// ResultsFile is the results file the run wrote, empty if it wrote
+	// none.
+	ResultsFile string
+	// ArtifactsDir holds the artifacts collected for the run, empty if
+	// none were.
+	ArtifactsDir string
+}
+
+// ResultSink delivers the results of a run somewhere once it ends, whether or
+// not the run failed. Sinks may be given the runs of several backups at once.
+type ResultSink interface {
+	// Name identifies the sink in logs.
+	Name() string
+	Write(ctx context.Context, out *RunOutput) error
+}
+
+// SinkFactory creates a sink from what follows its name in --sink
+// name=value, empty if there was nothing.
+type SinkFactory func(value string) (ResultSink, error)
+
+var (
+	sinkFactoriesMu sync.Mutex
+	sinkFactories   = map[string]SinkFactory{
+		sinkStdout:      newStdoutSink,
+		sinkJSON:        newJSONSink,
+		sinkPushgateway: newPushgatewaySink,
+		sinkHistory:     newHistorySink,
+		sinkObjectStore: newObjectStoreSink,
+		sinkOTLP:        newOTLPSink,
+	}
+)
+
+// Sinks built into the tool.
+const (
+	sinkStdout      = "stdout"
+	sinkJSON        = "json"
+	sinkPushgateway = "pushgateway"
+	sinkHistory     = "history"
+	sinkObjectStore = "objectstore"
+	sinkOTLP        = "otlp"
+)
+
+// RegisterSink makes the sinks factory creates available to the backup
+// command as --sink name=value, replacing any sink of that name.
+func RegisterSink(name string, factory SinkFactory) {
+	sinkFactoriesMu.Lock()
+	defer sinkFactoriesMu.Unlock()
+	sinkFactories[name] = factory
+}
+
+// parseSink creates the sink of a --sink flag, name or name=value.
+func parseSink(spec string) (ResultSink, error) {
+	name, value, _ := strings.Cut(spec, "=")
+	sinkFactoriesMu.Lock()
+	factory, ok := sinkFactories[name]
+	names := make([]string, 0, len(sinkFactories))
+	for n := range sinkFactories {
+		names = append(names, n)
+	}
+	sinkFactoriesMu.Unlock()
+	if !ok {
+		sort.Strings(names)
+		return nil, errors.Errorf("unknown sink %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+	sink, err := factory(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid sink %q", spec)
+	}
+	return sink, nil
+}
+
+// resultSinks returns the sinks of the history-db, results-url, otlp-endpoint
+// and sink flags followed by those given to the Runner.
+func (o *backupOptions) resultSinks() ([]ResultSink, error) {
+	sinks := []ResultSink{}
+	if o.historyDB != "" {
+		sinks = append(sinks, &historySink{path: o.historyDB})
+	}
+	if o.resultsURL != "" {
+		sink, err := newObjectStoreSink(o.resultsURL)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if o.otlpEndpoint != "" {
+		sink, err := newOTLPSink(o.otlpEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	for _, spec := range o.sinkSpecs {
+		sink, err := parseSink(spec)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return append(sinks, o.sinks...), nil
+}
+
+// writeSinks hands the results of the run to each sink in turn. Failures are
+// logged to the logger of ctx rather than returned so they do not fail a run
+// that is otherwise done. The sinks are not cancelled with ctx, so the
+// results of a run cut short are still delivered.
+func (o *backupOptions) writeSinks(ctx context.Context, results *runResults, runErr error) {
+	ctx = withLogger(context.Background(), loggerFrom(ctx))
+	sinks, err := o.resultSinks()
+	if err != nil {
+		loggerFrom(ctx).Errorw("failed to create result sinks", "error", err)
+		return
+	}
+	if len(sinks) == 0 {
+		return
+	}
+	// The run watcher may still be recording phases, so the sinks are
+	// given a snapshot rather than the results themselves.
+	snapshot, err := results.snapshot()
+	if err != nil {
+		loggerFrom(ctx).Errorw("failed to hand results to sinks", "error", err)
+		return
+	}
+	out := &RunOutput{Results: snapshot, Err: runErr}
+	if o.output != "" {
+		if path := o.resultsPath(results); fileExists(path) {
+			out.ResultsFile = path
+		}
+	}
+	if o.artifactsDir != "" {
+		if dir := filepath.Join(o.artifactsDir, results.Backup); fileExists(dir) {
+			out.ArtifactsDir = dir
+		}
+	}
+	for _, sink := range sinks {
+		err := sink.Write(ctx, out)
+		if err != nil {
+			loggerFrom(ctx).Errorw("failed to write results to sink", "sink", sink.Name(), "error", err)
+			continue
+		}
+		loggerFrom(ctx).Infow("results written to sink", "sink", sink.Name())
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// stdoutSink prints the summary of the report command.
+type stdoutSink struct{}
+
+func newStdoutSink(value string) (ResultSink, error) {
+	if value != "" {
+		return nil, errors.New("stdout takes no value")
+	}
+	return stdoutSink{}, nil
+}
+
+func (stdoutSink) Name() string { return sinkStdout }
+
+func (stdoutSink) Write(ctx context.Context, out *RunOutput) error {
+	printReport(out.Results)
+	return nil
+}
+
+// jsonSink writes the JSON results to a file.
+type jsonSink struct {
+	path string
+}
+
+func newJSONSink(value string) (ResultSink, error) {
+	return &jsonSink{path: value}, nil
+}
+
+func (s *jsonSink) Name() string { return sinkJSON }
+
+// Write writes to the path of the sink or, if it has none, to
+// results-[<cluster>-]<backup name>.json.
+func (s *jsonSink) Write(ctx context.Context, out *RunOutput) error {
+	path := s.path
+	if path == "" {
+		name := out.Results.Backup
+		if out.Results.Cluster != "" {
+			name = out.Results.Cluster + "-" + name
+		}
+		path = fmt.Sprintf("results-%s.json", name)
+	}
+	return out.Results.write(outputJSON, path)
+}
+
+// pushgatewaySink pushes the timings of the run, along with the metrics
+// served on --metrics-addr, to a Prometheus Pushgateway.
+type pushgatewaySink struct {
+	url string
+}
+
+func newPushgatewaySink(value string) (ResultSink, error) {
+	if value == "" {
+		return nil, errors.New("missing Pushgateway URL, use pushgateway=<url>")
+	}
+	return &pushgatewaySink{url: value}, nil
+}
+
+func (s *pushgatewaySink) Name() string { return sinkPushgateway }
+
+func (s *pushgatewaySink) Write(ctx context.Context, out *RunOutput) error {
+	r := out.Results
+	failed := 0
+	for _, v := range r.Volumes {
+		if v.Error != "" {
+			failed++
+		}
+	}
+	_, p95 := vsbPercentiles(r)
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"oadp_perf_run_snapshot_seconds", "Snapshot time of the last run.", r.SnapshotTime.Seconds()},
+		{"oadp_perf_run_data_mover_seconds", "Data mover time of the last run.", r.DataMoverTime.Seconds()},
+		{"oadp_perf_run_total_seconds", "Total time of the last run.", r.TotalTime.Seconds()},
+		{"oadp_perf_run_throughput_gib_per_minute", "GiB moved per minute of data mover time by the last run.", r.Throughput},
+		{"oadp_perf_run_volumes", "Number of volumes of the last run.", float64(len(r.Volumes))},
+		{"oadp_perf_run_failed_volumes", "Number of volumes of the last run whose data was not moved.", float64(failed)},
+		{"oadp_perf_run_vsb_duration_p95_seconds", "95th percentile VolumeSnapshotBackup duration of the last run.", p95.Seconds()},
+		{"oadp_perf_run_last_completion_unix_seconds", "When the last run ended.", float64(time.Now().Unix())},
+	}
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "oadp_perf_run_info",
+		Help: "The run the oadp_perf_run_ metrics are of, 1 if it succeeded and 0 if it failed.",
+	}, []string{"run", "mover"})
+	succeeded := 1.0
+	if out.Err != nil {
+		succeeded = 0
+	}
+	info.WithLabelValues(r.Backup, r.Mover).Set(succeeded)
+	metrics := r.metrics
+	if metrics == nil {
+		metrics = newRunMetrics(r.Cluster, "")
+	}
+
+	pusher := push.New(s.url, "oadp_perf").Gatherer(metrics.gatherer()).Collector(info)
+	for _, g := range gauges {
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: g.name, Help: g.help})
+		gauge.Set(g.value)
+		pusher.Collector(gauge)
+	}
+	if metrics.cluster != "" {
+		pusher.Grouping("cluster", metrics.cluster)
+	}
+	if metrics.shard != "" {
+		pusher.Grouping("shard", metrics.shard)
+	}
+	return errors.Wrapf(pusher.Push(), "failed to push to %s", s.url)
+}
+
+// historySink appends the results to a history database for the history
+// command.
+type historySink struct {
+	path string
+}
+
+func newHistorySink(value string) (ResultSink, error) {
+	if value == "" {
+		return nil, errors.New("missing path of the history database, use history=<path>")
+	}
+	return &historySink{path: value}, nil
+}
+
+func (s *historySink) Name() string { return sinkHistory }
+
+func (s *historySink) Write(ctx context.Context, out *RunOutput) error {
+	return recordHistory(s.path, out.Results)
+}
+
+// objectStoreSink uploads the results file and artifacts of the run under
+// [<cluster>/]<backup name>/ of an object store URL.
+type objectStoreSink struct {
+	store *objectStore
+}
+
+func newObjectStoreSink(value string) (ResultSink, error) {
+	store, err := newObjectStore(value)
+	if err != nil {
+		return nil, err
+	}
+	return &objectStoreSink{store: store}, nil
+}
+
+func (s *objectStoreSink) Name() string { return sinkObjectStore }
+
+func (s *objectStoreSink) Write(ctx context.Context, out *RunOutput) error {
+	prefix := path.Join(out.Results.Cluster, out.Results.Backup)
+	if out.ResultsFile != "" {
+		err := s.store.uploadFile(ctx, out.ResultsFile, path.Join(prefix, filepath.Base(out.ResultsFile)))
+		if err != nil {
+			return err
+		}
+	}
+	if out.ArtifactsDir != "" {
+		err := s.store.uploadDir(ctx, out.ArtifactsDir, path.Join(prefix, "artifacts"))
+		if err != nil {
+			return err
+		}
+	}
+	loggerFrom(ctx).Infow("results uploaded", "url", s.store.objectURL(prefix).String())
+	return nil
+}
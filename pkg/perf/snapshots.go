@@ -0,0 +1,134 @@
+package perf
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Reasons of the events the snapshot controller records on a VolumeSnapshot
+// as the CSI driver creates its snapshot.
+const (
+	eventReasonCreatingSnapshot = "CreatingSnapshot"
+	eventReasonSnapshotReady    = "SnapshotReady"
+)
+
+// recordSnapshotTimings works out when the snapshot of each of vscs was
+// asked for, cut and ready, so the latency of every snapshot is known rather
+// than only how long the run polled for all of them. The VolumeSnapshots
+// Velero's CSI plugin created may already be gone once the backup is done, in
+// which case the events the snapshot controller recorded on them and the
+// VSCs themselves stand in for them.
+func recordSnapshotTimings(ctx context.Context, c client.Client, results *runResults, vscs []v1.VolumeSnapshotContent) error {
+	events := map[types.NamespacedName]map[string]time.Time{}
+	listed := map[string]bool{}
+	for i := range vscs {
+		vsc := &vscs[i]
+		ref := types.NamespacedName{Namespace: vsc.Spec.VolumeSnapshotRef.Namespace, Name: vsc.Spec.VolumeSnapshotRef.Name}
+		if ref.Name == "" {
+			continue
+		}
+		if !listed[ref.Namespace] {
+			err := listSnapshotEvents(ctx, c, ref.Namespace, events)
+			if err != nil {
+				return err
+			}
+			listed[ref.Namespace] = true
+		}
+
+		requested := vsc.CreationTimestamp.Time
+		if t, ok := events[ref][eventReasonCreatingSnapshot]; ok && t.Before(requested) {
+			requested = t
+		}
+		vs := v1.VolumeSnapshot{}
+		err := c.Get(ctx, ref, &vs)
+		if err == nil {
+			requested = vs.CreationTimestamp.Time
+		}
+		var cut time.Time
+		if vsc.Status != nil && vsc.Status.CreationTime != nil {
+			cut = time.Unix(0, *vsc.Status.CreationTime)
+		}
+		results.snapshotTimings(vsc.Name, ref.Name, requested, cut, events[ref][eventReasonSnapshotReady])
+	}
+	return nil
+}
+
+// listSnapshotEvents adds the first time each VolumeSnapshot of namespace
+// had an event of each reason to events.
+func listSnapshotEvents(ctx context.Context, c client.Reader, namespace string, events map[types.NamespacedName]map[string]time.Time) error {
+	list := corev1.EventList{}
+	err := c.List(ctx, &list, client.InNamespace(namespace), client.MatchingFields{"involvedObject.kind": "VolumeSnapshot"})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list events of volumesnapshots in namespace %s", namespace)
+	}
+	for _, event := range list.Items {
+		key := types.NamespacedName{Namespace: namespace, Name: event.InvolvedObject.Name}
+		t := event.FirstTimestamp.Time
+		if t.IsZero() {
+			t = event.EventTime.Time
+		}
+		if t.IsZero() {
+			continue
+		}
+		if events[key] == nil {
+			events[key] = map[string]time.Time{}
+		}
+		if seen, ok := events[key][event.Reason]; !ok || t.Before(seen) {
+			events[key][event.Reason] = t
+		}
+	}
+	return nil
+}
+
+// snapshotTimings records when the snapshot of the VSC was asked for with
+// the VolumeSnapshot called vs, cut by the storage and ready to use. Without
+// a ready time from the snapshot controller, the time the run saw the VSC
+// ready stands in for it.
+func (r *runResults) snapshotTimings(vscName, vs string, requested, cut, ready time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.volume(vscName)
+	v.VolumeSnapshot = vs
+	v.SnapshotRequestTime = requested
+	v.SnapshotCreationTime = cut
+	if ready.IsZero() {
+		ready = v.VSCReadyTime
+	}
+	v.SnapshotReadyTime = ready
+	if !requested.IsZero() && !ready.IsZero() && ready.After(requested) {
+		v.SnapshotLatency = ready.Sub(requested)
+	}
+}
+
+// snapshotLatencyStats summarizes how long each snapshot took from its
+// VolumeSnapshot being created until it was ready to use.
+func snapshotLatencyStats(r *runResults) []durationStats {
+	return volumeStats(r, func(v *volumeResult) (time.Duration, bool) {
+		return v.SnapshotLatency, v.SnapshotLatency > 0
+	})
+}
+
+// logSnapshotTimings records the timings of each snapshot of the run and logs
+// their latency percentiles. Failing to work them out does not fail the run.
+func (o *backupOptions) logSnapshotTimings(ctx context.Context, c client.Client, w *runWatcher, results *runResults) {
+	vscList, err := listVolumeSnapshotContents(ctx, w.cache, results.Backup)
+	if err == nil {
+		err = recordSnapshotTimings(ctx, c, results, vscList.Items)
+	}
+	if err != nil {
+		loggerFrom(ctx).Warnw("failed to work out the timings of the snapshots", "phase", phaseSnapshot, "error", err)
+		return
+	}
+	results.mu.Lock()
+	all := snapshotLatencyStats(results)[0]
+	results.mu.Unlock()
+	if all.Count > 0 {
+		loggerFrom(ctx).Infow("snapshot latencies", "phase", phaseSnapshot, "count", all.Count, "min", all.Min.String(), "mean", all.Mean.String(), "p50", all.P50.String(), "p95", all.P95.String(), "max", all.Max.String())
+	}
+}
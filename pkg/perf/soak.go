@@ -0,0 +1,178 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// soak runs the whole backup and data mover cycle o.iterations times, or
+// until interrupted with o.forever, cleaning up each run before the next and
+// pausing o.interval in between. Once it stops it prints the timings of every
+// iteration with their mean, standard deviation and trend, so a restic
+// repository that slows down as it grows shows up as a rising trend.
+func (o *backupOptions) soak(ctx context.Context, c client.Client, out io.Writer) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	soakLogger := loggerFrom(ctx)
+	runs := []*runResults{}
+	var err error
+	for i := 1; o.forever || i <= o.iterations; i++ {
+		ctx := withLogger(ctx, soakLogger.With("iteration", i))
+		loggerFrom(ctx).Infow("starting iteration")
+		var results *runResults
+		results, err = o.backup(ctx, c)
+		if err != nil {
+			err = errors.Wrapf(err, "iteration %d", i)
+			break
+		}
+		runs = append(runs, results)
+		loggerFrom(ctx).Infow("iteration done", "total", results.TotalTime.String())
+		err = thresholdError(ctx, results, o.maxTotalTime, o.maxVSBP95)
+		if err != nil {
+			err = errors.Wrapf(err, "iteration %d", i)
+			break
+		}
+		if !o.forever && i == o.iterations {
+			break
+		}
+
+		// An existing backup is reused by every iteration, which clears
+		// the data mover resources of the one before itself.
+		if o.existingBackup == "" {
+			err = cleanupRun(ctx, c, o.veleroNamespace, results.Backup, false)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to clean up iteration %d", i)
+				break
+			}
+		}
+		if o.interval > 0 {
+			loggerFrom(ctx).Infow("waiting before the next iteration", "interval", o.interval.String())
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(o.interval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(runs) > 0 {
+		printSoak(out, runs)
+	}
+	if ctx.Err() != nil {
+		// Stopping a soak is how a forever run ends.
+		loggerFrom(ctx).Infow("soak interrupted", "iterations", len(runs))
+		return nil
+	}
+	return err
+}
+
+// soakMetric is a timing taken from the results of each iteration.
+type soakMetric struct {
+	name   string
+	value  func(*runResults) float64
+	format func(float64) string
+}
+
+func soakMetrics() []soakMetric {
+	seconds := func(d time.Duration) float64 { return d.Seconds() }
+	duration := func(v float64) string {
+		return (time.Duration(v * float64(time.Second))).Round(time.Second).String()
+	}
+	gibPerMin := func(v float64) string { return fmt.Sprintf("%.2f GiB/min", v) }
+	return []soakMetric{
+		{"snapshot time", func(r *runResults) float64 { return seconds(r.SnapshotTime) }, duration},
+		{"data mover time", func(r *runResults) float64 { return seconds(r.DataMoverTime) }, duration},
+		{"total time", func(r *runResults) float64 { return seconds(r.TotalTime) }, duration},
+		{"vsb p50", func(r *runResults) float64 { p50, _ := vsbPercentiles(r); return seconds(p50) }, duration},
+		{"vsb p95", func(r *runResults) float64 { _, p95 := vsbPercentiles(r); return seconds(p95) }, duration},
+		{"throughput", func(r *runResults) float64 { return r.Throughput }, gibPerMin},
+	}
+}
+
+// printSoak prints the timings of every iteration followed by their
+// aggregates.
+func printSoak(out io.Writer, runs []*runResults) {
+	metrics := soakMetrics()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprint(w, "ITERATION\tBACKUP\t")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "%s\t", m.name)
+	}
+	fmt.Fprintln(w)
+	for i, r := range runs {
+		fmt.Fprintf(w, "%d\t%s\t", i+1, r.Backup)
+		for _, m := range metrics {
+			fmt.Fprintf(w, "%s\t", m.format(m.value(r)))
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\nAcross %d iterations:\n", len(runs))
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tMEAN\tSTDDEV\tMIN\tMAX\tTREND PER ITERATION\t")
+	for _, m := range metrics {
+		values := make([]float64, len(runs))
+		for i, r := range runs {
+			values[i] = m.value(r)
+		}
+		mean, stddev := meanStddev(values)
+		min, max := values[0], values[0]
+		for _, v := range values {
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+		}
+		trend := slope(values)
+		sign := "+"
+		if trend < 0 {
+			sign = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s%s\t\n", m.name, m.format(mean), m.format(stddev), m.format(min), m.format(max), sign, m.format(math.Abs(trend)))
+	}
+	w.Flush()
+}
+
+// meanStddev returns the mean and population standard deviation of values.
+func meanStddev(values []float64) (float64, float64) {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)))
+}
+
+// slope returns the least squares slope of values against their index, how
+// much they change per iteration on average.
+func slope(values []float64) float64 {
+	n := float64(len(values))
+	if n < 2 {
+		return 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i, v := range values {
+		x := float64(i)
+		sumX += x
+		sumY += v
+		sumXY += x * v
+		sumXX += x * x
+	}
+	return (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+}
@@ -0,0 +1,221 @@
+package perf
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+)
+
+// durationStats summarizes the durations of a group of volumes.
+type durationStats struct {
+	// Group is the namespace of the volumes, or "all".
+	Group string
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+const statsGroupAll = "all"
+
+// newDurationStats summarizes durations, taking percentiles by nearest rank.
+func newDurationStats(group string, durations []time.Duration) durationStats {
+	s := durationStats{Group: group, Count: len(durations)}
+	if len(durations) == 0 {
+		return s
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	percentile := func(p int) time.Duration {
+		rank := (p*len(sorted) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		return sorted[rank-1]
+	}
+	s.Min = sorted[0]
+	s.Max = sorted[len(sorted)-1]
+	s.Mean = total / time.Duration(len(sorted))
+	s.P50 = percentile(50)
+	s.P90 = percentile(90)
+	s.P95 = percentile(95)
+	s.P99 = percentile(99)
+	return s
+}
+
+// volumeStats summarizes the durations value returns for the volumes of r,
+// skipping those it returns false for: first over all of them, then per
+// namespace when there is more than one. Like every stats helper built on it,
+// the caller must hold r.mu if the run is still going.
+func volumeStats(r *runResults, value func(*volumeResult) (time.Duration, bool)) []durationStats {
+	all := []time.Duration{}
+	byNamespace := map[string][]time.Duration{}
+	for _, v := range r.Volumes {
+		d, ok := value(v)
+		if !ok {
+			continue
+		}
+		all = append(all, d)
+		byNamespace[v.Namespace] = append(byNamespace[v.Namespace], d)
+	}
+	stats := []durationStats{newDurationStats(statsGroupAll, all)}
+	if len(byNamespace) < 2 {
+		return stats
+	}
+	namespaces := make([]string, 0, len(byNamespace))
+	for ns := range byNamespace {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		stats = append(stats, newDurationStats(ns, byNamespace[ns]))
+	}
+	return stats
+}
+
+// vsbDurationStats summarizes the durations of the VSBs that completed.
+func vsbDurationStats(r *runResults) []durationStats {
+	return volumeStats(r, func(v *volumeResult) (time.Duration, bool) {
+		return v.VSBDuration, v.Error == "" && !v.VSBCompletionTime.IsZero()
+	})
+}
+
+// vscReadyStats summarizes how long after the start of the run each VSC
+// became ready to use.
+func vscReadyStats(r *runResults) []durationStats {
+	return volumeStats(r, func(v *volumeResult) (time.Duration, bool) {
+		return v.VSCReadyTime.Sub(r.StartTime), !v.VSCReadyTime.IsZero()
+	})
+}
+
+// queueDurationStats summarizes how long VSBs waited for the data mover to
+// take them in progress, so queueing in the controller can be told apart from
+// slow transfers.
+func queueDurationStats(r *runResults) []durationStats {
+	return volumeStats(r, func(v *volumeResult) (time.Duration, bool) {
+		_, seen := v.PhaseTimes[dmv1.SnapMoverBackupPhaseInProgress]
+		return v.QueueDuration, seen && !v.VSBStartTime.IsZero()
+	})
+}
+
+// syncDurationStats summarizes the sync durations volsync reported for the
+// ReplicationSources of the VSBs.
+func syncDurationStats(r *runResults) []durationStats {
+	return volumeStats(r, func(v *volumeResult) (time.Duration, bool) {
+		return v.LastSyncDuration, v.LastSyncDuration > 0
+	})
+}
+
+// printDurationStats prints stats as a table under title, or nothing if there
+// are no durations.
+func printDurationStats(out io.Writer, title string, stats []durationStats) {
+	if len(stats) == 0 || stats[0].Count == 0 {
+		return
+	}
+	fmt.Fprintf(out, "%s:\n", title)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tCOUNT\tMIN\tMEAN\tP50\tP90\tP95\tP99\tMAX\t")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", s.Group, s.Count, s.Min.Round(time.Second), s.Mean.Round(time.Second), s.P50.Round(time.Second), s.P90.Round(time.Second), s.P95.Round(time.Second), s.P99.Round(time.Second), s.Max.Round(time.Second))
+	}
+	w.Flush()
+}
+
+// namespaceSummary aggregates the volumes of one namespace, so a run over
+// several applications shows which one's volumes are slow.
+type namespaceSummary struct {
+	Namespace string `json:"namespace"`
+	Volumes   int    `json:"volumes"`
+	Failed    int    `json:"failed,omitempty"`
+	// SizeBytes is the data of the volumes whose VSB completed.
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+	// VSBTime is the sum of the durations of the VSBs that completed.
+	VSBTime time.Duration `json:"vsbTime,omitempty"`
+	P95     time.Duration `json:"vsbP95,omitempty"`
+	// Throughput is SizeBytes per minute from the start of the first VSB
+	// of the namespace until the last one completed.
+	Throughput float64 `json:"throughputGiBPerMinute,omitempty"`
+}
+
+// namespaceSummaries aggregates the volumes of r by namespace, in namespace
+// order. The caller must hold r.mu.
+func namespaceSummaries(r *runResults) []namespaceSummary {
+	byNamespace := map[string]*namespaceSummary{}
+	durations := map[string][]time.Duration{}
+	first := map[string]time.Time{}
+	last := map[string]time.Time{}
+	for _, v := range r.Volumes {
+		s := byNamespace[v.Namespace]
+		if s == nil {
+			s = &namespaceSummary{Namespace: v.Namespace}
+			byNamespace[v.Namespace] = s
+		}
+		s.Volumes++
+		if v.Error != "" {
+			s.Failed++
+			continue
+		}
+		if v.VSBCompletionTime.IsZero() {
+			continue
+		}
+		s.SizeBytes += v.bytes()
+		s.VSBTime += v.VSBDuration
+		durations[v.Namespace] = append(durations[v.Namespace], v.VSBDuration)
+		if start := first[v.Namespace]; start.IsZero() || v.VSBStartTime.Before(start) {
+			first[v.Namespace] = v.VSBStartTime
+		}
+		if v.VSBCompletionTime.After(last[v.Namespace]) {
+			last[v.Namespace] = v.VSBCompletionTime
+		}
+	}
+
+	summaries := make([]namespaceSummary, 0, len(byNamespace))
+	for ns, s := range byNamespace {
+		s.P95 = newDurationStats(ns, durations[ns]).P95
+		if !first[ns].IsZero() {
+			s.Throughput = gibPerMinute(s.SizeBytes, last[ns].Sub(first[ns]))
+		}
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Namespace < summaries[j].Namespace
+	})
+	return summaries
+}
+
+// printNamespaceSummaries prints summaries as a table, or nothing if the run
+// covered a single namespace.
+func printNamespaceSummaries(out io.Writer, summaries []namespaceSummary) {
+	if len(summaries) < 2 {
+		return
+	}
+	fmt.Fprintln(out, "Namespaces:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tVOLUMES\tFAILED\tSIZE\tVSB TIME\tVSB P95\tGIB/MIN\t")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%v\t%v\t%.2f\t\n", s.Namespace, s.Volumes, s.Failed, formatBytes(s.SizeBytes), s.VSBTime.Round(time.Second), s.P95.Round(time.Second), s.Throughput)
+	}
+	w.Flush()
+}
+
+// vsrDurationStats summarizes the durations of the VSRs that completed, to
+// compare with vsbDurationStats.
+func vsrDurationStats(r *runResults) []durationStats {
+	return volumeStats(r, func(v *volumeResult) (time.Duration, bool) {
+		return v.VSRDuration, v.RestoreError == "" && !v.VSRCompletionTime.IsZero()
+	})
+}
@@ -0,0 +1,108 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type statusOptions struct {
+	*rootOptions
+	run string
+}
+
+func newStatusCommand(root *rootOptions) *cobra.Command {
+	o := &statusOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the progress of a run",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.run == "" {
+				return errors.New("missing run flag")
+			}
+			c, err := o.client(cmd.Context())
+			if err != nil {
+				return err
+			}
+			err = o.resolveVeleroNamespace(cmd.Context(), c)
+			if err != nil {
+				return err
+			}
+			return printStatus(cmd.Context(), c, o.veleroNamespace, o.run)
+		},
+	}
+	cmd.Flags().StringVar(&o.run, "run", "", "name of the backup created by the run")
+	return cmd
+}
+
+// printStatus prints the Velero backup phase of the run along with how many
+// of its VSCs are ready and how many VSBs and VSRs are in each phase.
+func printStatus(ctx context.Context, c client.Client, veleroNamespace, name string) error {
+	backup := velerov1.Backup{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: veleroNamespace}, &backup)
+	if err != nil {
+		return errors.Wrap(err, "failed to get backup")
+	}
+	fmt.Printf("Backup:  %s/%s\n", veleroNamespace, name)
+	fmt.Printf("Phase:   %v\n", backup.Status.Phase)
+
+	vscList, err := listVolumeSnapshotContents(ctx, c, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to list volumesnapshotcontents")
+	}
+	ready := 0
+	for _, vsc := range vscList.Items {
+		if vsc.Status != nil && vsc.Status.ReadyToUse != nil && *vsc.Status.ReadyToUse {
+			ready++
+		}
+	}
+	fmt.Printf("VSCs:    %v ready of %v\n", ready, len(vscList.Items))
+
+	vsbList, err := listVolumeSnapshotBackups(ctx, c, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to list volumesnapshotbackups")
+	}
+	vsbPhases := map[string]int{}
+	for _, vsb := range vsbList.Items {
+		vsbPhases[string(vsb.Status.Phase)]++
+	}
+	fmt.Printf("VSBs:    %v total%s\n", len(vsbList.Items), formatPhaseCounts(vsbPhases))
+
+	vsrList, err := listVolumeSnapshotRestores(ctx, c, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to list volumesnapshotrestores")
+	}
+	vsrPhases := map[string]int{}
+	for _, vsr := range vsrList.Items {
+		vsrPhases[string(vsr.Status.Phase)]++
+	}
+	fmt.Printf("VSRs:    %v total%s\n", len(vsrList.Items), formatPhaseCounts(vsrPhases))
+	return nil
+}
+
+func formatPhaseCounts(phases map[string]int) string {
+	if len(phases) == 0 {
+		return ""
+	}
+	names := []string{}
+	for phase := range phases {
+		names = append(names, phase)
+	}
+	sort.Strings(names)
+	counts := []string{}
+	for _, phase := range names {
+		label := phase
+		if label == "" {
+			label = "New"
+		}
+		counts = append(counts, fmt.Sprintf("%s: %v", label, phases[phase]))
+	}
+	return " (" + strings.Join(counts, ", ") + ")"
+}
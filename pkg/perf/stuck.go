@@ -0,0 +1,98 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// errVSBStalled is returned while waiting on a VSB whose status has not
+// changed for longer than the stall timeout.
+var errVSBStalled = errors.New("volumesnapshotbackup stopped making progress")
+
+// stallTracker remembers when each VSB last changed status so VSBs that stop
+// making progress can be told apart from ones that are just slow. A nil
+// tracker or a zero timeout never reports a stall.
+type stallTracker struct {
+	timeout time.Duration
+
+	mu   sync.Mutex
+	seen map[types.NamespacedName]progress
+}
+
+type progress struct {
+	fingerprint string
+	since       time.Time
+}
+
+func newStallTracker(timeout time.Duration) *stallTracker {
+	return &stallTracker{
+		timeout: timeout,
+		seen:    map[types.NamespacedName]progress{},
+	}
+}
+
+// stalled records the current status of vsb and reports whether it has been
+// unchanged for longer than the timeout.
+func (t *stallTracker) stalled(vsb *dmv1.VolumeSnapshotBackup, now time.Time) bool {
+	if t == nil || t.timeout == 0 {
+		return false
+	}
+	key := types.NamespacedName{Namespace: vsb.Namespace, Name: vsb.Name}
+	fingerprint := fmt.Sprintf("%s/%v/%v", vsb.Status.Phase, len(vsb.Status.Conditions), lastTransitionTime(vsb.Status.Conditions))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.seen[key]
+	if !ok || p.fingerprint != fingerprint {
+		t.seen[key] = progress{fingerprint: fingerprint, since: now}
+		return false
+	}
+	return now.Sub(p.since) > t.timeout
+}
+
+// logStuckVSB logs everything useful for working out why vsb stopped making
+// progress: its phase and conditions and the state of its volsync mover
+// pods in the Velero namespace.
+func logStuckVSB(ctx context.Context, c client.Client, veleroNamespace string, vsb *dmv1.VolumeSnapshotBackup) {
+	log := loggerFrom(ctx).With("phase", phaseDataMover, "namespace", vsb.Namespace, "vsb", vsb.Name)
+	log.Warnw("VSB stopped making progress", "vsbPhase", vsb.Status.Phase)
+	for _, condition := range vsb.Status.Conditions {
+		log.Warnw("VSB condition", "type", condition.Type, "status", condition.Status, "reason", condition.Reason, "since", condition.LastTransitionTime.Time, "message", condition.Message)
+	}
+
+	// The data mover names the ReplicationSource <vsb>-rep-src and volsync
+	// runs it as the job volsync-src-<replicationsource>.
+	jobName := fmt.Sprintf("volsync-src-%s-rep-src", vsb.Name)
+	pods := corev1.PodList{}
+	err := c.List(ctx, &pods, client.InNamespace(veleroNamespace), client.MatchingLabels{"job-name": jobName})
+	if err != nil {
+		log.Errorw("failed to list mover pods", "error", err)
+		return
+	}
+	if len(pods.Items) == 0 {
+		log.Warnw("no mover pods found", "job", jobName, "veleroNamespace", veleroNamespace)
+		return
+	}
+	for _, pod := range pods.Items {
+		podLog := log.With("pod", pod.Name, "podNamespace", pod.Namespace)
+		podLog.Warnw("mover pod", "podPhase", pod.Status.Phase, "node", pod.Spec.NodeName)
+		for _, status := range pod.Status.ContainerStatuses {
+			switch {
+			case status.State.Waiting != nil:
+				podLog.Warnw("mover container waiting", "container", status.Name, "reason", status.State.Waiting.Reason, "message", status.State.Waiting.Message)
+			case status.State.Terminated != nil:
+				podLog.Warnw("mover container terminated", "container", status.Name, "reason", status.State.Terminated.Reason, "exitCode", status.State.Terminated.ExitCode)
+			default:
+				podLog.Warnw("mover container running", "container", status.Name, "restarts", status.RestartCount)
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type sweepOptions struct {
+	*rootOptions
+	namespaces       string
+	namespacesFile   string
+	backup           string
+	concurrencies    []int
+	resticSecretName string
+	schedule         string
+	order            string
+	output           string
+	stallTimeout     time.Duration
+	cleanup          bool
+	skipPreflight    bool
+}
+
+// sweepPoint is the outcome of running the data mover at one concurrency.
+type sweepPoint struct {
+	concurrency int
+	results     *runResults
+	err         error
+}
+
+func newSweepCommand(root *rootOptions) *cobra.Command {
+	o := &sweepOptions{rootOptions: root}
+	cmd := &cobra.Command{
+		Use:   "sweep",
+		Short: "Run the data mover against the same snapshots at several concurrencies and compare their throughput",
+		Long: `Take the CSI snapshots of the namespaces once, or use those of an existing
+backup, then run the volsync data mover against them at each of the given
+concurrencies in turn and print a table of throughput against concurrency.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd.Context(), cmd.Flags())
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.namespaces, "namespaces", "", "comma separated list of namespaces to backup")
+	flags.StringVar(&o.namespacesFile, "namespaces-file", "", "path to a file listing namespaces to backup, one per line")
+	flags.StringVar(&o.backup, "backup", "", "completed backup whose volumesnapshotcontents to sweep instead of taking new snapshots of namespaces")
+	flags.IntSliceVar(&o.concurrencies, "concurrencies", []int{4, 8, 12, 24}, "comma separated concurrencies to run the data mover at, in order")
+	flags.StringVar(&o.resticSecretName, "restic-secret", defaultResticSecretName, "name of restic secret for volsync to use, <dpa-name>-volsync-restic of the DataProtectionApplication if not set")
+	flags.StringVar(&o.schedule, "schedule", scheduleWindow, "how volumesnapshotbackups are scheduled, window or batch")
+	flags.StringVar(&o.order, "order", "", "order to queue volumesnapshotcontents for volumesnapshotbackups in: largest-first, smallest-first or random")
+	flags.StringVar(&o.output, "output", "", "also write the results of each concurrency in this format, json, csv or junit")
+	flags.DurationVar(&o.stallTimeout, "vsb-stall-timeout", 0, "give up on a volumesnapshotbackup whose status has not changed for this long, disabled if 0")
+	flags.BoolVar(&o.cleanup, "cleanup", true, "delete the backup taken for the sweep once it is done, never the one given with --backup")
+	flags.BoolVar(&o.skipPreflight, "skip-preflight", false, "do not run the preflight checks before starting")
+	return cmd
+}
+
+func (o *sweepOptions) validate() error {
+	if len(o.concurrencies) == 0 {
+		return errors.New("missing concurrencies")
+	}
+	for _, n := range o.concurrencies {
+		if n < 1 {
+			return errors.Errorf("concurrency %d must be at least 1", n)
+		}
+	}
+	if o.backup == "" && o.namespaces == "" && o.namespacesFile == "" {
+		return errors.New("either backup or namespaces must be set")
+	}
+	if o.backup != "" && (o.namespaces != "" || o.namespacesFile != "") {
+		return errors.New("backup cannot be used with namespaces, they are taken from the backup")
+	}
+	// The rest of the flags are checked as the options of each backup.
+	return o.backupOptions(o.concurrencies[0]).validate()
+}
+
+// backupOptions returns the options of the data mover run at concurrency.
+func (o *sweepOptions) backupOptions(concurrency int) *backupOptions {
+	b := newBackupOptions(o.rootOptions)
+	b.resticSecretName = o.resticSecretName
+	b.namespaces = o.namespaces
+	b.namespacesFile = o.namespacesFile
+	b.concurrency = concurrency
+	b.schedule = o.schedule
+	b.order = o.order
+	b.output = o.output
+	b.stallTimeout = o.stallTimeout
+	b.onFailure = onFailureContinue
+	b.existingBackup = o.backup
+	return b
+}
+
+func (o *sweepOptions) run(ctx context.Context, flags *pflag.FlagSet) error {
+	err := o.validate()
+	if err != nil {
+		return err
+	}
+	c, err := o.client(ctx)
+	if err != nil {
+		return err
+	}
+	err = o.resolveVeleroNamespace(ctx, c)
+	if err != nil {
+		return err
+	}
+	resticSecretName, _ := unsetFlags(flags, &o.resticSecretName, nil)
+	err = o.applyDPADefaults(ctx, c, resticSecretName, nil, false)
+	if err != nil {
+		return err
+	}
+	if !o.skipPreflight {
+		err = runPreflight(ctx, c, o.veleroNamespace, o.resticSecretName, moverVSM, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	base := loggerFrom(ctx)
+	name := o.backup
+	if name == "" {
+		snapshots := o.backupOptions(o.concurrencies[0])
+		snapshots.snapshotOnly = true
+		snapshots.existingBackup = ""
+		results, err := snapshots.backup(ctx, c)
+		if err != nil {
+			return errors.Wrap(err, "failed to take the snapshots to sweep")
+		}
+		name = results.Backup
+		if o.cleanup {
+			defer func() {
+				err := cleanupRun(ctx, c, o.veleroNamespace, name, false)
+				if err != nil {
+					loggerFrom(ctx).Errorw("failed to clean up", "run", name, "error", err)
+				}
+			}()
+		}
+	}
+
+	points := []sweepPoint{}
+	for _, concurrency := range o.concurrencies {
+		ctx := withLogger(ctx, base.With("concurrency", concurrency))
+		loggerFrom(ctx).Infow("starting concurrency")
+		b := o.backupOptions(concurrency)
+		b.existingBackup = name
+		results, err := b.backup(ctx, c)
+		if err != nil {
+			loggerFrom(ctx).Errorw("concurrency failed", "error", err)
+		}
+		points = append(points, sweepPoint{concurrency: concurrency, results: results, err: err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	printSweep(os.Stdout, name, points)
+	return nil
+}
+
+// printSweep prints the data mover timings and throughput of each
+// concurrency, marking the one with the highest throughput.
+func printSweep(out io.Writer, backup string, points []sweepPoint) {
+	best := -1
+	for i, p := range points {
+		if p.err != nil || p.results == nil {
+			continue
+		}
+		if best < 0 || p.results.Throughput > points[best].results.Throughput {
+			best = i
+		}
+	}
+
+	fmt.Fprintf(out, "Sweep of backup %s:\n", backup)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONCURRENCY\tVOLUMES\tFAILED\tDATA MOVER TIME\tVSB P50\tVSB P95\tGIB/MIN\t\tERROR")
+	for i, p := range points {
+		volumes, failed := 0, 0
+		var transfer, p50, p95 time.Duration
+		var throughput float64
+		if p.results != nil {
+			volumes = len(p.results.Volumes)
+			for _, v := range p.results.Volumes {
+				if v.Error != "" {
+					failed++
+				}
+			}
+			transfer = p.results.DataMoverTime
+			p50, p95 = vsbPercentiles(p.results)
+			throughput = p.results.Throughput
+		}
+		mark := ""
+		if i == best {
+			mark = "best"
+		}
+		errMsg := ""
+		if p.err != nil {
+			errMsg = p.err.Error()
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%v\t%v\t%v\t%.2f\t%s\t%s\n", p.concurrency, volumes, failed, transfer.Round(time.Second), p50.Round(time.Second), p95.Round(time.Second), throughput, mark, errMsg)
+	}
+	w.Flush()
+}
@@ -0,0 +1,361 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// otlpTimeout bounds the export of the trace of a run.
+const otlpTimeout = 30 * time.Second
+
+// otlpSink exports the run as an OpenTelemetry trace to an OTLP/HTTP
+// collector, using the JSON encoding so it needs no OpenTelemetry SDK. The
+// spans are built from the timings in the results once the run ends, so
+// they line up exactly with the results file: the Velero backup and its
+// phases, the snapshots and the wait for each VSC, the data mover with a span
+// per batch and per VSB, split into setup, transfer and cleanup, and the
+// deletion of the backup.
+type otlpSink struct {
+	url string
+}
+
+func newOTLPSink(value string) (ResultSink, error) {
+	if value == "" {
+		return nil, errors.New("missing OTLP endpoint, use otlp=<url>")
+	}
+	if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+		return nil, errors.Errorf("OTLP endpoint %q must be an http:// or https:// URL", value)
+	}
+	url := strings.TrimSuffix(value, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &otlpSink{url: url}, nil
+}
+
+func (s *otlpSink) Name() string { return sinkOTLP }
+
+func (s *otlpSink) Write(ctx context.Context, out *RunOutput) error {
+	t := newRunTrace(out.Results, out.Err)
+
+	body, err := json.Marshal(t.export())
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal trace")
+	}
+	ctx, cancel := context.WithTimeout(ctx, otlpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create trace export request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to export trace to %s", s.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("failed to export trace to %s: %s", s.url, resp.Status)
+	}
+	loggerFrom(ctx).Infow("trace exported", "traceID", t.traceID, "spans", len(t.spans))
+	return nil
+}
+
+// traceSpan is a span of the trace of a run.
+type traceSpan struct {
+	id, parent string
+	name       string
+	start, end time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+// runTrace is the trace of a run.
+type runTrace struct {
+	traceID string
+	spans   []*traceSpan
+}
+
+// span adds a span under parent, or a root span if parent is nil. Spans whose
+// start is unknown are left out and nil is returned, and those that would end
+// before they start end at their start.
+func (t *runTrace) span(parent *traceSpan, name string, start, end time.Time, attributes map[string]interface{}) *traceSpan {
+	if start.IsZero() {
+		return nil
+	}
+	if end.Before(start) {
+		end = start
+	}
+	s := &traceSpan{id: randomHex(8), name: name, start: start, end: end, attributes: attributes}
+	if parent != nil {
+		s.parent = parent.id
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// newRunTrace builds the trace of r, which ended with runErr. r must not be
+// changing, such as the snapshot the sinks are given.
+func newRunTrace(r *runResults, runErr error) *runTrace {
+	t := &runTrace{traceID: randomHex(16)}
+	end := r.DataMoverEndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	if d := r.Deletion; d != nil {
+		end = laterOf(end, laterOf(d.BackupDeletedTime, d.SnapshotsDeletedTime))
+	}
+
+	root := t.span(nil, "backup "+r.Backup, r.StartTime, end, map[string]interface{}{
+		"oadp_perf.run":         r.Backup,
+		"oadp_perf.cluster":     r.Cluster,
+		"oadp_perf.mover":       r.Mover,
+		"oadp_perf.concurrency": r.Concurrency,
+		"oadp_perf.schedule":    r.Schedule,
+		"oadp_perf.namespaces":  strings.Join(r.Namespaces, ","),
+		"oadp_perf.volumes":     len(r.Volumes),
+	})
+	if root == nil {
+		return t
+	}
+	if runErr != nil {
+		root.err = runErr.Error()
+	}
+
+	snapshotEnd := r.SnapshotEndTime
+	if snapshotEnd.IsZero() {
+		snapshotEnd = end
+	}
+	if b := r.VeleroBackup; b != nil && len(b.Phases) > 0 {
+		backupEnd := b.Phases[len(b.Phases)-1].Time
+		if !b.CompletionTimestamp.IsZero() {
+			backupEnd = laterOf(backupEnd, b.CompletionTimestamp)
+		}
+		backup := t.span(root, "velero backup", r.StartTime, backupEnd, map[string]interface{}{
+			"velero.items_backed_up": b.ItemsBackedUp,
+			"velero.warnings":        b.Warnings,
+			"velero.errors":          b.Errors,
+		})
+		for i, p := range b.Phases {
+			phaseEnd := backupEnd
+			if i+1 < len(b.Phases) {
+				phaseEnd = b.Phases[i+1].Time
+			}
+			t.span(backup, "phase "+string(p.Phase), p.Time, phaseEnd, nil)
+		}
+		if backup != nil && b.FailureReason != "" {
+			backup.err = b.FailureReason
+		}
+	}
+
+	snapshots := t.span(root, "volumesnapshotcontents", r.StartTime, snapshotEnd, nil)
+	for _, v := range r.Volumes {
+		if v.VSCReadyTime.IsZero() {
+			continue
+		}
+		t.span(snapshots, "vsc "+v.VolumeSnapshotContent, r.StartTime, v.VSCReadyTime, map[string]interface{}{
+			"k8s.namespace.name": v.Namespace,
+			"oadp_perf.pvc":      v.PVC,
+			"oadp_perf.bytes":    v.SizeBytes,
+		})
+	}
+
+	if !r.SnapshotEndTime.IsZero() && r.Mover != modeCSI {
+		dataMoverEnd := r.DataMoverEndTime
+		if dataMoverEnd.IsZero() {
+			dataMoverEnd = end
+		}
+		dataMover := t.span(root, "data mover", r.SnapshotEndTime, dataMoverEnd, nil)
+		batches := map[int]*traceSpan{}
+		for _, b := range volumeBatches(r.Volumes, dataMoverEnd) {
+			batches[b.batch] = t.span(dataMover, fmt.Sprintf("batch %d", b.batch), b.start, b.end, map[string]interface{}{
+				"oadp_perf.batch":   b.batch,
+				"oadp_perf.volumes": b.volumes,
+			})
+		}
+		for _, v := range r.Volumes {
+			parent := dataMover
+			if b := batches[v.Batch]; b != nil {
+				parent = b
+			}
+			vsbEnd := v.VSBCompletionTime
+			if vsbEnd.IsZero() {
+				vsbEnd = dataMoverEnd
+			}
+			vsb := t.span(parent, "vsb "+v.VolumeSnapshotBackup, v.VSBStartTime, vsbEnd, map[string]interface{}{
+				"k8s.namespace.name":              v.Namespace,
+				"oadp_perf.pvc":                   v.PVC,
+				"oadp_perf.volumesnapshotcontent": v.VolumeSnapshotContent,
+				"oadp_perf.replicationsource":     v.ReplicationSource,
+				"oadp_perf.bytes":                 v.bytes(),
+				"oadp_perf.stalled":               v.Stalled,
+			})
+			if vsb == nil {
+				continue
+			}
+			vsb.err = v.Error
+			start := v.VSBStartTime
+			for _, phase := range []struct {
+				name     string
+				duration time.Duration
+			}{
+				{"queue", v.QueueDuration},
+				{"setup", v.SetupDuration},
+				{"transfer", v.TransferDuration},
+				{"cleanup", v.CleanupDuration},
+			} {
+				if phase.duration <= 0 {
+					continue
+				}
+				t.span(vsb, phase.name, start, start.Add(phase.duration), nil)
+				start = start.Add(phase.duration)
+			}
+		}
+	}
+
+	if d := r.Deletion; d != nil {
+		deletion := t.span(root, "deletion", d.RequestTime, laterOf(d.BackupDeletedTime, d.SnapshotsDeletedTime), map[string]interface{}{
+			"oadp_perf.volumesnapshotcontents": d.VolumeSnapshotContents,
+		})
+		if !d.BackupDeletedTime.IsZero() {
+			t.span(deletion, "backup deletion", d.RequestTime, d.BackupDeletedTime, nil)
+		}
+		if !d.SnapshotsDeletedTime.IsZero() {
+			t.span(deletion, "snapshot garbage collection", d.RequestTime, d.SnapshotsDeletedTime, nil)
+		}
+	}
+	return t
+}
+
+// volumeBatch is the span of the VSBs scheduled in the same batch.
+type volumeBatch struct {
+	batch      int
+	start, end time.Time
+	volumes    int
+}
+
+// volumeBatches returns the batches of the volumes that started a VSB, in
+// order, from the first VSB of each starting to the last one completing. VSBs
+// that did not complete end at end.
+func volumeBatches(volumes []*volumeResult, end time.Time) []volumeBatch {
+	byBatch := map[int]*volumeBatch{}
+	for _, v := range volumes {
+		if v.Batch == 0 || v.VSBStartTime.IsZero() {
+			continue
+		}
+		completion := v.VSBCompletionTime
+		if completion.IsZero() {
+			completion = end
+		}
+		b, ok := byBatch[v.Batch]
+		if !ok {
+			b = &volumeBatch{batch: v.Batch, start: v.VSBStartTime, end: completion}
+			byBatch[v.Batch] = b
+		}
+		if v.VSBStartTime.Before(b.start) {
+			b.start = v.VSBStartTime
+		}
+		b.end = laterOf(b.end, completion)
+		b.volumes++
+	}
+	batches := []volumeBatch{}
+	for _, b := range byBatch {
+		batches = append(batches, *b)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].batch < batches[j].batch })
+	return batches
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// export returns the trace as an OTLP ExportTraceServiceRequest in its JSON
+// encoding.
+func (t *runTrace) export() map[string]interface{} {
+	spans := []map[string]interface{}{}
+	for _, s := range t.spans {
+		span := map[string]interface{}{
+			"traceId":           t.traceID,
+			"spanId":            s.id,
+			"name":              s.name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.parent != "" {
+			span["parentSpanId"] = s.parent
+		}
+		if s.err != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.err} // STATUS_CODE_ERROR
+		}
+		spans = append(spans, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": "oadp-perf"}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/dymurray/perf"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlpAttributes converts attributes to OTLP KeyValues, in key order and
+// leaving out empty strings.
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	kvs := []interface{}{}
+	for _, key := range keys {
+		var value map[string]interface{}
+		switch v := attributes[key].(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+			value = map[string]interface{}{"stringValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, map[string]interface{}{"key": key, "value": value})
+	}
+	return kvs
+}
@@ -0,0 +1,278 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/term"
+)
+
+const (
+	// statusRefresh is how often the status display is redrawn.
+	statusRefresh = time.Second
+	// statusBatches and statusVSBs cap the batches and running VSBs the
+	// status display lists, so it fits on a screen.
+	statusBatches = 5
+	statusVSBs    = 10
+	// statusLogLines is the number of recent log messages shown below the
+	// status.
+	statusLogLines = 5
+)
+
+var spinner = []string{"|", "/", "-", "\\"}
+
+// statusDisplay redraws a live summary of a run on a terminal: the batches,
+// how many VSBs are pending, running, completed and failed, a spinner for
+// each running VSB, the elapsed time and an estimate of the time left. Log
+// messages are shown below it instead of scrolling it away.
+type statusDisplay struct {
+	out         *os.File
+	results     *runResults
+	concurrency int
+	// logger writes to the log tail and the log file, for the run to log
+	// to while the display is shown.
+	logger  *zap.SugaredLogger
+	logs    *logTail
+	logFile *os.File
+
+	done     chan struct{}
+	stopped  sync.WaitGroup
+	stopOnce sync.Once
+	// lines is the height of the last frame, which is cleared before the
+	// next one is drawn.
+	lines int
+	tick  int
+}
+
+// startStatusDisplay starts redrawing the status of results on stderr. The
+// messages logged through the context of the display go below it and to
+// logFile in full instead. It returns nil, leaving the logs as they are,
+// when stderr is not a terminal.
+func startStatusDisplay(ctx context.Context, results *runResults, concurrency int, logFile string) (*statusDisplay, error) {
+	if !term.IsTerminal(int(os.Stderr.Fd())) {
+		loggerFrom(ctx).Infow("stderr is not a terminal, logging progress instead of showing the status display")
+		return nil, nil
+	}
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open log file %s", logFile)
+	}
+	d := &statusDisplay{
+		out:         os.Stderr,
+		results:     results,
+		concurrency: concurrency,
+		logs:        &logTail{},
+		logFile:     f,
+		done:        make(chan struct{}),
+	}
+	fileEncoder := zapcore.NewJSONEncoder(logConfig.EncoderConfig)
+	if logConfig.Encoding == "console" {
+		fileEncoder = zapcore.NewConsoleEncoder(logConfig.EncoderConfig)
+	}
+	d.logger = loggerFrom(ctx).Desugar().WithOptions(zap.WrapCore(func(zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(
+			zapcore.NewCore(zapcore.NewConsoleEncoder(logConfig.EncoderConfig), zapcore.AddSync(d.logs), logConfig.Level),
+			zapcore.NewCore(fileEncoder, zapcore.AddSync(f), logConfig.Level),
+		)
+	})).Sugar()
+
+	d.stopped.Add(1)
+	go func() {
+		defer d.stopped.Done()
+		ticker := time.NewTicker(statusRefresh)
+		defer ticker.Stop()
+		for {
+			d.draw()
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return d, nil
+}
+
+// context returns ctx carrying the logger of the display, or ctx itself if
+// there is no display.
+func (d *statusDisplay) context(ctx context.Context) context.Context {
+	if d == nil {
+		return ctx
+	}
+	return withLogger(ctx, d.logger)
+}
+
+// stop draws the final status and hands the terminal back to the logs. It
+// may be called more than once.
+func (d *statusDisplay) stop() {
+	if d == nil {
+		return
+	}
+	d.stopOnce.Do(func() {
+		close(d.done)
+		d.stopped.Wait()
+		d.draw()
+		d.logFile.Close()
+	})
+}
+
+func (d *statusDisplay) draw() {
+	width := 0
+	if w, _, err := term.GetSize(int(d.out.Fd())); err == nil {
+		width = w
+	}
+	frame := d.frame(time.Now())
+	buf := bytes.Buffer{}
+	if d.lines > 0 {
+		// move to the start of the last frame and clear it
+		fmt.Fprintf(&buf, "\x1b[%dA\r\x1b[J", d.lines)
+	}
+	for _, line := range frame {
+		if width > 0 && len(line) >= width {
+			line = line[:width-1]
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	d.lines = len(frame)
+	d.tick++
+	d.out.Write(buf.Bytes())
+}
+
+// frame renders the status at now as lines of text.
+func (d *statusDisplay) frame(now time.Time) []string {
+	r := d.results
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type batchCounts struct{ volumes, running, completed, failed int }
+	batches := map[int]*batchCounts{}
+	var ready, pending, running, completed, failed int
+	active := []*volumeResult{}
+	for _, v := range r.Volumes {
+		if !v.VSCReadyTime.IsZero() {
+			ready++
+		}
+		b := batches[v.Batch]
+		if b == nil {
+			b = &batchCounts{}
+			batches[v.Batch] = b
+		}
+		switch {
+		case v.Error != "":
+			failed++
+			b.failed++
+		case !v.VSBCompletionTime.IsZero():
+			completed++
+			b.completed++
+		case !v.VSBStartTime.IsZero():
+			running++
+			b.running++
+			active = append(active, v)
+		default:
+			pending++
+			continue
+		}
+		b.volumes++
+	}
+
+	elapsed := now.Sub(r.StartTime).Round(time.Second)
+	phase, eta := "snapshots", "unknown"
+	if !r.SnapshotEndTime.IsZero() {
+		phase = "data mover"
+		if e, ok := r.eta(now); ok {
+			eta = fmt.Sprintf("%v (batch %d %v)", e.runLeft.Round(time.Second), e.batch, e.batchLeft.Round(time.Second))
+		}
+	}
+	if !r.DataMoverEndTime.IsZero() {
+		phase, eta = "done", "0s"
+		elapsed = r.TotalTime.Round(time.Second)
+	}
+
+	lines := []string{
+		fmt.Sprintf("Run %s  phase %s  elapsed %v  ETA %s", r.Backup, phase, elapsed, eta),
+		fmt.Sprintf("VSCs ready %d/%d  pending %d  running %d/%d  completed %d  failed %d", ready, len(r.Volumes), pending, running, d.concurrency, completed, failed),
+	}
+
+	numbers := []int{}
+	for n := range batches {
+		if n > 0 {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	if len(numbers) > statusBatches {
+		numbers = numbers[len(numbers)-statusBatches:]
+	}
+	if len(numbers) > 0 {
+		lines = append(lines, "", fmt.Sprintf("%-8s %8s %8s %10s %8s", "BATCH", "VOLUMES", "RUNNING", "COMPLETED", "FAILED"))
+		for _, n := range numbers {
+			b := batches[n]
+			lines = append(lines, fmt.Sprintf("%-8d %8d %8d %10d %8d", n, b.volumes, b.running, b.completed, b.failed))
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].VSBStartTime.Before(active[j].VSBStartTime)
+	})
+	if len(active) > 0 {
+		lines = append(lines, "")
+	}
+	for i, v := range active {
+		if i == statusVSBs {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(active)-statusVSBs))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s %s/%s  %s  %v", spinner[(d.tick+i)%len(spinner)], v.Namespace, v.VolumeSnapshotBackup, latestPhase(v), now.Sub(v.VSBStartTime).Round(time.Second)))
+	}
+
+	if logs := d.logs.lines(); len(logs) > 0 {
+		lines = append(lines, "")
+		lines = append(lines, logs...)
+	}
+	return lines
+}
+
+// latestPhase returns the last phase the VSB of v was seen in.
+func latestPhase(v *volumeResult) string {
+	phase, seen := "New", time.Time{}
+	for p, t := range v.PhaseTimes {
+		if t.After(seen) {
+			phase, seen = string(p), t
+		}
+	}
+	return phase
+}
+
+// logTail keeps the last statusLogLines lines written to it.
+type logTail struct {
+	mu   sync.Mutex
+	tail []string
+}
+
+func (l *logTail) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.tail = append(l.tail, line)
+	}
+	if len(l.tail) > statusLogLines {
+		l.tail = l.tail[len(l.tail)-statusLogLines:]
+	}
+	return len(p), nil
+}
+
+func (l *logTail) lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.tail...)
+}
@@ -0,0 +1,269 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Components whose resource usage is sampled during a run.
+const (
+	componentVelero    = "velero"
+	componentVSM       = "volume-snapshot-mover"
+	componentMovers    = "volsync-movers"
+	componentNodeAgent = "node-agent"
+	// componentNodes is every node of the cluster.
+	componentNodes = "nodes"
+)
+
+// metricsAPIPathPrefix is the path of the metrics API served by
+// metrics-server, or by the Prometheus adapter on OpenShift.
+const metricsAPIPathPrefix = "/apis/metrics.k8s.io/v1beta1"
+
+// resourceComponents orders the components in the results.
+var resourceComponents = []string{componentVelero, componentVSM, componentMovers, componentNodeAgent, componentNodes}
+
+// resourceUsage is the CPU and memory a component used during a run, summed
+// over its pods at each sample.
+type resourceUsage struct {
+	Component string `json:"component"`
+	// Samples is how many samples found the component running.
+	Samples         int   `json:"samples"`
+	PeakCPUMillis   int64 `json:"peakCPUMillis"`
+	MeanCPUMillis   int64 `json:"meanCPUMillis"`
+	PeakMemoryBytes int64 `json:"peakMemoryBytes"`
+	MeanMemoryBytes int64 `json:"meanMemoryBytes"`
+	// CPUPerGiB is the CPU seconds the component used per GiB the data
+	// mover backed up, when both are known.
+	CPUPerGiB float64 `json:"cpuSecondsPerGiB,omitempty"`
+}
+
+// metricsList is the part of the PodMetricsList and NodeMetricsList of the
+// metrics API the sampler reads.
+type metricsList struct {
+	Items []struct {
+		Metadata struct {
+			Name   string            `json:"name"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Usage      map[string]resource.Quantity `json:"usage"`
+		Containers []struct {
+			Usage map[string]resource.Quantity `json:"usage"`
+		} `json:"containers"`
+	} `json:"items"`
+}
+
+// resourceSampler samples the CPU and memory of the Velero pods and of the
+// nodes from the metrics API every interval until it is stopped, so the
+// throughput of a run comes with what it cost.
+type resourceSampler struct {
+	clientset       kubernetes.Interface
+	veleroNamespace string
+	interval        time.Duration
+	results         *runResults
+
+	// usage accumulates the samples of each component, its Mean fields
+	// holding sums until stop divides them.
+	usage  map[string]*resourceUsage
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+	once   sync.Once
+}
+
+// startResourceSampler checks the metrics API is served and starts sampling.
+func startResourceSampler(ctx context.Context, clientset kubernetes.Interface, veleroNamespace string, interval time.Duration, results *runResults) (*resourceSampler, error) {
+	s := &resourceSampler{
+		clientset:       clientset,
+		veleroNamespace: veleroNamespace,
+		interval:        interval,
+		results:         results,
+		usage:           map[string]*resourceUsage{},
+	}
+	err := s.sample(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sample resource usage, is metrics-server installed?")
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	loggerFrom(ctx).Infow("sampling resource usage", "interval", s.interval.String())
+	s.done.Add(1)
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *resourceSampler) run(ctx context.Context) {
+	defer s.done.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := s.sample(ctx)
+		if err != nil && ctx.Err() == nil {
+			loggerFrom(ctx).Warnw("failed to sample resource usage", "error", err)
+		}
+	}
+}
+
+// stop stops sampling and records the usage of each component in the
+// results. It may be called more than once.
+func (s *resourceSampler) stop() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.cancel()
+		s.done.Wait()
+		usage := []resourceUsage{}
+		for _, component := range resourceComponents {
+			u, ok := s.usage[component]
+			if !ok {
+				continue
+			}
+			u.MeanCPUMillis /= int64(u.Samples)
+			u.MeanMemoryBytes /= int64(u.Samples)
+			usage = append(usage, *u)
+		}
+		s.results.recordResourceUsage(usage, s.interval)
+	})
+}
+
+// sample reads the usage of the pods of the Velero namespace and of the
+// nodes once.
+func (s *resourceSampler) sample(ctx context.Context) error {
+	pods, err := s.list(ctx, fmt.Sprintf("%s/namespaces/%s/pods", metricsAPIPathPrefix, s.veleroNamespace))
+	if err != nil {
+		return err
+	}
+	nodes, err := s.list(ctx, metricsAPIPathPrefix+"/nodes")
+	if err != nil {
+		return err
+	}
+	cpu, memory := map[string]int64{}, map[string]int64{}
+	for _, pod := range pods.Items {
+		component := podComponent(pod.Metadata.Name, pod.Metadata.Labels)
+		if component == "" {
+			continue
+		}
+		for _, container := range pod.Containers {
+			cpu[component] += quantityMillis(container.Usage, "cpu")
+			memory[component] += quantityValue(container.Usage, "memory")
+		}
+	}
+	for _, node := range nodes.Items {
+		cpu[componentNodes] += quantityMillis(node.Usage, "cpu")
+		memory[componentNodes] += quantityValue(node.Usage, "memory")
+	}
+	for component := range cpu {
+		u, ok := s.usage[component]
+		if !ok {
+			u = &resourceUsage{Component: component}
+			s.usage[component] = u
+		}
+		u.Samples++
+		u.MeanCPUMillis += cpu[component]
+		u.MeanMemoryBytes += memory[component]
+		if cpu[component] > u.PeakCPUMillis {
+			u.PeakCPUMillis = cpu[component]
+		}
+		if memory[component] > u.PeakMemoryBytes {
+			u.PeakMemoryBytes = memory[component]
+		}
+	}
+	return nil
+}
+
+func (s *resourceSampler) list(ctx context.Context, path string) (*metricsList, error) {
+	out, err := s.clientset.CoreV1().RESTClient().Get().AbsPath(path).DoRaw(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", path)
+	}
+	list := &metricsList{}
+	err = json.Unmarshal(out, list)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return list, nil
+}
+
+// podComponent returns the component a pod of the Velero namespace belongs
+// to, empty for pods that are not sampled.
+func podComponent(name string, labels map[string]string) string {
+	switch {
+	case strings.HasPrefix(labels["job-name"], moverJobPrefix) || strings.HasPrefix(labels["job-name"], "volsync-dst-"):
+		return componentMovers
+	case strings.HasPrefix(name, "volume-snapshot-mover-"):
+		return componentVSM
+	case strings.HasPrefix(name, "node-agent-") || strings.HasPrefix(name, "restic-"):
+		return componentNodeAgent
+	case strings.HasPrefix(name, "velero-"):
+		return componentVelero
+	}
+	return ""
+}
+
+func quantityMillis(usage map[string]resource.Quantity, name string) int64 {
+	q, ok := usage[name]
+	if !ok {
+		return 0
+	}
+	return q.MilliValue()
+}
+
+func quantityValue(usage map[string]resource.Quantity, name string) int64 {
+	q, ok := usage[name]
+	if !ok {
+		return 0
+	}
+	return q.Value()
+}
+
+// recordResourceUsage records the usage of each component, working out the CPU
+// each used per GiB backed up from its mean and how long it ran, which is
+// its samples times interval.
+func (r *runResults) recordResourceUsage(usage []resourceUsage, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var size int64
+	for _, v := range r.Volumes {
+		if v.Error == "" {
+			size += v.SizeBytes
+		}
+	}
+	for i := range usage {
+		u := &usage[i]
+		if size > 0 && u.Component != componentNodes {
+			cpuSeconds := float64(u.MeanCPUMillis) / 1000 * (time.Duration(u.Samples) * interval).Seconds()
+			u.CPUPerGiB = cpuSeconds / (float64(size) / (1 << 30))
+		}
+	}
+	r.ResourceUsage = usage
+}
+
+func printResourceUsage(out io.Writer, usage []resourceUsage) {
+	if len(usage) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "Resource usage:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPONENT\tSAMPLES\tCPU PEAK\tCPU MEAN\tMEMORY PEAK\tMEMORY MEAN\tCPU S/GIB\t")
+	for _, u := range usage {
+		perGiB := "-"
+		if u.CPUPerGiB > 0 {
+			perGiB = fmt.Sprintf("%.2f", u.CPUPerGiB)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%dm\t%dm\t%s\t%s\t%s\t\n", u.Component, u.Samples, u.PeakCPUMillis, u.MeanCPUMillis, formatBytes(u.PeakMemoryBytes), formatBytes(u.MeanMemoryBytes), perGiB)
+	}
+	w.Flush()
+}
@@ -0,0 +1,239 @@
+package perf
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxBackupResources bounds how many resources the report lists from the
+// backup log, the slowest first.
+const maxBackupResources = 5
+
+// backupResource is what the Velero backup log says about the items of one
+// resource: how many were backed up and how long from the first to the last.
+type backupResource struct {
+	Resource string        `json:"resource"`
+	Items    int           `json:"items"`
+	Duration time.Duration `json:"duration"`
+}
+
+// logFieldPattern matches the key=value and key="quoted value" fields of the
+// logrus lines of the Velero backup log.
+var logFieldPattern = regexp.MustCompile(`(\w+)=("(?:[^"\\]|\\.)*"|\S*)`)
+
+// collectBackupLogs downloads the log and the resource list of the Velero
+// Backup of the run into the artifacts directory of the run and records the
+// item counts and durations they hold in the results. Errors are logged
+// rather than returned so a failed download does not fail a run that is
+// otherwise done.
+func (o *backupOptions) collectBackupLogs(ctx context.Context, c client.Client, results *runResults) {
+	name := results.Backup
+	dir := filepath.Join(o.artifactsDir, name)
+	log := loggerFrom(ctx).With("phase", phaseBackup, "dir", dir)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		log.Errorw("failed to create artifacts directory", "error", err)
+		return
+	}
+
+	backupLog, err := downloadBackupFile(ctx, c, o.veleroNamespace, name, velerov1.DownloadTargetKindBackupLog)
+	if err != nil {
+		log.Errorw("failed to download backup log", "error", err)
+	} else {
+		err = os.WriteFile(filepath.Join(dir, "backup.log"), backupLog, 0o644)
+		if err != nil {
+			log.Errorw("failed to write backup log", "error", err)
+		}
+	}
+	resourceList, err := downloadBackupFile(ctx, c, o.veleroNamespace, name, velerov1.DownloadTargetKindBackupResourceList)
+	if err != nil {
+		log.Errorw("failed to download backup resource list", "error", err)
+	} else {
+		err = os.WriteFile(filepath.Join(dir, "resource-list.json"), resourceList, 0o644)
+		if err != nil {
+			log.Errorw("failed to write backup resource list", "error", err)
+		}
+	}
+
+	results.backupLogsCollected(parseBackupLog(backupLog), countResourceList(resourceList))
+	log.Infow("collected backup log and resource list")
+}
+
+// downloadBackupFile downloads a file Velero stored with the backup called
+// name through a DownloadRequest, as velero backup logs does, returning it
+// uncompressed.
+func downloadBackupFile(ctx context.Context, c client.Client, veleroNamespace, name string, kind velerov1.DownloadTargetKind) ([]byte, error) {
+	req := &velerov1.DownloadRequest{}
+	req.Namespace = veleroNamespace
+	req.Name = fmt.Sprintf("%s-%s", name, strings.ToLower(string(kind)))
+	req.Spec.Target = velerov1.DownloadTarget{Kind: kind, Name: name}
+	err := createIfMissing(ctx, c, req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := deleteObject(context.Background(), c, req)
+		if err != nil {
+			loggerFrom(ctx).Warnw("failed to delete download request", "downloadRequest", req.Name, "error", err)
+		}
+	}()
+
+	var url string
+	err = wait.PollImmediate(time.Second, time.Minute, func() (bool, error) {
+		current := velerov1.DownloadRequest{}
+		err := c.Get(ctx, types.NamespacedName{Namespace: veleroNamespace, Name: req.Name}, &current)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get download request %s", req.Name)
+		}
+		url = current.Status.DownloadURL
+		return current.Status.Phase == velerov1.DownloadRequestPhaseProcessed && url != "", nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "download request %s was not processed", req.Name)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create download")
+	}
+	resp, err := (&http.Client{Timeout: 5 * time.Minute}).Do(httpReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to download %s", kind)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to download %s: %s", kind, resp.Status)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress %s", kind)
+	}
+	defer gz.Close()
+	out, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", kind)
+	}
+	return out, nil
+}
+
+// backupLogSummary is what parseBackupLog found in a Velero backup log.
+type backupLogSummary struct {
+	resources []backupResource
+	errors    int
+	warnings  int
+}
+
+// parseBackupLog counts the items Velero logged backing up for each
+// resource, with the time from the first to the last, and the errors and
+// warnings it logged.
+func parseBackupLog(log []byte) backupLogSummary {
+	type span struct {
+		items       map[string]bool
+		first, last time.Time
+	}
+	spans := map[string]*span{}
+	s := backupLogSummary{}
+	scanner := bufio.NewScanner(bytes.NewReader(log))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		fields := map[string]string{}
+		for _, m := range logFieldPattern.FindAllStringSubmatch(scanner.Text(), -1) {
+			fields[m[1]] = strings.Trim(m[2], `"`)
+		}
+		switch fields["level"] {
+		case "error":
+			s.errors++
+		case "warning":
+			s.warnings++
+		}
+		if fields["msg"] != "Backing up item" || fields["resource"] == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, fields["time"])
+		if err != nil {
+			continue
+		}
+		sp, ok := spans[fields["resource"]]
+		if !ok {
+			sp = &span{items: map[string]bool{}, first: t}
+			spans[fields["resource"]] = sp
+		}
+		sp.items[fields["namespace"]+"/"+fields["name"]] = true
+		sp.last = t
+	}
+	for resource, sp := range spans {
+		s.resources = append(s.resources, backupResource{Resource: resource, Items: len(sp.items), Duration: sp.last.Sub(sp.first)})
+	}
+	sort.Slice(s.resources, func(i, j int) bool {
+		if s.resources[i].Duration != s.resources[j].Duration {
+			return s.resources[i].Duration > s.resources[j].Duration
+		}
+		return s.resources[i].Resource < s.resources[j].Resource
+	})
+	return s
+}
+
+// countResourceList returns how many items the resource list of a backup
+// names, which maps each group, version and kind to its items.
+func countResourceList(list []byte) int {
+	resources := map[string][]string{}
+	if len(list) == 0 || json.Unmarshal(list, &resources) != nil {
+		return 0
+	}
+	n := 0
+	for _, items := range resources {
+		n += len(items)
+	}
+	return n
+}
+
+// backupLogsCollected records what the backup log and the resource list of
+// the Velero Backup of the run hold.
+func (r *runResults) backupLogsCollected(log backupLogSummary, listed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.VeleroBackup
+	if b == nil {
+		b = &veleroBackupResult{}
+		r.VeleroBackup = b
+	}
+	b.Resources = log.resources
+	b.LogErrors = log.errors
+	b.LogWarnings = log.warnings
+	b.ListedItems = listed
+}
+
+// resourcesSummary describes the slowest resources of the backup log.
+func (b *veleroBackupResult) resourcesSummary() string {
+	parts := []string{}
+	for i, res := range b.Resources {
+		if i == maxBackupResources {
+			parts = append(parts, fmt.Sprintf("and %d more", len(b.Resources)-i))
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s %d in %v", res.Resource, res.Items, res.Duration.Round(time.Second)))
+	}
+	summary := fmt.Sprintf("%d listed, %d log errors, %d log warnings", b.ListedItems, b.LogErrors, b.LogWarnings)
+	if len(parts) == 0 {
+		return summary
+	}
+	return summary + "; " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,142 @@
+package perf
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// scheduledBackup creates the Velero Schedule of the command the first time
+// it is called and waits for the schedule to fire a backup it has not
+// returned before, returning that backup. Velero fires a new schedule at
+// once, and later ones when the cron expression says, so the iterations of
+// a soak follow the schedule and may overlap with the data mover of the
+// previous backup as cron-triggered backups do.
+func (o *backupOptions) scheduledBackup(ctx context.Context, c client.Client, namespaces []string, template *velerov1.Backup) (*velerov1.Backup, error) {
+	if o.veleroScheduleName == "" {
+		name, err := createSchedule(ctx, c, o.veleroNamespace, o.namePrefix, o.veleroSchedule, namespaces, o.mover == moverNative, template)
+		if err != nil {
+			return nil, err
+		}
+		o.veleroScheduleName = name
+		o.scheduledBackups = map[string]bool{}
+		loggerFrom(ctx).Infow("velero schedule created", "schedule", name, "cron", o.veleroSchedule, "veleroNamespace", o.veleroNamespace)
+	}
+
+	loggerFrom(ctx).Infow("waiting for the velero schedule to fire", "phase", phaseBackup, "schedule", o.veleroScheduleName)
+	var fired *velerov1.Backup
+	err := wait.PollImmediateUntil(5*time.Second, func() (bool, error) {
+		schedule := velerov1.Schedule{}
+		err := c.Get(ctx, types.NamespacedName{Namespace: o.veleroNamespace, Name: o.veleroScheduleName}, &schedule)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get schedule %s", o.veleroScheduleName)
+		}
+		if schedule.Status.Phase == velerov1.SchedulePhaseFailedValidation {
+			return false, errors.Errorf("schedule %s failed validation: %v", schedule.Name, schedule.Status.ValidationErrors)
+		}
+		backups := velerov1.BackupList{}
+		err = listAll(ctx, c, &backups, client.InNamespace(o.veleroNamespace), client.MatchingLabels{velerov1.ScheduleNameLabel: o.veleroScheduleName})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to list scheduled backups")
+		}
+		// The latest backup is followed, those that fired while the
+		// previous one was followed are skipped.
+		sort.Slice(backups.Items, func(i, j int) bool {
+			return backups.Items[i].CreationTimestamp.Before(&backups.Items[j].CreationTimestamp)
+		})
+		for i := range backups.Items {
+			b := &backups.Items[i]
+			if !o.scheduledBackups[b.Name] {
+				o.scheduledBackups[b.Name] = true
+				fired = b
+			}
+		}
+		return fired != nil, nil
+	}, ctx.Done())
+	if err != nil {
+		return nil, err
+	}
+	return fired, nil
+}
+
+// createSchedule creates a Velero Schedule backing up namespaces on cron
+// under a new run name, as createBackup does for a backup, returning its
+// name. Velero names the backups of the schedule after it, followed by the
+// time they fired.
+func createSchedule(ctx context.Context, c client.Client, veleroNamespace, prefix, cron string, namespaces []string, snapshotMoveData bool, template *velerov1.Backup) (string, error) {
+	for attempt := 1; ; attempt++ {
+		name := newRunName(prefix, time.Now())
+		s, err := newSchedule(veleroNamespace, name, cron, namespaces, snapshotMoveData, template)
+		if err != nil {
+			return "", err
+		}
+		err = c.Create(ctx, s)
+		if !apierrors.IsAlreadyExists(err) {
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to create schedule %s", name)
+			}
+			return name, nil
+		}
+		if attempt == nameAttempts {
+			return "", errors.Errorf("failed to find a schedule name that is not taken after %d attempts", nameAttempts)
+		}
+		loggerFrom(ctx).Warnw("schedule name is taken, picking another", "schedule", name)
+	}
+}
+
+// newSchedule returns the Velero Schedule of namespaces, its backups made
+// from template as newBackup makes a backup. Velero copies the labels of the
+// schedule to its backups.
+func newSchedule(veleroNamespace, name, cron string, namespaces []string, snapshotMoveData bool, template *velerov1.Backup) (client.Object, error) {
+	s := velerov1.Schedule{}
+	if template != nil {
+		s.Labels = template.Labels
+		s.Annotations = template.Annotations
+		s.Spec.Template = template.Spec
+	}
+	s.SetGroupVersionKind(velerov1.SchemeGroupVersion.WithKind("Schedule"))
+	s.Spec.Template.IncludedNamespaces = namespaces
+	s.Spec.Schedule = cron
+	s.Namespace = veleroNamespace
+	s.Name = name
+	if !snapshotMoveData {
+		return &s, nil
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&s)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert schedule")
+	}
+	u := &unstructured.Unstructured{Object: obj}
+	err = unstructured.SetNestedField(u.Object, true, "spec", "template", "snapshotMoveData")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to set snapshotMoveData")
+	}
+	return u, nil
+}
+
+// deleteVeleroSchedule deletes the Velero Schedule of the command, if one
+// was created, so it stops firing. The backups it fired are left for cleanup.
+func (o *backupOptions) deleteVeleroSchedule(ctx context.Context, c client.Client) {
+	if o.veleroScheduleName == "" {
+		return
+	}
+	schedule := &velerov1.Schedule{}
+	schedule.Namespace = o.veleroNamespace
+	schedule.Name = o.veleroScheduleName
+	err := deleteObject(context.Background(), c, schedule)
+	if err != nil {
+		loggerFrom(ctx).Errorw("failed to delete velero schedule", "schedule", o.veleroScheduleName, "error", err)
+		return
+	}
+	loggerFrom(ctx).Infow("velero schedule deleted", "schedule", o.veleroScheduleName)
+}
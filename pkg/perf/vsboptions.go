@@ -0,0 +1,263 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// Keys of the volume options the OADP 1.2 data mover reads from the restic
+// secret of a VSB, prefixed with the storage class of the source PVC they
+// apply to, as the operator writes them from volumeOptionsForStorageClasses
+// of the DataProtectionApplication. The VSB spec itself only names the
+// secret.
+const (
+	sourceStorageClassKey         = "SourceStorageClassName"
+	sourceAccessModeKey           = "SourceAccessMode"
+	sourceCacheStorageClassKey    = "SourceCacheStorageClassName"
+	sourceCacheCapacityKey        = "SourceCacheCapacity"
+	sourceCacheAccessModeKey      = "SourceCacheAccessMode"
+	sourceMoverSecurityContextKey = "SourceMoverSecurityContext"
+)
+
+// vsbOptions are the tunables of the VSBs of a run beyond the VSC they back
+// up.
+type vsbOptions struct {
+	// resticSecrets holds comma separated namespace=secret pairs naming
+	// the restic secret the VSBs of a namespace use instead of the
+	// default one. resticSecretsFile is a YAML file of more of them.
+	resticSecrets        string
+	resticSecretsFile    string
+	storageClass         string
+	accessMode           string
+	cacheStorageClass    string
+	cacheCapacity        string
+	cacheAccessMode      string
+	moverSecurityContext bool
+}
+
+// volumeOptions returns the volume option keys to add to the restic secret
+// for a source PVC of the given storage class, or nil if none are set.
+func (o *vsbOptions) volumeOptions(storageClass string) map[string]string {
+	options := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			options[storageClass+"-"+key] = value
+		}
+	}
+	set(sourceStorageClassKey, o.storageClass)
+	set(sourceAccessModeKey, o.accessMode)
+	set(sourceCacheStorageClassKey, o.cacheStorageClass)
+	set(sourceCacheCapacityKey, o.cacheCapacity)
+	set(sourceCacheAccessModeKey, o.cacheAccessMode)
+	if o.moverSecurityContext {
+		set(sourceMoverSecurityContextKey, strconv.FormatBool(true))
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+func (o *vsbOptions) validate() error {
+	_, err := o.parseResticSecrets()
+	if err != nil {
+		return err
+	}
+	if o.cacheCapacity != "" {
+		_, err := resource.ParseQuantity(o.cacheCapacity)
+		if err != nil {
+			return errors.Wrapf(err, "invalid cache-capacity %q", o.cacheCapacity)
+		}
+	}
+	for _, mode := range []string{o.accessMode, o.cacheAccessMode} {
+		switch corev1.PersistentVolumeAccessMode(mode) {
+		case "", corev1.ReadWriteOnce, corev1.ReadOnlyMany, corev1.ReadWriteMany:
+		default:
+			return errors.Errorf("unknown access mode %q, must be one of %s, %s or %s", mode, corev1.ReadWriteOnce, corev1.ReadOnlyMany, corev1.ReadWriteMany)
+		}
+	}
+	return nil
+}
+
+// parseResticSecrets returns the namespace=secret pairs of the
+// restic-secrets-file mapping and the restic-secrets flag, which wins for
+// namespaces both name. Namespaces may be shell patterns such as team-a-*.
+func (o *vsbOptions) parseResticSecrets() (map[string]string, error) {
+	secrets := map[string]string{}
+	if o.resticSecretsFile != "" {
+		data, err := os.ReadFile(o.resticSecretsFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read restic-secrets-file %s", o.resticSecretsFile)
+		}
+		err = yaml.UnmarshalStrict(data, &secrets)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse restic-secrets-file %s, it must map namespaces to secrets", o.resticSecretsFile)
+		}
+	}
+	if o.resticSecrets != "" {
+		for _, pair := range strings.Split(o.resticSecrets, ",") {
+			ns, secret, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || ns == "" || secret == "" {
+				return nil, errors.Errorf("invalid restic-secrets entry %q, must be namespace=secret", pair)
+			}
+			secrets[ns] = secret
+		}
+	}
+	for ns, secret := range secrets {
+		if _, err := path.Match(ns, ""); err != nil || ns == "" || secret == "" {
+			return nil, errors.Errorf("invalid restic secret mapping %s=%s", ns, secret)
+		}
+	}
+	return secrets, nil
+}
+
+// secretNames returns the name of the restic secret of each namespace, keyed
+// by namespace, with defaultSecret for namespaces that have no secret of
+// their own. A namespace named as it is takes precedence over patterns, and
+// one matching patterns of different secrets is an error.
+func (o *vsbOptions) secretNames(defaultSecret string, namespaces []string) (map[string]string, error) {
+	overrides, err := o.parseResticSecrets()
+	if err != nil {
+		return nil, err
+	}
+	patterns := []string{}
+	for ns := range overrides {
+		patterns = append(patterns, ns)
+	}
+	sort.Strings(patterns)
+	secrets := map[string]string{}
+	for _, ns := range namespaces {
+		secrets[ns] = defaultSecret
+		if secret, ok := overrides[ns]; ok {
+			secrets[ns] = secret
+			continue
+		}
+		matched := ""
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, ns); !ok {
+				continue
+			}
+			if matched != "" && overrides[pattern] != overrides[matched] {
+				return nil, errors.Errorf("namespace %s matches restic secret patterns %s and %s of different secrets", ns, matched, pattern)
+			}
+			matched = pattern
+		}
+		if matched != "" {
+			secrets[ns] = overrides[matched]
+		}
+	}
+	return secrets, nil
+}
+
+// resticSecretsSummary counts the namespaces of each restic secret of
+// secrets, keyed by namespace, such as "perf-restic 8, team-a-restic 2".
+func resticSecretsSummary(secrets map[string]string) string {
+	counts := map[string]int{}
+	names := []string{}
+	for _, secret := range secrets {
+		if counts[secret] == 0 {
+			names = append(names, secret)
+		}
+		counts[secret]++
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %d", name, counts[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// resticSecretsFor returns the restic secret the VSBs of each namespace are
+// to use, keyed by namespace, with defaultSecret for namespaces that have no
+// secret of their own. When volume options are set, each secret is copied
+// for the run with the options added, so the secrets the operator manages
+// are left alone.
+func (o *vsbOptions) resticSecretsFor(ctx context.Context, c client.Client, veleroNamespace, name, defaultSecret string, namespaces []string) (map[string]string, error) {
+	secrets, err := o.secretNames(defaultSecret, namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	options := map[string]string{}
+	if o.volumeOptions("") != nil {
+		classes := storagev1.StorageClassList{}
+		err := c.List(ctx, &classes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list storageclasses")
+		}
+		for _, class := range classes.Items {
+			for key, value := range o.volumeOptions(class.Name) {
+				options[key] = value
+			}
+		}
+	}
+
+	copies := map[string]string{}
+	for ns, secret := range secrets {
+		if len(options) == 0 {
+			// the default secret is checked by preflight
+			if secret != defaultSecret {
+				err := checkResticSecret(ctx, c, veleroNamespace, secret)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if _, ok := copies[secret]; !ok {
+			copies[secret], err = copyResticSecret(ctx, c, veleroNamespace, name, secret, options)
+			if err != nil {
+				return nil, err
+			}
+		}
+		secrets[ns] = copies[secret]
+	}
+	return secrets, nil
+}
+
+// copyResticSecret copies the restic secret called secret for the run called
+// name with options added to its data, and returns the name of the copy. The
+// copy is labeled with the run so cleanup removes it.
+func copyResticSecret(ctx context.Context, c client.Client, veleroNamespace, name, secret string, options map[string]string) (string, error) {
+	original := corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: secret, Namespace: veleroNamespace}, &original)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get restic secret %s/%s", veleroNamespace, secret)
+	}
+	copied := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%.8s", secret, name),
+			Namespace: veleroNamespace,
+			Labels:    map[string]string{"perf-test": name},
+		},
+		Type: original.Type,
+		Data: map[string][]byte{},
+	}
+	for key, value := range original.Data {
+		copied.Data[key] = value
+	}
+	for key, value := range options {
+		copied.Data[key] = []byte(value)
+	}
+	err = createIfMissing(ctx, c, copied)
+	if err != nil {
+		return "", err
+	}
+	loggerFrom(ctx).Infow("created restic secret with volume options", "phase", phaseDataMover, "secret", copied.Name, "from", secret, "options", len(options))
+	return copied.Name, nil
+}
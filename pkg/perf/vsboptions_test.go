@@ -0,0 +1,98 @@
+package perf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseResticSecrets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secrets.yaml")
+	err := os.WriteFile(file, []byte("team-a-*: team-a-restic\nperf-1: file-restic\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		options vsbOptions
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "none", options: vsbOptions{}, want: map[string]string{}},
+		{
+			name:    "flag",
+			options: vsbOptions{resticSecrets: "perf-1=one, perf-2=two"},
+			want:    map[string]string{"perf-1": "one", "perf-2": "two"},
+		},
+		{
+			name:    "file",
+			options: vsbOptions{resticSecretsFile: file},
+			want:    map[string]string{"team-a-*": "team-a-restic", "perf-1": "file-restic"},
+		},
+		{
+			name:    "flag wins over file",
+			options: vsbOptions{resticSecrets: "perf-1=flag-restic", resticSecretsFile: file},
+			want:    map[string]string{"team-a-*": "team-a-restic", "perf-1": "flag-restic"},
+		},
+		{name: "missing secret", options: vsbOptions{resticSecrets: "perf-1="}, wantErr: true},
+		{name: "missing namespace", options: vsbOptions{resticSecrets: "=restic"}, wantErr: true},
+		{name: "no separator", options: vsbOptions{resticSecrets: "perf-1"}, wantErr: true},
+		{name: "bad pattern", options: vsbOptions{resticSecrets: "team-[a=restic"}, wantErr: true},
+		{name: "missing file", options: vsbOptions{resticSecretsFile: filepath.Join(t.TempDir(), "missing.yaml")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.options.parseResticSecrets()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseResticSecrets() = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretNames(t *testing.T) {
+	namespaces := []string{"perf-1", "team-a-1", "team-a-2", "other"}
+	tests := []struct {
+		name    string
+		secrets string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: map[string]string{"perf-1": "default", "team-a-1": "default", "team-a-2": "default", "other": "default"},
+		},
+		{
+			name:    "pattern",
+			secrets: "team-a-*=team-a",
+			want:    map[string]string{"perf-1": "default", "team-a-1": "team-a", "team-a-2": "team-a", "other": "default"},
+		},
+		{
+			name:    "name wins over pattern",
+			secrets: "team-a-*=team-a,team-a-2=own",
+			want:    map[string]string{"perf-1": "default", "team-a-1": "team-a", "team-a-2": "own", "other": "default"},
+		},
+		{
+			name:    "patterns of the same secret",
+			secrets: "team-*=team,team-a-*=team",
+			want:    map[string]string{"perf-1": "default", "team-a-1": "team", "team-a-2": "team", "other": "default"},
+		},
+		{name: "patterns of different secrets", secrets: "team-*=team,team-a-*=team-a", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := vsbOptions{resticSecrets: tt.secrets}
+			got, err := o.secretNames("default", namespaces)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("secretNames() = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
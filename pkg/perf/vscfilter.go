@@ -0,0 +1,73 @@
+package perf
+
+import (
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// vscFilter picks the VSCs to create VSBs for by their source PVC, so a run
+// can benchmark one kind of volume while the backup still snapshots them all.
+type vscFilter struct {
+	storageClass string
+	minSize      string
+	selector     string
+}
+
+func (f *vscFilter) validate() error {
+	if f.minSize != "" {
+		_, err := resource.ParseQuantity(f.minSize)
+		if err != nil {
+			return errors.Wrapf(err, "invalid min-pvc-size %q", f.minSize)
+		}
+	}
+	if f.selector != "" {
+		_, err := labels.Parse(f.selector)
+		if err != nil {
+			return errors.Wrapf(err, "invalid pvc-label-selector %q", f.selector)
+		}
+	}
+	return nil
+}
+
+func (f *vscFilter) enabled() bool {
+	return f.storageClass != "" || f.minSize != "" || f.selector != ""
+}
+
+// matches reports whether pvc passes every filter that is set.
+func (f *vscFilter) matches(pvc *corev1.PersistentVolumeClaim) bool {
+	if f.storageClass != "" && (pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != f.storageClass) {
+		return false
+	}
+	if f.minSize != "" {
+		requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if requested.Cmp(resource.MustParse(f.minSize)) < 0 {
+			return false
+		}
+	}
+	if f.selector != "" {
+		selector, _ := labels.Parse(f.selector)
+		if !selector.Matches(labels.Set(pvc.Labels)) {
+			return false
+		}
+	}
+	return true
+}
+
+// filter splits vscs into those whose source PVC in sources matches and the
+// names of the rest. VSCs whose source PVC is unknown never match.
+func (f *vscFilter) filter(vscs []v1.VolumeSnapshotContent, sources map[string]*corev1.PersistentVolumeClaim) ([]v1.VolumeSnapshotContent, []string) {
+	selected := []v1.VolumeSnapshotContent{}
+	excluded := []string{}
+	for _, vsc := range vscs {
+		pvc, ok := sources[vsc.Name]
+		if ok && f.matches(pvc) {
+			selected = append(selected, vsc)
+			continue
+		}
+		excluded = append(excluded, vsc.Name)
+	}
+	return selected, excluded
+}
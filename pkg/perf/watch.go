@@ -0,0 +1,214 @@
+package perf
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	volsyncv1alpha1 "github.com/backube/volsync/api/v1alpha1"
+	dmv1 "github.com/konveyor/volume-snapshot-mover/api/v1alpha1"
+	v1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// runWatcher keeps an informer cache of the Velero Backup and the VSCs, VSBs
+// and volsync ReplicationSources, or DataUploads with the native mover or
+// PodVolumeBackups with the file system backup, of a run. Waits read from the
+// cache and are re-evaluated whenever a watched object changes, instead of
+// polling the API server with full List calls, which does not scale to
+// clusters with thousands of snapshots.
+type runWatcher struct {
+	cache cache.Cache
+	// log is the logger of the run the watcher was started for.
+	log *zap.SugaredLogger
+	// results records the phases the Backup and VSBs are seen in, if set.
+	results *runResults
+
+	mu sync.Mutex
+	// changed is closed and replaced every time a watched object changes,
+	// waking up every waiter at once.
+	changed chan struct{}
+}
+
+// newRunWatcher starts informers for the objects of the run called name that
+// mover works with and waits for their caches to sync. Every phase the Backup
+// and each VSB go through is recorded in results as it is seen. The informers
+// stop when ctx is cancelled.
+func newRunWatcher(ctx context.Context, config *rest.Config, scheme *runtime.Scheme, name, mover string, results *runResults) (*runWatcher, error) {
+	selectors := cache.SelectorsByObject{
+		&velerov1.Backup{}: cache.ObjectSelector{
+			Field: fields.OneTermEqualSelector("metadata.name", name),
+		},
+	}
+	switch mover {
+	case moverVSM:
+		selectors[&v1.VolumeSnapshotContent{}] = cache.ObjectSelector{
+			Label: labels.SelectorFromSet(labels.Set{"velero.io/backup-name": name}),
+		}
+		selectors[&dmv1.VolumeSnapshotBackup{}] = cache.ObjectSelector{
+			Label: labels.SelectorFromSet(labels.Set{"perf-test": name}),
+		}
+		// ReplicationSources carry the name of their VSB rather than the
+		// run, so those of other runs are ignored when observed.
+		vsbSelector, err := hasLabel(vsbLabel)
+		if err != nil {
+			return nil, err
+		}
+		selectors[&volsyncv1alpha1.ReplicationSource{}] = cache.ObjectSelector{
+			Label: vsbSelector,
+		}
+	case moverNative:
+		selectors[newDataUpload()] = cache.ObjectSelector{
+			Label: labels.SelectorFromSet(labels.Set{"velero.io/backup-name": name}),
+		}
+	case moverFSBackup:
+		selectors[&velerov1.PodVolumeBackup{}] = cache.ObjectSelector{
+			Label: labels.SelectorFromSet(labels.Set{velerov1.BackupNameLabel: name}),
+		}
+	}
+	return startRunWatcher(ctx, config, scheme, selectors, results)
+}
+
+// newRestoreWatcher starts informers for the VolumeSnapshotRestores of the
+// run called name and waits for their caches to sync.
+func newRestoreWatcher(ctx context.Context, config *rest.Config, scheme *runtime.Scheme, name string) (*runWatcher, error) {
+	selectors := cache.SelectorsByObject{
+		&dmv1.VolumeSnapshotRestore{}: cache.ObjectSelector{
+			Label: labels.SelectorFromSet(labels.Set{"perf-test": name}),
+		},
+	}
+	return startRunWatcher(ctx, config, scheme, selectors, nil)
+}
+
+// startRunWatcher starts an informer for each of selectors, waking up the
+// waits of the watcher whenever one of their objects changes.
+func startRunWatcher(ctx context.Context, config *rest.Config, scheme *runtime.Scheme, selectors cache.SelectorsByObject, results *runResults) (*runWatcher, error) {
+	c, err := cache.New(config, cache.Options{
+		Scheme:            scheme,
+		SelectorsByObject: selectors,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cache")
+	}
+
+	w := &runWatcher{
+		cache:   c,
+		log:     loggerFrom(ctx),
+		results: results,
+		changed: make(chan struct{}),
+	}
+	handler := toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.observe(obj)
+			w.notify()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			w.observe(newObj)
+			w.notify()
+		},
+		DeleteFunc: func(obj interface{}) { w.notify() },
+	}
+	for obj := range selectors {
+		informer, err := c.GetInformer(ctx, obj)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get informer")
+		}
+		informer.AddEventHandler(handler)
+	}
+
+	go func() {
+		err := c.Start(ctx)
+		if err != nil {
+			loggerFrom(ctx).Errorw("failed to run cache", "error", err)
+		}
+	}()
+	if !c.WaitForCacheSync(ctx) {
+		return nil, errors.New("failed to sync cache")
+	}
+	return w, nil
+}
+
+// observe records the phase of the Backup or a VSB, or the sync status of a
+// ReplicationSource, when it changes. Waits only look at a VSB until it is
+// done, so watching every update is what catches phases such as cleanup that
+// finish after the tool has moved on.
+func (w *runWatcher) observe(obj interface{}) {
+	if w.results == nil {
+		return
+	}
+	switch o := obj.(type) {
+	case *dmv1.VolumeSnapshotBackup:
+		w.results.vsbPhaseSeen(o.Spec.VolumeSnapshotContent.Name, o.Status.Phase, time.Now())
+	case *velerov1.Backup:
+		w.results.backupSeen(w.log, &o.Status, time.Now())
+	case *volsyncv1alpha1.ReplicationSource:
+		w.results.replicationSourceSeen(w.log, o.Labels[vsbLabel], o)
+	}
+}
+
+// hasLabel selects the objects that have key, whatever its value.
+func hasLabel(key string) (labels.Selector, error) {
+	requirement, err := labels.NewRequirement(key, selection.Exists, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid label %s", key)
+	}
+	return labels.NewSelector().Add(*requirement), nil
+}
+
+func (w *runWatcher) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+func (w *runWatcher) changes() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changed
+}
+
+// recheckInterval is how often waits re-evaluate their condition when nothing
+// changes, so VSBs that stop making progress are noticed.
+const recheckInterval = 30 * time.Second
+
+// waitFor evaluates condition every time a watched object changes, and at
+// least every recheckInterval, until it returns true or an error. It returns
+// wait.ErrWaitTimeout if condition is still false after timeout, matching the
+// polling helpers.
+func (w *runWatcher) waitFor(ctx context.Context, timeout time.Duration, condition func() (bool, error)) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(recheckInterval)
+	defer ticker.Stop()
+	for {
+		// Grab the channel before evaluating so a change that lands while
+		// condition runs is not missed.
+		changed := w.changes()
+		done, err := condition()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-timer.C:
+			return wait.ErrWaitTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}